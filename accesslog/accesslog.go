@@ -0,0 +1,451 @@
+// Package accesslog provides a filter that writes one JSON line per proxied
+// request or tunnel, carrying the context that's otherwise only sent to ops
+// and measured.
+package accesslog
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/netx"
+	"github.com/getlantern/proxy/v3/filters"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+	"github.com/getlantern/http-proxy-lantern/v2/tlslistener"
+)
+
+var log = golog.LoggerFor("accesslog")
+
+// Privacy policies for sensitive fields like the device ID and client IP
+const (
+	// PrivacyHash replaces sensitive fields with a keyed hash so that entries
+	// can still be correlated without revealing the original values.
+	PrivacyHash = "hash"
+	// PrivacyDrop omits sensitive fields altogether.
+	PrivacyDrop = "drop"
+	// PrivacyNone logs sensitive fields as is.
+	PrivacyNone = "none"
+
+	// Stdout is the path that makes the access log go to stdout.
+	Stdout = "-"
+
+	// DefaultMaxSize is the default size in bytes at which the log file is
+	// rotated.
+	DefaultMaxSize = 100 * 1024 * 1024
+
+	// DefaultMaxBackups is the default number of rotated log files to keep.
+	DefaultMaxBackups = 5
+)
+
+// Opts configures a Logger.
+type Opts struct {
+	// Path is the file to write to, or Stdout.
+	Path string
+
+	// MaxSize is the size in bytes at which the file is rotated. Defaults to
+	// DefaultMaxSize. Ignored for Stdout.
+	MaxSize int64
+
+	// MaxBackups is how many rotated files to keep. Defaults to
+	// DefaultMaxBackups. Ignored for Stdout.
+	MaxBackups int
+
+	// Privacy is the policy for sensitive fields, one of PrivacyHash (the
+	// default), PrivacyDrop or PrivacyNone.
+	Privacy string
+
+	// HashKey is the key used to hash sensitive fields. If empty, a random key
+	// is used, meaning that hashes can only be correlated until the proxy
+	// restarts.
+	HashKey string
+
+	// Protocol is the protocol of this proxy, included in entries for
+	// connections that don't come from a listener with a known protocol.
+	Protocol string
+}
+
+// ProtocolConn is implemented by connections that know the protocol of the
+// listener that accepted them, which is logged in place of Opts.Protocol.
+type ProtocolConn interface {
+	Protocol() string
+}
+
+// Entry is a single line in the access log.
+type Entry struct {
+	Time           time.Time `json:"time"`
+	DurationMillis int64     `json:"duration_ms"`
+	Type           string    `json:"type"`
+	Protocol       string    `json:"protocol,omitempty"`
+	HTTPVersion    string    `json:"http_version,omitempty"`
+	Method         string    `json:"method"`
+	OriginHost     string    `json:"origin_host,omitempty"`
+	OriginPort     string    `json:"origin_port,omitempty"`
+	Status         int       `json:"status,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	BytesSent      int64     `json:"bytes_sent"`
+	BytesRecv      int64     `json:"bytes_recv"`
+	DeviceID       string    `json:"device_id,omitempty"`
+	ClientIP       string    `json:"client_ip,omitempty"`
+	Platform       string    `json:"client_platform,omitempty"`
+	App            string    `json:"client_app,omitempty"`
+	AppVersion     string    `json:"client_app_version,omitempty"`
+	LibraryVersion string    `json:"client_version,omitempty"`
+	ProbingError   string    `json:"probing_error,omitempty"`
+	ThrottleCohort string    `json:"throttle_cohort,omitempty"`
+	Throttled      bool      `json:"throttled"`
+}
+
+// Entry types
+const (
+	TypeHTTP   = "http"
+	TypeTunnel = "tunnel"
+)
+
+// Logger is a filter that writes an Entry for every request. Its listener
+// wrapper needs to be installed for entries to include byte counts and for
+// tunnels to be logged once they're closed.
+type Logger struct {
+	opts    *Opts
+	hashKey []byte
+	out     io.WriteCloser
+	outMx   sync.Mutex
+}
+
+// New creates a new Logger that writes to the destination given by opts.
+func New(opts *Opts) (*Logger, error) {
+	switch opts.Privacy {
+	case "":
+		opts.Privacy = PrivacyHash
+	case PrivacyHash, PrivacyDrop, PrivacyNone:
+	default:
+		return nil, errors.New("unknown access log privacy policy %v", opts.Privacy)
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if opts.MaxBackups <= 0 {
+		opts.MaxBackups = DefaultMaxBackups
+	}
+
+	hashKey := []byte(opts.HashKey)
+	if len(hashKey) == 0 {
+		hashKey = make([]byte, 32)
+		if _, err := rand.Read(hashKey); err != nil {
+			return nil, errors.New("unable to generate access log hash key: %v", err)
+		}
+	}
+
+	var out io.WriteCloser
+	if opts.Path == Stdout {
+		out = nopCloser{os.Stdout}
+	} else {
+		var err error
+		out, err = openRotatingFile(opts.Path, opts.MaxSize, opts.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Logger{
+		opts:    opts,
+		hashKey: hashKey,
+		out:     out,
+	}, nil
+}
+
+// Close closes the underlying file.
+func (l *Logger) Close() error {
+	l.outMx.Lock()
+	defer l.outMx.Unlock()
+	return l.out.Close()
+}
+
+// WrapListener wraps the given listener so that connections accepted by it
+// count their bytes and log their tunnels when closed.
+func (l *Logger) WrapListener(wrapped net.Listener) net.Listener {
+	return &listener{Listener: wrapped, logger: l}
+}
+
+type entryKey struct{}
+
+// SetThrottle records the throttle cohort and whether or not the request with
+// the given context is being throttled. It's a no-op for requests that aren't
+// being logged.
+func SetThrottle(ctx context.Context, cohort string, throttled bool) {
+	e, ok := ctx.Value(entryKey{}).(*Entry)
+	if !ok {
+		return
+	}
+	e.ThrottleCohort = cohort
+	e.Throttled = throttled
+}
+
+func (l *Logger) Apply(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	start := time.Now()
+	e := l.newEntry(req, start)
+	var c *conn
+	netx.WalkWrapped(cs.Downstream(), func(wrapped net.Conn) bool {
+		switch t := wrapped.(type) {
+		case *conn:
+			c = t
+		case tlslistener.ProbingDetectingConn:
+			e.ProbingError = t.ProbingError()
+		}
+		return true
+	})
+	if c != nil {
+		if c.protocol != "" {
+			e.Protocol = c.protocol
+		}
+		c.inheritThrottle(e)
+	}
+
+	resp, nextCS, err := next(cs, req.WithContext(context.WithValue(req.Context(), entryKey{}, e)))
+	if resp != nil {
+		e.Status = resp.StatusCode
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if c != nil {
+		c.rememberThrottle(e)
+	}
+
+	switch {
+	case c == nil:
+		l.finish(e, start, nil)
+	case req.Method == http.MethodConnect && err == nil && resp != nil && resp.StatusCode == http.StatusOK:
+		// the tunnel lasts until the connection is closed
+		e.Type = TypeTunnel
+		c.startTunnel(e, start)
+	case resp != nil && resp.Body != nil:
+		// the response is done once the proxy is done writing its body
+		resp.Body = &body{ReadCloser: resp.Body, onClose: func() { l.finish(e, start, c) }}
+	default:
+		l.finish(e, start, c)
+	}
+	return resp, nextCS, err
+}
+
+func (l *Logger) newEntry(req *http.Request, start time.Time) *Entry {
+	originHost, originPort, _ := net.SplitHostPort(req.Host)
+	if (originPort == "0" || originPort == "") && req.Method != http.MethodConnect {
+		// Default port for HTTP
+		originPort = "80"
+	}
+	if originHost == "" && !strings.Contains(req.Host, ":") {
+		originHost = req.Host
+	}
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+
+	return &Entry{
+		Time:           start,
+		Type:           TypeHTTP,
+		Protocol:       l.opts.Protocol,
+		HTTPVersion:    req.Proto,
+		Method:         req.Method,
+		OriginHost:     originHost,
+		OriginPort:     originPort,
+		DeviceID:       l.sensitive(req.Header.Get(common.DeviceIdHeader)),
+		ClientIP:       l.sensitive(clientIP),
+		Platform:       req.Header.Get(common.PlatformHeader),
+		App:            req.Header.Get(common.AppHeader),
+		AppVersion:     req.Header.Get(common.AppVersionHeader),
+		LibraryVersion: req.Header.Get(common.LibraryVersionHeader),
+	}
+}
+
+// sensitive applies the privacy policy to the given value.
+func (l *Logger) sensitive(value string) string {
+	if value == "" {
+		return ""
+	}
+	switch l.opts.Privacy {
+	case PrivacyNone:
+		return value
+	case PrivacyDrop:
+		return ""
+	default:
+		mac := hmac.New(sha256.New, l.hashKey)
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+}
+
+func (l *Logger) finish(e *Entry, start time.Time, c *conn) {
+	e.DurationMillis = time.Since(start).Milliseconds()
+	if c != nil {
+		e.BytesRecv, e.BytesSent = c.sinceMark()
+	}
+	l.write(e)
+}
+
+func (l *Logger) write(e *Entry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Unable to encode access log entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+	l.outMx.Lock()
+	_, err = l.out.Write(line)
+	l.outMx.Unlock()
+	if err != nil {
+		log.Errorf("Unable to write access log entry: %v", err)
+	}
+}
+
+type listener struct {
+	net.Listener
+	logger *Logger
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	wc, _ := c.(listeners.WrapConnEmbeddable)
+	var protocol string
+	netx.WalkWrapped(c, func(wrapped net.Conn) bool {
+		if pc, ok := wrapped.(ProtocolConn); ok {
+			protocol = pc.Protocol()
+			return false
+		}
+		return true
+	})
+	return &conn{Conn: c, WrapConnEmbeddable: wc, logger: l.logger, protocol: protocol}, nil
+}
+
+// conn counts the bytes read from and written to the client. It keeps a mark
+// so that each entry only counts the bytes since the previous one.
+type conn struct {
+	net.Conn
+	listeners.WrapConnEmbeddable
+	logger   *Logger
+	protocol string
+
+	read    atomic.Int64
+	written atomic.Int64
+
+	mx             sync.Mutex
+	markRead       int64
+	markWritten    int64
+	tunnel         *Entry
+	tunnelStart    time.Time
+	throttleCohort string
+	throttled      bool
+	closed         bool
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func (c *conn) sinceMark() (read int64, written int64) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	currentRead, currentWritten := c.read.Load(), c.written.Load()
+	read, written = currentRead-c.markRead, currentWritten-c.markWritten
+	c.markRead, c.markWritten = currentRead, currentWritten
+	return
+}
+
+// inheritThrottle fills in the throttle cohort for requests after the first
+// on a connection, which don't go through the device filter.
+func (c *conn) inheritThrottle(e *Entry) {
+	c.mx.Lock()
+	e.ThrottleCohort, e.Throttled = c.throttleCohort, c.throttled
+	c.mx.Unlock()
+}
+
+func (c *conn) rememberThrottle(e *Entry) {
+	c.mx.Lock()
+	c.throttleCohort, c.throttled = e.ThrottleCohort, e.Throttled
+	c.mx.Unlock()
+}
+
+func (c *conn) startTunnel(e *Entry, start time.Time) {
+	c.mx.Lock()
+	if !c.closed {
+		c.tunnel, c.tunnelStart = e, start
+		c.mx.Unlock()
+		return
+	}
+	c.mx.Unlock()
+	c.logger.finish(e, start, c)
+}
+
+func (c *conn) Close() error {
+	c.mx.Lock()
+	tunnel, tunnelStart := c.tunnel, c.tunnelStart
+	c.tunnel, c.closed = nil, true
+	c.mx.Unlock()
+	if tunnel != nil {
+		c.logger.finish(tunnel, tunnelStart, c)
+	}
+	return c.Conn.Close()
+}
+
+func (c *conn) OnState(s http.ConnState) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.OnState(s)
+	}
+}
+
+func (c *conn) ControlMessage(msgType string, data interface{}) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.ControlMessage(msgType, data)
+	}
+}
+
+func (c *conn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// body calls onClose once the first time it's closed.
+type body struct {
+	io.ReadCloser
+	onClose func()
+	once    sync.Once
+}
+
+func (b *body) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.onClose)
+	return err
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
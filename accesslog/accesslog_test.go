@@ -0,0 +1,193 @@
+package accesslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/proxy/v3/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+)
+
+func TestAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := New(&Opts{Path: path, Protocol: "https"})
+	require.NoError(t, err)
+	defer l.Close()
+
+	clientConn, serverConn := net.Pipe()
+	go io.Copy(io.Discard, clientConn)
+	c := &conn{Conn: serverConn, logger: l}
+
+	// plain HTTP request whose response body is written by the proxy after the
+	// filter returns
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/index.html", nil)
+	req.RemoteAddr = "1.2.3.4:5678"
+	req.Header.Set(common.DeviceIdHeader, "device1")
+	req.Header.Set(common.PlatformHeader, "android")
+	cs := filters.NewConnectionState(req, nil, c)
+	resp, _, err := l.Apply(cs, req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		SetThrottle(req.Context(), "cohort1", true)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("hello"))}, cs, nil
+	})
+	require.NoError(t, err)
+	assert.Empty(t, readEntries(t, path), "entry shouldn't be written until the response body is closed")
+	_, err = io.Copy(c, resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	// CONNECT on the same connection, logged once the connection is closed
+	req, _ = http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	req.RemoteAddr = "1.2.3.4:5678"
+	_, _, err = l.Apply(cs, req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	})
+	require.NoError(t, err)
+	_, err = c.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	require.Len(t, readEntries(t, path), 1)
+	require.NoError(t, c.Close())
+
+	entries := readEntries(t, path)
+	require.Len(t, entries, 2)
+
+	httpEntry := entries[0]
+	assert.Equal(t, TypeHTTP, httpEntry.Type)
+	assert.Equal(t, "https", httpEntry.Protocol)
+	assert.Equal(t, http.MethodGet, httpEntry.Method)
+	assert.Equal(t, "example.com", httpEntry.OriginHost)
+	assert.Equal(t, "80", httpEntry.OriginPort)
+	assert.Equal(t, http.StatusOK, httpEntry.Status)
+	assert.EqualValues(t, 5, httpEntry.BytesSent)
+	assert.Equal(t, "android", httpEntry.Platform)
+	assert.Equal(t, "cohort1", httpEntry.ThrottleCohort)
+	assert.True(t, httpEntry.Throttled)
+	assert.Len(t, httpEntry.DeviceID, 32, "device ID should be hashed")
+	assert.NotEqual(t, "device1", httpEntry.DeviceID)
+	assert.Len(t, httpEntry.ClientIP, 32, "client IP should be hashed")
+	assert.NotContains(t, httpEntry.ClientIP, "1.2.3.4")
+
+	tunnelEntry := entries[1]
+	assert.Equal(t, TypeTunnel, tunnelEntry.Type)
+	assert.Equal(t, http.MethodConnect, tunnelEntry.Method)
+	assert.Equal(t, "443", tunnelEntry.OriginPort)
+	assert.EqualValues(t, 10, tunnelEntry.BytesSent)
+	assert.Equal(t, "cohort1", tunnelEntry.ThrottleCohort, "throttle cohort should carry over to later requests on the connection")
+	assert.Equal(t, httpEntry.ClientIP, tunnelEntry.ClientIP, "hashes should be consistent")
+}
+
+func TestPrivacy(t *testing.T) {
+	doTest := func(privacy string, expectedDeviceID, expectedClientIP string) {
+		path := filepath.Join(t.TempDir(), "access.log")
+		l, err := New(&Opts{Path: path, Privacy: privacy})
+		require.NoError(t, err)
+		defer l.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.RemoteAddr = "1.2.3.4:5678"
+		req.Header.Set(common.DeviceIdHeader, "device1")
+		_, _, err = l.Apply(filters.NewConnectionState(req, nil, nil), req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			return nil, cs, nil
+		})
+		require.NoError(t, err)
+
+		entries := readEntries(t, path)
+		require.Len(t, entries, 1)
+		assert.Equal(t, expectedDeviceID, entries[0].DeviceID, privacy)
+		assert.Equal(t, expectedClientIP, entries[0].ClientIP, privacy)
+	}
+
+	doTest(PrivacyDrop, "", "")
+	doTest(PrivacyNone, "device1", "1.2.3.4")
+
+	_, err := New(&Opts{Path: Stdout, Privacy: "bogus"})
+	assert.Error(t, err)
+}
+
+type protocolConn struct {
+	net.Conn
+}
+
+func (c *protocolConn) Protocol() string {
+	return "shadowsocks"
+}
+
+type singleConnListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	return l.conn, nil
+}
+
+func TestListenerProtocol(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := New(&Opts{Path: path, Protocol: "https"})
+	require.NoError(t, err)
+	defer l.Close()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	c, err := l.WrapListener(&singleConnListener{conn: &protocolConn{serverConn}}).Accept()
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	_, _, err = l.Apply(filters.NewConnectionState(req, nil, c), req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return nil, cs, nil
+	})
+	require.NoError(t, err)
+
+	entries := readEntries(t, path)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "shadowsocks", entries[0].Protocol, "protocol of the listener should be logged")
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	for file, expected := range map[string]string{
+		path:        "dddddddd\n",
+		path + ".1": "cccccccc\n",
+		path + ".2": "bbbbbbbb\n",
+	} {
+		b, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(b), file)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "only maxBackups files should be kept")
+}
+
+func readEntries(t *testing.T, path string) []*Entry {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var entries []*Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := &Entry{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), e))
+		entries = append(entries, e)
+	}
+	require.NoError(t, scanner.Err())
+	return entries
+}
@@ -0,0 +1,78 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/getlantern/errors"
+)
+
+// rotatingFile is a file that's rotated once it reaches maxSize, keeping up to
+// maxBackups rotated files named path.1 (the most recent) through
+// path.<maxBackups>. It's not safe for concurrent use.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.New("unable to open access log %v: %v", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.New("unable to stat access log %v: %v", f.path, err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	if f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		log.Errorf("Unable to close access log %v: %v", f.path, err)
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		// ignore errors since older backups may not exist yet
+		_ = os.Rename(f.backup(i), f.backup(i+1))
+	}
+	if err := os.Rename(f.path, f.backup(1)); err != nil {
+		log.Errorf("Unable to rotate access log %v: %v", f.path, err)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%v.%d", f.path, i)
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,319 @@
+// package admin provides an authenticated HTTP API for inspecting and
+// controlling a running proxy without redeploying it.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
+	"github.com/getlantern/http-proxy-lantern/v2/shadowsocks"
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+	"github.com/getlantern/http-proxy-lantern/v2/usage"
+	"github.com/getlantern/http-proxy-lantern/v2/v2ray/vmess"
+)
+
+var (
+	log = golog.LoggerFor("http-proxy-lantern.admin")
+)
+
+// Listener describes a listener the proxy is serving.
+type Listener struct {
+	Protocol    string `json:"protocol"`
+	Addr        string `json:"addr"`
+	Connections int64  `json:"connections"`
+}
+
+// Opts configures the admin API.
+type Opts struct {
+	// Token is required in the Authorization header of all requests, as in
+	// "Authorization: Bearer <token>".
+	Token string
+
+	// Listeners returns the listeners the proxy is currently serving.
+	Listeners func() []Listener
+
+	// ThrottleConfig is used to resolve throttle settings for devices. It may
+	// be nil if throttling isn't configured.
+	ThrottleConfig throttle.Config
+
+	// ShadowsocksKeys are the access keys of the shadowsocks listeners. It may
+	// be nil if shadowsocks isn't enabled.
+	ShadowsocksKeys *shadowsocks.AccessKeys
+
+	// VMessUsers are the UUIDs accepted by the VMess listener. It may be nil if
+	// VMess isn't enabled.
+	VMessUsers *vmess.Users
+
+	// Blacklist is the proxy's blacklist. It may be nil if the proxy isn't
+	// serving yet.
+	Blacklist *blacklist.Blacklist
+}
+
+type handler struct {
+	*http.ServeMux
+	opts *Opts
+}
+
+// NewHandler returns an http.Handler serving the admin API, which consists
+// of:
+//
+//	GET /listeners                       lists the listeners with their connection counts
+//	GET /throttle?device=<id>&country=<code>&platform=<platform>&app=<name>&datacaps=<caps>
+//	                                     shows the throttle settings resolved for a device
+//	GET /usage?device=<id>               shows the latest known usage of a device
+//	GET|POST /blacklisting[?enabled=<bool>][&dryRun=<bool>]
+//	                                     shows or toggles whether blacklisting is enabled and
+//	                                     whether it's in dry-run mode
+//	GET /blacklist/entries               lists the entries in the blacklist
+//	POST /blacklist/entries?entry=<ip|cidr|asn>[&ttl=<duration>]
+//	                                     adds an entry to the blacklist, which never expires
+//	                                     without a ttl
+//	DELETE /blacklist/entries?entry=<ip|cidr|asn>
+//	                                     removes an entry from the blacklist
+//	GET|PUT /shadowsocks/keys            lists the shadowsocks access keys (without their
+//	                                     secrets) or replaces them with the JSON list in the body
+//	GET|PUT /vmess/uuids                 lists the VMess UUIDs (redacted) or replaces them with the
+//	                                     JSON list in the body, until they change in the reloaded
+//	                                     configuration
+func NewHandler(opts *Opts) http.Handler {
+	h := &handler{ServeMux: http.NewServeMux(), opts: opts}
+	h.HandleFunc("/listeners", h.listeners)
+	h.HandleFunc("/throttle", h.throttle)
+	h.HandleFunc("/usage", h.usage)
+	h.HandleFunc("/blacklisting", h.blacklisting)
+	h.HandleFunc("/blacklist/entries", h.blacklistEntries)
+	h.HandleFunc("/shadowsocks/keys", h.shadowsocksKeys)
+	h.HandleFunc("/vmess/uuids", h.vmessUUIDs)
+	return h
+}
+
+func (h *handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if h.opts.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.opts.Token)) != 1 {
+		log.Debugf("Unauthorized admin request from %v", req.RemoteAddr)
+		http.Error(resp, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	log.Debugf("Admin request from %v: %v %v", req.RemoteAddr, req.Method, req.URL)
+	h.ServeMux.ServeHTTP(resp, req)
+}
+
+func (h *handler) listeners(resp http.ResponseWriter, req *http.Request) {
+	if !allowMethods(resp, req, http.MethodGet) {
+		return
+	}
+	var result []Listener
+	if h.opts.Listeners != nil {
+		result = h.opts.Listeners()
+	}
+	if result == nil {
+		result = []Listener{}
+	}
+	writeJSON(resp, result)
+}
+
+func (h *handler) throttle(resp http.ResponseWriter, req *http.Request) {
+	if !allowMethods(resp, req, http.MethodGet) {
+		return
+	}
+	q := req.URL.Query()
+	deviceID := q.Get("device")
+	if deviceID == "" {
+		http.Error(resp, "missing device", http.StatusBadRequest)
+		return
+	}
+	if h.opts.ThrottleConfig == nil {
+		http.Error(resp, "throttling not configured", http.StatusNotFound)
+		return
+	}
+	var dataCaps []string
+	if caps := q.Get("datacaps"); caps != "" {
+		dataCaps = strings.Split(caps, ",")
+	}
+	settings, ok := h.opts.ThrottleConfig.SettingsFor(deviceID, q.Get("country"), q.Get("platform"), q.Get("app"), dataCaps)
+	if !ok {
+		http.Error(resp, "no throttle settings for device", http.StatusNotFound)
+		return
+	}
+	writeJSON(resp, settings)
+}
+
+func (h *handler) usage(resp http.ResponseWriter, req *http.Request) {
+	if !allowMethods(resp, req, http.MethodGet) {
+		return
+	}
+	deviceID := req.URL.Query().Get("device")
+	if deviceID == "" {
+		http.Error(resp, "missing device", http.StatusBadRequest)
+		return
+	}
+	u := usage.Get(deviceID)
+	if u == nil {
+		http.Error(resp, "no usage for device", http.StatusNotFound)
+		return
+	}
+	writeJSON(resp, u)
+}
+
+func (h *handler) blacklisting(resp http.ResponseWriter, req *http.Request) {
+	if !allowMethods(resp, req, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if req.Method == http.MethodPost {
+		query := req.URL.Query()
+		if !query.Has("enabled") && !query.Has("dryRun") {
+			http.Error(resp, "missing enabled or dryRun", http.StatusBadRequest)
+			return
+		}
+		var enabled, dryRun bool
+		var err error
+		if query.Has("enabled") {
+			if enabled, err = strconv.ParseBool(query.Get("enabled")); err != nil {
+				http.Error(resp, "enabled must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+		if query.Has("dryRun") {
+			if dryRun, err = strconv.ParseBool(query.Get("dryRun")); err != nil {
+				http.Error(resp, "dryRun must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+		if query.Has("enabled") {
+			log.Debugf("Setting blacklisting enabled to %v on behalf of %v", enabled, req.RemoteAddr)
+			blacklist.SetEnabled(enabled)
+		}
+		if query.Has("dryRun") {
+			log.Debugf("Setting blacklisting dry-run to %v on behalf of %v", dryRun, req.RemoteAddr)
+			blacklist.SetDryRun(dryRun)
+		}
+	}
+	writeJSON(resp, map[string]bool{"enabled": blacklist.Enabled(), "dryRun": blacklist.DryRun()})
+}
+
+func (h *handler) blacklistEntries(resp http.ResponseWriter, req *http.Request) {
+	if !allowMethods(resp, req, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	if h.opts.Blacklist == nil {
+		http.Error(resp, "blacklist not available", http.StatusNotFound)
+		return
+	}
+	entry := req.URL.Query().Get("entry")
+	switch req.Method {
+	case http.MethodPost:
+		var ttl time.Duration
+		if ttlString := req.URL.Query().Get("ttl"); ttlString != "" {
+			var err error
+			ttl, err = time.ParseDuration(ttlString)
+			if err != nil || ttl < 0 {
+				http.Error(resp, "invalid ttl", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := h.opts.Blacklist.Add(entry, ttl); err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Debugf("Blacklisted %v for %v on behalf of %v", entry, ttl, req.RemoteAddr)
+	case http.MethodDelete:
+		if err := h.opts.Blacklist.Remove(entry); err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Debugf("Removed %v from blacklist on behalf of %v", entry, req.RemoteAddr)
+	}
+	writeJSON(resp, h.opts.Blacklist.Entries())
+}
+
+func (h *handler) shadowsocksKeys(resp http.ResponseWriter, req *http.Request) {
+	if !allowMethods(resp, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if h.opts.ShadowsocksKeys == nil {
+		http.Error(resp, "shadowsocks not enabled", http.StatusNotFound)
+		return
+	}
+	if req.Method == http.MethodPut {
+		var keys []shadowsocks.CipherConfig
+		if err := json.NewDecoder(req.Body).Decode(&keys); err != nil {
+			http.Error(resp, "invalid keys: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.opts.ShadowsocksKeys.SetKeys(keys); err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Debugf("Updated %d shadowsocks keys on behalf of %v", len(keys), req.RemoteAddr)
+	}
+	keys := h.opts.ShadowsocksKeys.Keys()
+	for i := range keys {
+		// so that it is omitted from the response
+		keys[i].Secret = ""
+	}
+	writeJSON(resp, keys)
+}
+
+func (h *handler) vmessUUIDs(resp http.ResponseWriter, req *http.Request) {
+	if !allowMethods(resp, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if h.opts.VMessUsers == nil {
+		http.Error(resp, "vmess not enabled", http.StatusNotFound)
+		return
+	}
+	if req.Method == http.MethodPut {
+		var uuids []string
+		if err := json.NewDecoder(req.Body).Decode(&uuids); err != nil {
+			http.Error(resp, "invalid uuids: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.opts.VMessUsers.Update(uuids); err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Debugf("Updated %d vmess UUIDs on behalf of %v", len(uuids), req.RemoteAddr)
+	}
+	uuids := h.opts.VMessUsers.UUIDs()
+	for i, uuid := range uuids {
+		uuids[i] = redactUUID(uuid)
+	}
+	writeJSON(resp, uuids)
+}
+
+// redactUUID masks all but the last 4 hex digits of a UUID, which is enough to
+// tell UUIDs apart without exposing them.
+func redactUUID(uuid string) string {
+	redacted := []byte(uuid)
+	for i := 0; i < len(redacted)-4; i++ {
+		if redacted[i] != '-' {
+			redacted[i] = '*'
+		}
+	}
+	return string(redacted)
+}
+
+func allowMethods(resp http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	resp.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(resp http.ResponseWriter, v interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(v); err != nil {
+		log.Errorf("Unable to write admin response: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
+	"github.com/getlantern/http-proxy-lantern/v2/shadowsocks"
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+	"github.com/getlantern/http-proxy-lantern/v2/usage"
+	"github.com/getlantern/http-proxy-lantern/v2/v2ray/vmess"
+)
+
+const token = "4dm1nT0k3n"
+
+func TestAdmin(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	ssKeys, err := shadowsocks.NewAccessKeys([]shadowsocks.CipherConfig{{ID: "default", Secret: "static"}}, keysFile, time.Hour)
+	require.NoError(t, err)
+	vmessUsers, err := vmess.NewUsers([]string{"3fed9a96-900c-4dd4-9fd2-f333a5667681"})
+	require.NoError(t, err)
+	defer vmessUsers.Close()
+	bl, err := blacklist.New(blacklist.Options{Entries: []string{"AS64496"}})
+	require.NoError(t, err)
+	h := NewHandler(&Opts{
+		Token: token,
+		Listeners: func() []Listener {
+			return []Listener{{Protocol: "https", Addr: "127.0.0.1:443", Connections: 3}}
+		},
+		ThrottleConfig:  throttle.NewForcedConfig(1000, 100, throttle.Daily),
+		ShadowsocksKeys: ssKeys,
+		VMessUsers:      vmessUsers,
+		Blacklist:       bl,
+	})
+
+	do := func(method, url, authToken string, result interface{}) int {
+		req := httptest.NewRequest(method, url, nil)
+		if authToken != "" {
+			req.Header.Set("Authorization", "Bearer "+authToken)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if result != nil && rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), result))
+		}
+		return rec.Code
+	}
+
+	t.Run("unauthorized", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/listeners", "", nil))
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/listeners", "wrong", nil))
+
+		req := httptest.NewRequest(http.MethodGet, "/listeners", nil)
+		req.Header.Set("Authorization", "Bearer ")
+		rec := httptest.NewRecorder()
+		NewHandler(&Opts{}).ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "empty token should never be accepted")
+	})
+
+	t.Run("listeners", func(t *testing.T) {
+		var listeners []Listener
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/listeners", token, &listeners))
+		assert.Equal(t, []Listener{{Protocol: "https", Addr: "127.0.0.1:443", Connections: 3}}, listeners)
+		assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPost, "/listeners", token, nil))
+	})
+
+	t.Run("throttle", func(t *testing.T) {
+		var settings throttle.Settings
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/throttle?device=dev1&country=cn&platform=android", token, &settings))
+		assert.Equal(t, "forced", settings.Label)
+		assert.EqualValues(t, 1000, settings.Threshold)
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/throttle", token, nil))
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		usage.Set("admin-test-device", "ir", 5000, time.Now(), 3600)
+		var u usage.Usage
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/usage?device=admin-test-device", token, &u))
+		assert.Equal(t, "ir", u.CountryCode)
+		assert.EqualValues(t, 5000, u.Bytes)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/usage?device=unknown-device", token, nil))
+	})
+
+	t.Run("blacklisting", func(t *testing.T) {
+		defer blacklist.SetEnabled(blacklist.Enabled())
+
+		var status map[string]bool
+		assert.Equal(t, http.StatusOK, do(http.MethodPost, "/blacklisting?enabled=true", token, &status))
+		assert.True(t, status["enabled"])
+		assert.True(t, blacklist.Enabled())
+
+		assert.Equal(t, http.StatusOK, do(http.MethodPost, "/blacklisting?enabled=false", token, &status))
+		assert.False(t, status["enabled"])
+		assert.False(t, blacklist.Enabled())
+
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/blacklisting?enabled=maybe", token, nil))
+
+		defer blacklist.SetDryRun(blacklist.DryRun())
+		assert.Equal(t, http.StatusOK, do(http.MethodPost, "/blacklisting?dryRun=true", token, &status))
+		assert.True(t, status["dryRun"])
+		assert.False(t, status["enabled"], "enabled shouldn't change with only dryRun")
+		assert.True(t, blacklist.DryRun())
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/blacklisting", token, nil))
+	})
+
+	t.Run("blacklist entries", func(t *testing.T) {
+		var entries []blacklist.Entry
+		assert.Equal(t, http.StatusOK, do(http.MethodPost, "/blacklist/entries?entry=192.0.2.0/24&ttl=1h", token, &entries))
+		require.Len(t, entries, 2)
+		assert.Equal(t, "192.0.2.0/24", entries[0].Entry)
+		assert.False(t, entries[0].ExpiresAt.IsZero())
+		assert.Equal(t, "AS64496", entries[1].Entry)
+		assert.True(t, entries[1].Static)
+
+		assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/blacklist/entries?entry=192.0.2.0/24", token, &entries))
+		assert.Len(t, entries, 1)
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/blacklist/entries?entry=bogus", token, nil))
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/blacklist/entries?entry=192.0.2.1&ttl=forever", token, nil))
+
+		req := httptest.NewRequest(http.MethodGet, "/blacklist/entries", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		NewHandler(&Opts{Token: token}).ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("shadowsocks keys", func(t *testing.T) {
+		put := func(body string) int {
+			req := httptest.NewRequest(http.MethodPut, "/shadowsocks/keys", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			return rec.Code
+		}
+
+		assert.Equal(t, http.StatusOK, put(`[{"id": "user1", "secret": "secret1"}, {"id": "user2", "secret": "secret2", "cipher": "AEAD_AES_256_GCM"}]`))
+		var keys []map[string]interface{}
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/shadowsocks/keys", token, &keys))
+		assert.Equal(t, []map[string]interface{}{{"id": "user1"}, {"id": "user2", "cipher": "AEAD_AES_256_GCM"}}, keys, "secrets shouldn't be exposed")
+		saved, err := os.ReadFile(keysFile)
+		require.NoError(t, err)
+		assert.Contains(t, string(saved), "secret2", "keys should have been saved to the keys file")
+
+		assert.Equal(t, http.StatusBadRequest, put(`[{"id": "default", "secret": "duplicate"}]`))
+		assert.Equal(t, http.StatusBadRequest, put(`[{"id": "nosecret"}]`))
+		assert.Equal(t, http.StatusBadRequest, put(`not json`))
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/shadowsocks/keys", token, &keys))
+		assert.Len(t, keys, 2, "invalid keys shouldn't have replaced the existing ones")
+	})
+
+	t.Run("vmess uuids", func(t *testing.T) {
+		put := func(body string) int {
+			req := httptest.NewRequest(http.MethodPut, "/vmess/uuids", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			return rec.Code
+		}
+
+		var uuids []string
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/vmess/uuids", token, &uuids))
+		assert.Equal(t, []string{"********-****-****-****-********7681"}, uuids, "uuids shouldn't be exposed")
+
+		assert.Equal(t, http.StatusOK, put(`["3fed9a96-900c-4dd4-9fd2-f333a5667682"]`))
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/vmess/uuids", token, &uuids))
+		assert.Equal(t, []string{"********-****-****-****-********7682"}, uuids)
+
+		assert.Equal(t, http.StatusBadRequest, put(`not json`))
+		assert.Equal(t, []string{"3fed9a96-900c-4dd4-9fd2-f333a5667682"}, vmessUsers.UUIDs(), "invalid request shouldn't have replaced the existing uuids")
+	})
+}
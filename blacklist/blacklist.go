@@ -1,15 +1,28 @@
 // Package blacklist provides a mechanism for blacklisting IP addresses that
 // connect but never make it past our security filtering, either because they're
 // not sending HTTP requests or sending invalid HTTP requests.
+//
+// Besides the IPs it blacklists on its own, a blacklist can contain IPs, CIDRs
+// and ASNs that are added to it explicitly, and an allowlist of the same always
+// wins over it. The blacklist can be saved to a file so that it survives
+// restarts and shared with other proxies through Redis.
 package blacklist
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/getlantern/geo"
 	"github.com/getlantern/golog"
+	"github.com/go-redis/redis/v8"
 
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
 )
@@ -30,14 +43,50 @@ const (
 	// DefaultExpiration is used fro Expiration if a non-positive value is
 	// specified.
 	DefaultExpiration = 6 * time.Hour
+
+	// DefaultSyncInterval is used for SyncInterval if a non-positive value is
+	// specified.
+	DefaultSyncInterval = 1 * time.Minute
+
+	// the sorted set holding the shared blacklist in Redis, scored by the unix
+	// time at which each entry expires
+	redisKey     = "_blacklist"
+	redisTimeout = 10 * time.Second
 )
 
 var (
 	log = golog.LoggerFor("blacklist")
 
-	blacklistingEnabled = false // we've temporarily turned off blacklisting for safety
+	// blacklisting is off unless it's explicitly turned on
+	blacklistingEnabled atomic.Bool
+
+	dryRun atomic.Bool
 )
 
+// Enabled indicates whether blacklisted IPs are actually refused.
+func Enabled() bool {
+	return blacklistingEnabled.Load()
+}
+
+// SetEnabled turns blacklisting on or off. While disabled, connections aren't
+// tracked and nobody gets blacklisted.
+func SetEnabled(enabled bool) {
+	blacklistingEnabled.Store(enabled)
+}
+
+// DryRun indicates whether blacklisting is in dry-run mode.
+func DryRun() bool {
+	return dryRun.Load()
+}
+
+// SetDryRun turns dry-run mode on or off. In dry-run mode, connections are
+// tracked and IPs are blacklisted as usual, even if blacklisting isn't enabled,
+// but connections that match the blacklist are only counted with
+// Instrument.BlacklistDryRun instead of being refused.
+func SetDryRun(enabled bool) {
+	dryRun.Store(enabled)
+}
+
 // Options is a set of options to initialize a blacklist.
 type Options struct {
 	// The maximum amount of time we'll wait between the start of a connection
@@ -58,6 +107,28 @@ type Options struct {
 	// 6 hours.
 	Expiration time.Duration
 
+	// IPs, CIDRs and ASNs (like AS64496) that are always blacklisted.
+	Entries []string
+
+	// IPs, CIDRs and ASNs that are never blacklisted, even if they match an
+	// entry in the blacklist.
+	Allowlist []string
+
+	// Used to look up the ASN of clients if there are any ASN entries.
+	ISPLookup geo.ISPLookup
+
+	// If specified, the blacklist is saved to this file so that it survives
+	// restarts.
+	File string
+
+	// If specified, the blacklist is shared through this Redis with all other
+	// proxies using the same Redis.
+	RedisClient redis.UniversalClient
+
+	// How frequently to pick up changes to the blacklist from Redis. Defaults to
+	// 1 minute.
+	SyncInterval time.Duration
+
 	Instrument instrument.Instrument
 }
 
@@ -81,46 +152,93 @@ func (opts *Options) applyDefaults() {
 		opts.Expiration = DefaultExpiration
 		log.Debugf("Defaulted Expiration to %v", opts.Expiration)
 	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if opts.ISPLookup == nil {
+		opts.ISPLookup = geo.NoLookup{}
+	}
 	if opts.Instrument == nil {
 		opts.Instrument = instrument.NoInstrument{}
 	}
 }
 
+// Entry is an entry in the blacklist.
+type Entry struct {
+	// An IP, CIDR or ASN
+	Entry string `json:"entry"`
+	// When the entry expires, zero if it doesn't
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+	// Whether the entry came from Options.Entries rather than being added
+	// while running
+	Static bool `json:"static,omitempty"`
+}
+
 // Blacklist is a blacklist of IPs.
 type Blacklist struct {
 	maxIdleTime         time.Duration
 	maxConnectInterval  time.Duration
 	allowedFailures     int
 	blacklistExpiration time.Duration
+	syncInterval        time.Duration
+	ispLookup           geo.ISPLookup
+	file                string
+	redisClient         redis.UniversalClient
 	connections         chan string
 	successes           chan string
 	firstConnectionTime map[string]time.Time
 	lastConnectionTime  map[string]time.Time
 	failureCounts       map[string]int
-	blacklist           map[string]time.Time
+	static              *list
+	allowlist           *list
+	blacklist           *list
+	unpublished         map[string]time.Time // entries not added to Redis yet
+	unremoved           map[string]bool      // entries not removed from Redis yet
 	instrument          instrument.Instrument
 	mutex               sync.RWMutex
+	saveMutex           sync.Mutex
 }
 
-// New creates a new Blacklist with given options.
-func New(opts Options) *Blacklist {
+// New creates a new Blacklist with given options, loading the blacklist saved
+// in opts.File, if any.
+func New(opts Options) (*Blacklist, error) {
 	opts.applyDefaults()
 
+	static, err := newStaticList(opts.Entries)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blacklist entry: %w", err)
+	}
+	allowlist, err := newStaticList(opts.Allowlist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowlist entry: %w", err)
+	}
+
 	bl := &Blacklist{
 		maxIdleTime:         opts.MaxIdleTime,
 		maxConnectInterval:  opts.MaxConnectInterval,
 		allowedFailures:     opts.AllowedFailures,
 		blacklistExpiration: opts.Expiration,
+		syncInterval:        opts.SyncInterval,
+		ispLookup:           opts.ISPLookup,
+		file:                opts.File,
+		redisClient:         opts.RedisClient,
 		connections:         make(chan string, 10000),
 		successes:           make(chan string, 10000),
 		firstConnectionTime: make(map[string]time.Time),
 		lastConnectionTime:  make(map[string]time.Time),
 		failureCounts:       make(map[string]int),
-		blacklist:           make(map[string]time.Time),
+		static:              static,
+		allowlist:           allowlist,
+		blacklist:           newList(),
+		unpublished:         make(map[string]time.Time),
+		unremoved:           make(map[string]bool),
 		instrument:          opts.Instrument,
 	}
+	if err := bl.load(); err != nil {
+		return nil, err
+	}
 	go bl.track()
-	return bl
+	return bl, nil
 }
 
 // Succeed records a success for the given addr, which resets the failure count
@@ -137,17 +255,25 @@ func (bl *Blacklist) Succeed(ip string) {
 // OnConnect records an attempt to connect from the given IP. If the IP is
 // blacklisted, this returns false.
 func (bl *Blacklist) OnConnect(ip string) bool {
-	if !blacklistingEnabled {
+	if !Enabled() && !DryRun() {
+		bl.instrument.Blacklist(context.Background(), false)
+		return true
+	}
+
+	allowed, kind, blacklisted := bl.check(ip)
+	if allowed {
+		// allowlisted IPs are never tracked
 		bl.instrument.Blacklist(context.Background(), false)
 		return true
 	}
-	bl.mutex.RLock()
-	defer bl.mutex.RUnlock()
-	_, blacklisted := bl.blacklist[ip]
 	if blacklisted {
-		log.Errorf("%v is blacklisted", ip)
-		bl.instrument.Blacklist(context.Background(), true)
-		return false
+		if !DryRun() {
+			log.Errorf("%v is blacklisted", ip)
+			bl.instrument.Blacklist(context.Background(), true)
+			return false
+		}
+		log.Debugf("%v matches a blacklisted %v, not refusing it in dry-run mode", ip, kind)
+		bl.instrument.BlacklistDryRun(context.Background(), kind)
 	}
 	bl.instrument.Blacklist(context.Background(), false)
 	select {
@@ -159,9 +285,133 @@ func (bl *Blacklist) OnConnect(ip string) bool {
 	return true
 }
 
+// check checks the given IP against the allowlist and the blacklist, returning
+// the kind of blacklist entry that it matched, if any.
+func (bl *Blacklist) check(ip string) (allowed bool, kind string, blacklisted bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false, "", false
+	}
+	var asn string
+	lookedUpASN := false
+	lookupASN := func() string {
+		if !lookedUpASN {
+			asn = bl.ispLookup.ASN(parsed)
+			lookedUpASN = true
+		}
+		return asn
+	}
+
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+	if _, allowed := bl.allowlist.match(parsed, lookupASN); allowed {
+		return true, "", false
+	}
+	if kind, blacklisted := bl.static.match(parsed, lookupASN); blacklisted {
+		return false, kind, true
+	}
+	kind, blacklisted = bl.blacklist.match(parsed, lookupASN)
+	return false, kind, blacklisted
+}
+
+// SetEntries replaces the entries that are always blacklisted.
+func (bl *Blacklist) SetEntries(entries []string) error {
+	static, err := newStaticList(entries)
+	if err != nil {
+		return fmt.Errorf("invalid blacklist entry: %w", err)
+	}
+	bl.mutex.Lock()
+	bl.static = static
+	bl.mutex.Unlock()
+	return nil
+}
+
+// SetAllowlist replaces the allowlist.
+func (bl *Blacklist) SetAllowlist(allowlist []string) error {
+	l, err := newStaticList(allowlist)
+	if err != nil {
+		return fmt.Errorf("invalid allowlist entry: %w", err)
+	}
+	bl.mutex.Lock()
+	bl.allowlist = l
+	bl.mutex.Unlock()
+	return nil
+}
+
+// Add adds the given IP, CIDR or ASN to the blacklist for the given duration,
+// or until it's removed if ttl is zero. Like the IPs that are blacklisted
+// automatically, it's saved and shared with other proxies.
+func (bl *Blacklist) Add(entry string, ttl time.Duration) error {
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	bl.mutex.Lock()
+	key, err := bl.blacklist.add(entry, expiresAt)
+	if err == nil && bl.redisClient != nil {
+		// until it's in Redis, so that syncing in the meantime doesn't drop it
+		bl.unpublished[key] = expiresAt
+		delete(bl.unremoved, key)
+	}
+	bl.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Added %v to blacklist", key)
+	bl.publish(map[string]time.Time{key: expiresAt})
+	return bl.save()
+}
+
+// Remove removes the given IP, CIDR or ASN from the blacklist. Entries from
+// Options.Entries can't be removed, they have to be changed with SetEntries.
+func (bl *Blacklist) Remove(entry string) error {
+	key, _, _, err := parseEntry(entry)
+	if err != nil {
+		return err
+	}
+	bl.mutex.Lock()
+	removed := bl.blacklist.remove(key)
+	if removed && bl.redisClient != nil {
+		// until it's gone from Redis, so that syncing in the meantime doesn't
+		// bring it back
+		bl.unremoved[key] = true
+		delete(bl.unpublished, key)
+	}
+	bl.mutex.Unlock()
+	if !removed {
+		return nil
+	}
+	log.Debugf("Removed %v from blacklist", key)
+	bl.unpublish(key)
+	return bl.save()
+}
+
+// Entries lists all entries in the blacklist, sorted by entry.
+func (bl *Blacklist) Entries() []Entry {
+	bl.mutex.RLock()
+	result := make([]Entry, 0, len(bl.static.entries)+len(bl.blacklist.entries))
+	for key := range bl.static.entries {
+		result = append(result, Entry{Entry: key, Static: true})
+	}
+	for key, expiresAt := range bl.blacklist.entries {
+		result = append(result, Entry{Entry: key, ExpiresAt: expiresAt})
+	}
+	bl.mutex.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Entry < result[j].Entry
+	})
+	return result
+}
+
 func (bl *Blacklist) track() {
 	idleTicker := time.NewTicker(bl.maxIdleTime)
 	blacklistTicker := time.NewTicker(bl.blacklistExpiration / 10)
+	var syncCh <-chan time.Time
+	if bl.redisClient != nil {
+		bl.sync()
+		syncTicker := time.NewTicker(bl.syncInterval)
+		syncCh = syncTicker.C
+	}
 	for {
 		select {
 		case ip := <-bl.connections:
@@ -172,6 +422,8 @@ func (bl *Blacklist) track() {
 			bl.checkForIdlers()
 		case <-blacklistTicker.C:
 			bl.checkExpiration()
+		case <-syncCh:
+			bl.sync()
 		}
 	}
 }
@@ -195,9 +447,19 @@ func (bl *Blacklist) onSuccess(ip string) {
 	bl.failureCounts[ip] = 0
 	delete(bl.lastConnectionTime, ip)
 	delete(bl.firstConnectionTime, ip)
+	key, kind, _, err := parseEntry(ip)
+	if err != nil || kind != kindIP {
+		return
+	}
 	bl.mutex.Lock()
-	delete(bl.blacklist, ip)
+	removed := bl.blacklist.remove(key)
 	bl.mutex.Unlock()
+	if removed {
+		bl.unpublish(key)
+		if err := bl.save(); err != nil {
+			log.Error(err)
+		}
+	}
 }
 
 func (bl *Blacklist) checkForIdlers() {
@@ -219,24 +481,228 @@ func (bl *Blacklist) checkForIdlers() {
 		}
 	}
 	if len(blacklistAdditions) > 0 {
+		expiresAt := now.Add(bl.blacklistExpiration)
+		added := make(map[string]time.Time, len(blacklistAdditions))
 		bl.mutex.Lock()
 		for _, ip := range blacklistAdditions {
-			bl.blacklist[ip] = now
+			if key, err := bl.blacklist.add(ip, expiresAt); err == nil {
+				added[key] = expiresAt
+			}
 		}
 		bl.mutex.Unlock()
+		bl.publish(added)
+		if err := bl.save(); err != nil {
+			log.Error(err)
+		}
 	}
 }
 
 func (bl *Blacklist) checkExpiration() {
 	now := time.Now()
 	bl.mutex.Lock()
-	for ip, blacklistedAt := range bl.blacklist {
-		if now.Sub(blacklistedAt) > bl.blacklistExpiration {
-			log.Tracef("Removing %v from blacklist", ip)
-			delete(bl.blacklist, ip)
-			delete(bl.failureCounts, ip)
-			delete(bl.firstConnectionTime, ip)
+	expired := bl.blacklist.removeExpired(now)
+	bl.mutex.Unlock()
+	for _, key := range expired {
+		log.Tracef("Removing %v from blacklist", key)
+		delete(bl.failureCounts, key)
+		delete(bl.firstConnectionTime, key)
+	}
+	if len(expired) > 0 {
+		if err := bl.save(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// load loads the blacklist saved in the file, if any, skipping entries that
+// expired in the meantime.
+func (bl *Blacklist) load() error {
+	if bl.file == "" {
+		return nil
+	}
+	b, err := os.ReadFile(bl.file)
+	if os.IsNotExist(err) {
+		log.Debugf("No blacklist saved at %v yet", bl.file)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read blacklist from %v: %w", bl.file, err)
+	}
+	var saved map[string]int64
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("unable to parse blacklist in %v: %w", bl.file, err)
+	}
+	for entry, expiresAt := range saved {
+		if _, err := bl.blacklist.add(entry, fromUnix(expiresAt)); err != nil {
+			log.Errorf("Ignoring saved blacklist entry: %v", err)
+		}
+	}
+	bl.blacklist.removeExpired(time.Now())
+	log.Debugf("Loaded %d blacklist entries from %v", len(bl.blacklist.entries), bl.file)
+	return nil
+}
+
+// save writes the blacklist to the file, replacing it atomically. The saved
+// entries map to the unix time at which they expire, or 0 if they don't.
+func (bl *Blacklist) save() error {
+	if bl.file == "" {
+		return nil
+	}
+	bl.saveMutex.Lock()
+	defer bl.saveMutex.Unlock()
+
+	bl.mutex.RLock()
+	saved := make(map[string]int64, len(bl.blacklist.entries))
+	for key, expiresAt := range bl.blacklist.entries {
+		saved[key] = toUnix(expiresAt)
+	}
+	bl.mutex.RUnlock()
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("unable to encode blacklist: %w", err)
+	}
+
+	tmpPath := bl.file + ".tmp"
+	if err := os.WriteFile(tmpPath, b, 0600); err != nil {
+		return fmt.Errorf("unable to write blacklist to %v: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, bl.file); err != nil {
+		return fmt.Errorf("unable to save blacklist to %v: %w", bl.file, err)
+	}
+	return nil
+}
+
+// publish adds the given entries to the shared blacklist in Redis. Entries that
+// can't be added are kept locally and retried with the next sync.
+func (bl *Blacklist) publish(entries map[string]time.Time) {
+	if bl.redisClient == nil || len(entries) == 0 {
+		return
+	}
+	members := make([]*redis.Z, 0, len(entries))
+	for key, expiresAt := range entries {
+		members = append(members, &redis.Z{Score: redisScore(expiresAt), Member: key})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	err := bl.redisClient.ZAdd(ctx, redisKey, members...).Err()
+	if err != nil {
+		log.Errorf("Unable to share blacklist entries through Redis: %v", err)
+	}
+	bl.mutex.Lock()
+	for key, expiresAt := range entries {
+		if err != nil {
+			bl.unpublished[key] = expiresAt
+			delete(bl.unremoved, key)
+		} else {
+			delete(bl.unpublished, key)
+		}
+	}
+	bl.mutex.Unlock()
+}
+
+// unpublish removes the given entry from the shared blacklist in Redis. If it
+// can't be removed, that's retried with the next sync.
+func (bl *Blacklist) unpublish(key string) {
+	if bl.redisClient == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	err := bl.redisClient.ZRem(ctx, redisKey, key).Err()
+	if err != nil {
+		log.Errorf("Unable to remove %v from blacklist in Redis: %v", key, err)
+	}
+	bl.mutex.Lock()
+	if err != nil {
+		bl.unremoved[key] = true
+		delete(bl.unpublished, key)
+	} else {
+		delete(bl.unremoved, key)
+	}
+	bl.mutex.Unlock()
+}
+
+// sync replaces the blacklist with the shared one from Redis, which includes
+// the entries added by all proxies, after dropping the entries that expired.
+// Local changes that haven't made it to Redis yet, including those being made
+// while syncing, are retried first and kept if they still fail.
+func (bl *Blacklist) sync() {
+	bl.mutex.RLock()
+	retryPublish := make(map[string]time.Time, len(bl.unpublished))
+	for key, expiresAt := range bl.unpublished {
+		retryPublish[key] = expiresAt
+	}
+	retryUnpublish := make([]string, 0, len(bl.unremoved))
+	for key := range bl.unremoved {
+		retryUnpublish = append(retryUnpublish, key)
+	}
+	bl.mutex.RUnlock()
+	bl.publish(retryPublish)
+	for _, key := range retryUnpublish {
+		bl.unpublish(key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	now := time.Now()
+	if err := bl.redisClient.ZRemRangeByScore(ctx, redisKey, "-inf", fmt.Sprintf("(%d", now.Unix())).Err(); err != nil {
+		log.Errorf("Unable to remove expired blacklist entries from Redis: %v", err)
+	}
+	members, err := bl.redisClient.ZRangeWithScores(ctx, redisKey, 0, -1).Result()
+	if err != nil {
+		log.Errorf("Unable to get blacklist from Redis: %v", err)
+		return
+	}
+	shared := newList()
+	for _, member := range members {
+		entry, _ := member.Member.(string)
+		if _, err := shared.add(entry, fromRedisScore(member.Score)); err != nil {
+			log.Errorf("Ignoring blacklist entry from Redis: %v", err)
 		}
 	}
+	bl.mutex.Lock()
+	for key, expiresAt := range bl.unpublished {
+		if !expiresAt.IsZero() && !now.Before(expiresAt) {
+			delete(bl.unpublished, key)
+			continue
+		}
+		_, _ = shared.add(key, expiresAt)
+	}
+	for key := range bl.unremoved {
+		shared.remove(key)
+	}
+	shared.removeExpired(now)
+	bl.blacklist = shared
 	bl.mutex.Unlock()
+	if err := bl.save(); err != nil {
+		log.Error(err)
+	}
+}
+
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnix(ts int64) time.Time {
+	if ts <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts, 0)
+}
+
+func redisScore(expiresAt time.Time) float64 {
+	if expiresAt.IsZero() {
+		return math.Inf(1)
+	}
+	return float64(expiresAt.Unix())
+}
+
+func fromRedisScore(score float64) time.Time {
+	if math.IsInf(score, 1) {
+		return time.Time{}
+	}
+	return fromUnix(int64(score))
 }
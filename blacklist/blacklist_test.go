@@ -1,10 +1,21 @@
 package blacklist
 
 import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/internal/testutil"
 )
 
 const (
@@ -12,16 +23,17 @@ const (
 )
 
 func init() {
-	blacklistingEnabled = true
+	SetEnabled(true)
 }
 
 func TestBlacklistSucceed(t *testing.T) {
-	bl := New(Options{
+	bl, err := New(Options{
 		MaxIdleTime:        50 * time.Millisecond,
 		MaxConnectInterval: 1 * time.Millisecond,
 		AllowedFailures:    2,
 		Expiration:         5 * time.Second,
 	})
+	require.NoError(t, err)
 	for i := 0; i < 10000; i++ {
 		assert.True(t, bl.OnConnect(ip), "Should be able to continuously connect while succeeding")
 		bl.Succeed(ip)
@@ -30,12 +42,13 @@ func TestBlacklistSucceed(t *testing.T) {
 
 func TestBlacklistFail(t *testing.T) {
 	maxIdleTime := 10 * time.Millisecond
-	bl := New(Options{
+	bl, err := New(Options{
 		MaxIdleTime:        maxIdleTime,
 		MaxConnectInterval: maxIdleTime * 5,
 		AllowedFailures:    3,
 		Expiration:         maxIdleTime * 50,
 	})
+	require.NoError(t, err)
 	// Run through the same tests multiple times since this depends somewhat on timing
 	for i := 0; i < 10; i++ {
 		for j := 0; j < bl.allowedFailures; j++ {
@@ -61,3 +74,191 @@ func TestBlacklistFail(t *testing.T) {
 		bl.Succeed(ip)
 	}
 }
+
+type fakeISPLookup map[string]string
+
+func (l fakeISPLookup) ISP(ip net.IP) string { return "" }
+func (l fakeISPLookup) ASN(ip net.IP) string { return l[ip.String()] }
+
+type fakeInstrument struct {
+	instrument.NoInstrument
+	dryRuns []string
+	mx      sync.Mutex
+}
+
+func (i *fakeInstrument) BlacklistDryRun(ctx context.Context, kind string) {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	i.dryRuns = append(i.dryRuns, kind)
+}
+
+func TestBlacklistEntries(t *testing.T) {
+	ins := &fakeInstrument{}
+	bl, err := New(Options{
+		Entries:    []string{"10.0.0.0/8", "as64496", "2001:db8::1"},
+		Allowlist:  []string{"10.1.0.0/16"},
+		ISPLookup:  fakeISPLookup{"192.0.2.1": "AS64496"},
+		Instrument: ins,
+	})
+	require.NoError(t, err)
+
+	assert.False(t, bl.OnConnect("10.2.3.4"), "IP in blacklisted CIDR should be refused")
+	assert.False(t, bl.OnConnect("192.0.2.1"), "IP in blacklisted ASN should be refused")
+	assert.False(t, bl.OnConnect("2001:0db8::1"), "blacklisted IPv6 should be refused")
+	assert.True(t, bl.OnConnect("10.1.2.3"), "allowlist should win over blacklist")
+	assert.True(t, bl.OnConnect(ip))
+
+	require.NoError(t, bl.Add("8.8.4.0/24", time.Hour))
+	assert.False(t, bl.OnConnect("8.8.4.4"))
+	require.NoError(t, bl.Remove("8.8.4.0/24"))
+	assert.True(t, bl.OnConnect("8.8.4.4"))
+	assert.Error(t, bl.Add("not an entry", 0))
+
+	require.NoError(t, bl.SetAllowlist([]string{"AS64496"}))
+	assert.True(t, bl.OnConnect("192.0.2.1"), "updated allowlist should apply")
+	require.NoError(t, bl.SetEntries(nil))
+	assert.True(t, bl.OnConnect("10.2.3.4"), "updated entries should apply")
+	assert.Error(t, bl.SetEntries([]string{"10.0.0.0/33"}))
+
+	_, err = New(Options{Allowlist: []string{"bogus"}})
+	assert.Error(t, err)
+
+	SetDryRun(true)
+	defer SetDryRun(false)
+	require.NoError(t, bl.Add("192.0.2.0/24", 0))
+	assert.True(t, bl.OnConnect("192.0.2.2"), "shouldn't refuse in dry-run mode")
+	SetEnabled(false)
+	defer SetEnabled(true)
+	assert.True(t, bl.OnConnect("192.0.2.3"), "shouldn't refuse in dry-run mode without blacklisting enabled")
+	ins.mx.Lock()
+	assert.Equal(t, []string{"cidr", "cidr"}, ins.dryRuns, "dry-run mode should work without blacklisting enabled")
+	ins.mx.Unlock()
+}
+
+func TestBlacklistPersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blacklist.json")
+	bl, err := New(Options{File: file})
+	require.NoError(t, err)
+	require.NoError(t, bl.Add("192.0.2.0/24", time.Hour))
+	require.NoError(t, bl.Add("AS64496", 0))
+	require.NoError(t, bl.Add("192.0.2.10", time.Nanosecond))
+
+	bl, err = New(Options{File: file})
+	require.NoError(t, err)
+	assert.False(t, bl.OnConnect("192.0.2.1"), "blacklist should survive restarts")
+	entries := bl.Entries()
+	require.Len(t, entries, 2, "expired entry shouldn't be loaded")
+	assert.Equal(t, "192.0.2.0/24", entries[0].Entry)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), entries[0].ExpiresAt, time.Minute)
+	assert.Equal(t, "AS64496", entries[1].Entry)
+	assert.True(t, entries[1].ExpiresAt.IsZero())
+}
+
+func TestBlacklistSharedThroughRedis(t *testing.T) {
+	rc := testutil.TestRedis(t)
+	opts := Options{RedisClient: rc, SyncInterval: 50 * time.Millisecond}
+	bl1, err := New(opts)
+	require.NoError(t, err)
+	bl2, err := New(opts)
+	require.NoError(t, err)
+
+	require.NoError(t, bl1.Add("192.0.2.0/24", time.Hour))
+	assert.Eventually(t, func() bool {
+		return !bl2.OnConnect("192.0.2.1")
+	}, 5*time.Second, 50*time.Millisecond, "entry should be shared")
+
+	require.NoError(t, bl2.Remove("192.0.2.0/24"))
+	assert.Eventually(t, func() bool {
+		return bl1.OnConnect("192.0.2.1")
+	}, 5*time.Second, 50*time.Millisecond, "removal should be shared")
+}
+
+// failingZAdd makes ZADD fail while failing is set.
+type failingZAdd struct {
+	failing atomic.Bool
+}
+
+func (h *failingZAdd) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if cmd.Name() == "zadd" && h.failing.Load() {
+		return ctx, errors.New("failing")
+	}
+	return ctx, nil
+}
+
+func (h *failingZAdd) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h *failingZAdd) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *failingZAdd) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestBlacklistKeepsUnpublishedEntries(t *testing.T) {
+	rc := testutil.TestRedis(t)
+	hook := &failingZAdd{}
+	rc.AddHook(hook)
+	bl, err := New(Options{RedisClient: rc, SyncInterval: time.Hour})
+	require.NoError(t, err)
+
+	hook.failing.Store(true)
+	require.NoError(t, bl.Add("192.0.2.0/24", time.Hour))
+	bl.sync()
+	assert.False(t, bl.OnConnect("192.0.2.1"), "entry that couldn't be shared should survive syncs")
+
+	hook.failing.Store(false)
+	bl.sync()
+	members, err := rc.ZRange(context.Background(), redisKey, 0, -1).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.0/24"}, members, "entry should be shared once Redis accepts it")
+	assert.False(t, bl.OnConnect("192.0.2.1"))
+}
+
+// changeOnRead runs change right after the blacklist is read from Redis, once.
+type changeOnRead struct {
+	change atomic.Pointer[func()]
+}
+
+func (h *changeOnRead) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *changeOnRead) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if cmd.Name() == "zrange" {
+		if change := h.change.Swap(nil); change != nil {
+			(*change)()
+		}
+	}
+	return nil
+}
+
+func (h *changeOnRead) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *changeOnRead) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestBlacklistKeepsChangesWhileSyncing(t *testing.T) {
+	rc := testutil.TestRedis(t)
+	hook := &changeOnRead{}
+	rc.AddHook(hook)
+	bl, err := New(Options{RedisClient: rc, SyncInterval: time.Hour})
+	require.NoError(t, err)
+	require.NoError(t, bl.Add("192.0.2.0/24", time.Hour))
+	bl.sync()
+
+	change := func() {
+		require.NoError(t, bl.Add("198.51.100.0/24", time.Hour))
+		require.NoError(t, bl.Remove("192.0.2.0/24"))
+	}
+	hook.change.Store(&change)
+	bl.sync()
+	require.Nil(t, hook.change.Load(), "blacklist should have changed while syncing")
+	assert.False(t, bl.OnConnect("198.51.100.1"), "entry added while syncing should be kept")
+	assert.True(t, bl.OnConnect("192.0.2.1"), "entry removed while syncing should stay removed")
+}
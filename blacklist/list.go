@@ -0,0 +1,132 @@
+package blacklist
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kindIP   = "ip"
+	kindCIDR = "cidr"
+	kindASN  = "asn"
+)
+
+// list is a set of entries, each of which is an IP, a CIDR or an ASN (like
+// AS64496) along with the time at which it expires. Entries that never expire
+// have a zero expiration.
+type list struct {
+	entries map[string]time.Time
+	cidrs   map[string]*net.IPNet
+	numASNs int
+}
+
+func newList() *list {
+	return &list{
+		entries: make(map[string]time.Time),
+		cidrs:   make(map[string]*net.IPNet),
+	}
+}
+
+// newStaticList builds a list of entries that never expire.
+func newStaticList(entries []string) (*list, error) {
+	l := newList()
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		if _, err := l.add(entry, time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// parseEntry normalizes the given entry and determines its kind.
+func parseEntry(entry string) (string, string, *net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if ip := net.ParseIP(entry); ip != nil {
+		return ip.String(), kindIP, nil, nil
+	}
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid CIDR %v: %w", entry, err)
+		}
+		return ipNet.String(), kindCIDR, ipNet, nil
+	}
+	upper := strings.ToUpper(entry)
+	if strings.HasPrefix(upper, "AS") {
+		if _, err := strconv.ParseUint(upper[2:], 10, 32); err == nil {
+			return upper, kindASN, nil, nil
+		}
+	}
+	return "", "", nil, fmt.Errorf("%v is not an IP, CIDR or ASN", entry)
+}
+
+// add adds the given entry, replacing its expiration if it's already in the
+// list. It returns the normalized entry.
+func (l *list) add(entry string, expiresAt time.Time) (string, error) {
+	key, kind, ipNet, err := parseEntry(entry)
+	if err != nil {
+		return "", err
+	}
+	if _, exists := l.entries[key]; !exists && kind == kindASN {
+		l.numASNs++
+	}
+	l.entries[key] = expiresAt
+	if ipNet != nil {
+		l.cidrs[key] = ipNet
+	}
+	return key, nil
+}
+
+// remove removes the given normalized entry, returning whether it was there.
+func (l *list) remove(key string) bool {
+	if _, exists := l.entries[key]; !exists {
+		return false
+	}
+	delete(l.entries, key)
+	delete(l.cidrs, key)
+	if strings.HasPrefix(key, "AS") {
+		l.numASNs--
+	}
+	return true
+}
+
+// removeExpired removes the entries that expired by now and returns them.
+func (l *list) removeExpired(now time.Time) []string {
+	var expired []string
+	for key, expiresAt := range l.entries {
+		if !expiresAt.IsZero() && now.After(expiresAt) {
+			expired = append(expired, key)
+		}
+	}
+	for _, key := range expired {
+		l.remove(key)
+	}
+	return expired
+}
+
+// match checks whether the given IP matches any entry, returning the kind of
+// the entry it matched. asn is only called if the list contains ASNs.
+func (l *list) match(ip net.IP, asn func() string) (string, bool) {
+	if _, found := l.entries[ip.String()]; found {
+		return kindIP, true
+	}
+	for _, ipNet := range l.cidrs {
+		if ipNet.Contains(ip) {
+			return kindCIDR, true
+		}
+	}
+	if l.numASNs > 0 {
+		if a := strings.ToUpper(asn()); a != "" {
+			if _, found := l.entries[a]; found {
+				return kindASN, true
+			}
+		}
+	}
+	return "", false
+}
@@ -8,6 +8,7 @@ const (
 	LibraryVersionHeader    = "X-Lantern-Version"
 	AppVersionHeader        = "X-Lantern-App-Version"
 	DeviceIdHeader          = "X-Lantern-Device-Id"
+	DeviceSignatureHeader   = "X-Lantern-Device-Signature"
 	SupportedDataCapsHeader = "X-Lantern-Supported-Data-Caps"
 	TimeZoneHeader          = "X-Lantern-Time-Zone"
 	TokenHeader             = "X-Lantern-Auth-Token"
@@ -44,4 +45,15 @@ const (
 	ThrottleSettings  = "throttle_settings"
 	TimeZone          = "time_zone"
 	SupportedDataCaps = "supported_data_caps"
+	// AccessKeyID identifies the shadowsocks access key a client connected with
+	AccessKeyID = "access_key_id"
+	// VMessUUID identifies the VMess UUID a client connected with
+	VMessUUID = "vmess_uuid"
+	// VLESSUUID identifies the VLESS UUID a client connected with
+	VLESSUUID = "vless_uuid"
+	// TokenLabel identifies the labeled auth token a client connected with
+	TokenLabel = "token_label"
+	// ForcedThrottleSettings identifies the throttle settings forced by the
+	// credentials a client connected with, if any
+	ForcedThrottleSettings = "forced_throttle_settings"
 )
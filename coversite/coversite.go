@@ -0,0 +1,209 @@
+// Package coversite reverse-proxies requests to a real website, so that clients
+// who fail authentication see that website rather than a proxy.
+package coversite
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy-lantern/v2/mimic"
+)
+
+const (
+	dialTimeout           = 10 * time.Second
+	tlsHandshakeTimeout   = 10 * time.Second
+	responseHeaderTimeout = 30 * time.Second
+	idleConnTimeout       = 90 * time.Second
+	maxIdleConnsPerHost   = 10
+
+	// keepAliveTimeout is how long a client's connection is kept open for its
+	// next request, like nginx's default keepalive_timeout.
+	keepAliveTimeout = 75 * time.Second
+)
+
+var log = golog.LoggerFor("coversite")
+
+// hopHeaders only apply to a single connection and aren't forwarded, see
+// RFC 9110 section 7.6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Site is a cover website that requests are reverse-proxied to.
+type Site struct {
+	origin    *url.URL
+	transport *http.Transport
+}
+
+// New creates a Site for the origin at the given URL, like
+// https://www.example.com. Only its scheme and host are used.
+func New(origin string) (*Site, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cover site origin %v: %v", origin, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("cover site origin %v should look like https://host[:port]", origin)
+	}
+	return &Site{
+		origin: &url.URL{Scheme: u.Scheme, Host: u.Host},
+		transport: &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: dialTimeout}).DialContext,
+			TLSHandshakeTimeout:   tlsHandshakeTimeout,
+			ResponseHeaderTimeout: responseHeaderTimeout,
+			IdleConnTimeout:       idleConnTimeout,
+			MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+			ForceAttemptHTTP2:     true,
+			// pass compressed responses through exactly as the origin sent them
+			DisableCompression: true,
+		},
+	}, nil
+}
+
+// Origin returns the origin requests are sent to.
+func (s *Site) Origin() string {
+	return s.origin.String()
+}
+
+// CloseIdleConnections closes the connections to the origin that aren't in
+// use, once the Site is replaced for example. Requests in flight still
+// complete.
+func (s *Site) CloseIdleConnections() {
+	s.transport.CloseIdleConnections()
+}
+
+// Serve sends the request to the origin and writes its response to conn,
+// streaming both bodies, then does the same for any further requests on conn
+// until either the client closes it or it's idle for too long. Requests
+// pipelined behind the first one are lost. Lantern headers and hop-by-hop
+// headers are removed, redirects to the origin are made relative and nothing
+// reveals that the request was proxied. CONNECT requests are sent to the origin
+// like any other, so that the client gets the origin's own response. If the
+// origin can't be reached, the response is the 502 of the configured mimic
+// personality, as though it was the web server in front of the origin, and the
+// first such error is returned.
+func (s *Site) Serve(conn net.Conn, req *http.Request) error {
+	var firstErr error
+	br := bufio.NewReader(conn)
+	for {
+		keepAlive, err := s.serve(conn, req)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if !keepAlive {
+			return firstErr
+		}
+		conn.SetReadDeadline(time.Now().Add(keepAliveTimeout))
+		req, err = http.ReadRequest(br)
+		if err != nil {
+			return firstErr
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// serve serves a single request, returning whether the connection should be
+// kept open for another one.
+func (s *Site) serve(conn net.Conn, req *http.Request) (bool, error) {
+	keepAlive := !req.Close && req.ProtoAtLeast(1, 1)
+	target := *s.origin
+	target.Path = req.URL.Path
+	target.RawPath = req.URL.RawPath
+	target.RawQuery = req.URL.RawQuery
+	body := req.Body
+	if body == nil || req.ContentLength == 0 && len(req.TransferEncoding) == 0 {
+		body = http.NoBody
+	}
+	outReq, err := http.NewRequestWithContext(req.Context(), req.Method, target.String(), body)
+	if err != nil {
+		return false, fmt.Errorf("unable to build request for cover site: %v", err)
+	}
+	outReq.Header = req.Header.Clone()
+	removeHeaders(outReq.Header)
+	for key := range outReq.Header {
+		if strings.HasPrefix(key, "X-Lantern-") {
+			outReq.Header.Del(key)
+		}
+	}
+	if _, found := outReq.Header["User-Agent"]; !found {
+		// don't let net/http add its own
+		outReq.Header.Set("User-Agent", "")
+	}
+	outReq.ContentLength = req.ContentLength
+	// the Host is taken from the origin so that it serves the right site
+	outReq.Host = s.origin.Host
+
+	resp, err := s.transport.RoundTrip(outReq)
+	if err != nil {
+		mimic.BadGateway(conn, req)
+		return keepAlive, fmt.Errorf("unable to reach cover site %v: %v", s.origin, err)
+	}
+	defer resp.Body.Close()
+	removeHeaders(resp.Header)
+	for _, key := range []string{"Location", "Content-Location"} {
+		if value := resp.Header.Get(key); value != "" {
+			resp.Header.Set(key, s.relativize(value))
+		}
+	}
+	// the client speaks HTTP/1.1 to us regardless of what the origin speaks,
+	// so bodies of unknown length are chunked to keep the connection open
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && keepAlive && bodyAllowed(resp.StatusCode) {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	resp.Close = !keepAlive
+	if err := resp.Write(conn); err != nil {
+		log.Debugf("Unable to write cover site response to %v: %v", conn.RemoteAddr(), err)
+		return false, nil
+	}
+	return keepAlive, nil
+}
+
+// relativize makes location relative if it's on the origin, so that it
+// doesn't reveal the origin's host.
+func (s *Site) relativize(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" || !strings.EqualFold(u.Hostname(), s.origin.Hostname()) {
+		return location
+	}
+	rel := &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery, Fragment: u.Fragment, RawFragment: u.RawFragment}
+	if rel.Path == "" {
+		rel.Path = "/"
+	}
+	return rel.String()
+}
+
+// bodyAllowed tells whether responses with the given status can have a body,
+// see RFC 9110 section 6.4.1.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+func removeHeaders(header http.Header) {
+	// headers listed in Connection are hop-by-hop too
+	for _, value := range header.Values("Connection") {
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				header.Del(key)
+			}
+		}
+	}
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+}
@@ -0,0 +1,185 @@
+package coversite
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/mimic"
+)
+
+func TestServe(t *testing.T) {
+	closed := make(chan bool, 1)
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodConnect {
+			resp.Header().Set("X-Host", req.Host)
+			http.Error(resp, "no proxying here", http.StatusMethodNotAllowed)
+			return
+		}
+		if req.URL.Path == "/redirect" {
+			resp.Header().Set("Location", req.URL.Query().Get("to"))
+			resp.WriteHeader(http.StatusFound)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		resp.Header().Set("X-Host", req.Host)
+		resp.Header().Set("X-Lantern-Seen", req.Header.Get("X-Lantern-Auth-Token"))
+		resp.Header().Set("X-User-Agent", req.Header.Get("User-Agent"))
+		resp.Header().Set("X-Keep-Alive", req.Header.Get("Keep-Alive"))
+		resp.Write([]byte(req.Method + " " + req.URL.RequestURI() + " " + string(body)))
+	}))
+	origin.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			select {
+			case closed <- true:
+			default:
+			}
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	site, err := New(origin.URL + "/ignored")
+	require.NoError(t, err)
+	assert.Equal(t, origin.URL, site.Origin())
+
+	// dial connects to a listener that serves the connection from site. Serve's
+	// result is sent on the returned channel.
+	dial := func(t *testing.T, site *Site) (net.Conn, <-chan error) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		served := make(chan error, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				served <- err
+				return
+			}
+			defer conn.Close()
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				served <- err
+				return
+			}
+			served <- site.Serve(conn, req)
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		return conn, served
+	}
+
+	// roundTrip sends the raw request on conn and reads the response.
+	roundTrip := func(t *testing.T, conn net.Conn, br *bufio.Reader, raw string) (*http.Response, string) {
+		_, err := conn.Write([]byte(raw))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	// serve sends the raw request on a new connection served from site and
+	// returns the response.
+	serve := func(t *testing.T, site *Site, raw string) (*http.Response, string) {
+		conn, served := dial(t, site)
+		resp, body := roundTrip(t, conn, bufio.NewReader(conn), raw)
+		conn.Close()
+		require.NoError(t, <-served)
+		return resp, body
+	}
+
+	resp, body := serve(t, site, "POST /path?q=1 HTTP/1.1\r\nHost: proxy.example.com\r\nX-Lantern-Auth-Token: secret\r\nConnection: keep-alive, Keep-Alive\r\nKeep-Alive: timeout=5\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "HTTP/1.1", resp.Proto)
+	assert.False(t, resp.Close, "connection should be kept open")
+	assert.Equal(t, "POST /path?q=1 hello world", body, "body should be streamed")
+	assert.Equal(t, strings.TrimPrefix(origin.URL, "http://"), resp.Header.Get("X-Host"), "Host should be the origin's")
+	assert.Empty(t, resp.Header.Get("X-Lantern-Seen"), "Lantern headers shouldn't be forwarded")
+	assert.Empty(t, resp.Header.Get("X-Keep-Alive"), "hop-by-hop headers shouldn't be forwarded")
+	assert.Empty(t, resp.Header.Get("X-User-Agent"), "no User-Agent should be added")
+
+	resp, body = serve(t, site, "GET / HTTP/1.1\r\nHost: proxy.example.com\r\nUser-Agent: curl/8.0\r\n\r\n")
+	assert.Equal(t, "GET / ", body)
+	assert.Equal(t, "curl/8.0", resp.Header.Get("X-User-Agent"))
+
+	originHost := strings.TrimPrefix(origin.URL, "http://")
+	for to, expected := range map[string]string{
+		origin.URL + "/login?next=%2F#top":         "/login?next=%2F#top",
+		"https://" + originHost:                    "/",
+		"//" + strings.ToUpper(originHost) + "/up": "/up",
+		"/relative":                  "/relative",
+		"https://other.example.com/": "https://other.example.com/",
+	} {
+		resp, _ = serve(t, site, "GET /redirect?to="+url.QueryEscape(to)+" HTTP/1.1\r\nHost: proxy.example.com\r\n\r\n")
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.Equal(t, expected, resp.Header.Get("Location"), to)
+	}
+
+	resp, body = serve(t, site, "CONNECT www.google.com:443 HTTP/1.1\r\nHost: www.google.com:443\r\n\r\n")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode, "CONNECT should get the origin's response")
+	assert.Equal(t, originHost, resp.Header.Get("X-Host"))
+	assert.Equal(t, "no proxying here\n", body)
+
+	conn, served := dial(t, site)
+	br := bufio.NewReader(conn)
+	resp, body = roundTrip(t, conn, br, "GET /first HTTP/1.1\r\nHost: proxy.example.com\r\n\r\n")
+	assert.Equal(t, "GET /first ", body)
+	assert.False(t, resp.Close)
+	resp, body = roundTrip(t, conn, br, "POST /second HTTP/1.1\r\nHost: proxy.example.com\r\nContent-Length: 2\r\nConnection: close\r\n\r\nhi")
+	assert.Equal(t, "POST /second hi", body, "further requests on the connection should be served")
+	assert.True(t, resp.Close, "connection should be closed when the client asks to")
+	require.NoError(t, <-served)
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	conn.Close()
+
+	resp, _ = serve(t, site, "GET / HTTP/1.0\r\nHost: proxy.example.com\r\n\r\n")
+	assert.True(t, resp.Close, "HTTP/1.0 connections should be closed")
+
+	site.CloseIdleConnections()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("idle connection to origin should have been closed")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable, err := New("http://" + l.Addr().String())
+	require.NoError(t, err)
+	l.Close()
+	defer mimic.SetPersonality(mimic.CurrentPersonality())
+	nginx, err := mimic.ParsePersonality("nginx")
+	require.NoError(t, err)
+	mimic.SetPersonality(nginx)
+	conn, served = dial(t, unreachable)
+	br = bufio.NewReader(conn)
+	resp, body = roundTrip(t, conn, br, "GET / HTTP/1.1\r\nHost: proxy.example.com\r\n\r\n")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "unreachable origin should get a bad gateway")
+	assert.Equal(t, "nginx/1.24.0 (Ubuntu)", resp.Header.Get("Server"), "bad gateway should come from the mimicked web server")
+	assert.Contains(t, body, "<center><h1>502 Bad Gateway</h1></center>")
+	assert.False(t, resp.Close)
+	resp, _ = roundTrip(t, conn, br, "GET / HTTP/1.1\r\nHost: proxy.example.com\r\n\r\n")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	conn.Close()
+	assert.Error(t, <-served)
+
+	for _, origin := range []string{"", "www.example.com", "ftp://www.example.com", "https://", "https://www.example.com:port"} {
+		_, err := New(origin)
+		assert.Error(t, err, origin)
+	}
+}
@@ -1,6 +1,7 @@
 package devicefilter
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -11,16 +12,19 @@ import (
 	"github.com/dustin/go-humanize"
 
 	"github.com/getlantern/golog"
+	"github.com/getlantern/netx"
 	"github.com/getlantern/proxy/v3/filters"
 
 	"github.com/getlantern/http-proxy-lantern/v2/listeners"
 
+	"github.com/getlantern/http-proxy-lantern/v2/accesslog"
 	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
 	"github.com/getlantern/http-proxy-lantern/v2/common"
 	"github.com/getlantern/http-proxy-lantern/v2/domains"
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
-	"github.com/getlantern/http-proxy-lantern/v2/redis"
+	"github.com/getlantern/http-proxy-lantern/v2/internal/ttlcache"
 	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+	"github.com/getlantern/http-proxy-lantern/v2/tokenfilter"
 	"github.com/getlantern/http-proxy-lantern/v2/usage"
 )
 
@@ -32,15 +36,46 @@ var (
 	alwaysThrottle = listeners.NewRateLimiter(10, 10) // this is basically unusably slow, only used for malicious or really old/broken clients
 
 	defaultThrottleRate = int64(5000 * 1024 / 8) // 5 Mbps
+
+	// bounds for the rate limiters kept per device
+	maxLimiters        = 250000
+	limiterIdleTimeout = 1 * time.Hour
 )
 
+// DeviceFetcher fetches device usage into the usage package, like
+// redis.DeviceFetcher does from Redis.
+type DeviceFetcher interface {
+	// RequestNewDeviceUsage requests the usage for the given device without
+	// blocking.
+	RequestNewDeviceUsage(deviceID string)
+}
+
+// ForcedThrottleConn is implemented by connections whose credentials carry
+// their own throttle settings, like shadowsocks.AccessKeyConn.
+type ForcedThrottleConn interface {
+	ForcedThrottle() *throttle.Settings
+}
+
+// connForcedThrottle returns the throttle settings of the first
+// ForcedThrottleConn wrapped by conn that has any.
+func connForcedThrottle(conn net.Conn) (settings *throttle.Settings) {
+	netx.WalkWrapped(conn, func(conn net.Conn) bool {
+		if fc, ok := conn.(ForcedThrottleConn); ok {
+			settings = fc.ForcedThrottle()
+		}
+		return settings == nil
+	})
+	return
+}
+
 // deviceFilterPre does the device-based filtering
 type deviceFilterPre struct {
-	deviceFetcher      *redis.DeviceFetcher
+	deviceFetcher      DeviceFetcher
 	throttleConfig     throttle.Config
 	sendXBQHeader      bool
 	instrument         instrument.Instrument
-	limitersByDevice   map[string]*listeners.RateLimiter
+	verifier           *DeviceVerifier
+	limitersByDevice   *ttlcache.Cache
 	limitersByDeviceMx sync.Mutex
 }
 
@@ -50,7 +85,8 @@ type deviceFilterPost struct {
 }
 
 // NewPre creates a filter which throttling all connections from a device if its data usage threshold is reached.
-// * df is used to fetch device data usage across all proxies from a central Redis.
+// * df is used to fetch device data usage, either across all proxies from a
+// central Redis or from this proxy's local usage store.
 // * throttleConfig is to determine the threshold and throttle rate. They can
 // be fixed values or fetched from Redis periodically.
 // * If sendXBQHeader is true, it attaches a common.XBQHeader to inform the
@@ -63,17 +99,35 @@ type deviceFilterPost struct {
 // <allowed> is the string representation of a 64-bit unsigned integer
 // <asof> is the 64-bit signed integer representing seconds since a custom
 // epoch (00:00:00 01/01/2016 UTC).
-func NewPre(df *redis.DeviceFetcher, throttleConfig throttle.Config, sendXBQHeader bool, instrument instrument.Instrument) filters.Filter {
+// * If verifier is enabled, devices whose common.DeviceSignatureHeader doesn't
+// verify are always throttled.
+func NewPre(df DeviceFetcher, throttleConfig throttle.Config, sendXBQHeader bool, instrument instrument.Instrument, verifier *DeviceVerifier) filters.Filter {
 	if throttleConfig != nil {
 		log.Debug("Throttling enabled")
 	}
 
 	return &deviceFilterPre{
-		deviceFetcher:    df,
-		throttleConfig:   throttleConfig,
-		sendXBQHeader:    sendXBQHeader,
-		instrument:       instrument,
-		limitersByDevice: make(map[string]*listeners.RateLimiter, 0),
+		deviceFetcher:  df,
+		throttleConfig: throttleConfig,
+		sendXBQHeader:  sendXBQHeader,
+		instrument:     instrument,
+		verifier:       verifier,
+		limitersByDevice: ttlcache.New(ttlcache.Opts{
+			MaxSize:     maxLimiters,
+			IdleTimeout: limiterIdleTimeout,
+			OnEvict: func(reason string, count int) {
+				instrument.CacheEvictions(context.Background(), "rate_limiters", reason, count)
+			},
+			OnSweep: func(size int) {
+				instrument.CacheSize(context.Background(), "rate_limiters", size)
+			},
+			// Limiters are kept while connections use them, otherwise the device's
+			// next connection would get a new limiter and the device twice the
+			// rate.
+			InUse: func(value interface{}) bool {
+				return value.(*listeners.RateLimiter).InUse()
+			},
+		}),
 	}
 }
 
@@ -95,7 +149,7 @@ func (f *deviceFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 		if defaultThrottleRate <= 0 {
 			f.instrument.Throttle(req.Context(), false, message)
 		}
-		limiter := f.rateLimiterForDevice(lanternDeviceID, defaultThrottleRate, defaultThrottleRate)
+		limiter := f.rateLimiterForDevice(lanternDeviceID, defaultThrottleRate, defaultThrottleRate, 0)
 		if log.IsTraceEnabled() {
 			log.Tracef("Throttling connection to %v per second by default",
 				humanize.Bytes(uint64(defaultThrottleRate)))
@@ -115,6 +169,7 @@ func (f *deviceFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 		// Old lantern versions and possible cracks do not include the device
 		// ID. Just throttle them.
 		f.instrument.Throttle(req.Context(), true, "no-device-id")
+		accesslog.SetThrottle(req.Context(), "no-device-id", true)
 		wc.ControlMessage("throttle", alwaysThrottle)
 		return next(cs, req)
 	}
@@ -123,8 +178,30 @@ func (f *deviceFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 		f.instrument.Throttle(req.Context(), false, "checkfallbacks")
 		return next(cs, req)
 	}
+	if f.verifier.Enabled() {
+		if err := f.verifier.Verify(lanternDeviceID, req.Header.Get(common.DeviceSignatureHeader), time.Now()); err != nil {
+			// Without a valid signature, the device could be rotating its ID to
+			// escape the data cap. Just throttle it.
+			reason := err.Error()
+			f.instrument.Throttle(req.Context(), true, reason)
+			accesslog.SetThrottle(req.Context(), reason, true)
+			wc.ControlMessage("throttle", alwaysThrottle)
+			return next(cs, req)
+		}
+	}
 
-	if f.throttleConfig == nil {
+	// Clients using a token or an access key with its own throttle settings get
+	// those instead of the configured ones
+	forced := tokenfilter.ForcedThrottle(req.Context())
+	if forced == nil {
+		forced = connForcedThrottle(cs.Downstream())
+	}
+	if forced != nil {
+		// Usage is tracked and reset according to the forced settings, even when
+		// no throttle config applies to the device or there's no usage data yet
+		wc.ControlMessage("measured", map[string]interface{}{common.ForcedThrottleSettings: forced})
+	}
+	if f.throttleConfig == nil && forced == nil {
 		f.instrument.Throttle(req.Context(), false, "no-config")
 		return next(cs, req)
 	}
@@ -138,7 +215,10 @@ func (f *deviceFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 		return next(cs, req)
 	}
 
-	settings, capOn := f.throttleConfig.SettingsFor(lanternDeviceID, u.CountryCode, req.Header.Get(common.PlatformHeader), req.Header.Get(common.AppHeader), req.Header[common.SupportedDataCapsHeader])
+	settings, capOn := forced, true
+	if forced == nil {
+		settings, capOn = f.throttleConfig.SettingsFor(lanternDeviceID, u.CountryCode, req.Header.Get(common.PlatformHeader), req.Header.Get(common.AppHeader), req.Header[common.SupportedDataCapsHeader])
+	}
 
 	measuredCtx := map[string]interface{}{
 		"throttled": false,
@@ -153,13 +233,15 @@ func (f *deviceFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 
 		// Send throttle settings to measured as well
 		measuredCtx["throttle_settings"] = settings
+		accesslog.SetThrottle(req.Context(), settings.Label, false)
 	}
 
 	if capOn && u.Bytes > settings.Threshold {
 		// per connection limiter
 		// Note - when people hit the data cap, we only throttle writes back to the client, not reads.
 		// This way, they can continue to upload videos or other bandwidth intensive content for sharing.
-		limiter := f.rateLimiterForDevice(lanternDeviceID, defaultThrottleRate, settings.Rate)
+		// the device is no longer over the cap once its usage resets
+		limiter := f.rateLimiterForDevice(lanternDeviceID, defaultThrottleRate, settings.Rate, time.Duration(u.TTLSeconds)*time.Second)
 		if log.IsTraceEnabled() {
 			log.Tracef("Throttling connection from device %s to %v per second", lanternDeviceID,
 				humanize.Bytes(uint64(settings.Rate)))
@@ -167,6 +249,7 @@ func (f *deviceFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 		f.instrument.Throttle(req.Context(), true, "datacap")
 		wc.ControlMessage("throttle", limiter)
 		measuredCtx["throttled"] = true
+		accesslog.SetThrottle(req.Context(), settings.Label, true)
 	} else {
 		// default case is not throttling
 		throttleDefault("")
@@ -192,15 +275,22 @@ func (f *deviceFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 	return resp, nextCtx, err
 }
 
-func (f *deviceFilterPre) rateLimiterForDevice(deviceID string, rateLimitRead, rateLimitWrite int64) *listeners.RateLimiter {
+// rateLimiterForDevice returns the device's limiter with the given rates,
+// shared by all of its connections. If ttl is positive, a new limiter is made
+// once ttl has passed.
+func (f *deviceFilterPre) rateLimiterForDevice(deviceID string, rateLimitRead, rateLimitWrite int64, ttl time.Duration) *listeners.RateLimiter {
 	f.limitersByDeviceMx.Lock()
 	defer f.limitersByDeviceMx.Unlock()
 
-	limiter := f.limitersByDevice[deviceID]
-	if limiter == nil || limiter.GetRateRead() != rateLimitRead || limiter.GetRateWrite() != rateLimitWrite {
-		limiter = listeners.NewRateLimiter(rateLimitRead, rateLimitWrite)
-		f.limitersByDevice[deviceID] = limiter
+	_limiter, found := f.limitersByDevice.Get(deviceID)
+	if found {
+		limiter := _limiter.(*listeners.RateLimiter)
+		if limiter.GetRateRead() == rateLimitRead && limiter.GetRateWrite() == rateLimitWrite {
+			return limiter
+		}
 	}
+	limiter := listeners.NewRateLimiter(rateLimitRead, rateLimitWrite)
+	f.limitersByDevice.Set(deviceID, limiter, ttl)
 	return limiter
 }
 
@@ -213,6 +303,7 @@ func NewPost(bl *blacklist.Blacklist) filters.Filter {
 func (f *deviceFilterPost) Apply(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
 	// For privacy, delete the DeviceId header before passing it along
 	req.Header.Del(common.DeviceIdHeader)
+	req.Header.Del(common.DeviceSignatureHeader)
 	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
 	f.bl.Succeed(ip)
 	return next(cs, req)
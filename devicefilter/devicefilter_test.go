@@ -0,0 +1,149 @@
+package devicefilter
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/getlantern/measured"
+	"github.com/getlantern/proxy/v3/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+	"github.com/getlantern/http-proxy-lantern/v2/localusage"
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+	"github.com/getlantern/http-proxy-lantern/v2/usage"
+)
+
+type fakeLookup struct{ countryCode string }
+
+func (l *fakeLookup) CountryCode(ip net.IP) string {
+	return l.countryCode
+}
+
+// testConn records the control messages sent to it by the filter.
+type testConn struct {
+	net.Conn
+	forced   *throttle.Settings
+	limiter  *listeners.RateLimiter
+	measured map[string]interface{}
+}
+
+func (c *testConn) OnState(s http.ConnState) {}
+
+func (c *testConn) ControlMessage(msgType string, data interface{}) {
+	switch msgType {
+	case "throttle":
+		c.limiter = data.(*listeners.RateLimiter)
+	case "measured":
+		for key, value := range data.(map[string]interface{}) {
+			c.measured[key] = value
+		}
+	}
+}
+
+func (c *testConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+func (c *testConn) ForcedThrottle() *throttle.Settings {
+	return c.forced
+}
+
+// apply applies f to a request with the given headers on a new connection
+// whose credentials force the given throttle settings, if any. It returns the
+// response along with the connection.
+func apply(t *testing.T, f filters.Filter, forced *throttle.Settings, header http.Header) (*http.Response, *testConn) {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header = header
+	downstream, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go io.Copy(io.Discard, client)
+	conn := &testConn{Conn: downstream, forced: forced, measured: make(map[string]interface{})}
+
+	resp, _, err := f.Apply(filters.NewConnectionState(req, nil, conn), req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}, cs, nil
+	})
+	require.NoError(t, err)
+	return resp, conn
+}
+
+// noUsage is a DeviceFetcher that never finds any usage.
+type noUsage struct{}
+
+func (noUsage) RequestNewDeviceUsage(deviceID string) {}
+
+func TestDeviceSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	verifier, err := NewDeviceVerifier([]string{base64.StdEncoding.EncodeToString(publicKey)})
+	require.NoError(t, err)
+	f := NewPre(noUsage{}, throttle.NewForcedConfig(5000, 500, throttle.Daily), true, instrument.NoInstrument{}, verifier)
+
+	deviceID := "signed-device"
+	throttled := func(signature string) bool {
+		header := http.Header{common.DeviceIdHeader: {deviceID}}
+		if signature != "" {
+			header.Set(common.DeviceSignatureHeader, signature)
+		}
+		_, conn := apply(t, f, nil, header)
+		require.NotNil(t, conn.limiter)
+		return conn.limiter == alwaysThrottle
+	}
+
+	assert.True(t, throttled(""), "device without signature should always be throttled")
+	assert.True(t, throttled("garbage"), "device with invalid signature should always be throttled")
+	assert.True(t, throttled(SignDevice(privateKey, "other-device", time.Now().Add(time.Hour))), "device with signature for another device should always be throttled")
+	assert.True(t, throttled(SignDevice(privateKey, deviceID, time.Now().Add(-time.Hour))), "device with expired signature should always be throttled")
+	assert.False(t, throttled(SignDevice(privateKey, deviceID, time.Now().Add(time.Hour))), "device with valid signature shouldn't always be throttled")
+}
+
+func TestForcedThrottleWithoutConfig(t *testing.T) {
+	// usage is global, so use a new device every time
+	deviceID := "forced-throttle-device-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	s, err := localusage.Open(filepath.Join(t.TempDir(), "usage.json"), &fakeLookup{"IR"}, nil, instrument.NoInstrument{}, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer s.Close()
+	f := NewPre(s, nil, true, instrument.NoInstrument{}, nil)
+	forced := &throttle.Settings{Label: "forced", Threshold: 100, Rate: 10, CapResets: throttle.Daily}
+	header := http.Header{common.DeviceIdHeader: {deviceID}}
+
+	resp, conn := apply(t, f, nil, header)
+	assert.Empty(t, resp.Header.Get(common.XBQHeaderv2))
+	assert.Nil(t, conn.limiter, "device without forced settings shouldn't be throttled without a config")
+	assert.Empty(t, conn.measured)
+
+	resp, conn = apply(t, f, forced, header)
+	assert.Empty(t, resp.Header.Get(common.XBQHeaderv2), "there shouldn't be any usage data yet")
+	require.NotNil(t, conn.limiter)
+	assert.Equal(t, defaultThrottleRate, conn.limiter.GetRateWrite())
+	assert.Equal(t, forced, conn.measured[common.ForcedThrottleSettings])
+
+	ctx := map[string]interface{}{common.DeviceID: deviceID, common.ClientIP: "1.1.1.1"}
+	for key, value := range conn.measured {
+		ctx[key] = value
+	}
+	s.NewMeasuredReporter()(ctx, nil, &measured.Stats{RecvTotal: 150, SentTotal: 50}, false)
+	require.Eventually(t, func() bool {
+		u := usage.Get(deviceID)
+		return u != nil && u.Bytes == 200
+	}, time.Second, 10*time.Millisecond)
+	now := time.Now()
+	expectedTTL := throttle.ExpirationFor(now, throttle.Daily, now.Location().String()) - now.Unix()
+	assert.InDelta(t, expectedTTL, usage.Get(deviceID).TTLSeconds, 1, "usage should reset when the forced cap does")
+
+	resp, conn = apply(t, f, forced, header)
+	assert.NotEmpty(t, resp.Header.Get(common.XBQHeaderv2))
+	require.NotNil(t, conn.limiter)
+	assert.EqualValues(t, 10, conn.limiter.GetRateWrite(), "device over the forced cap should be throttled")
+	assert.Equal(t, true, conn.measured["throttled"])
+}
@@ -0,0 +1,115 @@
+package devicefilter
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons for which device signatures fail verification, as reported through
+// instrument.Throttle.
+var (
+	ErrMissingSignature = errors.New("missing-device-signature")
+	ErrInvalidSignature = errors.New("invalid-device-signature")
+	ErrExpiredSignature = errors.New("expired-device-signature")
+)
+
+// SignDevice creates the credential for common.DeviceSignatureHeader that
+// proves the device ID was issued by the holder of the private key, until
+// expiresAt.
+//
+// Credentials look like <unix expiry>.<signature>, where the signature is the
+// base64url-encoded Ed25519 signature of "<device ID>\n<unix expiry>".
+func SignDevice(privateKey ed25519.PrivateKey, deviceID string, expiresAt time.Time) string {
+	expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+	signature := ed25519.Sign(privateKey, signedMessage(deviceID, expiry))
+	return expiry + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func signedMessage(deviceID, expiry string) []byte {
+	return []byte(deviceID + "\n" + expiry)
+}
+
+// DeviceVerifier verifies the credentials created by SignDevice against a set
+// of public keys, any of which may have signed them so that keys can be
+// rotated. It's safe for concurrent use.
+type DeviceVerifier struct {
+	keys atomic.Pointer[[]ed25519.PublicKey]
+}
+
+// NewDeviceVerifier creates a DeviceVerifier for the given base64-encoded
+// Ed25519 public keys. Without any keys, all devices pass verification.
+func NewDeviceVerifier(publicKeys []string) (*DeviceVerifier, error) {
+	v := &DeviceVerifier{}
+	if err := v.SetKeys(publicKeys); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// SetKeys replaces the base64-encoded Ed25519 public keys that credentials are
+// verified against.
+func (v *DeviceVerifier) SetKeys(publicKeys []string) error {
+	keys := make([]ed25519.PublicKey, 0, len(publicKeys))
+	for _, encoded := range publicKeys {
+		encoded = strings.TrimSpace(encoded)
+		if encoded == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("unable to decode device signature key %v: %v", encoded, err)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("device signature key %v has %d bytes instead of %d", encoded, len(key), ed25519.PublicKeySize)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	v.keys.Store(&keys)
+	return nil
+}
+
+// Enabled indicates whether there are any keys to verify credentials against.
+func (v *DeviceVerifier) Enabled() bool {
+	return v != nil && len(*v.keys.Load()) > 0
+}
+
+// Verify checks that the credential was signed for the device ID by one of the
+// keys and hasn't expired by now. It returns one of ErrMissingSignature,
+// ErrInvalidSignature or ErrExpiredSignature if it wasn't.
+func (v *DeviceVerifier) Verify(deviceID, credential string, now time.Time) error {
+	if credential == "" {
+		return ErrMissingSignature
+	}
+	expiry, encoded, found := strings.Cut(credential, ".")
+	if !found {
+		return ErrInvalidSignature
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	verified := false
+	for _, key := range *v.keys.Load() {
+		if ed25519.Verify(key, signedMessage(deviceID, expiry), signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return ErrInvalidSignature
+	}
+	if !now.Before(time.Unix(unix, 0)) {
+		return ErrExpiredSignature
+	}
+	return nil
+}
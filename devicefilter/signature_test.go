@@ -0,0 +1,51 @@
+package devicefilter
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceVerifier(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	otherPublicKey, otherPrivateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	encode := base64.StdEncoding.EncodeToString
+
+	var disabled *DeviceVerifier
+	assert.False(t, disabled.Enabled())
+	v, err := NewDeviceVerifier([]string{""})
+	require.NoError(t, err)
+	assert.False(t, v.Enabled(), "verifier without keys shouldn't be enabled")
+
+	require.NoError(t, v.SetKeys([]string{encode(publicKey), encode(otherPublicKey)}))
+	assert.True(t, v.Enabled())
+
+	now := time.Now()
+	credential := SignDevice(privateKey, "device", now.Add(time.Hour))
+	assert.NoError(t, v.Verify("device", credential, now))
+	assert.NoError(t, v.Verify("device", SignDevice(otherPrivateKey, "device", now.Add(time.Hour)), now), "any key should do")
+	assert.Equal(t, ErrInvalidSignature, v.Verify("other-device", credential, now))
+	assert.Equal(t, ErrExpiredSignature, v.Verify("device", credential, now.Add(2*time.Hour)))
+	assert.Equal(t, ErrMissingSignature, v.Verify("device", "", now))
+	assert.Equal(t, ErrInvalidSignature, v.Verify("device", "garbage", now))
+	assert.Equal(t, ErrInvalidSignature, v.Verify("device", "1.!!!", now))
+
+	// extending the expiry invalidates the signature
+	expired := SignDevice(privateKey, "device", now.Add(-time.Hour))
+	_, signature, _ := strings.Cut(expired, ".")
+	assert.Equal(t, ErrInvalidSignature, v.Verify("device", strconv.FormatInt(now.Add(time.Hour).Unix(), 10)+"."+signature, now))
+
+	require.NoError(t, v.SetKeys([]string{encode(otherPublicKey)}))
+	assert.Equal(t, ErrInvalidSignature, v.Verify("device", credential, now), "rotated out key shouldn't verify")
+
+	assert.Error(t, v.SetKeys([]string{"not base64!"}))
+	assert.Error(t, v.SetKeys([]string{encode([]byte("short"))}))
+}
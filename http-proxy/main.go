@@ -14,6 +14,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -26,8 +27,11 @@ import (
 	"github.com/getlantern/memhelper"
 
 	proxy "github.com/getlantern/http-proxy-lantern/v2"
+	"github.com/getlantern/http-proxy-lantern/v2/accesslog"
 	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
 	"github.com/getlantern/http-proxy-lantern/v2/googlefilter"
+	"github.com/getlantern/http-proxy-lantern/v2/ipfilter"
+	"github.com/getlantern/http-proxy-lantern/v2/mimic"
 	"github.com/getlantern/http-proxy-lantern/v2/obfs4listener"
 	lanternredis "github.com/getlantern/http-proxy-lantern/v2/redis"
 	"github.com/getlantern/http-proxy-lantern/v2/shadowsocks"
@@ -74,6 +78,12 @@ var (
 	keyfile              = flag.String("key", "", "Private key file name")
 	certfile             = flag.String("cert", "", "Certificate file name")
 	token                = flag.String("token", "", "Lantern token")
+	tokenMode            = flag.String("token-mode", "static", "Which tokens to accept: static (only -token), hmac (only time-based HMAC tokens derived from -token-secret) or transition (both)")
+	tokenSecret          = flag.String("token-secret", "", "Shared secret for verifying time-based HMAC tokens, required by the hmac and transition token modes")
+	deviceSignatureKeys  = flag.String("device-signature-keys", "", "Comma separated list of base64 encoded Ed25519 public keys. If specified, devices have to send an X-Lantern-Device-Signature signed by one of them, or they're always throttled")
+	mimicPersonality     = flag.String("mimic", mimic.DefaultPersonality, "Web server to mimic to clients that fail authentication: apache-2.4.7, apache, nginx, caddy or dir:<path> to serve a custom site")
+	coverSite            = flag.String("cover-site", "", "Origin like https://www.example.com to which requests that fail authentication are reverse-proxied instead of mimicking a web server")
+	tokensFile           = flag.String("tokens-file", "", "JSON file with additional labeled tokens, each with an optional expiry and forced throttle settings. Checked for changes periodically")
 	sessionTicketKeyFile = flag.String("sessionticketkey", "", "File name for storing rotating session ticket keys (deprecated, use -sessionticketkeys instead)")
 	sessionTicketKeys    = flag.String("sessionticketkeys", "", "One or more 32 byte session ticket keys, base64 encoded. We will rotate through these every 24 hours. Replaces -sessionticketkey")
 
@@ -90,15 +100,21 @@ var (
 	connectOKWaitsForUpstream = flag.Bool("connect-ok-waits-for-upstream", false, "Set to true to wait for upstream connection before responding OK to CONNECT requests")
 
 	throttleRefreshInterval = flag.Duration("throttlerefresh", throttle.DefaultRefreshInterval, "Specifies how frequently to refresh throttling configuration from redis. Defaults to 5 minutes.")
+	throttleConfigFile      = flag.String("throttleconfig", "", "Path to a JSON file with throttling configuration, checked for changes as often as -throttlerefresh. Used as a fallback while redis is unreachable if redis is also configured.")
+	usageFile               = flag.String("usagefile", "", "Path to a file in which to keep device usage when there's no reporting redis, allowing this proxy to enforce data caps on its own. Without -throttleconfig, only the caps forced by labeled tokens and access keys are enforced.")
 
 	enableMultipath = flag.Bool("enablemultipath", false, "Enable multipath. Only clients support multipath can communicate with it.")
 
+	drainTimeout = flag.Duration("draintimeout", 30*time.Second, "How long to wait for open connections to finish when shutting down before forcibly closing them")
+
 	externalIP = flag.String("externalip", "", "The external IP of this proxy, used for reporting")
 	https      = flag.Bool("https", false, "Use TLS for client to proxy communication")
 	idleClose  = flag.Uint64("idleclose", 70, "Time in seconds that an idle connection will be allowed before closing it")
 	_          = flag.Uint64("maxconns", 0, "Max number of simultaneous allowed connections, unused")
 
 	pprofAddr         = flag.String("pprofaddr", "", "pprof address to listen on, not activate pprof if empty")
+	adminAddr         = flag.String("adminaddr", "", "Address at which to serve the admin API, not serving it if empty. Only listen on localhost or private addresses.")
+	adminToken        = flag.String("admintoken", "", "Bearer token required by the admin API")
 	maxmindLicenseKey = flag.String("maxmindlicensekey", "", "MaxMind license key to load the GeoLite2 City database")
 	geoip2ISPDBFile   = flag.String("geoip2ispdbfile", "", "The local copy of the GeoIP2 ISP database")
 
@@ -107,7 +123,16 @@ var (
 	proxiedSitesSamplePercentage = flag.Float64("proxied-sites-sample-percentage", 0, "The percentage of requests to sample (0.01 = 1%)")
 	proxiedSitesTrackingId       = flag.String("proxied-sites-tracking-id", "UA-21815217-16", "The Google Analytics property id for tracking proxied sites")
 
-	reportingRedisAddr = flag.String("reportingredis", "", "The address of the reporting Redis instance in \"redis[s]://host:port\" format")
+	reportingRedisAddr       = flag.String("reportingredis", "", "The address of the reporting Redis instance in \"redis[s]://host:port\" format, \"redis[s]-sentinel://sentinel1:port,sentinel2:port/master\" format for Sentinel or \"redis[s]-cluster://node1:port,node2:port\" format for Cluster")
+	reportingRedisPoolSize   = flag.Int("reportingredis-poolsize", lanternredis.DefaultPoolSize, "The number of connections to each reporting Redis node")
+	reportingRedisTLS        = flag.String("reportingredis-tls", lanternredis.TLSAlways, "When to use TLS to connect to the reporting Redis, one of always, never or scheme (only for rediss URLs)")
+	reportingRedisSpool      = flag.String("reportingredis-spool", "", "Path to a file in which to keep device usage that couldn't be reported to the reporting Redis once there's too much of it to keep in memory")
+	reportingRedisMaxPending = flag.Int("reportingredis-max-pending", lanternredis.DefaultMaxPendingDevices, "The maximum number of devices whose unreported usage is kept in memory while the reporting Redis is unavailable")
+
+	proxyProtocolTrusted = flag.String("proxy-protocol-trusted-sources", "", "Semicolon separated list of listener addresses with the comma separated IPs or CIDRs of the load balancers whose PROXY protocol headers are trusted at that address, like ':443=10.0.0.0/8,192.0.2.1;:8443=10.0.0.0/8'. Connections from those sources must send a PROXY protocol header, connections from anywhere else are accepted as is.")
+
+	ipFilterFile      = flag.String("ipfilter-file", "", "JSON file with the IPs, CIDRs, countries (country:<code>) and ISPs (isp:<name>) to allow and deny connections from, like {\"allow\": [...], \"deny\": [...]}. It's reloaded whenever it changes. If it's removed, the last rules loaded from it stay in effect.")
+	ipFilterReactions = flag.String("ipfilter-reactions", "", "Semicolon separated list of listener addresses with what to do with connections rejected by the IP filter there, one of close (the default), mimic or reflect:<host:port>, like ':443=reflect:example.com:443;:80=mimic'.")
 
 	// default value of tunnelPorts matches ports in flashlight/client/client.go
 	tunnelPorts         = flag.String("tunnelports", "80,443,22,110,995,143,993,8080,8443,5222,5223,5224,5228,5229,7300,19302,19303,19304,19305,19306,19307,19308,19309", "Comma seperated list of ports allowed for HTTP CONNECT tunnel. Allow all ports if empty.")
@@ -134,6 +159,12 @@ var (
 	blacklistMaxConnectInterval = flag.Duration("blacklist-max-connect-interval", blacklist.DefaultMaxConnectInterval, "Successive connection attempts within this interval will be treated as a single attempt for blacklisting")
 	blacklistAllowedFailures    = flag.Int("blacklist-allowed-failures", blacklist.DefaultAllowedFailures, "The number of failed connection attempts we tolerate before blacklisting an IP address")
 	blacklistExpiration         = flag.Duration("blacklist-expiration", blacklist.DefaultExpiration, "How long to wait before removing an ip from the blacklist")
+	blacklistEnabled            = flag.Bool("blacklist-enabled", false, "Whether to refuse connections from blacklisted IPs")
+	blacklistDryRun             = flag.Bool("blacklist-dry-run", false, "Track and blacklist IPs, even without -blacklist-enabled, but only record connections that would have been refused as metrics instead of refusing them")
+	blacklistEntries            = flag.String("blacklist-entries", "", "Comma separated list of IPs, CIDRs and ASNs (like AS64496) that are always blacklisted")
+	blacklistAllowlist          = flag.String("blacklist-allowlist", "", "Comma separated list of IPs, CIDRs and ASNs that are never blacklisted")
+	blacklistFile               = flag.String("blacklist-file", "", "File in which to save the blacklist so that it survives restarts")
+	blacklistShared             = flag.Bool("blacklist-shared", false, "Share the blacklist with other proxies through the reporting Redis")
 
 	stackdriverProjectID        = flag.String("stackdriver-project-id", "lantern-http-proxy", "Optional project ID for stackdriver error reporting as in http-proxy-lantern")
 	stackdriverCreds            = flag.String("stackdriver-creds", "/home/lantern/lantern-stackdriver.json", "Optional full json file path containing stackdriver credentials")
@@ -178,6 +209,10 @@ var (
 	shadowsocksSecret        = flag.String("shadowsocks-secret", "", "shadowsocks secret")
 	shadowsocksCipher        = flag.String("shadowsocks-cipher", shadowsocks.DefaultCipher, "shadowsocks cipher")
 	shadowsocksWithTLS       = flag.Bool("shadowsocks-with-tls", false, "shadowsocks with tls option")
+	shadowsocksKeysFile      = flag.String("shadowsocks-keys-file", "", "Path to a JSON file with a list of additional shadowsocks access keys, each with an id, secret, optional cipher and optional throttle settings. The file is checked for changes periodically and updated by the admin API.")
+	shadowsocksUDP           = flag.Bool("shadowsocks-udp", false, "Also relay shadowsocks UDP packets at the shadowsocks address. UDP traffic is checked against the IP filter and the blacklist but isn't measured or throttled, and PROXY protocol headers aren't supported")
+	shadowsocksUDPIdle       = flag.Duration("shadowsocks-udp-idle-timeout", shadowsocks.DefaultUDPIdleTimeout, "How long to keep a shadowsocks UDP association without any traffic")
+	shadowsocksUDPPerClient  = flag.Int("shadowsocks-udp-max-per-client", shadowsocks.DefaultMaxUDPAssociationsPerClient, "Maximum number of shadowsocks UDP associations per client IP")
 
 	tracesSampleRate   = flag.Int("traces-sample-rate", 1000, "rate at which to sample trace data")
 	teleportSampleRate = flag.Int("teleport-sample-rate", 1, "rate at which to sample data for Teleport")
@@ -195,9 +230,29 @@ var (
 	vmessAddr  = flag.String("vmess-addr", "", "Address at which to listen for vmess connections.")
 	vmessUUIDs = flag.String("vmess-uuids", "", "Comma separated list of UUIDs for vmess connections.")
 
+	vlessAddr          = flag.String("vless-addr", "", "Address at which to listen for vless connections, which use TLS with the configured cert.")
+	vlessUUIDs         = flag.String("vless-uuids", "", "Comma separated list of UUIDs for vless connections.")
+	vlessFallbackAddr  = flag.String("vless-fallback-addr", "", "Address of a server to which to hand off connections that fail to authenticate with vless. They're closed if unspecified.")
+	trojanAddr         = flag.String("trojan-addr", "", "Address at which to listen for trojan connections, which use TLS with the configured cert.")
+	trojanPasswords    = flag.String("trojan-passwords", "", "Comma separated list of passwords for trojan connections.")
+	trojanFallbackAddr = flag.String("trojan-fallback-addr", "", "Address of a plain HTTP cover site to which to hand off connections that fail to authenticate with trojan. They're closed if unspecified.")
+
+	socks5Addr          = flag.String("socks5-addr", "", "Address at which to listen for SOCKS5 connections. Clients pass their device ID and token as the username and password.")
+	socks5MultiplexAddr = flag.String("socks5-multiplexaddr", "", "Address at which to listen for multiplexed SOCKS5 connections.")
+	socks5WithTLS       = flag.Bool("socks5-tls", false, "Whether or not to use TLS with the configured cert for SOCKS5 connections.")
+
 	disablePanicWrap = flag.Bool("disable-panicwrap", false, "Disable panicwrap (for debugging)")
 
 	track = flag.String("track", "", "The track this proxy is running on")
+
+	accessLogPath       = flag.String("accesslog", "", "File to which to write a JSON access log line per request or tunnel, \"-\" for stdout. Not writing an access log if empty")
+	accessLogPrivacy    = flag.String("accesslog-privacy", accesslog.PrivacyHash, "How to log device IDs and client IPs in the access log, one of hash, drop or none")
+	accessLogHashKey    = flag.String("accesslog-hash-key", "", "Key used to hash device IDs and client IPs in the access log. A random key is used if empty, so hashes only match until restart")
+	accessLogMaxSize    = flag.Int64("accesslog-max-size", accesslog.DefaultMaxSize/(1024*1024), "Size in MB at which the access log file is rotated")
+	accessLogMaxBackups = flag.Int("accesslog-max-backups", accesslog.DefaultMaxBackups, "Number of rotated access log files to keep")
+
+	otlpEndpoint   = flag.String("otlp-endpoint", "telemetry.iantem.io:443", "OTLP/HTTP endpoint to which to push metrics and traces, not pushing them if empty")
+	prometheusAddr = flag.String("prometheus-addr", "", "Address at which to expose metrics for Prometheus at /metrics, not exposing them if empty")
 )
 
 const (
@@ -206,6 +261,9 @@ const (
 
 func main() {
 	iniflags.SetAllowUnknownFlags(true)
+	// callbacks have to be registered before iniflags starts re-reading the
+	// config file in the background
+	updates := onConfigChange()
 	iniflags.Parse()
 	if *version {
 		fmt.Fprintf(os.Stderr, "%s: commit %s built with %s (%s)\n", os.Args[0], revision, runtime.Version(), build_type)
@@ -275,11 +333,11 @@ func main() {
 
 	// Capture signals and exit normally because when relying on the default
 	// behavior, exit status -1 would confuse the parent process into thinking
-	// it's the child process and keeps running.
+	// it's the child process and keeps running. SIGHUP is handled by iniflags,
+	// which re-reads the config file, see reloadOnConfigChange.
 	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan os.Signal, 1)
 	signal.Notify(c,
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
@@ -307,51 +365,86 @@ func main() {
 		}()
 	}
 
-	var reaction tlslistener.HandshakeReaction
-	switch *missingTicketReaction {
-	case "AlertHandshakeFailure":
-		reaction = tlslistener.AlertHandshakeFailure
-	case "AlertProtocolVersion":
-		reaction = tlslistener.AlertProtocolVersion
-	case "AlertInternalError":
-		reaction = tlslistener.AlertInternalError
-	case "CloseConnection":
-		reaction = tlslistener.CloseConnection
-	case "ReflectToSite":
-		if *missingTicketReflectSite == "" {
-			log.Fatal("missing-session-ticket-reflect-site should not be empty")
-		}
-		reaction = tlslistener.ReflectToSite(*missingTicketReflectSite)
-		log.Debugf("Reflecting missing session tickets to site %v", *missingTicketReflectSite)
-	case "None":
-		log.Debug("Not reacting to missing session tickets")
-		reaction = tlslistener.None
-	default:
-		log.Errorf("bad missing-session-ticket-reaction for '%s': '%s', fallback to %s", *proxyProtocol, *missingTicketReaction, reaction.Action())
-		reaction = tlslistener.AlertInternalError
+	if *tlsmasqAddr != "" && (*tlsmasqSecret == "" || *tlsmasqOriginAddr == "") {
+		log.Fatalf("tlsmasq requires tlsmasq-secret and tlsmasq-origin-addr")
 	}
-	if *missingTicketReactionDelay != 0 {
-		reaction = tlslistener.Delayed(*missingTicketReactionDelay, reaction)
+
+	if *packetForwardIntf != "" {
+		*externalIntf = *packetForwardIntf
+	}
+	mux := *multiplexProtocol
+	if mux != "smux" && mux != "psmux" {
+		log.Fatalf("unsupported multiplex protocol %v", mux)
 	}
 
-	if reaction.Action() == "" {
-		log.Debug("Not using missing-session-ticket-reaction")
+	memhelper.Track(15*time.Second, 15*time.Second, func(err error) {
+		log.Errorf("error logging memory usage: %v", err)
+	})
+	go periodicallyForceGC()
+
+	var reportingRedisClient redis.UniversalClient
+	if *reportingRedisAddr != "" {
+		var err error
+		reportingRedisClient, err = lanternredis.NewClient(*reportingRedisAddr, &lanternredis.ClientOpts{
+			PoolSize: *reportingRedisPoolSize,
+			TLSMode:  *reportingRedisTLS,
+		})
+		if err != nil {
+			log.Errorf("failed to initialize redis client, will not be able to perform bandwidth limiting: %v", err)
+		}
 	} else {
-		log.Debugf("Using missing-session-ticket-reaction %v", reaction.Action())
+		log.Debug("no redis address configured for bandwidth reporting")
+	}
+
+	// changes from now on are picked up by reloadOnConfigChange
+	updates.start(reportingRedisClient)
+	p, err := proxyFromFlags(reportingRedisClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *maxmindLicenseKey != "" {
+		log.Debug("Will use Maxmind for geolocating clients")
+		if err := deleteStaleISPDB(); err != nil {
+			log.Errorf("Error deleting stale ISP DB, ignore: %v", err)
+		}
+		p.CountryLookup = geo.FromWeb(geolite2CityURL, "GeoLite2-City.mmdb", 24*time.Hour, cityDBFile, geo.CountryCode)
+		p.ISPLookup = geo.FromWeb(geoip2ISPURL, "GeoIP2-ISP.mmdb", 24*time.Hour, *geoip2ISPDBFile, geo.ISP)
+	}
+
+	go reloadOnConfigChange(p, updates)
+
+	err = p.ListenAndServe(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// proxyFromFlags builds a proxy.Proxy from the current flag values. It's used
+// both on startup and whenever the config file is re-read.
+func proxyFromFlags(reportingRedisClient redis.UniversalClient) (*proxy.Proxy, error) {
+	reaction, err := missingTicketReactionFromFlags()
+	if err != nil {
+		return nil, err
 	}
 
 	var (
 		tlsmasqTLSMinVersion uint16
 		tlsmasqTLSSuites     []uint16
-		err                  error
 	)
-	if *tlsmasqAddr != "" && (*tlsmasqSecret == "" || *tlsmasqOriginAddr == "") {
-		log.Fatalf("tlsmasq requires tlsmasq-secret and tlsmasq-origin-addr")
+	proxyProtocolTrustedSources, err := parseProxyProtocolTrustedSources(*proxyProtocolTrusted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse proxy-protocol-trusted-sources: %v", err)
 	}
+
+	ipFilterReactionsByAddr, err := parseIPFilterReactions(*ipFilterReactions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ipfilter-reactions: %v", err)
+	}
+
 	if *tlsmasqMinVersionStr != "" {
 		tlsmasqTLSMinVersion, err = decodeUint16(*tlsmasqMinVersionStr)
 		if err != nil {
-			log.Fatal(fmt.Sprintln("failed to decode tlsmasq-tls-min-version:", err))
+			return nil, fmt.Errorf("failed to decode tlsmasq-tls-min-version: %v", err)
 		}
 	}
 	if *tlsmasqSuitesStr != "" {
@@ -359,36 +452,13 @@ func main() {
 		for _, s := range strings.Split(*tlsmasqSuitesStr, ",") {
 			suite, err := decodeUint16(s)
 			if err != nil {
-				log.Fatal(fmt.Sprintln("failed to decode tlsmasq-tls-cipher-suites:", err))
+				return nil, fmt.Errorf("failed to decode tlsmasq-tls-cipher-suites: %v", err)
 			}
 			tlsmasqTLSSuites = append(tlsmasqTLSSuites, suite)
 		}
 	}
 
-	if *packetForwardIntf != "" {
-		*externalIntf = *packetForwardIntf
-	}
-	mux := *multiplexProtocol
-	if mux != "smux" && mux != "psmux" {
-		log.Fatalf("unsupported multiplex protocol %v", mux)
-	}
-
-	memhelper.Track(15*time.Second, 15*time.Second, func(err error) {
-		log.Errorf("error logging memory usage: %v", err)
-	})
-	go periodicallyForceGC()
-
-	var reportingRedisClient *redis.Client
-	if *reportingRedisAddr != "" {
-		reportingRedisClient, err = lanternredis.NewClient(*reportingRedisAddr)
-		if err != nil {
-			log.Errorf("failed to initialize redis client, will not be able to perform bandwidth limiting: %v", err)
-		}
-	} else {
-		log.Debug("no redis address configured for bandwidth reporting")
-	}
-
-	p := &proxy.Proxy{
+	return &proxy.Proxy{
 		HTTPAddr:                           *addr,
 		HTTPMultiplexAddr:                  *multiplexAddr,
 		CertFile:                           *certfile,
@@ -396,7 +466,12 @@ func main() {
 		CfgSvrAuthToken:                    *cfgSvrAuthToken,
 		ConnectOKWaitsForUpstream:          *connectOKWaitsForUpstream,
 		EnableMultipath:                    *enableMultipath,
+		DrainTimeout:                       *drainTimeout,
+		AdminAddr:                          *adminAddr,
+		AdminToken:                         *adminToken,
 		ThrottleRefreshInterval:            *throttleRefreshInterval,
+		ThrottleConfigFile:                 *throttleConfigFile,
+		UsageFile:                          *usageFile,
 		TracesSampleRate:                   *tracesSampleRate,
 		TeleportSampleRate:                 *teleportSampleRate,
 		ExternalIP:                         *externalIP,
@@ -410,7 +485,15 @@ func main() {
 		ProxiedSitesSamplePercentage:       *proxiedSitesSamplePercentage,
 		ProxiedSitesTrackingID:             *proxiedSitesTrackingId,
 		ReportingRedisClient:               reportingRedisClient,
+		ReportingSpoolFile:                 *reportingRedisSpool,
+		ReportingMaxPendingDevices:         *reportingRedisMaxPending,
 		Token:                              *token,
+		TokenMode:                          *tokenMode,
+		TokenSecret:                        *tokenSecret,
+		TokensFile:                         *tokensFile,
+		DeviceSignatureKeys:                strings.Split(*deviceSignatureKeys, ","),
+		MimicPersonality:                   *mimicPersonality,
+		CoverSiteOrigin:                    *coverSite,
 		TunnelPorts:                        *tunnelPorts,
 		Obfs4Addr:                          *obfs4Addr,
 		Obfs4MultiplexAddr:                 *obfs4MultiplexAddr,
@@ -424,6 +507,9 @@ func main() {
 		ENHTTPReapIdleTime:                 *enhttpReapIdleTime,
 		Benchmark:                          *bench,
 		DiffServTOS:                        *tos,
+		ProxyProtocolTrustedSources:        proxyProtocolTrustedSources,
+		IPFilterFile:                       *ipFilterFile,
+		IPFilterReactions:                  ipFilterReactionsByAddr,
 		LampshadeAddr:                      *lampshadeAddr,
 		LampshadeKeyCacheSize:              *lampshadeKeyCacheSize,
 		LampshadeMaxClientInitAge:          *lampshadeMaxClientInitAge,
@@ -433,7 +519,20 @@ func main() {
 		BlacklistMaxConnectInterval:        *blacklistMaxConnectInterval,
 		BlacklistAllowedFailures:           *blacklistAllowedFailures,
 		BlacklistExpiration:                *blacklistExpiration,
+		BlacklistEnabled:                   *blacklistEnabled,
+		BlacklistDryRun:                    *blacklistDryRun,
+		BlacklistEntries:                   strings.Split(*blacklistEntries, ","),
+		BlacklistAllowlist:                 strings.Split(*blacklistAllowlist, ","),
+		BlacklistFile:                      *blacklistFile,
+		BlacklistShared:                    *blacklistShared,
 		ProxyName:                          *proxyName,
+		OTLPEndpoint:                       *otlpEndpoint,
+		AccessLogPath:                      *accessLogPath,
+		AccessLogPrivacy:                   *accessLogPrivacy,
+		AccessLogHashKey:                   *accessLogHashKey,
+		AccessLogMaxSize:                   *accessLogMaxSize * 1024 * 1024,
+		AccessLogMaxBackups:                *accessLogMaxBackups,
+		PrometheusAddr:                     *prometheusAddr,
 		ProxyProtocol:                      *proxyProtocol,
 		Provider:                           *provider,
 		DC:                                 *dc,
@@ -460,6 +559,10 @@ func main() {
 		ShadowsocksCipher:                  *shadowsocksCipher,
 		ShadowsocksReplayHistory:           *shadowsocksReplayHistory,
 		ShadowsocksWithTLS:                 *shadowsocksWithTLS,
+		ShadowsocksKeysFile:                *shadowsocksKeysFile,
+		ShadowsocksUDP:                     *shadowsocksUDP,
+		ShadowsocksUDPIdleTimeout:          *shadowsocksUDPIdle,
+		ShadowsocksUDPMaxPerClient:         *shadowsocksUDPPerClient,
 		StarbridgeAddr:                     *starbridgeAddr,
 		StarbridgePrivateKey:               *starbridgePrivateKey,
 		MultiplexProtocol:                  *multiplexProtocol,
@@ -486,19 +589,171 @@ func main() {
 		WaterMismatchProtocol:              *waterMismatchProtocol,
 		VMessAddr:                          *vmessAddr,
 		VMessUUIDs:                         strings.Split(*vmessUUIDs, ","),
+		VLESSAddr:                          *vlessAddr,
+		VLESSUUIDs:                         strings.Split(*vlessUUIDs, ","),
+		VLESSFallbackAddr:                  *vlessFallbackAddr,
+		TrojanAddr:                         *trojanAddr,
+		TrojanPasswords:                    strings.Split(*trojanPasswords, ","),
+		TrojanFallbackAddr:                 *trojanFallbackAddr,
+		SOCKS5Addr:                         *socks5Addr,
+		SOCKS5MultiplexAddr:                *socks5MultiplexAddr,
+		SOCKS5WithTLS:                      *socks5WithTLS,
+	}, nil
+}
+
+// missingTicketReactionFromFlags builds the HandshakeReaction configured by the
+// missing-session-ticket-* flags.
+func missingTicketReactionFromFlags() (tlslistener.HandshakeReaction, error) {
+	var reaction tlslistener.HandshakeReaction
+	switch *missingTicketReaction {
+	case "AlertHandshakeFailure":
+		reaction = tlslistener.AlertHandshakeFailure
+	case "AlertProtocolVersion":
+		reaction = tlslistener.AlertProtocolVersion
+	case "AlertInternalError":
+		reaction = tlslistener.AlertInternalError
+	case "CloseConnection":
+		reaction = tlslistener.CloseConnection
+	case "ReflectToSite":
+		if *missingTicketReflectSite == "" {
+			return reaction, errors.New("missing-session-ticket-reflect-site should not be empty")
+		}
+		reaction = tlslistener.ReflectToSite(*missingTicketReflectSite)
+		log.Debugf("Reflecting missing session tickets to site %v", *missingTicketReflectSite)
+	case "None":
+		log.Debug("Not reacting to missing session tickets")
+		reaction = tlslistener.None
+	default:
+		log.Errorf("bad missing-session-ticket-reaction for '%s': '%s', fallback to %s", *proxyProtocol, *missingTicketReaction, reaction.Action())
+		reaction = tlslistener.AlertInternalError
 	}
-	if *maxmindLicenseKey != "" {
-		log.Debug("Will use Maxmind for geolocating clients")
-		if err := deleteStaleISPDB(); err != nil {
-			log.Errorf("Error deleting stale ISP DB, ignore: %v", err)
+	if *missingTicketReactionDelay != 0 {
+		reaction = tlslistener.Delayed(*missingTicketReactionDelay, reaction)
+	}
+
+	if reaction.Action() == "" {
+		log.Debug("Not using missing-session-ticket-reaction")
+	} else {
+		log.Debugf("Using missing-session-ticket-reaction %v", reaction.Action())
+	}
+	return reaction, nil
+}
+
+// parseProxyProtocolTrustedSources parses the value of the
+// proxy-protocol-trusted-sources flag into a map from listener address to the
+// trusted sources at that address.
+func parseProxyProtocolTrustedSources(s string) (map[string][]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	result := make(map[string][]string)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
 		}
-		p.CountryLookup = geo.FromWeb(geolite2CityURL, "GeoLite2-City.mmdb", 24*time.Hour, cityDBFile, geo.CountryCode)
-		p.ISPLookup = geo.FromWeb(geoip2ISPURL, "GeoIP2-ISP.mmdb", 24*time.Hour, *geoip2ISPDBFile, geo.ISP)
+		addr, sources, ok := strings.Cut(entry, "=")
+		if !ok || addr == "" || sources == "" {
+			return nil, fmt.Errorf("expected <addr>=<sources> but got %q", entry)
+		}
+		result[addr] = append(result[addr], strings.Split(sources, ",")...)
 	}
+	return result, nil
+}
 
-	err = p.ListenAndServe(ctx)
-	if err != nil {
-		log.Fatal(err)
+// parseIPFilterReactions parses the value of the ipfilter-reactions flag into a
+// map from listener address to reaction.
+func parseIPFilterReactions(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	result := make(map[string]string)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		addr, action, ok := strings.Cut(entry, "=")
+		if !ok || addr == "" || action == "" {
+			return nil, fmt.Errorf("expected <addr>=<reaction> but got %q", entry)
+		}
+		if _, err := ipfilter.ParseReaction(action); err != nil {
+			return nil, err
+		}
+		result[addr] = action
+	}
+	return result, nil
+}
+
+// configUpdate is the configuration built from the flags after the config
+// file changed.
+type configUpdate struct {
+	cfg *proxy.Proxy
+	err error
+}
+
+// configUpdates builds the configuration whenever iniflags re-reads the config
+// file and any flag changed, which happens on SIGHUP and, if
+// -configUpdateInterval is set, every time that interval elapses. The file
+// isn't watched otherwise.
+type configUpdates struct {
+	reportingRedisClient redis.UniversalClient
+	started              bool
+	generation           int
+	updates              chan *configUpdate
+	mx                   sync.Mutex
+}
+
+// onConfigChange registers the callbacks for configUpdates with iniflags. It
+// must be called before iniflags.Parse.
+func onConfigChange() *configUpdates {
+	u := &configUpdates{updates: make(chan *configUpdate, 1)}
+	flag.VisitAll(func(f *flag.Flag) {
+		iniflags.OnFlagChange(f.Name, u.flagChanged)
+	})
+	return u
+}
+
+// start starts building configurations for changes from now on.
+func (u *configUpdates) start(reportingRedisClient redis.UniversalClient) {
+	u.mx.Lock()
+	u.reportingRedisClient = reportingRedisClient
+	u.started = true
+	u.mx.Unlock()
+}
+
+// flagChanged is called by iniflags in the goroutine that sets the flags, after
+// setting them, so the flags are read here rather than while iniflags might
+// be setting them again.
+func (u *configUpdates) flagChanged() {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	if !u.started || iniflags.Generation == u.generation {
+		// iniflags calls this once per changed flag, one update covers them all
+		return
+	}
+	u.generation = iniflags.Generation
+	cfg, err := proxyFromFlags(u.reportingRedisClient)
+	// a pending update is superseded by this one
+	select {
+	case <-u.updates:
+	default:
+	}
+	u.updates <- &configUpdate{cfg, err}
+}
+
+// reloadOnConfigChange applies the configurations built by updates to the
+// running proxy.
+func reloadOnConfigChange(p *proxy.Proxy, updates *configUpdates) {
+	for update := range updates.updates {
+		log.Debug("Config file changed, reloading")
+		if update.err != nil {
+			log.Errorf("Invalid configuration, not reloading: %v", update.err)
+			continue
+		}
+		if err := p.Reload(update.cfg); err != nil {
+			log.Errorf("Unable to fully reload configuration: %v", err)
+		}
 	}
 }
 
@@ -17,7 +17,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Jigsaw-Code/outline-ss-server/service"
 	rclient "github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/getlantern/cmux/v2"
 	"github.com/getlantern/cmuxprivate"
@@ -32,7 +35,10 @@ import (
 	"github.com/getlantern/http-proxy-lantern/v2/opsfilter"
 	"github.com/getlantern/http-proxy-lantern/v2/otel"
 	"github.com/getlantern/http-proxy-lantern/v2/shadowsocks"
+	"github.com/getlantern/http-proxy-lantern/v2/socks5"
 	"github.com/getlantern/http-proxy-lantern/v2/starbridge"
+	"github.com/getlantern/http-proxy-lantern/v2/v2ray/trojan"
+	"github.com/getlantern/http-proxy-lantern/v2/v2ray/vless"
 	"github.com/getlantern/http-proxy-lantern/v2/v2ray/vmess"
 
 	"github.com/xtaci/smux"
@@ -47,18 +53,23 @@ import (
 	"github.com/getlantern/tlsdefaults"
 
 	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+	"github.com/getlantern/http-proxy-lantern/v2/localusage"
 	"github.com/getlantern/http-proxy-lantern/v2/proxyfilters"
 	"github.com/getlantern/http-proxy-lantern/v2/server"
 
+	"github.com/getlantern/http-proxy-lantern/v2/accesslog"
+	"github.com/getlantern/http-proxy-lantern/v2/admin"
 	"github.com/getlantern/http-proxy-lantern/v2/analytics"
 	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
 	"github.com/getlantern/http-proxy-lantern/v2/cleanheadersfilter"
+	"github.com/getlantern/http-proxy-lantern/v2/coversite"
 	"github.com/getlantern/http-proxy-lantern/v2/devicefilter"
 	"github.com/getlantern/http-proxy-lantern/v2/diffserv"
 	"github.com/getlantern/http-proxy-lantern/v2/domains"
 	"github.com/getlantern/http-proxy-lantern/v2/googlefilter"
 	"github.com/getlantern/http-proxy-lantern/v2/httpsupgrade"
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/ipfilter"
 	"github.com/getlantern/http-proxy-lantern/v2/lampshade"
 	"github.com/getlantern/http-proxy-lantern/v2/mimic"
 	"github.com/getlantern/http-proxy-lantern/v2/obfs4listener"
@@ -68,6 +79,7 @@ import (
 	"github.com/getlantern/http-proxy-lantern/v2/tlslistener"
 	"github.com/getlantern/http-proxy-lantern/v2/tlsmasq"
 	"github.com/getlantern/http-proxy-lantern/v2/tokenfilter"
+	"github.com/getlantern/http-proxy-lantern/v2/usage"
 	"github.com/getlantern/http-proxy-lantern/v2/wss"
 
 	algeneva "github.com/getlantern/lantern-algeneva"
@@ -77,8 +89,6 @@ import (
 
 const (
 	timeoutToDialOriginSite = 10 * time.Second
-
-	teleportHost = "telemetry.iantem.io:443"
 )
 
 var (
@@ -94,11 +104,21 @@ type Proxy struct {
 	HTTPMultiplexAddr                  string
 	TracesSampleRate                   int
 	TeleportSampleRate                 int
+	OTLPEndpoint                       string
+	PrometheusAddr                     string
 	ExternalIP                         string
 	CertFile                           string
 	CfgSvrAuthToken                    string
 	CfgSvrCacheClear                   time.Duration
+	AccessLogPath                      string
+	AccessLogPrivacy                   string
+	AccessLogHashKey                   string
+	AccessLogMaxSize                   int64
+	AccessLogMaxBackups                int
+	AdminAddr                          string
+	AdminToken                         string
 	ConnectOKWaitsForUpstream          bool
+	DrainTimeout                       time.Duration
 	ENHTTPAddr                         string
 	ENHTTPServerURL                    string
 	ENHTTPReapIdleTime                 time.Duration
@@ -110,9 +130,19 @@ type Proxy struct {
 	Pro                                bool
 	ProxiedSitesSamplePercentage       float64
 	ProxiedSitesTrackingID             string
-	ReportingRedisClient               *rclient.Client
+	ReportingRedisClient               rclient.UniversalClient
+	ReportingSpoolFile                 string
+	ReportingMaxPendingDevices         int
 	ThrottleRefreshInterval            time.Duration
+	ThrottleConfigFile                 string
+	UsageFile                          string
 	Token                              string
+	TokenMode                          string
+	TokenSecret                        string
+	TokensFile                         string
+	DeviceSignatureKeys                []string
+	MimicPersonality                   string
+	CoverSiteOrigin                    string
 	TunnelPorts                        string
 	Obfs4Addr                          string
 	Obfs4MultiplexAddr                 string
@@ -123,6 +153,9 @@ type Proxy struct {
 	KCPConf                            string
 	Benchmark                          bool
 	DiffServTOS                        int
+	ProxyProtocolTrustedSources        map[string][]string
+	IPFilterFile                       string
+	IPFilterReactions                  map[string]string
 	LampshadeAddr                      string
 	LampshadeKeyCacheSize              int
 	LampshadeMaxClientInitAge          time.Duration
@@ -132,6 +165,12 @@ type Proxy struct {
 	BlacklistMaxConnectInterval        time.Duration
 	BlacklistAllowedFailures           int
 	BlacklistExpiration                time.Duration
+	BlacklistEnabled                   bool
+	BlacklistDryRun                    bool
+	BlacklistEntries                   []string
+	BlacklistAllowlist                 []string
+	BlacklistFile                      string
+	BlacklistShared                    bool
 	ProxyName                          string
 	ProxyProtocol                      string
 	Provider                           string
@@ -162,6 +201,10 @@ type Proxy struct {
 	ShadowsocksSecret                  string
 	ShadowsocksCipher                  string
 	ShadowsocksReplayHistory           int
+	ShadowsocksKeysFile                string
+	ShadowsocksUDP                     bool
+	ShadowsocksUDPIdleTimeout          time.Duration
+	ShadowsocksUDPMaxPerClient         int
 	StarbridgeAddr                     string
 	StarbridgePrivateKey               string
 	CountryLookup                      geo.CountryLookup
@@ -199,8 +242,32 @@ type Proxy struct {
 	VMessAddr  string
 	VMessUUIDs []string
 
+	VLESSAddr         string
+	VLESSUUIDs        []string
+	VLESSFallbackAddr string
+
+	TrojanAddr         string
+	TrojanPasswords    []string
+	TrojanFallbackAddr string
+
+	SOCKS5Addr          string
+	SOCKS5MultiplexAddr string
+	SOCKS5WithTLS       bool
+
 	throttleConfig throttle.Config
+	localUsage     *localusage.Store
 	instrument     instrument.Instrument
+	tokenFilter    *tokenfilter.TokenFilter
+	deviceVerifier *devicefilter.DeviceVerifier
+	blacklist      *blacklist.Blacklist
+	ipFilter       *ipfilter.Filter
+	connectPorts   *proxyfilters.ConnectPortsFilter
+	reloader       *reloader
+
+	// shadowsocksKeys are shared by all shadowsocks listeners
+	shadowsocksKeys *shadowsocks.AccessKeys
+	// vmessUsers are the UUIDs accepted by the VMess listener
+	vmessUsers *vmess.Users
 }
 
 type listenerBuilderFN func(addr string) (net.Listener, error)
@@ -225,21 +292,50 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 	if err != nil {
 		return errors.New("Unable to configure instrumentation: %v", err)
 	}
+	usage.SetInstrument(p.instrument)
 
 	var onServerError func(conn net.Conn, err error)
 	if err := p.setupPacketForward(); err != nil {
 		log.Errorf("Unable to set up packet forwarding, will continue to start up: %v", err)
 	}
 	p.setBenchmarkMode()
-	p.loadThrottleConfig()
+	if err := p.setMimicPersonality(); err != nil {
+		return err
+	}
+	if err := p.loadThrottleConfig(); err != nil {
+		return err
+	}
+	if err := p.openLocalUsage(); err != nil {
+		return err
+	}
+	if p.localUsage != nil {
+		defer p.localUsage.Close()
+	}
+	if err := p.loadShadowsocksKeys(); err != nil {
+		return err
+	}
+	if err := p.loadVMessUsers(); err != nil {
+		return err
+	}
+	if err := p.loadIPFilter(); err != nil {
+		return err
+	}
+	if p.ipFilter != nil {
+		defer p.ipFilter.Close()
+	}
+	// stops watching files like the tokens file once the proxy stops
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
 
 	if p.ENHTTPAddr != "" {
-		return p.ListenAndServeENHTTP()
+		return p.ListenAndServeENHTTP(ctx)
 	}
 
 	// Only allow connections from remote IPs that are not blacklisted
-	blacklist := p.createBlacklist()
-	filterChain, dial, err := p.createFilterChain(blacklist)
+	if err := p.createBlacklist(); err != nil {
+		return err
+	}
+	filterChain, dial, err := p.createFilterChain(ctx, p.blacklist)
 	if err != nil {
 		return err
 	}
@@ -249,6 +345,15 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 	}
 	filterChain = filterChain.Prepend(opsfilter.New())
 
+	accessLog, err := p.configureAccessLog()
+	if err != nil {
+		return err
+	}
+	if accessLog != nil {
+		defer accessLog.Close()
+		filterChain = filterChain.Prepend(accessLog)
+	}
+
 	instrumentedFilter, err := p.instrument.WrapFilter("proxy", filterChain)
 	if err != nil {
 		return errors.New("unable to instrument filter: %v", err)
@@ -268,6 +373,9 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 			// count the connection only when a connection is established and becomes active
 			p.instrument.Connection(ctx, clientIP)
 		},
+		OnDrain: func(remaining int) {
+			p.instrument.Draining(context.Background(), remaining)
+		},
 	})
 	stopProxiedBytes := p.configureTeleportProxiedBytes()
 	defer stopProxiedBytes()
@@ -284,12 +392,20 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 	bwReporting := p.configureBandwidthReporting()
 	// Throttle connections when signaled
 	srv.AddListenerWrappers(listeners.NewBitrateListener, bwReporting.wrapper)
+	if accessLog != nil {
+		srv.AddListenerWrappers(accessLog.WrapListener)
+	}
 
 	// Add listeners for all protocols
 	allListeners := make([]net.Listener, 0)
 	listenerProtocols := make([]string, 0)
 
-	listenerArgs := getProtoListenersArgs(p)
+	p.reloader = newReloader(p, instrumentedErrorHandler, func(l net.Listener) net.Listener {
+		// Unless blacklisting is enabled and not in dry-run mode, this only tracks
+		// potential blacklisting and doesn't actually refuse anyone.
+		return listeners.NewAllowingListener(l, p.blacklist.OnConnect)
+	})
+	listenerArgs := getProtoListenersArgs(p, instrumentedErrorHandler)
 	for _, args := range listenerArgs {
 		if args.addr == "" {
 			continue
@@ -301,14 +417,33 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 		}
 
 		listenerProtocols = append(listenerProtocols, args.protocol)
-		// Although we include blacklist functionality, it's currently only used to
-		// track potential blacklisting ad doesn't actually blacklist anyone.
-		allListeners = append(allListeners, listeners.NewAllowingListener(l, blacklist.OnConnect))
+		allListeners = append(allListeners, p.reloader.add(args.protocol, args.addr, l))
+	}
+
+	if p.AdminAddr != "" {
+		stopAdmin, err := p.serveAdmin()
+		if err != nil {
+			return err
+		}
+		defer stopAdmin()
 	}
 
-	errCh := make(chan error, len(allListeners))
+	// listeners that get rebuilt on Reload are served in addition to the
+	// initial ones, but each protocol has at most one listener that reports
+	// errors at any given time.
+	errCh := make(chan error, len(listenerArgs))
 	if p.EnableMultipath {
-		mpl := multipath.NewListener(allListeners, p.instrument.MultipathStats(listenerProtocols))
+		subflowListeners := allListeners
+		ml := multipath.NewListener(subflowListeners, p.instrument.MultipathStats(listenerProtocols))
+		// closing the multipath listener leaves existing connections alone but
+		// doesn't close the subflow listeners, which are closed first so that
+		// nothing is accepted on them once the multipath listener is gone
+		mpl := listeners.NewDrainableListener(ml, func() error {
+			for _, l := range subflowListeners {
+				l.Close()
+			}
+			return ml.Close()
+		})
 		log.Debug("Serving multipath at:")
 		for i, l := range allListeners {
 			log.Debugf("  %-20s:  %v", listenerProtocols[i], l.Addr())
@@ -317,24 +452,83 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 			errCh <- srv.Serve(mpl, nil)
 		}()
 	} else {
-		for _, _l := range allListeners {
-			l := _l
+		p.reloader.serveWith(func(l *runningListener) {
 			go func() {
 				log.Debugf("Serving at: %v", l.Addr())
-				errCh <- srv.Serve(l, mimic.SetServerAddr)
+				err := srv.Serve(l, mimic.SetServerAddr)
+				if l.isStopped() {
+					log.Debugf("Stopped serving %v at %v", l.protocol, l.addr)
+					return
+				}
+				errCh <- err
 			}()
-		}
+		})
 	}
 	select {
 	case err := <-errCh:
 		return err
 	case <-ctx.Done():
 		// this is an expected path for closing, no error
+		p.shutdown(srv)
 		return err
 	}
 }
 
-func (p *Proxy) ListenAndServeENHTTP() error {
+// shutdown stops accepting new connections and gives the open ones up to
+// DrainTimeout to finish before closing them.
+func (p *Proxy) shutdown(srv *server.Server) {
+	timeout := p.drainTimeout()
+	log.Debugf("Draining connections for up to %v", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Debugf("Not all connections finished draining: %v", err)
+	}
+}
+
+// drainTimeout returns the DrainTimeout of the most recently loaded
+// configuration.
+func (p *Proxy) drainTimeout() time.Duration {
+	if p.reloader == nil {
+		return p.DrainTimeout
+	}
+	p.reloader.mx.Lock()
+	defer p.reloader.mx.Unlock()
+	return p.reloader.current.DrainTimeout
+}
+
+// serveAdmin serves the admin API at AdminAddr until the returned function is
+// called.
+func (p *Proxy) serveAdmin() (func(), error) {
+	if p.AdminToken == "" {
+		return nil, errors.New("an admin token is required to serve the admin API")
+	}
+	l, err := net.Listen("tcp", p.AdminAddr)
+	if err != nil {
+		return nil, errors.New("unable to listen for admin API at %v: %v", p.AdminAddr, err)
+	}
+	srv := &http.Server{
+		Handler: admin.NewHandler(&admin.Opts{
+			Token:           p.AdminToken,
+			Listeners:       p.reloader.listenerInfo,
+			ThrottleConfig:  p.throttleConfig,
+			ShadowsocksKeys: p.shadowsocksKeys,
+			VMessUsers:      p.vmessUsers,
+			Blacklist:       p.blacklist,
+		}),
+	}
+	log.Debugf("Serving admin API at %v", l.Addr())
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			log.Errorf("Error serving admin API: %v", err)
+		}
+	}()
+	return func() {
+		srv.Close()
+	}, nil
+}
+
+func (p *Proxy) ListenAndServeENHTTP(ctx context.Context) error {
 	el, err := net.Listen("tcp", p.ENHTTPAddr)
 	if err != nil {
 		return errors.New("Unable to listen for encapsulated HTTP at %v: %v", p.ENHTTPAddr, err)
@@ -344,7 +538,12 @@ func (p *Proxy) ListenAndServeENHTTP() error {
 	if err != nil {
 		return errors.New("unable to instrument ping filter: %v", err)
 	}
-	filterChain := filters.Join(tokenfilter.New(p.Token, p.instrument), instrumentedPingFilter)
+	p.tokenFilter, err = p.newTokenFilter(ctx)
+	if err != nil {
+		return err
+	}
+	p.reloader = newReloader(p, nil, nil)
+	filterChain := filters.Join(p.tokenFilter, instrumentedPingFilter)
 	enhttpHandler := enhttp.NewServerHandler(p.ENHTTPReapIdleTime, p.ENHTTPServerURL)
 	instrumentedProxyFilter, err := p.instrument.WrapFilter("proxy", filterChain)
 	if err != nil {
@@ -372,6 +571,12 @@ func (p *Proxy) wrapTLSIfNecessary(fn listenerBuilderFN) listenerBuilderFN {
 				return nil, err
 			}
 
+			if p.SessionTicketKeyFile == "" && p.SessionTicketKeys != "" {
+				tl := l
+				p.onReload(addr, []string{"SessionTicketKeys"}, func(newCfg *Proxy) error {
+					return tlslistener.UpdateSessionTicketKeys(tl, newCfg.SessionTicketKeys)
+				})
+			}
 			log.Debugf("Using TLS on %v", l.Addr())
 		}
 
@@ -399,9 +604,11 @@ func (p *Proxy) wrapMultiplexing(fn listenerBuilderFN) listenerBuilderFN {
 			return nil, err
 		}
 
-		l = cmux.Listen(&cmux.ListenOpts{
-			Listener: l,
-			Protocol: proto,
+		l = listeners.NewDrainableMultiplexListener(l, func(base net.Listener) net.Listener {
+			return cmux.Listen(&cmux.ListenOpts{
+				Listener: base,
+				Protocol: proto,
+			})
 		})
 
 		log.Debugf("Multiplexing on %v", l.Addr())
@@ -483,13 +690,70 @@ func (p *Proxy) setBenchmarkMode() {
 	}
 }
 
-func (p *Proxy) createBlacklist() *blacklist.Blacklist {
-	return blacklist.New(blacklist.Options{
+// setMimicPersonality sets the web server that's mimicked to clients that
+// fail authentication.
+func (p *Proxy) setMimicPersonality() error {
+	personality, err := mimic.ParsePersonality(p.MimicPersonality)
+	if err != nil {
+		return errors.New("invalid mimic personality: %v", err)
+	}
+	mimic.SetPersonality(personality)
+	return nil
+}
+
+func (p *Proxy) createBlacklist() error {
+	opts := blacklist.Options{
 		MaxIdleTime:        p.BlacklistMaxIdleTime,        // 30 * time.Second,
 		MaxConnectInterval: p.BlacklistMaxConnectInterval, // 5 * time.Second,
 		AllowedFailures:    p.BlacklistAllowedFailures,    // 10,
 		Expiration:         p.BlacklistExpiration,         // 6 * time.Hour,
-	})
+		Entries:            p.BlacklistEntries,
+		Allowlist:          p.BlacklistAllowlist,
+		ISPLookup:          p.ISPLookup,
+		File:               p.BlacklistFile,
+		Instrument:         p.instrument,
+	}
+	if p.BlacklistShared {
+		if p.ReportingRedisClient == nil {
+			return errors.New("sharing the blacklist requires a reporting Redis")
+		}
+		opts.RedisClient = p.ReportingRedisClient
+	}
+	bl, err := blacklist.New(opts)
+	if err != nil {
+		return errors.New("unable to create blacklist: %v", err)
+	}
+	blacklist.SetEnabled(p.BlacklistEnabled)
+	blacklist.SetDryRun(p.BlacklistDryRun)
+	p.blacklist = bl
+	return nil
+}
+
+// newTokenFilter creates a token filter for the configured token, token mode
+// and secret, along with the labeled tokens in TokensFile and the cover site at
+// CoverSiteOrigin if specified. TokensFile is watched until ctx is done.
+func (p *Proxy) newTokenFilter(ctx context.Context) (*tokenfilter.TokenFilter, error) {
+	mode, err := tokenfilter.ParseMode(p.TokenMode)
+	if err != nil {
+		return nil, errors.New("invalid token mode: %v", err)
+	}
+	tf := tokenfilter.New(p.Token, p.instrument)
+	if err := tf.SetHMAC(p.TokenSecret, mode); err != nil {
+		return nil, errors.New("unable to configure token filter: %v", err)
+	}
+	if p.TokensFile != "" {
+		if err := tf.WatchTokens(ctx, p.TokensFile, 0); err != nil {
+			return nil, errors.New("unable to load tokens: %v", err)
+		}
+	}
+	if p.CoverSiteOrigin != "" {
+		site, err := coversite.New(p.CoverSiteOrigin)
+		if err != nil {
+			return nil, err
+		}
+		tf.SetCoverSite(site)
+	}
+	return tf, nil
 }
 
 // createFilterChain creates a chain of filters that modify the default behavior
@@ -497,7 +761,7 @@ func (p *Proxy) createBlacklist() *blacklist.Blacklist {
 // Apache mimicry, bandwidth throttling, BBR metric reporting, etc. The actual
 // work of proxying plain HTTP and CONNECT requests is handled by proxy.Proxy
 // itself.
-func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy.DialFunc, error) {
+func (p *Proxy) createFilterChain(ctx context.Context, bl *blacklist.Blacklist) (filters.Chain, proxy.DialFunc, error) {
 	filterChain := filters.Join()
 
 	if p.Benchmark {
@@ -510,16 +774,31 @@ func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy
 			"ping-chained-server": 1 * time.Nanosecond, // Internal ping-chained-server protocol
 		}))
 	} else {
-		filterChain = filterChain.Append(proxy.OnFirstOnly(tokenfilter.New(p.Token, p.instrument)))
+		tokenFilter, err := p.newTokenFilter(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.tokenFilter = tokenFilter
+		filterChain = filterChain.Append(proxy.OnFirstOnly(p.tokenFilter))
 	}
 
-	if p.ReportingRedisClient == nil {
-		log.Debug("Not enabling bandwidth limiting")
-	} else {
+	deviceVerifier, err := devicefilter.NewDeviceVerifier(p.DeviceSignatureKeys)
+	if err != nil {
+		return nil, nil, errors.New("invalid device signature keys: %v", err)
+	}
+	p.deviceVerifier = deviceVerifier
+	if p.ReportingRedisClient != nil {
+		filterChain = filterChain.Append(
+			proxy.OnFirstOnly(devicefilter.NewPre(
+				redis.NewDeviceFetcher(p.ReportingRedisClient), p.throttleConfig, !p.Pro, p.instrument, p.deviceVerifier)),
+		)
+	} else if p.localUsage != nil {
 		filterChain = filterChain.Append(
 			proxy.OnFirstOnly(devicefilter.NewPre(
-				redis.NewDeviceFetcher(p.ReportingRedisClient), p.throttleConfig, !p.Pro, p.instrument)),
+				p.localUsage, p.throttleConfig, !p.Pro, p.instrument, p.deviceVerifier)),
 		)
+	} else {
+		log.Debug("Not enabling bandwidth limiting")
 	}
 
 	filterChain = filterChain.Append(
@@ -568,6 +847,7 @@ func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy
 		return conn, nil
 	}
 	dialerForPforward := dialer
+	p.connectPorts = proxyfilters.RestrictConnectPorts(p.allowedTunnelPorts())
 
 	filterChain = filterChain.Append(
 		proxyfilters.DiscardInitialPersistentRequest,
@@ -579,7 +859,7 @@ func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy
 			return next(cs, req)
 		}),
 		httpsupgrade.NewHTTPSUpgrade(p.CfgSvrAuthToken),
-		proxyfilters.RestrictConnectPorts(p.allowedTunnelPorts()),
+		p.connectPorts,
 		proxyfilters.RecordOp,
 		cleanheadersfilter.New(), // IMPORTANT, this should be the last filter in the chain to avoid stripping any headers that other filters might need
 	)
@@ -592,9 +872,35 @@ func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy
 	}, nil
 }
 
+// configureAccessLog creates the access log if AccessLogPath is set, returning
+// nil otherwise.
+func (p *Proxy) configureAccessLog() (*accesslog.Logger, error) {
+	if p.AccessLogPath == "" {
+		log.Debug("Not writing access log")
+		return nil, nil
+	}
+	accessLog, err := accesslog.New(&accesslog.Opts{
+		Path:       p.AccessLogPath,
+		MaxSize:    p.AccessLogMaxSize,
+		MaxBackups: p.AccessLogMaxBackups,
+		Privacy:    p.AccessLogPrivacy,
+		HashKey:    p.AccessLogHashKey,
+		Protocol:   p.ProxyProtocol,
+	})
+	if err != nil {
+		return nil, errors.New("unable to configure access log: %v", err)
+	}
+	log.Debugf("Writing access log to %v", p.AccessLogPath)
+	return accessLog, nil
+}
+
 func (p *Proxy) configureTeleportProxiedBytes() func() {
+	if p.OTLPEndpoint == "" {
+		log.Debug("No OTLP endpoint, not reporting proxied bytes")
+		return func() {}
+	}
 	log.Debug("Configuring Teleport proxied bytes")
-	tp, stop := otel.BuildTracerProvider(p.buildOTELOpts(teleportHost, true))
+	tp, stop := otel.BuildTracerProvider(p.buildOTELOpts(p.OTLPEndpoint, true))
 	if tp != nil {
 		go p.instrument.ReportProxiedBytesPeriodically(1*time.Hour, tp)
 		ogStop := stop
@@ -607,9 +913,13 @@ func (p *Proxy) configureTeleportProxiedBytes() func() {
 }
 
 func (p *Proxy) configureTeleportOriginBytes() func() {
+	if p.OTLPEndpoint == "" {
+		log.Debug("No OTLP endpoint, not reporting origin bytes")
+		return func() {}
+	}
 	log.Debug("Configuring Teleport origin bytes")
 	// Note - we do not include the proxy name here to avoid associating origin site usage with devices on that proxy name
-	tp, stop := otel.BuildTracerProvider(p.buildOTELOpts(teleportHost, false))
+	tp, stop := otel.BuildTracerProvider(p.buildOTELOpts(p.OTLPEndpoint, false))
 	if tp != nil {
 		go p.instrument.ReportOriginBytesPeriodically(1*time.Hour, tp)
 		ogStop := stop
@@ -622,11 +932,54 @@ func (p *Proxy) configureTeleportOriginBytes() func() {
 }
 
 func (p *Proxy) configureOTELMetrics() (func(), error) {
-	return otel.InitGlobalMeterProvider(
-		p.buildOTELOpts(
-			teleportHost,
-			false, // don't include proxy name in order to reduce DataDog costs
-		))
+	opts := p.buildOTELOpts(
+		p.OTLPEndpoint,
+		false, // don't include proxy name in order to reduce DataDog costs
+	)
+	var stopPrometheus func()
+	if p.PrometheusAddr != "" {
+		registry := prometheus.NewRegistry()
+		opts.PrometheusRegisterer = registry
+		var err error
+		stopPrometheus, err = p.servePrometheus(registry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	stopMetrics, err := otel.InitGlobalMeterProvider(opts)
+	if err != nil {
+		if stopPrometheus != nil {
+			stopPrometheus()
+		}
+		return nil, err
+	}
+	return func() {
+		stopMetrics()
+		if stopPrometheus != nil {
+			stopPrometheus()
+		}
+	}, nil
+}
+
+// servePrometheus serves the metrics gathered by registry at /metrics on
+// PrometheusAddr until the returned function is called.
+func (p *Proxy) servePrometheus(registry *prometheus.Registry) (func(), error) {
+	l, err := net.Listen("tcp", p.PrometheusAddr)
+	if err != nil {
+		return nil, errors.New("unable to listen for Prometheus at %v: %v", p.PrometheusAddr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+	log.Debugf("Serving Prometheus metrics at http://%v/metrics", l.Addr())
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			log.Errorf("Error serving Prometheus metrics: %v", err)
+		}
+	}()
+	return func() {
+		srv.Close()
+	}, nil
 }
 
 func (p *Proxy) buildOTELOpts(endpoint string, includeProxyName bool) *otel.Opts {
@@ -674,6 +1027,14 @@ func (p *Proxy) buildOTELOpts(endpoint string, includeProxyName bool) *otel.Opts
 		opts.Addr = p.WaterAddr
 	} else if p.VMessAddr != "" {
 		opts.Addr = p.VMessAddr
+	} else if p.VLESSAddr != "" {
+		opts.Addr = p.VLESSAddr
+	} else if p.TrojanAddr != "" {
+		opts.Addr = p.TrojanAddr
+	} else if p.SOCKS5MultiplexAddr != "" {
+		opts.Addr = p.SOCKS5MultiplexAddr
+	} else if p.SOCKS5Addr != "" {
+		opts.Addr = p.SOCKS5Addr
 	}
 	if includeProxyName {
 		opts.ProxyName = proxyName
@@ -682,16 +1043,57 @@ func (p *Proxy) buildOTELOpts(endpoint string, includeProxyName bool) *otel.Opts
 }
 
 func (p *Proxy) configureBandwidthReporting() *reportingConfig {
-	return newReportingConfig(p.CountryLookup, p.ReportingRedisClient, p.instrument, p.throttleConfig)
+	return newReportingConfig(p.CountryLookup, p.ReportingRedisClient, p.localUsage, p.instrument, p.throttleConfig, &redis.ReporterOpts{
+		MaxPendingDevices: p.ReportingMaxPendingDevices,
+		SpoolFile:         p.ReportingSpoolFile,
+		Instrument:        p.instrument,
+	})
 }
 
-func (p *Proxy) loadThrottleConfig() {
-	if !p.Pro && p.ThrottleRefreshInterval > 0 && p.ReportingRedisClient != nil {
-		p.throttleConfig = throttle.NewRedisConfig(p.ReportingRedisClient, p.ThrottleRefreshInterval)
+func (p *Proxy) loadThrottleConfig() error {
+	if p.Pro {
+		log.Debug("Not loading throttle config")
+		return nil
+	}
+
+	var fileConfig throttle.Config
+	if p.ThrottleConfigFile != "" {
+		var err error
+		fileConfig, err = throttle.NewFileConfig(p.ThrottleConfigFile, p.ThrottleRefreshInterval)
+		if err != nil {
+			return errors.New("unable to load throttle config: %v", err)
+		}
+	}
+
+	if p.ThrottleRefreshInterval > 0 && p.ReportingRedisClient != nil {
+		// the file config, if any, is only used while redis is unreachable
+		p.throttleConfig = throttle.NewRedisConfigWithFallback(p.ReportingRedisClient, p.ThrottleRefreshInterval, fileConfig)
+	} else if fileConfig != nil {
+		p.throttleConfig = fileConfig
 	} else {
 		log.Debug("Not loading throttle config")
-		return
 	}
+	return nil
+}
+
+// openLocalUsage opens the local usage store at UsageFile, which is used to
+// enforce data caps in place of the reporting Redis when that's not
+// configured.
+func (p *Proxy) openLocalUsage() error {
+	if p.UsageFile == "" {
+		return nil
+	}
+	if p.ReportingRedisClient != nil {
+		log.Debugf("Reporting Redis configured, ignoring local usage file %v", p.UsageFile)
+		return nil
+	}
+	localUsage, err := localusage.Open(p.UsageFile, p.CountryLookup, p.throttleConfig, p.instrument, measuredReportingInterval)
+	if err != nil {
+		return errors.New("unable to open local usage store: %v", err)
+	}
+	log.Debugf("Tracking device usage locally in %v", p.UsageFile)
+	p.localUsage = localUsage
+	return nil
 }
 
 func (p *Proxy) allowedTunnelPorts() []int {
@@ -776,7 +1178,7 @@ func (p *Proxy) listenTLSMasq(baseListen func(string) (net.Listener, error)) lis
 }
 
 func (p *Proxy) listenTCP(addr string) (net.Listener, error) {
-	l, err := net.Listen("tcp", addr)
+	l, err := p.listenRawTCP(addr)
 	if err != nil {
 		return nil, err
 	}
@@ -794,6 +1196,39 @@ func (p *Proxy) listenTCP(addr string) (net.Listener, error) {
 	return l, nil
 }
 
+// listenRawTCP listens at addr, taking the client's address from the PROXY
+// protocol headers sent by the trusted sources configured for addr, if any,
+// and then rejecting clients that the IP filter doesn't allow with the
+// reaction configured for addr. This happens before anything else sees the
+// connections.
+func (p *Proxy) listenRawTCP(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if trustedSources := p.ProxyProtocolTrustedSources[addr]; len(trustedSources) > 0 {
+		log.Debugf("Accepting PROXY protocol headers at %v from %v", addr, strings.Join(trustedSources, ", "))
+		pl, err := listeners.NewProxyProtocolListener(l, trustedSources)
+		if err != nil {
+			l.Close()
+			return nil, errors.New("unable to accept PROXY protocol at %v: %v", addr, err)
+		}
+		l = pl
+	}
+	if p.ipFilter != nil {
+		reaction := ipfilter.Close
+		if action := p.IPFilterReactions[addr]; action != "" {
+			reaction, err = ipfilter.ParseReaction(action)
+			if err != nil {
+				l.Close()
+				return nil, errors.New("unable to filter IPs at %v: %v", addr, err)
+			}
+		}
+		l = ipfilter.NewListener(l, p.ipFilter, reaction)
+	}
+	return l, nil
+}
+
 func (p *Proxy) listenKCP(kcpConf string) (net.Listener, error) {
 	cfg := &kcpwrapper.ListenerConfig{}
 	file, err := os.Open(kcpConf) // For read access.
@@ -841,18 +1276,16 @@ func (p *Proxy) listenShadowsocks(addr string) (net.Listener, error) {
 	// The idea here is to be as close to what outline shadowsocks does without any intervention,
 	// especially with respect to draining connections and the timing of closures.
 
-	configs := []shadowsocks.CipherConfig{
-		{
-			ID:     "default",
-			Secret: p.ShadowsocksSecret,
-			Cipher: p.ShadowsocksCipher,
-		},
-	}
-	ciphers, err := shadowsocks.NewCipherListWithConfigs(configs)
-	if err != nil {
-		return nil, errors.New("Unable to create shadowsocks cipher: %v", err)
+	if p.shadowsocksKeys == nil {
+		// shadowsocks was only enabled on reload
+		if err := p.loadShadowsocksKeys(); err != nil {
+			return nil, err
+		}
+	} else if err := p.updateShadowsocksKeys(); err != nil {
+		return nil, err
 	}
 	var tlsConfig *tls.Config
+	var err error
 	if p.ShadowsocksWithTLS {
 		var cert tls.Certificate
 		cert, err = tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
@@ -863,14 +1296,15 @@ func (p *Proxy) listenShadowsocks(addr string) (net.Listener, error) {
 		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 	}
 
-	base, err := net.Listen("tcp", addr)
+	base, err := p.listenRawTCP(addr)
 	if err != nil {
 		return nil, err
 	}
 
 	l, err := shadowsocks.ListenLocalTCP(
-		base, ciphers,
+		base, p.shadowsocksKeys,
 		p.ShadowsocksReplayHistory,
+		shadowsocks.NewInstrumentMetrics(p.instrument),
 	)
 	if err != nil {
 		return nil, errors.New("Unable to listen for shadowsocks: %v", err)
@@ -880,10 +1314,136 @@ func (p *Proxy) listenShadowsocks(addr string) (net.Listener, error) {
 		l = tls.NewListener(l, tlsConfig)
 	}
 
+	if p.ShadowsocksUDP {
+		relay, err := p.listenShadowsocksUDP(addr)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l = shadowsocks.WithUDPRelay(l, relay)
+	}
+
+	p.onReload(addr, []string{"ShadowsocksSecret", "ShadowsocksCipher", "ShadowsocksKeysFile"}, func(newCfg *Proxy) error {
+		return newCfg.updateShadowsocksKeys()
+	})
+
 	log.Debugf("Listening for shadowsocks at %v", l.Addr())
 	return l, nil
 }
 
+// listenShadowsocksUDP relays shadowsocks UDP packets received at addr until
+// the returned relay is closed. Clients are subject to the IP filter and the
+// blacklist like on TCP, but their packets aren't measured or throttled, which
+// is why relaying UDP is opt-in.
+func (p *Proxy) listenShadowsocksUDP(addr string) (*shadowsocks.UDPRelay, error) {
+	if len(p.ProxyProtocolTrustedSources[addr]) > 0 {
+		log.Errorf("PROXY protocol isn't supported for shadowsocks UDP at %v, clients will be identified by the packets' source address", addr)
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, errors.New("Unable to listen for shadowsocks UDP: %v", err)
+	}
+	replayCache := service.NewReplayCache(p.ShadowsocksReplayHistory)
+	relay := shadowsocks.NewUDPRelay(conn, &shadowsocks.UDPOptions{
+		Ciphers:                  p.shadowsocksKeys.CipherList(),
+		ReplayCache:              &replayCache,
+		IdleTimeout:              p.ShadowsocksUDPIdleTimeout,
+		MaxAssociationsPerClient: p.ShadowsocksUDPMaxPerClient,
+		AllowClient:              p.allowShadowsocksUDPClient,
+	})
+	go func() {
+		if err := relay.Serve(); err != nil {
+			log.Errorf("Error relaying shadowsocks UDP: %v", err)
+		}
+	}()
+	log.Debugf("Relaying shadowsocks UDP at %v", relay.Addr())
+	return relay, nil
+}
+
+// allowShadowsocksUDPClient checks a shadowsocks UDP client that authenticated
+// against the IP filter and the blacklist.
+func (p *Proxy) allowShadowsocksUDPClient(clientIP net.IP) bool {
+	if p.ipFilter != nil && !p.ipFilter.Allow(clientIP) {
+		return false
+	}
+	ip := clientIP.String()
+	if !p.blacklist.OnConnect(ip) {
+		return false
+	}
+	// the client authenticated, which is as good as a successful request over
+	// TCP
+	p.blacklist.Succeed(ip)
+	return true
+}
+
+func (p *Proxy) shadowsocksCipherConfigs() []shadowsocks.CipherConfig {
+	if p.ShadowsocksSecret == "" && p.ShadowsocksKeysFile != "" {
+		// all keys come from the keys file
+		return nil
+	}
+	return []shadowsocks.CipherConfig{
+		{
+			ID:     "default",
+			Secret: p.ShadowsocksSecret,
+			Cipher: p.ShadowsocksCipher,
+		},
+	}
+}
+
+// loadShadowsocksKeys loads the access keys shared by the shadowsocks
+// listeners, if there are any.
+func (p *Proxy) loadShadowsocksKeys() error {
+	if p.ShadowsocksAddr == "" && p.ShadowsocksMultiplexAddr == "" {
+		return nil
+	}
+	keys, err := shadowsocks.NewAccessKeys(p.shadowsocksCipherConfigs(), p.ShadowsocksKeysFile, 0)
+	if err != nil {
+		return errors.New("Unable to load shadowsocks keys: %v", err)
+	}
+	p.shadowsocksKeys = keys
+	return nil
+}
+
+// updateShadowsocksKeys applies the configured static keys and keys file to the
+// access keys kept from a previous configuration.
+func (p *Proxy) updateShadowsocksKeys() error {
+	if err := p.shadowsocksKeys.SetStaticKeys(p.shadowsocksCipherConfigs()); err != nil {
+		return errors.New("Unable to update shadowsocks keys: %v", err)
+	}
+	if err := p.shadowsocksKeys.SetPath(p.ShadowsocksKeysFile); err != nil {
+		return errors.New("Unable to update shadowsocks keys: %v", err)
+	}
+	return nil
+}
+
+// loadVMessUsers loads the UUIDs accepted by the VMess listener, if there is
+// one.
+func (p *Proxy) loadVMessUsers() error {
+	if p.VMessAddr == "" {
+		return nil
+	}
+	users, err := vmess.NewUsers(p.VMessUUIDs)
+	if err != nil {
+		return errors.New("Unable to load vmess UUIDs: %v", err)
+	}
+	p.vmessUsers = users
+	return nil
+}
+
+// loadIPFilter loads the rules deciding which clients may connect at all, if
+// there are any.
+func (p *Proxy) loadIPFilter() error {
+	if p.IPFilterFile == "" {
+		return nil
+	}
+	filter, err := ipfilter.New(p.IPFilterFile, p.CountryLookup, p.ISPLookup, 0)
+	if err != nil {
+		return errors.New("Unable to load IP filter: %v", err)
+	}
+	p.ipFilter = filter
+	return nil
+}
+
 func (p *Proxy) listenStarbridge(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
 	return func(addr string) (net.Listener, error) {
 		if p.StarbridgePrivateKey == "" {
@@ -936,7 +1496,7 @@ func (p *Proxy) listenWSS(addr string) (net.Listener, error) {
 
 func (p *Proxy) listenBroflake(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
 	return func(addr string) (net.Listener, error) {
-		l, err := net.Listen("tcp", addr)
+		l, err := p.listenRawTCP(addr)
 		if err != nil {
 			return nil, err
 		}
@@ -1002,15 +1562,84 @@ func (p *Proxy) listenVMess(baseListen func(string) (net.Listener, error)) liste
 		if err != nil {
 			return nil, err
 		}
+		if p.vmessUsers == nil {
+			// vmess was only enabled on reload
+			if err := p.loadVMessUsers(); err != nil {
+				_ = base.Close()
+				return nil, fmt.Errorf("vmess wrapping error: %w", err)
+			}
+		} else if p.vmessUsers.Closed() {
+			// vmess was turned off and on again
+			if err := p.vmessUsers.Update(p.VMessUUIDs); err != nil {
+				_ = base.Close()
+				return nil, fmt.Errorf("vmess wrapping error: %w", err)
+			}
+		}
 		log.Debugf("Listening for vmess at %v", base.Addr())
-		wrapper, err := vmess.NewVMessListener(base, p.VMessUUIDs)
+		return vmess.NewVMessListenerWithUsers(base, p.vmessUsers), nil
+	}
+}
+
+func (p *Proxy) listenVLESS(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
+	return func(addr string) (net.Listener, error) {
+		base, err := p.listenWithCertTLS(baseListen, addr)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Listening for vless at %v", base.Addr())
+		return vless.NewVLESSListener(base, p.VLESSUUIDs, p.VLESSFallbackAddr), nil
+	}
+}
+
+func (p *Proxy) listenTrojan(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
+	return func(addr string) (net.Listener, error) {
+		base, err := p.listenWithCertTLS(baseListen, addr)
+		if err != nil {
+			return nil, err
+		}
+		l, err := trojan.NewTrojanListener(base, p.TrojanPasswords, p.TrojanFallbackAddr)
 		if err != nil {
 			_ = base.Close()
-			return nil, fmt.Errorf("vmess wrapping error: %w", err)
+			return nil, fmt.Errorf("trojan wrapping error: %w", err)
 		}
+		log.Debugf("Listening for trojan at %v", base.Addr())
+		return l, nil
+	}
+}
 
-		return wrapper, nil
+// listenSOCKS5 wraps the listener from baseListen with a SOCKS5 server, whose
+// clients' CONNECT requests are handled like any other CONNECT request.
+func (p *Proxy) listenSOCKS5(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
+	return func(addr string) (net.Listener, error) {
+		base, err := baseListen(addr)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Listening for socks5 at %v", base.Addr())
+		return socks5.NewListener(base), nil
+	}
+}
+
+// listenSOCKS5Base listens for the connections carrying SOCKS5, which use TLS
+// with the configured certificate if SOCKS5WithTLS is set.
+func (p *Proxy) listenSOCKS5Base(addr string) (net.Listener, error) {
+	if p.SOCKS5WithTLS {
+		return p.listenWithCertTLS(p.listenTCP, addr)
+	}
+	return p.listenTCP(addr)
+}
+
+// listenWithCertTLS listens at addr using TLS with the configured certificate.
+func (p *Proxy) listenWithCertTLS(baseListen func(string) (net.Listener, error), addr string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if err != nil {
+		return nil, errors.New("unable to load cert: %v", err)
+	}
+	base, err := baseListen(addr)
+	if err != nil {
+		return nil, err
 	}
+	return tls.NewListener(base, &tls.Config{Certificates: []tls.Certificate{cert}}), nil
 }
 
 // listenWATER start a WATER listener and return it
@@ -31,13 +31,21 @@ type Instrument interface {
 	WrapFilter(prefix string, f filters.Filter) (filters.Filter, error)
 	WrapConnErrorHandler(prefix string, f func(conn net.Conn, err error)) (func(conn net.Conn, err error), error)
 	Blacklist(ctx context.Context, b bool)
+	BlacklistDryRun(ctx context.Context, kind string)
 	Mimic(ctx context.Context, m bool)
 	MultipathStats([]string) []multipath.StatsTracker
 	Throttle(ctx context.Context, m bool, reason string)
 	XBQHeaderSent(ctx context.Context)
 	SuspectedProbing(ctx context.Context, fromIP net.IP, reason string)
-	ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch string)
+	ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch, tokenLabel, accessKeyID, vmessUUID, vlessUUID string)
 	Connection(ctx context.Context, clientIP net.IP)
+	Draining(ctx context.Context, remaining int)
+	CacheEvictions(ctx context.Context, cache, reason string, count int)
+	CacheSize(ctx context.Context, cache string, size int)
+	UsageReportsDropped(ctx context.Context, bytes int, reason string)
+	UsageReportRetries(ctx context.Context)
+	ShadowsocksCipherSearch(ctx context.Context, found bool, timeToCipher time.Duration)
+	ShadowsocksConnection(ctx context.Context, status string)
 	ReportProxiedBytesPeriodically(interval time.Duration, tp *sdktrace.TracerProvider)
 	ReportProxiedBytes(tp *sdktrace.TracerProvider)
 	ReportOriginBytesPeriodically(interval time.Duration, tp *sdktrace.TracerProvider)
@@ -59,8 +67,9 @@ func (i NoInstrument) WrapFilter(prefix string, f filters.Filter) (filters.Filte
 func (i NoInstrument) WrapConnErrorHandler(prefix string, f func(conn net.Conn, err error)) (func(conn net.Conn, err error), error) {
 	return f, nil
 }
-func (i NoInstrument) Blacklist(ctx context.Context, b bool) {}
-func (i NoInstrument) Mimic(ctx context.Context, m bool)     {}
+func (i NoInstrument) Blacklist(ctx context.Context, b bool)            {}
+func (i NoInstrument) BlacklistDryRun(ctx context.Context, kind string) {}
+func (i NoInstrument) Mimic(ctx context.Context, m bool)                {}
 func (i NoInstrument) MultipathStats(protocols []string) (trackers []multipath.StatsTracker) {
 	for range protocols {
 		trackers = append(trackers, multipath.NullTracker{})
@@ -71,12 +80,22 @@ func (i NoInstrument) Throttle(ctx context.Context, m bool, reason string) {}
 
 func (i NoInstrument) XBQHeaderSent(ctx context.Context)                                  {}
 func (i NoInstrument) SuspectedProbing(ctx context.Context, fromIP net.IP, reason string) {}
-func (i NoInstrument) ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch string) {
+func (i NoInstrument) ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch, tokenLabel, accessKeyID, vmessUUID, vlessUUID string) {
 }
 func (i NoInstrument) ReportProxiedBytesPeriodically(interval time.Duration, tp *sdktrace.TracerProvider) {
 }
 func (i NoInstrument) ReportProxiedBytes(tp *sdktrace.TracerProvider)  {}
 func (i NoInstrument) Connection(ctx context.Context, clientIP net.IP) {}
+func (i NoInstrument) Draining(ctx context.Context, remaining int)     {}
+func (i NoInstrument) CacheEvictions(ctx context.Context, cache, reason string, count int) {
+}
+func (i NoInstrument) CacheSize(ctx context.Context, cache string, size int) {}
+func (i NoInstrument) UsageReportsDropped(ctx context.Context, bytes int, reason string) {
+}
+func (i NoInstrument) UsageReportRetries(ctx context.Context) {}
+func (i NoInstrument) ShadowsocksCipherSearch(ctx context.Context, found bool, timeToCipher time.Duration) {
+}
+func (i NoInstrument) ShadowsocksConnection(ctx context.Context, status string) {}
 func (i NoInstrument) ReportOriginBytesPeriodically(interval time.Duration, tp *sdktrace.TracerProvider) {
 }
 func (i NoInstrument) ReportOriginBytes(tp *sdktrace.TracerProvider) {}
@@ -186,6 +205,14 @@ func (ins *defaultInstrument) Blacklist(ctx context.Context, b bool) {
 		metric.WithAttributes(attribute.KeyValue{"blacklisted", attribute.BoolValue(b)}))
 }
 
+// BlacklistDryRun counts connections that would have been refused by the
+// blacklist if it weren't in dry-run mode, by the kind of entry that matched
+// (ip, cidr or asn).
+func (ins *defaultInstrument) BlacklistDryRun(ctx context.Context, kind string) {
+	otelinstrument.BlacklistDryRun.Add(ctx, 1,
+		metric.WithAttributes(attribute.KeyValue{"kind", attribute.StringValue(kind)}))
+}
+
 // Mimic instruments the Apache mimicry.
 func (ins *defaultInstrument) Mimic(ctx context.Context, m bool) {
 	otelinstrument.Mimicked.Add(ctx, 1, metric.WithAttributes(
@@ -227,7 +254,7 @@ func (ins *defaultInstrument) SuspectedProbing(ctx context.Context, fromIP net.I
 
 // ProxiedBytes records the volume of application data clients sent and
 // received via the proxy.
-func (ins *defaultInstrument) ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch string) {
+func (ins *defaultInstrument) ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch, tokenLabel, accessKeyID, vmessUUID, vlessUUID string) {
 	// Track the cardinality of clients.
 	otelinstrument.DistinctClients1m.Add(deviceID)
 	otelinstrument.DistinctClients10m.Add(deviceID)
@@ -245,6 +272,7 @@ func (ins *defaultInstrument) ProxiedBytes(ctx context.Context, sent, recv int,
 		{common.AppVersion, attribute.StringValue(appVersion)},
 		{common.App, attribute.StringValue(app)},
 		{"datacap_cohort", attribute.StringValue(dataCapCohort)},
+		{common.TokenLabel, attribute.StringValue(tokenLabel)},
 		{"country", attribute.StringValue(country)},
 		{"client_isp", attribute.StringValue(isp)},
 		{"client_asn", attribute.StringValue(asn)},
@@ -277,6 +305,10 @@ func (ins *defaultInstrument) ProxiedBytes(ctx context.Context, sent, recv int,
 		isp:             isp,
 		asn:             asn,
 		probingError:    probingError,
+		tokenLabel:      tokenLabel,
+		accessKeyID:     accessKeyID,
+		vmessUUID:       vmessUUID,
+		vlessUUID:       vlessUUID,
 	}
 
 	var originKey originDetails
@@ -313,6 +345,57 @@ func (ins *defaultInstrument) Connection(ctx context.Context, clientIP net.IP) {
 		))
 }
 
+// Draining records the number of connections that are still open while the
+// proxy is shutting down.
+func (ins *defaultInstrument) Draining(ctx context.Context, remaining int) {
+	otelinstrument.ConnectionsDraining.Store(int64(remaining))
+}
+
+// CacheEvictions counts entries evicted from the named cache for the given
+// reason.
+func (ins *defaultInstrument) CacheEvictions(ctx context.Context, cache, reason string, count int) {
+	otelinstrument.CacheEvictions.Add(ctx, int64(count),
+		metric.WithAttributes(
+			attribute.KeyValue{"cache", attribute.StringValue(cache)},
+			attribute.KeyValue{"reason", attribute.StringValue(reason)},
+		))
+}
+
+// CacheSize records the number of entries in the named cache.
+func (ins *defaultInstrument) CacheSize(ctx context.Context, cache string, size int) {
+	otelinstrument.CacheSizes.Store(cache, size)
+}
+
+// UsageReportsDropped counts bytes of device usage that were never reported to
+// the reporting Redis, for the given reason.
+func (ins *defaultInstrument) UsageReportsDropped(ctx context.Context, bytes int, reason string) {
+	otelinstrument.UsageReportsDropped.Add(ctx, int64(bytes),
+		metric.WithAttributes(attribute.KeyValue{"reason", attribute.StringValue(reason)}))
+}
+
+// UsageReportRetries counts attempts to report device usage after a failure.
+func (ins *defaultInstrument) UsageReportRetries(ctx context.Context) {
+	otelinstrument.UsageReportRetries.Add(ctx, 1)
+}
+
+// ShadowsocksCipherSearch records how long it took to find the access key of
+// a shadowsocks connection, and whether one was found at all.
+func (ins *defaultInstrument) ShadowsocksCipherSearch(ctx context.Context, found bool, timeToCipher time.Duration) {
+	otelinstrument.ShadowsocksTimeToCipher.Record(ctx, float64(timeToCipher)/float64(time.Millisecond),
+		metric.WithAttributes(attribute.KeyValue{"found", attribute.BoolValue(found)}))
+}
+
+// ShadowsocksConnection counts closed shadowsocks connections by status, which
+// is OK or an error like ERR_CIPHER or ERR_REPLAY_CLIENT. Access keys aren't
+// recorded here since there can be any number of them, usage per key is in
+// the proxied bytes instead.
+func (ins *defaultInstrument) ShadowsocksConnection(ctx context.Context, status string) {
+	otelinstrument.ShadowsocksConnections.Add(ctx, 1,
+		metric.WithAttributes(
+			attribute.KeyValue{"status", attribute.StringValue(status)},
+		))
+}
+
 // quicPackets is used by QuicTracer to update QUIC retransmissions mainly for block detection.
 func (ins *defaultInstrument) quicSentPacket(ctx context.Context) {
 	otelinstrument.QuicPackets.Add(ctx, 1, metric.WithAttributes(attribute.KeyValue{"state", attribute.StringValue("sent")}))
@@ -373,6 +456,10 @@ type clientDetails struct {
 	isp             string
 	asn             string
 	probingError    string
+	tokenLabel      string
+	accessKeyID     string
+	vmessUUID       string
+	vlessUUID       string
 }
 
 type originDetails struct {
@@ -432,7 +519,11 @@ func (ins *defaultInstrument) ReportProxiedBytes(tp *sdktrace.TracerProvider) {
 					attribute.String("client_country", key.country),
 					attribute.String("client_isp", key.isp),
 					attribute.String("client_asn", key.asn),
-					attribute.String(common.ProbingError, key.probingError)))
+					attribute.String(common.ProbingError, key.probingError),
+					attribute.String(common.TokenLabel, key.tokenLabel),
+					attribute.String(common.AccessKeyID, key.accessKeyID),
+					attribute.String(common.VMessUUID, key.vmessUUID),
+					attribute.String(common.VLESSUUID, key.vlessUUID)))
 		span.End()
 	}
 }
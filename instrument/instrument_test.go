@@ -1,9 +1,11 @@
 package instrument
 
 import (
+	"context"
 	"net"
 	"testing"
 
+	"github.com/getlantern/geo"
 	"github.com/stretchr/testify/require"
 )
 
@@ -39,3 +41,47 @@ func (m *mockISPLookup) ISP(ip net.IP) string {
 func (m *mockISPLookup) ASN(ip net.IP) string {
 	return m.ASNS[ip.String()]
 }
+
+func TestProxiedBytesByAccessKey(t *testing.T) {
+	ins, err := NewDefault(geo.NoLookup{}, geo.NoLookup{}, "test")
+	require.NoError(t, err)
+	proxied := func(sent, recv int, accessKeyID string) {
+		ins.ProxiedBytes(context.Background(), sent, recv, "", "", "", "", "", "", "", "", net.ParseIP("1.1.1.1"), "device", "", "", "", accessKeyID, "", "")
+	}
+	proxied(10, 20, "key1")
+	proxied(1, 2, "key1")
+	proxied(5, 5, "key2")
+	proxied(7, 7, "")
+
+	require.Equal(t, &usage{sent: 11, recv: 22}, ins.clientStats[clientDetails{deviceID: "device", accessKeyID: "key1"}])
+	require.Equal(t, &usage{sent: 5, recv: 5}, ins.clientStats[clientDetails{deviceID: "device", accessKeyID: "key2"}])
+	require.Equal(t, &usage{sent: 7, recv: 7}, ins.clientStats[clientDetails{deviceID: "device"}])
+}
+
+func TestProxiedBytesByVMessUUID(t *testing.T) {
+	ins, err := NewDefault(geo.NoLookup{}, geo.NoLookup{}, "test")
+	require.NoError(t, err)
+	proxied := func(sent, recv int, vmessUUID string) {
+		ins.ProxiedBytes(context.Background(), sent, recv, "", "", "", "", "", "", "", "", net.ParseIP("1.1.1.1"), "device", "", "", "", "", vmessUUID, "")
+	}
+	proxied(10, 20, "uuid1")
+	proxied(1, 2, "uuid1")
+	proxied(5, 5, "uuid2")
+
+	require.Equal(t, &usage{sent: 11, recv: 22}, ins.clientStats[clientDetails{deviceID: "device", vmessUUID: "uuid1"}])
+	require.Equal(t, &usage{sent: 5, recv: 5}, ins.clientStats[clientDetails{deviceID: "device", vmessUUID: "uuid2"}])
+}
+
+func TestProxiedBytesByVLESSUUID(t *testing.T) {
+	ins, err := NewDefault(geo.NoLookup{}, geo.NoLookup{}, "test")
+	require.NoError(t, err)
+	proxied := func(sent, recv int, vlessUUID string) {
+		ins.ProxiedBytes(context.Background(), sent, recv, "", "", "", "", "", "", "", "", net.ParseIP("1.1.1.1"), "device", "", "", "", "", "", vlessUUID)
+	}
+	proxied(10, 20, "uuid1")
+	proxied(1, 2, "uuid1")
+	proxied(5, 5, "uuid2")
+
+	require.Equal(t, &usage{sent: 11, recv: 22}, ins.clientStats[clientDetails{deviceID: "device", vlessUUID: "uuid1"}])
+	require.Equal(t, &usage{sent: 5, recv: 5}, ins.clientStats[clientDetails{deviceID: "device", vlessUUID: "uuid2"}])
+}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.opentelemetry.io/otel"
@@ -23,6 +24,7 @@ var (
 	initOnce                                                 sync.Once
 	meter                                                    metric.Meter
 	Blacklist                                                metric.Int64Counter
+	BlacklistDryRun                                          metric.Int64Counter
 	ProxyIO                                                  metric.Int64Counter
 	QuicPackets                                              metric.Int64Counter
 	Mimicked                                                 metric.Int64Counter
@@ -34,6 +36,19 @@ var (
 	Connections                                              metric.Int64Counter
 	DistinctClients1m, DistinctClients10m, DistinctClients1h *distinct.SlidingWindowDistinctCount
 	distinctClients                                          metric.Int64ObservableGauge
+	// ConnectionsDraining is the number of connections still open while the
+	// server is shutting down.
+	ConnectionsDraining atomic.Int64
+	connectionsDraining metric.Int64ObservableGauge
+	CacheEvictions      metric.Int64Counter
+	// CacheSizes holds the latest size of each cache by name.
+	CacheSizes          sync.Map
+	cacheSizes          metric.Int64ObservableGauge
+	UsageReportsDropped metric.Int64Counter
+	UsageReportRetries  metric.Int64Counter
+	// ShadowsocksConnections counts closed shadowsocks connections by status.
+	ShadowsocksConnections  metric.Int64Counter
+	ShadowsocksTimeToCipher metric.Float64Histogram
 )
 
 // Note - we don't use package-level init() because we want to defer initialization of
@@ -73,6 +88,9 @@ func initialize() error {
 	if Blacklist, err = meter.Int64Counter("proxy.clients.blacklist"); err != nil {
 		return err
 	}
+	if BlacklistDryRun, err = meter.Int64Counter("proxy.clients.blacklist.dry_run"); err != nil {
+		return err
+	}
 	if SuspectedProbing, err = meter.Int64Counter("proxy.probing.suspected"); err != nil {
 		return err
 	}
@@ -94,6 +112,44 @@ func initialize() error {
 		})); err != nil {
 		return err
 	}
+
+	if CacheEvictions, err = meter.Int64Counter("proxy.cache.evictions"); err != nil {
+		return err
+	}
+	if cacheSizes, err = meter.Int64ObservableGauge(
+		"proxy.cache.size",
+		metric.WithInt64Callback(func(ctx context.Context, io metric.Int64Observer) error {
+			CacheSizes.Range(func(cache, size interface{}) bool {
+				io.Observe(int64(size.(int)), metric.WithAttributes(attribute.String("cache", cache.(string))))
+				return true
+			})
+			return nil
+		})); err != nil {
+		return err
+	}
+
+	if UsageReportsDropped, err = meter.Int64Counter("proxy.usage_reports.dropped", metric.WithUnit("bytes")); err != nil {
+		return err
+	}
+	if UsageReportRetries, err = meter.Int64Counter("proxy.usage_reports.retries"); err != nil {
+		return err
+	}
+
+	if ShadowsocksConnections, err = meter.Int64Counter("proxy.shadowsocks.connections"); err != nil {
+		return err
+	}
+	if ShadowsocksTimeToCipher, err = meter.Float64Histogram("proxy.shadowsocks.time_to_cipher", metric.WithUnit("ms")); err != nil {
+		return err
+	}
+
+	if connectionsDraining, err = meter.Int64ObservableGauge(
+		"proxy.connections.draining",
+		metric.WithInt64Callback(func(ctx context.Context, io metric.Int64Observer) error {
+			io.Observe(ConnectionsDraining.Load())
+			return nil
+		})); err != nil {
+		return err
+	}
 	return nil
 }
 
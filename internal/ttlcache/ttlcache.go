@@ -0,0 +1,238 @@
+// Package ttlcache provides a cache that's bounded in size and whose entries
+// expire, either at a given time or after not being accessed for a while.
+package ttlcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Reasons for which entries are evicted
+const (
+	// EvictedSize means that the entry was the least recently used one when the
+	// cache was full.
+	EvictedSize = "size"
+	// EvictedExpired means that the entry's TTL passed.
+	EvictedExpired = "expired"
+	// EvictedIdle means that the entry wasn't accessed within the idle timeout.
+	EvictedIdle = "idle"
+
+	// DefaultSweepInterval is used for SweepInterval if a non-positive value is
+	// specified.
+	DefaultSweepInterval = 1 * time.Minute
+)
+
+// Opts configures a Cache.
+type Opts struct {
+	// MaxSize is the maximum number of entries in the cache. Once reached, the
+	// least recently used entry is evicted to make room for new ones. Zero means
+	// unbounded.
+	MaxSize int
+
+	// IdleTimeout is how long an entry is kept without being accessed. Zero
+	// means forever.
+	IdleTimeout time.Duration
+
+	// SweepInterval is how frequently expired and idle entries are removed in
+	// the background. Defaults to 1 minute.
+	SweepInterval time.Duration
+
+	// OnEvict, if specified, is called with the reason and the number of
+	// entries evicted for that reason.
+	OnEvict func(reason string, count int)
+
+	// OnSweep, if specified, is called with the size of the cache after each
+	// background sweep.
+	OnSweep func(size int)
+
+	// InUse, if specified, reports whether a value is still in use, in which
+	// case its entry is neither evicted for being idle nor to make room, even
+	// if that takes the cache over MaxSize. It's still evicted once its TTL
+	// passes. It's called with the cache locked, so it should be cheap.
+	InUse func(value interface{}) bool
+}
+
+// Cache is a size-bounded cache whose entries expire. It's safe for
+// concurrent use.
+type Cache struct {
+	opts    Opts
+	entries map[string]*list.Element
+	lru     *list.List // most recently used at the front
+	mx      sync.Mutex
+	stopCh  chan interface{}
+	stop    sync.Once
+	now     func() time.Time
+}
+
+type entry struct {
+	key        string
+	value      interface{}
+	expiresAt  time.Time
+	lastAccess time.Time
+}
+
+// New creates a new Cache, which sweeps itself in the background until it's
+// closed.
+func New(opts Opts) *Cache {
+	return newCache(opts, time.Now)
+}
+
+// newCache is like New but uses the given clock.
+func newCache(opts Opts, now func() time.Time) *Cache {
+	if opts.SweepInterval <= 0 {
+		opts.SweepInterval = DefaultSweepInterval
+	}
+	if opts.OnEvict == nil {
+		opts.OnEvict = func(reason string, count int) {}
+	}
+	if opts.OnSweep == nil {
+		opts.OnSweep = func(size int) {}
+	}
+	if opts.InUse == nil {
+		opts.InUse = func(value interface{}) bool { return false }
+	}
+	c := &Cache{
+		opts:    opts,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		stopCh:  make(chan interface{}),
+		now:     now,
+	}
+	go c.sweepPeriodically()
+	return c
+}
+
+// Set sets the value for the given key. If ttl is positive, the entry expires
+// after ttl even if it's being accessed.
+func (c *Cache) Set(key string, value interface{}, ttl time.Duration) {
+	now := c.now()
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = now.Add(ttl)
+	}
+
+	c.mx.Lock()
+	if el, found := c.entries[key]; found {
+		e := el.Value.(*entry)
+		e.value, e.expiresAt, e.lastAccess = value, expiresAt, now
+		c.lru.MoveToFront(el)
+		c.mx.Unlock()
+		return
+	}
+	added := c.lru.PushFront(&entry{key, value, expiresAt, now})
+	c.entries[key] = added
+	evicted := 0
+	for el := c.lru.Back(); el != added && c.opts.MaxSize > 0 && c.lru.Len() > c.opts.MaxSize; {
+		prev := el.Prev()
+		if !c.opts.InUse(el.Value.(*entry).value) {
+			c.remove(el)
+			evicted++
+		}
+		el = prev
+	}
+	c.mx.Unlock()
+
+	if evicted > 0 {
+		c.opts.OnEvict(EvictedSize, evicted)
+	}
+}
+
+// Delete removes the given key from the cache, if it's there.
+func (c *Cache) Delete(key string) {
+	c.mx.Lock()
+	if el, found := c.entries[key]; found {
+		c.remove(el)
+	}
+	c.mx.Unlock()
+}
+
+// Get gets the value for the given key, if it's in the cache and hasn't
+// expired.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	now := c.now()
+	c.mx.Lock()
+	el, found := c.entries[key]
+	if !found {
+		c.mx.Unlock()
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if reason := c.expired(e, now); reason != "" {
+		c.remove(el)
+		c.mx.Unlock()
+		c.opts.OnEvict(reason, 1)
+		return nil, false
+	}
+	e.lastAccess = now
+	c.lru.MoveToFront(el)
+	value := e.value
+	c.mx.Unlock()
+	return value, true
+}
+
+// Len returns the number of entries in the cache, including ones that have
+// expired but haven't been swept yet.
+func (c *Cache) Len() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.lru.Len()
+}
+
+// Sweep removes all expired and idle entries.
+func (c *Cache) Sweep() {
+	now := c.now()
+	evicted := make(map[string]int)
+	c.mx.Lock()
+	for el := c.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if reason := c.expired(el.Value.(*entry), now); reason != "" {
+			c.remove(el)
+			evicted[reason]++
+		}
+		el = prev
+	}
+	c.mx.Unlock()
+
+	for reason, count := range evicted {
+		c.opts.OnEvict(reason, count)
+	}
+}
+
+// Close stops sweeping the cache in the background.
+func (c *Cache) Close() {
+	c.stop.Do(func() {
+		close(c.stopCh)
+	})
+}
+
+func (c *Cache) sweepPeriodically() {
+	ticker := time.NewTicker(c.opts.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+			c.Sweep()
+			c.opts.OnSweep(c.Len())
+		}
+	}
+}
+
+// expired returns the reason for which the entry should be evicted, or an
+// empty string if it shouldn't be.
+func (c *Cache) expired(e *entry, now time.Time) string {
+	if !e.expiresAt.IsZero() && !now.Before(e.expiresAt) {
+		return EvictedExpired
+	}
+	if c.opts.IdleTimeout > 0 && now.Sub(e.lastAccess) >= c.opts.IdleTimeout && !c.opts.InUse(e.value) {
+		return EvictedIdle
+	}
+	return ""
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*entry).key)
+}
@@ -0,0 +1,155 @@
+package ttlcache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type evictions struct {
+	counts map[string]int
+	mx     sync.Mutex
+}
+
+func (e *evictions) onEvict(reason string, count int) {
+	e.mx.Lock()
+	e.counts[reason] += count
+	e.mx.Unlock()
+}
+
+func (e *evictions) get(reason string) int {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	return e.counts[reason]
+}
+
+func TestMaxSize(t *testing.T) {
+	ev := &evictions{counts: make(map[string]int)}
+	c := New(Opts{MaxSize: 2, OnEvict: ev.onEvict})
+	defer c.Close()
+
+	c.Set("a", 1, 0)
+	c.Set("b", 2, 0)
+	_, found := c.Get("a")
+	assert.True(t, found)
+	c.Set("c", 3, 0)
+
+	assert.Equal(t, 2, c.Len())
+	_, found = c.Get("b")
+	assert.False(t, found, "least recently used entry should have been evicted")
+	value, found := c.Get("a")
+	assert.True(t, found)
+	assert.Equal(t, 1, value)
+	assert.Equal(t, 1, ev.get(EvictedSize))
+
+	c.Set("a", 4, 0)
+	value, _ = c.Get("a")
+	assert.Equal(t, 4, value, "setting an existing key should replace its value")
+	assert.Equal(t, 2, c.Len())
+}
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	now time.Time
+	mx  sync.Mutex
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mx.Lock()
+	c.now = c.now.Add(d)
+	c.mx.Unlock()
+}
+
+func TestExpiration(t *testing.T) {
+	ev := &evictions{counts: make(map[string]int)}
+	clock := &fakeClock{now: time.Now()}
+	c := newCache(Opts{IdleTimeout: 50 * time.Second, OnEvict: ev.onEvict}, clock.Now)
+	defer c.Close()
+
+	c.Set("ttl", 1, 20*time.Second)
+	c.Set("idle", 2, 0)
+	c.Set("active", 3, 0)
+	for i := 0; i < 4; i++ {
+		clock.Advance(20 * time.Second)
+		_, found := c.Get("active")
+		assert.True(t, found, "entries that are being accessed shouldn't expire")
+	}
+
+	_, found := c.Get("ttl")
+	assert.False(t, found, "entry should have expired after its TTL")
+	assert.Equal(t, 1, ev.get(EvictedExpired))
+
+	c.Sweep()
+	assert.Equal(t, 1, ev.get(EvictedIdle), "idle entry should have been swept")
+	assert.Equal(t, 1, c.Len())
+
+	c.Delete("active")
+	c.Delete("missing")
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestInUse(t *testing.T) {
+	ev := &evictions{counts: make(map[string]int)}
+	clock := &fakeClock{now: time.Now()}
+	inUse := map[interface{}]bool{1: true}
+	c := newCache(Opts{
+		MaxSize:     2,
+		IdleTimeout: 50 * time.Second,
+		OnEvict:     ev.onEvict,
+		InUse: func(value interface{}) bool {
+			return inUse[value]
+		},
+	}, clock.Now)
+	defer c.Close()
+
+	c.Set("used", 1, 0)
+	c.Set("ttl", 2, 20*time.Second)
+	inUse[2] = true
+	c.Set("unused", 3, 0)
+	assert.Equal(t, 3, c.Len(), "entries in use shouldn't be evicted to make room")
+	c.Set("other", 4, 0)
+	_, found := c.Get("unused")
+	assert.False(t, found, "least recently used entry that's not in use should have been evicted")
+	assert.Equal(t, 1, ev.get(EvictedSize))
+
+	clock.Advance(time.Minute)
+	c.Sweep()
+	_, found = c.Get("used")
+	assert.True(t, found, "entry in use shouldn't be evicted for being idle")
+	_, found = c.Get("ttl")
+	assert.False(t, found, "entry in use should still expire after its TTL")
+	assert.Equal(t, 1, ev.get(EvictedExpired))
+	assert.Equal(t, 1, ev.get(EvictedIdle))
+
+	inUse[1] = false
+	clock.Advance(time.Minute)
+	c.Sweep()
+	assert.Equal(t, 0, c.Len(), "entry should be evicted once it's no longer in use")
+}
+
+func TestSweepPeriodically(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	sizes := make(chan int, 100)
+	c := newCache(Opts{
+		SweepInterval: 10 * time.Millisecond,
+		OnSweep: func(size int) {
+			sizes <- size
+		},
+	}, clock.Now)
+	defer c.Close()
+
+	c.Set("a", 1, 5*time.Second)
+	c.Set("b", 2, 0)
+	clock.Advance(5 * time.Second)
+	assert.Eventually(t, func() bool {
+		return <-sizes == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
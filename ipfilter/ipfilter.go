@@ -0,0 +1,254 @@
+// Package ipfilter decides which clients may connect to the proxy at all,
+// based on static allow and deny lists that are kept in a file and reloaded
+// whenever it changes.
+package ipfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/geo"
+	"github.com/getlantern/golog"
+)
+
+// DefaultRefreshInterval is how often the rules file is checked for changes by
+// default.
+const DefaultRefreshInterval = 30 * time.Second
+
+const (
+	countryPrefix = "country:"
+	ispPrefix     = "isp:"
+)
+
+var log = golog.LoggerFor("ipfilter")
+
+// Rules is the content of a rules file. Each entry is an IP, a CIDR, a country
+// code like "country:IR" or an ISP name like "isp:Example Telecom", all of
+// which are matched case-insensitively.
+type Rules struct {
+	// If not empty, only clients matching one of these entries are allowed.
+	Allow []string `json:"allow"`
+	// Clients matching any of these entries are rejected, even if they match
+	// an Allow entry.
+	Deny []string `json:"deny"`
+}
+
+type matcher struct {
+	cidrs     []*net.IPNet
+	countries map[string]bool
+	isps      map[string]bool
+}
+
+func newMatcher(entries []string) (*matcher, error) {
+	m := &matcher{countries: make(map[string]bool), isps: make(map[string]bool)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		lower := strings.ToLower(entry)
+		switch {
+		case entry == "":
+			continue
+		case strings.HasPrefix(lower, countryPrefix):
+			country := strings.TrimSpace(entry[len(countryPrefix):])
+			if len(country) != 2 {
+				return nil, fmt.Errorf("invalid country code in %v", entry)
+			}
+			m.countries[strings.ToUpper(country)] = true
+		case strings.HasPrefix(lower, ispPrefix):
+			isp := strings.TrimSpace(entry[len(ispPrefix):])
+			if isp == "" {
+				return nil, fmt.Errorf("missing ISP name in %v", entry)
+			}
+			m.isps[strings.ToLower(isp)] = true
+		case strings.Contains(entry, "/"):
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %v: %v", entry, err)
+			}
+			m.cidrs = append(m.cidrs, ipNet)
+		default:
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%v is not an IP, CIDR, country or ISP", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			m.cidrs = append(m.cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return m, nil
+}
+
+func (m *matcher) empty() bool {
+	return len(m.cidrs) == 0 && len(m.countries) == 0 && len(m.isps) == 0
+}
+
+func (m *matcher) match(ip net.IP, countryCode, isp func() string) bool {
+	for _, ipNet := range m.cidrs {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	if len(m.countries) > 0 && m.countries[strings.ToUpper(countryCode())] {
+		return true
+	}
+	return len(m.isps) > 0 && m.isps[strings.ToLower(isp())]
+}
+
+type compiledRules struct {
+	allow *matcher
+	deny  *matcher
+}
+
+// Filter applies the Rules from a file to client IPs.
+type Filter struct {
+	path          string
+	countryLookup geo.CountryLookup
+	ispLookup     geo.ISPLookup
+	rules         atomic.Pointer[compiledRules]
+	modTime       time.Time
+	mx            sync.Mutex
+	stop          chan struct{}
+	stopped       chan struct{}
+	closeOnce     sync.Once
+}
+
+// New creates a Filter with the JSON-encoded Rules in the file at path, which
+// is checked for changes every refreshInterval until the Filter is closed.
+// Until the file exists, all clients are allowed. If the file is removed, the
+// last rules loaded from it stay in effect rather than allowing everyone.
+func New(path string, countryLookup geo.CountryLookup, ispLookup geo.ISPLookup, refreshInterval time.Duration) (*Filter, error) {
+	if countryLookup == nil {
+		countryLookup = geo.NoLookup{}
+	}
+	if ispLookup == nil {
+		ispLookup = geo.NoLookup{}
+	}
+	f := &Filter{
+		path:          path,
+		countryLookup: countryLookup,
+		ispLookup:     ispLookup,
+		stop:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	if err := f.SetRules(&Rules{}); err != nil {
+		return nil, err
+	}
+	if err := f.refresh(); err != nil {
+		return nil, err
+	}
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultRefreshInterval
+	}
+	go f.keepCurrent(refreshInterval)
+	return f, nil
+}
+
+// SetRules replaces the rules until the file changes again.
+func (f *Filter) SetRules(rules *Rules) error {
+	allow, err := newMatcher(rules.Allow)
+	if err != nil {
+		return fmt.Errorf("invalid allow entry: %v", err)
+	}
+	deny, err := newMatcher(rules.Deny)
+	if err != nil {
+		return fmt.Errorf("invalid deny entry: %v", err)
+	}
+	f.rules.Store(&compiledRules{allow: allow, deny: deny})
+	return nil
+}
+
+// Allow determines whether the client at the given IP may connect.
+func (f *Filter) Allow(ip net.IP) bool {
+	rules := f.rules.Load()
+	var countryCode, isp *string
+	lookupCountryCode := func() string {
+		if countryCode == nil {
+			cc := f.countryLookup.CountryCode(ip)
+			countryCode = &cc
+		}
+		return *countryCode
+	}
+	lookupISP := func() string {
+		if isp == nil {
+			i := f.ispLookup.ISP(ip)
+			isp = &i
+		}
+		return *isp
+	}
+	if rules.deny.match(ip, lookupCountryCode, lookupISP) {
+		return false
+	}
+	return rules.allow.empty() || rules.allow.match(ip, lookupCountryCode, lookupISP)
+}
+
+// Close stops checking the rules file for changes, waiting until that's done.
+// The rules stay in effect.
+func (f *Filter) Close() {
+	f.closeOnce.Do(func() {
+		close(f.stop)
+	})
+	<-f.stopped
+}
+
+func (f *Filter) keepCurrent(refreshInterval time.Duration) {
+	defer close(f.stopped)
+	log.Debugf("Checking %v for changes every %v", f.path, refreshInterval)
+	for {
+		select {
+		case <-f.stop:
+			log.Debugf("Stopped checking %v for changes", f.path)
+			return
+		case <-time.After(refreshInterval):
+			if err := f.refresh(); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+func (f *Filter) refresh() error {
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		f.mx.Lock()
+		defer f.mx.Unlock()
+		if f.modTime.IsZero() {
+			log.Debugf("No IP filter rules at %v yet", f.path)
+			return nil
+		}
+		// load the file again whenever it's back
+		f.modTime = time.Time{}
+		return fmt.Errorf("IP filter rules at %v were removed, still applying the last rules loaded from it", f.path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to stat IP filter rules %v: %v", f.path, err)
+	}
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+	// don't bother trying again until the file changes
+	f.modTime = info.ModTime()
+
+	encoded, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("unable to read IP filter rules from %v: %v", f.path, err)
+	}
+	rules := &Rules{}
+	if err := json.Unmarshal(encoded, rules); err != nil {
+		return fmt.Errorf("unable to parse IP filter rules in %v: %v", f.path, err)
+	}
+	if err := f.SetRules(rules); err != nil {
+		return fmt.Errorf("invalid IP filter rules in %v: %v", f.path, err)
+	}
+	log.Debugf("Loaded IP filter rules with %d allow and %d deny entries from %v", len(rules.Allow), len(rules.Deny), f.path)
+	return nil
+}
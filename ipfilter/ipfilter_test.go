@@ -0,0 +1,140 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/geo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeLookup struct {
+	geo.NoLookup
+	countries map[string]string
+	isps      map[string]string
+}
+
+func (l *fakeLookup) CountryCode(ip net.IP) string { return l.countries[ip.String()] }
+func (l *fakeLookup) ISP(ip net.IP) string         { return l.isps[ip.String()] }
+
+func writeRules(t *testing.T, path string, rules *Rules) {
+	b, err := json.Marshal(rules)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b, 0600))
+}
+
+func TestFilter(t *testing.T) {
+	lookup := &fakeLookup{
+		countries: map[string]string{"192.0.2.1": "IR", "192.0.2.2": "US"},
+		isps:      map[string]string{"198.51.100.1": "Example Telecom"},
+	}
+	path := filepath.Join(t.TempDir(), "rules.json")
+	f, err := New(path, lookup, lookup, 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, f.Allow(net.ParseIP("192.0.2.1")), "everyone should be allowed without rules")
+
+	writeRules(t, path, &Rules{Deny: []string{"203.0.113.0/24", "country:us", "isp:example telecom", "2001:db8::1"}})
+	require.Eventually(t, func() bool {
+		return !f.Allow(net.ParseIP("203.0.113.5"))
+	}, 5*time.Second, 10*time.Millisecond, "rules should be reloaded")
+	assert.False(t, f.Allow(net.ParseIP("192.0.2.2")), "denied country")
+	assert.False(t, f.Allow(net.ParseIP("198.51.100.1")), "denied ISP")
+	assert.False(t, f.Allow(net.ParseIP("2001:db8::1")), "denied IP")
+	assert.True(t, f.Allow(net.ParseIP("192.0.2.1")))
+
+	require.NoError(t, f.SetRules(&Rules{Allow: []string{"country:IR", "203.0.113.0/24"}, Deny: []string{"203.0.113.5"}}))
+	assert.True(t, f.Allow(net.ParseIP("192.0.2.1")), "allowed country")
+	assert.True(t, f.Allow(net.ParseIP("203.0.113.6")), "allowed CIDR")
+	assert.False(t, f.Allow(net.ParseIP("203.0.113.5")), "deny should win over allow")
+	assert.False(t, f.Allow(net.ParseIP("192.0.2.2")), "only allowed clients should be allowed")
+
+	assert.Error(t, f.SetRules(&Rules{Deny: []string{"country:IRN"}}))
+	assert.Error(t, f.SetRules(&Rules{Allow: []string{"not an entry"}}))
+	assert.True(t, f.Allow(net.ParseIP("192.0.2.1")), "invalid rules shouldn't be applied")
+
+	invalidPath := filepath.Join(t.TempDir(), "invalid.json")
+	require.NoError(t, os.WriteFile(invalidPath, []byte("{"), 0600))
+	_, err = New(invalidPath, nil, nil, 0)
+	assert.Error(t, err)
+}
+
+func TestFilterFileChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeRules(t, path, &Rules{Deny: []string{"203.0.113.0/24"}})
+	f, err := New(path, nil, nil, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.False(t, f.Allow(net.ParseIP("203.0.113.5")))
+
+	require.NoError(t, os.Remove(path))
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, f.Allow(net.ParseIP("203.0.113.5")), "rules should stay in effect when the file is removed")
+
+	writeRules(t, path, &Rules{Deny: []string{"198.51.100.0/24"}})
+	require.Eventually(t, func() bool {
+		return f.Allow(net.ParseIP("203.0.113.5"))
+	}, 5*time.Second, 10*time.Millisecond, "rules should be reloaded once the file is back")
+	assert.False(t, f.Allow(net.ParseIP("198.51.100.1")))
+
+	f.Close()
+	f.Close()
+	writeRules(t, path, &Rules{Deny: []string{"203.0.113.0/24"}})
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, f.Allow(net.ParseIP("203.0.113.5")), "file shouldn't be checked anymore once closed")
+}
+
+func TestListener(t *testing.T) {
+	f, err := New(filepath.Join(t.TempDir(), "rules.json"), nil, nil, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, f.SetRules(&Rules{Deny: []string{"127.0.0.1"}}))
+
+	cover := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("cover site"))
+	}))
+	defer cover.Close()
+
+	request := func(t *testing.T, reaction Reaction) string {
+		base, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		l := NewListener(base, f, reaction)
+		defer l.Close()
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				conn.Write([]byte("accepted"))
+				conn.Close()
+			}
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, _ := io.ReadAll(conn)
+		return string(b)
+	}
+
+	assert.Empty(t, request(t, Close))
+	assert.True(t, strings.HasPrefix(request(t, Mimic), "HTTP/1.1 200 OK"), "should respond like Apache")
+	reaction, err := ParseReaction("reflect:" + cover.Listener.Addr().String())
+	require.NoError(t, err)
+	assert.Contains(t, request(t, reaction), "cover site")
+
+	require.NoError(t, f.SetRules(&Rules{}))
+	assert.Equal(t, "accepted", request(t, Close))
+
+	_, err = ParseReaction("reflect:nowhere")
+	assert.Error(t, err)
+	_, err = ParseReaction("ignore")
+	assert.Error(t, err)
+}
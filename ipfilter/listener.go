@@ -0,0 +1,130 @@
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/getlantern/netx"
+
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+	"github.com/getlantern/http-proxy-lantern/v2/mimic"
+)
+
+const (
+	mimicReadTimeout   = 10 * time.Second
+	reflectDialTimeout = 10 * time.Second
+)
+
+// Reaction determines what happens to connections from rejected clients.
+type Reaction struct {
+	action string
+	handle func(net.Conn)
+}
+
+// Action returns the name of the action taken.
+func (r Reaction) Action() string {
+	return r.action
+}
+
+var (
+	// Close simply closes the connection.
+	Close = Reaction{
+		action: "close",
+		handle: func(conn net.Conn) {
+			conn.Close()
+		},
+	}
+
+	// Mimic reads an HTTP request from the connection and responds to it like
+	// the configured web server personality would, see mimic.Mimic. Anything
+	// that isn't an HTTP request gets a 400 Bad Request.
+	Mimic = Reaction{
+		action: "mimic",
+		handle: func(conn net.Conn) {
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(mimicReadTimeout))
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				// a request without a Host is answered with 400 Bad Request
+				req = &http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/"}}
+			}
+			mimic.Mimic(conn, req)
+		},
+	}
+
+	// ReflectTo copies everything between the connection and the TCP server at
+	// addr, so that the proxy looks like that server to rejected clients.
+	ReflectTo = func(addr string) Reaction {
+		return Reaction{
+			action: "reflect:" + addr,
+			handle: func(conn net.Conn) {
+				defer conn.Close()
+				upstream, err := net.DialTimeout("tcp", addr, reflectDialTimeout)
+				if err != nil {
+					log.Debugf("Unable to dial %v to reflect %v: %v", addr, conn.RemoteAddr(), err)
+					return
+				}
+				defer upstream.Close()
+				bufOut := make([]byte, 32*1024)
+				bufIn := make([]byte, 32*1024)
+				_, _ = netx.BidiCopy(conn, upstream, bufOut, bufIn)
+			},
+		}
+	}
+)
+
+// ParseReaction parses a Reaction from its action, which is one of "close",
+// "mimic" or "reflect:<host:port>".
+func ParseReaction(action string) (Reaction, error) {
+	switch {
+	case action == Close.action:
+		return Close, nil
+	case action == Mimic.action:
+		return Mimic, nil
+	case strings.HasPrefix(action, "reflect:"):
+		addr := strings.TrimPrefix(action, "reflect:")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return Reaction{}, fmt.Errorf("invalid address to reflect to %v: %v", addr, err)
+		}
+		return ReflectTo(addr), nil
+	default:
+		return Reaction{}, fmt.Errorf("unknown reaction %v", action)
+	}
+}
+
+type filteringListener struct {
+	net.Listener
+	filter   *Filter
+	reaction Reaction
+}
+
+// NewListener wraps a net.Listener so that it only returns connections from
+// clients allowed by the filter. Connections from other clients are handed to
+// the reaction in the background.
+func NewListener(l net.Listener, filter *Filter, reaction Reaction) net.Listener {
+	return &filteringListener{Listener: l, filter: filter, reaction: reaction}
+}
+
+func (l *filteringListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || l.filter.Allow(tcpAddr.IP) {
+			return conn, nil
+		}
+		log.Debugf("Rejecting connection from %v with %v", tcpAddr, l.reaction.action)
+		go l.reaction.handle(conn)
+	}
+}
+
+func (l *filteringListener) Drain() error {
+	return listeners.Drain(l.Listener)
+}
@@ -44,6 +44,10 @@ func (l *allowingListener) Close() error {
 	return l.wrapped.Close()
 }
 
+func (l *allowingListener) Drain() error {
+	return Drain(l.wrapped)
+}
+
 func (l *allowingListener) Addr() net.Addr {
 	return l.wrapped.Addr()
 }
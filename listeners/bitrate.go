@@ -3,6 +3,8 @@ package listeners
 import (
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/ratelimit"
@@ -17,6 +19,8 @@ type RateLimiter struct {
 	w         *ratelimit.Bucket
 	rateRead  int64
 	rateWrite int64
+	// conns is the number of open connections limited by this limiter
+	conns int64
 }
 
 func NewRateLimiter(rateRead, rateWrite int64) *RateLimiter {
@@ -41,6 +45,19 @@ func (l *RateLimiter) GetRateWrite() int64 {
 	return l.rateWrite
 }
 
+// InUse reports whether any open connection is limited by this limiter.
+func (l *RateLimiter) InUse() bool {
+	return atomic.LoadInt64(&l.conns) > 0
+}
+
+func (l *RateLimiter) acquire() {
+	atomic.AddInt64(&l.conns, 1)
+}
+
+func (l *RateLimiter) release() {
+	atomic.AddInt64(&l.conns, -1)
+}
+
 func (l *RateLimiter) waitRead(n int) {
 	d := l.wait(l.r, n)
 	if d > 0 {
@@ -83,10 +100,12 @@ func (bl *bitrateListener) Accept() (net.Conn, error) {
 	}
 
 	wc, _ := c.(WrapConnEmbeddable)
+	limiter := NewRateLimiter(0, 0)
+	limiter.acquire()
 	return &bitrateConn{
 		WrapConnEmbeddable: wc,
 		Conn:               c,
-		limiter:            NewRateLimiter(0, 0),
+		limiter:            limiter,
 	}, err
 }
 
@@ -94,7 +113,9 @@ func (bl *bitrateListener) Accept() (net.Conn, error) {
 type bitrateConn struct {
 	WrapConnEmbeddable
 	net.Conn
-	limiter *RateLimiter
+	limiter   *RateLimiter
+	closed    bool
+	limiterMx sync.Mutex
 }
 
 func (c *bitrateConn) Read(p []byte) (n int, err error) {
@@ -121,6 +142,28 @@ func (c *bitrateConn) Write(p []byte) (n int, err error) {
 	return
 }
 
+// Close releases the limiter, so that it's no longer in use by this
+// connection.
+func (c *bitrateConn) Close() error {
+	c.limiterMx.Lock()
+	if !c.closed {
+		c.closed = true
+		c.limiter.release()
+	}
+	c.limiterMx.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *bitrateConn) setLimiter(limiter *RateLimiter) {
+	c.limiterMx.Lock()
+	defer c.limiterMx.Unlock()
+	if !c.closed {
+		limiter.acquire()
+		c.limiter.release()
+	}
+	c.limiter = limiter
+}
+
 func (c *bitrateConn) OnState(s http.ConnState) {
 	// Pass down to wrapped connections
 	if c.WrapConnEmbeddable != nil {
@@ -131,7 +174,7 @@ func (c *bitrateConn) OnState(s http.ConnState) {
 func (c *bitrateConn) ControlMessage(msgType string, data interface{}) {
 	// per user message always overrides the active flag
 	if msgType == "throttle" {
-		c.limiter = data.(*RateLimiter)
+		c.setLimiter(data.(*RateLimiter))
 	}
 
 	if c.WrapConnEmbeddable != nil {
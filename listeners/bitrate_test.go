@@ -89,6 +89,45 @@ Done:
 	assert.True(t, 2*bitrateLimit > totalRead && totalRead > bitrateLimit, "Read an unexpected number of bytes (%d)! Rate limiting is not working", totalRead)
 }
 
+func TestLimiterInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	bl := NewBitrateListener(ln)
+	defer bl.Close()
+	accept := func() net.Conn {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(func() { client.Close() })
+		conn, err := bl.Accept()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return conn
+	}
+
+	limiter := NewRateLimiter(bitrateLimit, bitrateLimit)
+	other := NewRateLimiter(bitrateLimit, bitrateLimit)
+	assert.False(t, limiter.InUse())
+	conn1, conn2 := accept(), accept()
+	conn1.(WrapConn).ControlMessage("throttle", limiter)
+	conn2.(WrapConn).ControlMessage("throttle", limiter)
+	assert.True(t, limiter.InUse())
+
+	conn1.(WrapConn).ControlMessage("throttle", other)
+	assert.True(t, limiter.InUse(), "limiter should still be used by the other connection")
+	conn2.Close()
+	conn2.Close()
+	assert.False(t, limiter.InUse(), "limiter shouldn't be in use once connections are closed or use other limiters")
+	conn2.(WrapConn).ControlMessage("throttle", other)
+	assert.True(t, other.InUse())
+	conn1.Close()
+	assert.False(t, other.InUse(), "closed connections shouldn't keep limiters in use")
+}
+
 var onceStd, onceInThr, onceThr sync.Once
 var benchBuf []byte
 
@@ -0,0 +1,91 @@
+package listeners
+
+import (
+	"net"
+	"sync"
+)
+
+// Drainable is implemented by listeners that need to do more than just Close
+// in order to stop accepting new connections without disrupting the
+// connections they've already accepted.
+type Drainable interface {
+	// Drain stops accepting new connections. The listener still needs to be
+	// closed once its existing connections are done.
+	Drain() error
+}
+
+// Drain stops the given listener from accepting new connections, leaving the
+// connections it already accepted open. Listeners that aren't Drainable are
+// simply closed.
+func Drain(l net.Listener) error {
+	if d, ok := l.(Drainable); ok {
+		return d.Drain()
+	}
+	return l.Close()
+}
+
+// NewDrainableListener wraps the given listener so that it's drained with the
+// given function.
+func NewDrainableListener(l net.Listener, drain func() error) net.Listener {
+	return &drainableListener{l, drain}
+}
+
+type drainableListener struct {
+	net.Listener
+	drain func() error
+}
+
+func (l *drainableListener) Drain() error {
+	return l.drain()
+}
+
+// NewDrainableMultiplexListener builds a multiplexing listener on top of base
+// using mux and makes it drainable. Multiplexing listeners like cmux close all
+// of their sessions as soon as accepting from the underlying listener fails,
+// so draining closes base without letting the multiplexing listener know until
+// it's closed for real.
+func NewDrainableMultiplexListener(base net.Listener, mux func(net.Listener) net.Listener) net.Listener {
+	dl := &drainingBaseListener{
+		Listener: base,
+		drained:  make(chan interface{}),
+		closed:   make(chan interface{}),
+	}
+	return NewDrainableListener(mux(dl), dl.Drain)
+}
+
+type drainingBaseListener struct {
+	net.Listener
+	drained   chan interface{}
+	drainOnce sync.Once
+	closed    chan interface{}
+	closeOnce sync.Once
+}
+
+func (l *drainingBaseListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.drained:
+			// hold off reporting the error until the listener is actually closed
+			<-l.closed
+		default:
+		}
+	}
+	return conn, err
+}
+
+func (l *drainingBaseListener) Drain() error {
+	var err error
+	l.drainOnce.Do(func() {
+		close(l.drained)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+func (l *drainingBaseListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Drain()
+}
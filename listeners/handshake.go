@@ -0,0 +1,135 @@
+package listeners
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/netx"
+)
+
+const (
+	// HandshakeTimeout is how long clients have to complete their handshake.
+	HandshakeTimeout = 10 * time.Second
+
+	fallbackDialTimeout = 10 * time.Second
+)
+
+// HandshakeFunc authenticates a client connection, returning the connection
+// over which to exchange application data.
+type HandshakeFunc func(conn net.Conn) (net.Conn, error)
+
+type handshakingListener struct {
+	net.Listener
+	handshake    HandshakeFunc
+	fallbackAddr string
+	conns        chan net.Conn
+	done         chan struct{}
+	err          error
+	closeOnce    sync.Once
+}
+
+// NewHandshakingListener returns a net.Listener that performs the handshake on each
+// connection accepted from base in the background and returns the connections
+// that complete it. Connections that fail the handshake are handed off to the
+// TCP server at fallbackAddr, along with everything they sent so far, so that
+// the listener looks like that server to probes. They're simply closed if
+// fallbackAddr is empty.
+func NewHandshakingListener(base net.Listener, handshake HandshakeFunc, fallbackAddr string) net.Listener {
+	l := &handshakingListener{
+		Listener:     base,
+		handshake:    handshake,
+		fallbackAddr: fallbackAddr,
+		conns:        make(chan net.Conn),
+		done:         make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *handshakingListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			l.err = err
+			l.closeOnce.Do(func() { close(l.done) })
+			return
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *handshakingListener) handle(conn net.Conn) {
+	rc := &recordingConn{Conn: conn, recording: l.fallbackAddr != ""}
+	_ = conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	inner, err := l.handshake(rc)
+	if err != nil {
+		log.Debugf("Handshake with %v failed: %v", conn.RemoteAddr(), err)
+		if l.fallbackAddr == "" {
+			conn.Close()
+			return
+		}
+		_ = conn.SetDeadline(time.Time{})
+		fallback(conn, rc.recorded, l.fallbackAddr)
+		return
+	}
+	rc.recording = false
+	rc.recorded = nil
+	_ = conn.SetDeadline(time.Time{})
+	select {
+	case l.conns <- inner:
+	case <-l.done:
+		inner.Close()
+	}
+}
+
+// Accept returns the next connection that completed the handshake.
+func (l *handshakingListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// fallback copies data between conn and the server at addr, starting with
+// what was already read from conn.
+func fallback(conn net.Conn, recorded []byte, addr string) {
+	defer conn.Close()
+	upstream, err := net.DialTimeout("tcp", addr, fallbackDialTimeout)
+	if err != nil {
+		log.Debugf("Unable to dial fallback %v: %v", addr, err)
+		return
+	}
+	defer upstream.Close()
+	if _, err := upstream.Write(recorded); err != nil {
+		return
+	}
+	bufOut := make([]byte, 32*1024)
+	bufIn := make([]byte, 32*1024)
+	_, _ = netx.BidiCopy(conn, upstream, bufOut, bufIn)
+}
+
+// recordingConn records what's read from the wrapped connection during the
+// handshake so that it can be replayed to the fallback.
+type recordingConn struct {
+	net.Conn
+	recording bool
+	recorded  []byte
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.recording && n > 0 {
+		c.recorded = append(c.recorded, b[:n]...)
+	}
+	return n, err
+}
+
+func (c *recordingConn) Wrapped() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,256 @@
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	proxyProtocolV1MaxLength = 107
+
+	proxyProtocolV2CommandLocal = 0
+	proxyProtocolV2CommandProxy = 1
+	proxyProtocolV2FamilyTCP4   = 0x11
+	proxyProtocolV2FamilyTCP6   = 0x21
+)
+
+var (
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// NewProxyProtocolListener wraps a listener whose connections come through
+// load balancers that send a HAProxy PROXY protocol (v1 or v2) header ahead of
+// the client's data. Connections from the given trusted sources, which are IPs
+// or CIDRs, have to start with a header, and report the client address from it
+// as their RemoteAddr. Connections from any other source are passed through
+// unchanged, so that they can't spoof their address. This has to wrap the
+// listener before anything else that looks at the remote address.
+func NewProxyProtocolListener(base net.Listener, trustedSources []string) (net.Listener, error) {
+	trusted, err := parseTrustedSources(trustedSources)
+	if err != nil {
+		return nil, err
+	}
+	return NewHandshakingListener(base, func(conn net.Conn) (net.Conn, error) {
+		if !isTrusted(trusted, conn.RemoteAddr()) {
+			return conn, nil
+		}
+		br := bufio.NewReader(conn)
+		remoteAddr, localAddr, err := readProxyProtocolHeader(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol header: %w", err)
+		}
+		if remoteAddr == nil {
+			remoteAddr, localAddr = conn.RemoteAddr(), conn.LocalAddr()
+		}
+		return &proxyProtocolConn{Conn: conn, r: br, remoteAddr: remoteAddr, localAddr: localAddr}, nil
+	}, ""), nil
+}
+
+func parseTrustedSources(sources []string) ([]*net.IPNet, error) {
+	var trusted []*net.IPNet
+	for _, source := range sources {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted source %v", source)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted source %v: %w", source, err)
+		}
+		trusted = append(trusted, ipNet)
+	}
+	if len(trusted) == 0 {
+		return nil, errors.New("at least one trusted source is required")
+	}
+	return trusted, nil
+}
+
+func isTrusted(trusted []*net.IPNet, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyProtocolHeader reads a PROXY protocol header of either version,
+// returning the addresses of the client and of the server it connected to.
+// Both are nil if the header doesn't carry the client's address, like for
+// health checks from the load balancer itself.
+func readProxyProtocolHeader(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	// v1 headers are at least as long as the v2 signature
+	start, err := br.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(start, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(br)
+	}
+	if bytes.HasPrefix(start, proxyProtocolV1Prefix) {
+		return readProxyProtocolV1(br)
+	}
+	return nil, nil, errors.New("missing header")
+}
+
+// readProxyProtocolV1 reads a human-readable header like:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readProxyProtocolV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, nil, errors.New("v1 header too long")
+		}
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	src, err := parseTCPAddr(parts[2], parts[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseTCPAddr(parts[3], parts[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseTCPAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %v", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %v", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyProtocolV2 reads a binary header, which consists of the signature,
+// the version and command, the address family and protocol, the length of the
+// rest of the header and finally the addresses followed by optional TLVs,
+// which are ignored.
+func readProxyProtocolV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, nil, err
+	}
+	versionCommand := header[len(proxyProtocolV2Signature)]
+	family := header[len(proxyProtocolV2Signature)+1]
+	length := binary.BigEndian.Uint16(header[len(proxyProtocolV2Signature)+2:])
+	if versionCommand>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+	rest := make([]byte, length)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, nil, err
+	}
+
+	switch versionCommand & 0x0f {
+	case proxyProtocolV2CommandLocal:
+		return nil, nil, nil
+	case proxyProtocolV2CommandProxy:
+	default:
+		return nil, nil, fmt.Errorf("unsupported command %d", versionCommand&0x0f)
+	}
+
+	var ipLen int
+	switch family {
+	case proxyProtocolV2FamilyTCP4:
+		ipLen = net.IPv4len
+	case proxyProtocolV2FamilyTCP6:
+		ipLen = net.IPv6len
+	default:
+		// other families and protocols don't have an address we can use
+		return nil, nil, nil
+	}
+	if len(rest) < 2*ipLen+4 {
+		return nil, nil, errors.New("v2 header too short for its addresses")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(rest[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(rest[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(rest[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(rest[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
+
+// proxyProtocolConn reports the addresses from the PROXY protocol header. It
+// exposes the raw connection of the wrapped *net.TCPConn so that options like
+// the diffserv TOS can still be set on it.
+type proxyProtocolConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *proxyProtocolConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errors.New("not a syscall.Conn")
+}
+
+func (c *proxyProtocolConn) SetLinger(sec int) error {
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		return tc.SetLinger(sec)
+	}
+	return errors.New("not a *net.TCPConn")
+}
+
+func (c *proxyProtocolConn) Wrapped() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,123 @@
+package listeners
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyProtocolListener(t *testing.T) {
+	v2Header := func(command byte, src, dst *net.TCPAddr) []byte {
+		b := append([]byte{}, proxyProtocolV2Signature...)
+		b = append(b, 0x20|command, proxyProtocolV2FamilyTCP4, 0, 12)
+		b = append(b, src.IP.To4()...)
+		b = append(b, dst.IP.To4()...)
+		b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+		return binary.BigEndian.AppendUint16(b, uint16(dst.Port))
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	server := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	// accept sends the given data over a new connection to l and returns the
+	// accepted connection, or nil if it isn't accepted.
+	accept := func(t *testing.T, l net.Listener, data []byte) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write(data)
+		require.NoError(t, err)
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, err := l.Accept()
+			if err == nil {
+				accepted <- c
+			}
+		}()
+		select {
+		case c := <-accepted:
+			t.Cleanup(func() { c.Close() })
+			return c
+		case <-time.After(250 * time.Millisecond):
+			return nil
+		}
+	}
+	readAll := func(t *testing.T, conn net.Conn, n int) string {
+		b := make([]byte, n)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.ReadFull(conn, b)
+		require.NoError(t, err)
+		return string(b)
+	}
+	listen := func(t *testing.T, trustedSources ...string) net.Listener {
+		base, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		l, err := NewProxyProtocolListener(base, trustedSources)
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		return l
+	}
+
+	t.Run("v1", func(t *testing.T) {
+		l := listen(t, "127.0.0.1")
+		conn := accept(t, l, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello"))
+		require.NotNil(t, conn)
+		assert.Equal(t, client.String(), conn.RemoteAddr().String())
+		assert.Equal(t, server.String(), conn.LocalAddr().String())
+		assert.Equal(t, "hello", readAll(t, conn, 5))
+	})
+
+	t.Run("v1 unknown", func(t *testing.T) {
+		l := listen(t, "127.0.0.0/8")
+		conn := accept(t, l, []byte("PROXY UNKNOWN\r\nhello"))
+		require.NotNil(t, conn)
+		assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+		assert.Equal(t, "hello", readAll(t, conn, 5))
+	})
+
+	t.Run("v2", func(t *testing.T) {
+		l := listen(t, "127.0.0.0/8")
+		conn := accept(t, l, append(v2Header(proxyProtocolV2CommandProxy, client, server), "hello"...))
+		require.NotNil(t, conn)
+		assert.Equal(t, client.String(), conn.RemoteAddr().String())
+		assert.Equal(t, server.String(), conn.LocalAddr().String())
+		assert.Equal(t, "hello", readAll(t, conn, 5))
+	})
+
+	t.Run("v2 local", func(t *testing.T) {
+		l := listen(t, "127.0.0.0/8")
+		conn := accept(t, l, append(v2Header(proxyProtocolV2CommandLocal, client, server), "hello"...))
+		require.NotNil(t, conn)
+		assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+		assert.Equal(t, "hello", readAll(t, conn, 5))
+	})
+
+	t.Run("missing header from trusted source", func(t *testing.T) {
+		l := listen(t, "127.0.0.1")
+		assert.Nil(t, accept(t, l, []byte("GET / HTTP/1.1\r\n\r\n")))
+	})
+
+	t.Run("untrusted source", func(t *testing.T) {
+		l := listen(t, "10.0.0.0/8")
+		data := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+		conn := accept(t, l, []byte(data))
+		require.NotNil(t, conn)
+		assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String(), "untrusted source shouldn't be able to spoof its address")
+		assert.Equal(t, data, readAll(t, conn, len(data)))
+	})
+
+	t.Run("invalid trusted source", func(t *testing.T) {
+		base, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer base.Close()
+		_, err = NewProxyProtocolListener(base, []string{"not an ip"})
+		assert.Error(t, err)
+		_, err = NewProxyProtocolListener(base, nil)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,296 @@
+// Package localusage keeps track of device data usage on the local disk, which
+// allows a single proxy to enforce data caps without a reporting Redis.
+package localusage
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/geo"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/measured"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+	"github.com/getlantern/http-proxy-lantern/v2/usage"
+)
+
+var log = golog.LoggerFor("localusage")
+
+// dropLogInterval is how often dropped usage is logged at most
+const dropLogInterval = 1 * time.Minute
+
+// device is the usage recorded for a single device, equivalent to the
+// _client:<deviceID> hash in the reporting Redis.
+type device struct {
+	BytesIn     int64  `json:"bytesIn"`
+	BytesOut    int64  `json:"bytesOut"`
+	CountryCode string `json:"countryCode"`
+	ClientIP    string `json:"clientIP"`
+	ExpiresAt   int64  `json:"expiresAt"`
+}
+
+func (d *device) expired(now time.Time) bool {
+	return d.ExpiresAt > 0 && now.Unix() > d.ExpiresAt
+}
+
+func (d *device) ttlSeconds(now time.Time) int64 {
+	if d.ExpiresAt <= 0 {
+		return 0
+	}
+	return d.ExpiresAt - now.Unix()
+}
+
+type statsAndContext struct {
+	ctx   map[string]interface{}
+	stats *measured.Stats
+}
+
+// Store keeps device usage in memory and periodically saves it to a file. It
+// does for a single proxy what redis.DeviceFetcher and
+// redis.NewMeasuredReporter do for all proxies sharing a reporting Redis.
+type Store struct {
+	path           string
+	countryLookup  geo.CountryLookup
+	throttleConfig throttle.Config
+	instrument     instrument.Instrument
+	devices        map[string]*device
+	mx             sync.Mutex
+	statsCh        chan *statsAndContext
+	stopCh         chan interface{}
+	stoppedCh      chan interface{}
+	stop           sync.Once
+	// dropped usage not logged yet and when it was last logged, in unix nanos
+	droppedBytes   int64
+	lastDropLogged int64
+}
+
+// Open opens the Store saved at path, creating it if necessary. Usage reported
+// to the Store is applied and saved every reportInterval. throttleConfig may be
+// nil, in which case only devices with forced throttle settings are tracked.
+// Usage that can't be recorded is counted with ins.
+func Open(path string, countryLookup geo.CountryLookup, throttleConfig throttle.Config, ins instrument.Instrument, reportInterval time.Duration) (*Store, error) {
+	s := &Store{
+		path:           path,
+		countryLookup:  countryLookup,
+		throttleConfig: throttleConfig,
+		instrument:     ins,
+		devices:        make(map[string]*device),
+		// Provide some buffering so that we don't lose data while saving
+		statsCh:   make(chan *statsAndContext, 10000),
+		stopCh:    make(chan interface{}),
+		stoppedCh: make(chan interface{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.reportPeriodically(reportInterval)
+	return s, nil
+}
+
+func (s *Store) load() error {
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		log.Debugf("No usage saved at %v yet", s.path)
+		return nil
+	}
+	if err != nil {
+		return errors.New("unable to read usage from %v: %v", s.path, err)
+	}
+	if err := json.Unmarshal(b, &s.devices); err != nil {
+		return errors.New("unable to parse usage in %v: %v", s.path, err)
+	}
+	log.Debugf("Loaded usage for %d devices from %v", len(s.devices), s.path)
+	return nil
+}
+
+// RequestNewDeviceUsage looks up the usage for the given device and stores it
+// in the usage package.
+func (s *Store) RequestNewDeviceUsage(deviceID string) {
+	now := time.Now()
+	s.mx.Lock()
+	d, found := s.devices[deviceID]
+	if found && d.expired(now) {
+		delete(s.devices, deviceID)
+		found = false
+	}
+	if !found {
+		s.mx.Unlock()
+		// no usage so far
+		usage.Set(deviceID, "", 0, now, 0)
+		return
+	}
+	countryCode, bytes, ttlSeconds := d.CountryCode, d.BytesIn+d.BytesOut, d.ttlSeconds(now)
+	s.mx.Unlock()
+	usage.Set(deviceID, countryCode, bytes, now, ttlSeconds)
+}
+
+// NewMeasuredReporter returns a listeners.MeasuredReportFN that records usage
+// in this Store.
+func (s *Store) NewMeasuredReporter() listeners.MeasuredReportFN {
+	return func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+		select {
+		case s.statsCh <- &statsAndContext{ctx, deltaStats}:
+			// submitted successfully
+		default:
+			// data lost, probably because saving is taking longer than expected
+			s.dropped(deltaStats.SentTotal + deltaStats.RecvTotal)
+		}
+	}
+}
+
+// dropped records usage that was reported but couldn't be recorded, logging it
+// at most every dropLogInterval.
+func (s *Store) dropped(bytes int) {
+	s.instrument.UsageReportsDropped(context.Background(), bytes, "queue_full")
+	atomic.AddInt64(&s.droppedBytes, int64(bytes))
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.lastDropLogged)
+	if now-last < int64(dropLogInterval) || !atomic.CompareAndSwapInt64(&s.lastDropLogged, last, now) {
+		return
+	}
+	// usage dropped after the swap is logged next time
+	log.Errorf("Dropped %d bytes of usage because saving is falling behind", atomic.SwapInt64(&s.droppedBytes, 0))
+}
+
+// Close stops recording usage, saving any usage that's been reported so far.
+func (s *Store) Close() error {
+	s.stop.Do(func() {
+		close(s.stopCh)
+	})
+	<-s.stoppedCh
+	return s.save()
+}
+
+func (s *Store) reportPeriodically(reportInterval time.Duration) {
+	defer close(s.stoppedCh)
+
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+	statsByDeviceID := make(map[string]*statsAndContext)
+	add := func(sac *statsAndContext) {
+		deviceID, _ := sac.ctx[common.DeviceID].(string)
+		if deviceID == "" {
+			// ignore
+			return
+		}
+		stats := *sac.stats
+		if existing := statsByDeviceID[deviceID]; existing != nil {
+			stats.SentTotal += existing.stats.SentTotal
+			stats.RecvTotal += existing.stats.RecvTotal
+		}
+		statsByDeviceID[deviceID] = &statsAndContext{sac.ctx, &stats}
+	}
+	apply := func() {
+		s.apply(statsByDeviceID)
+		statsByDeviceID = make(map[string]*statsAndContext)
+	}
+	for {
+		select {
+		case sac := <-s.statsCh:
+			add(sac)
+		case <-ticker.C:
+			if len(statsByDeviceID) == 0 {
+				continue
+			}
+			apply()
+			if err := s.save(); err != nil {
+				log.Error(err)
+			}
+		case <-s.stopCh:
+			// pick up whatever was reported before stopping
+			for {
+				select {
+				case sac := <-s.statsCh:
+					add(sac)
+				default:
+					apply()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Store) apply(statsByDeviceID map[string]*statsAndContext) {
+	for deviceID, sac := range statsByDeviceID {
+		now := time.Now()
+
+		clientIP, _ := sac.ctx[common.ClientIP].(string)
+		if clientIP == "" {
+			log.Error("Missing client_ip in context, this shouldn't happen. Ignoring.")
+			continue
+		}
+		countryCode := s.countryLookup.CountryCode(net.ParseIP(clientIP))
+		platform, _ := sac.ctx[common.Platform].(string)
+		appName, _ := sac.ctx[common.App].(string)
+		supportedDataCaps, _ := sac.ctx[common.SupportedDataCaps].([]string)
+		throttleSettings, _ := sac.ctx[common.ForcedThrottleSettings].(*throttle.Settings)
+		if throttleSettings == nil && s.throttleConfig != nil {
+			throttleSettings, _ = s.throttleConfig.SettingsFor(deviceID, countryCode, platform, appName, supportedDataCaps)
+		}
+		if throttleSettings == nil {
+			// uncapped, no need to track usage
+			continue
+		}
+		timeZone, _ := sac.ctx[common.TimeZone].(string)
+		if timeZone == "" {
+			// default timeZone to now
+			timeZone = now.Location().String()
+		}
+
+		s.mx.Lock()
+		d := s.devices[deviceID]
+		if d == nil || d.expired(now) {
+			d = &device{}
+			s.devices[deviceID] = d
+		}
+		d.BytesIn += int64(sac.stats.RecvTotal)
+		d.BytesOut += int64(sac.stats.SentTotal)
+		if d.CountryCode == "" {
+			d.CountryCode = strings.ToLower(countryCode)
+			// record the IP on which we based the countryCode for auditing
+			d.ClientIP = clientIP
+			d.ExpiresAt = throttle.ExpirationFor(now, throttleSettings.CapResets, timeZone)
+		}
+		countryCode, bytes, ttlSeconds := d.CountryCode, d.BytesIn+d.BytesOut, d.ttlSeconds(now)
+		s.mx.Unlock()
+
+		usage.Set(deviceID, countryCode, bytes, now, ttlSeconds)
+	}
+}
+
+// save writes the usage of all devices whose usage hasn't reset yet to the
+// file, replacing it atomically.
+func (s *Store) save() error {
+	now := time.Now()
+	s.mx.Lock()
+	for deviceID, d := range s.devices {
+		if d.expired(now) {
+			delete(s.devices, deviceID)
+		}
+	}
+	b, err := json.Marshal(s.devices)
+	s.mx.Unlock()
+	if err != nil {
+		return errors.New("unable to encode usage: %v", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, b, 0600); err != nil {
+		return errors.New("unable to write usage to %v: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.New("unable to save usage to %v: %v", s.path, err)
+	}
+	return nil
+}
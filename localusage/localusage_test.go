@@ -0,0 +1,109 @@
+package localusage
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/measured"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+	"github.com/getlantern/http-proxy-lantern/v2/usage"
+)
+
+type fakeLookup struct{ countryCode string }
+
+func (l *fakeLookup) CountryCode(ip net.IP) string {
+	return l.countryCode
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	deviceID := "localusage-device"
+	throttleConfig := throttle.NewForcedConfig(5000, 500, throttle.Monthly)
+
+	s, err := Open(path, &fakeLookup{"IR"}, throttleConfig, instrument.NoInstrument{}, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	s.RequestNewDeviceUsage(deviceID)
+	u := usage.Get(deviceID)
+	require.NotNil(t, u)
+	assert.EqualValues(t, 0, u.Bytes)
+
+	report := s.NewMeasuredReporter()
+	ctx := map[string]interface{}{common.DeviceID: deviceID, common.ClientIP: "1.1.1.1"}
+	report(ctx, nil, &measured.Stats{RecvTotal: 2, SentTotal: 1}, false)
+	report(ctx, nil, &measured.Stats{RecvTotal: 20, SentTotal: 10}, false)
+	report(map[string]interface{}{common.ClientIP: "1.1.1.1"}, nil, &measured.Stats{RecvTotal: 100}, false)
+
+	require.Eventually(t, func() bool {
+		u := usage.Get(deviceID)
+		return u != nil && u.Bytes == 33
+	}, time.Second, 10*time.Millisecond)
+	u = usage.Get(deviceID)
+	assert.Equal(t, "ir", u.CountryCode)
+	assert.True(t, u.TTLSeconds > 0, "should have set TTL based on the cap interval")
+	expectedTTL := throttle.ExpirationFor(time.Now(), throttle.Monthly, time.Now().Location().String()) - time.Now().Unix()
+	assert.InDelta(t, expectedTTL, u.TTLSeconds, 1)
+
+	report(ctx, nil, &measured.Stats{RecvTotal: 4, SentTotal: 3}, true)
+	require.NoError(t, s.Close())
+
+	// usage should survive reopening
+	s, err = Open(path, &fakeLookup{}, throttleConfig, instrument.NoInstrument{}, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer s.Close()
+	s.RequestNewDeviceUsage(deviceID)
+	u = usage.Get(deviceID)
+	require.NotNil(t, u)
+	assert.EqualValues(t, 40, u.Bytes)
+	assert.Equal(t, "ir", u.CountryCode)
+}
+
+func TestExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	deviceID := "localusage-expired-device"
+	b, err := json.Marshal(map[string]*device{
+		deviceID: {BytesIn: 5000, BytesOut: 5000, CountryCode: "cn", ExpiresAt: time.Now().Add(-1 * time.Minute).Unix()},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b, 0600))
+
+	s, err := Open(path, &fakeLookup{}, throttle.NewForcedConfig(5000, 500, throttle.Daily), instrument.NoInstrument{}, time.Hour)
+	require.NoError(t, err)
+	defer s.Close()
+
+	s.RequestNewDeviceUsage(deviceID)
+	u := usage.Get(deviceID)
+	require.NotNil(t, u)
+	assert.EqualValues(t, 0, u.Bytes, "usage should have reset")
+	assert.Empty(t, u.CountryCode)
+}
+
+type fakeInstrument struct {
+	instrument.NoInstrument
+	dropped map[string]int
+}
+
+func (i *fakeInstrument) UsageReportsDropped(ctx context.Context, bytes int, reason string) {
+	i.dropped[reason] += bytes
+}
+
+func TestDropped(t *testing.T) {
+	ins := &fakeInstrument{dropped: make(map[string]int)}
+	// nothing receives the reports, as if saving were falling behind
+	s := &Store{instrument: ins, statsCh: make(chan *statsAndContext)}
+	report := s.NewMeasuredReporter()
+	ctx := map[string]interface{}{common.DeviceID: "localusage-dropped-device"}
+	report(ctx, nil, &measured.Stats{RecvTotal: 100, SentTotal: 20}, false)
+	report(ctx, nil, &measured.Stats{RecvTotal: 30}, true)
+	assert.Equal(t, 150, ins.dropped["queue_full"])
+}
@@ -1,69 +1,74 @@
-/*
-Package mimic mimics popular web servers to keep the server from being detected
-Currently it only mimics Apache web server.
-*/
-
 package mimic
 
 import (
 	"bytes"
-	"crypto/rand"
 	"fmt"
 	"net"
 	"net/http"
-	"sync"
 	"text/template"
-	"time"
-
-	"github.com/getlantern/golog"
 )
 
+// apache is the personality of an unconfigured Apache 2.4 on Ubuntu.
+type apache struct {
+	name string
+	// server is the Server header and signature
+	server string
+	// allow is the Allow header for the default page
+	allow string
+	// echoURL indicates whether error pages include the request path, which
+	// Apache stopped doing in 2.4.39
+	echoURL bool
+	// index is the default page
+	index []byte
+	// fileETags indicates whether ETags are derived from the size and
+	// modification time of each file, like Apache does, rather than random
+	fileETags bool
+}
+
 var (
-	log = golog.LoggerFor("apache")
+	// legacyApache is Apache 2.4.7 installed by 'apt-get install apache2' on
+	// Ubuntu 14.04.
+	legacyApache = &apache{
+		name:    "apache-2.4.7",
+		server:  "Apache/2.4.7 (Ubuntu)",
+		allow:   "GET,HEAD,POST,OPTIONS",
+		echoURL: true,
+		index:   indexDotHTML,
+	}
+
+	// modernApache is Apache 2.4.58 installed by 'apt-get install apache2' on
+	// Ubuntu 24.04.
+	modernApache = &apache{
+		name:      "apache",
+		server:    "Apache/2.4.58 (Ubuntu)",
+		allow:     "GET,POST,OPTIONS,HEAD",
+		index:     modernIndexDotHTML,
+		fileETags: true,
+	}
 )
 
 type apacheMimic struct {
+	*apache
 	conn net.Conn
 	req  *http.Request
 	path string
 }
 
-const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
-
-var (
-	Host         string
-	Port         string
-	lastModified = time.Now().Format(timeFormat)
-	etag         = makeETag()
-	mutex        = &sync.Mutex{}
-)
-
-func SetServerAddr(addr string) {
-	host, port, err := net.SplitHostPort(addr)
-	if err != nil {
-		panic("should not happen")
-	}
-	mutex.Lock()
-	Host = host
-	Port = port
-	mutex.Unlock()
-}
-
 // Apache mimics the behaviour of an unconfigured Apache web server 2.4.7
-// (the one installed by 'apt-get install apache2') running on Ubuntu 14.04.
+// (the one installed by 'apt-get install apache2') running on Ubuntu 14.04,
+// regardless of the configured Personality.
 // Set 'Host' and 'Port' before calling it.
 func Apache(conn net.Conn, req *http.Request) {
-	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-	log.Tracef("Mimicking apache to client at %v", ip)
-	path := req.URL.Path
-	// remove extra leading slash
-	if len(path) > 0 && path[0] == '/' {
-		i := 1
-		for ; i < len(path) && path[i] == '/'; i++ {
-		}
-		path = path[i-1:]
-	}
-	m := apacheMimic{conn, req, path}
+	legacyApache.Mimic(conn, req)
+}
+
+func (a *apache) Name() string {
+	return a.name
+}
+
+func (a *apache) Mimic(conn net.Conn, req *http.Request) {
+	path := trimLeadingSlashes(req.URL.Path)
+	m := apacheMimic{a, conn, req, path}
 	if req.Host == "" {
 		m.writeError(badRequestHeader, badRequestBody)
 		return
@@ -74,27 +79,27 @@ func Apache(conn net.Conn, req *http.Request) {
 	case "GET", "POST":
 		switch path {
 		case "/", "/index.html":
-			m.ok(indexHeader, indexDotHTML)
+			m.ok(indexHeader, m.index, false)
 		case "/icons/ubuntu-logo.png":
-			m.ok(logoHeader, ubuntuLogo)
+			m.ok(logoHeader, ubuntuLogo, false)
 		default:
 			m.writeError(notFoundHeader, notFoundBody)
 		}
 	case "HEAD":
 		switch path {
 		case "/", "/index.html":
-			m.ok(indexHeader, nil)
+			m.ok(indexHeader, m.index, true)
 		case "/icons/ubuntu-logo.png":
-			m.ok(logoHeader, nil)
+			m.ok(logoHeader, ubuntuLogo, true)
 		default:
 			m.writeError(notFoundHeaderWhenHead, nil)
 		}
 	case "OPTIONS":
 		switch path {
 		case "/", "/index.html":
-			m.ok(optionsHeader, nil)
+			m.ok(optionsHeader, nil, true)
 		case "/icons/ubuntu-logo.png":
-			m.ok(optionsHeaderOfLogo, nil)
+			m.ok(optionsHeaderOfLogo, nil, true)
 		default:
 			m.writeError(optionsHeaderWhenNotFound, nil)
 		}
@@ -115,15 +120,37 @@ func Apache(conn net.Conn, req *http.Request) {
 	}
 }
 
-func (f *apacheMimic) ok(header *template.Template, body []byte) {
+// BadGateway writes the response of mod_proxy when it can't read a response
+// from its backend.
+func (a *apache) BadGateway(conn net.Conn, req *http.Request) {
+	m := apacheMimic{a, conn, req, trimLeadingSlashes(req.URL.Path)}
+	if req.Method == http.MethodHead {
+		m.writeError(badGatewayHeaderWhenHead, nil)
+		return
+	}
+	m.writeError(badGatewayHeader, badGatewayBody)
+}
+
+// ok writes the given file, leaving out the content but not its length if head
+// is true.
+func (f *apacheMimic) ok(header *template.Template, content []byte, head bool) {
 	var buf bytes.Buffer
-	err := header.Execute(&buf, f.collectVars())
+	vars := f.collectVars()
+	vars.ContentLength = len(content)
+	if f.fileETags {
+		// Apache's default ETag is the size and the modification time in
+		// microseconds of the file
+		vars.ETag = fmt.Sprintf("%x-%x", len(content), modTime.UnixMicro())
+	}
+	err := header.Execute(&buf, vars)
 	if err != nil {
 		panic(fmt.Sprintf("execute template err: %s", err))
 	}
+	if !head {
+		buf.Write(content)
+	}
 	// ignore any errors writing back to connection
 	_, _ = buf.WriteTo(f.conn)
-	_, _ = f.conn.Write(body)
 }
 
 func (f *apacheMimic) writeError(header, body *template.Template) {
@@ -148,32 +175,12 @@ func (f *apacheMimic) writeError(header, body *template.Template) {
 	_, _ = bodyBuf.WriteTo(f.conn)
 }
 
-type vars struct {
-	Date, LastModified, ETag, Path, Host, Port string
-	ContentType                                string
-	ContentLength                              int
-}
-
 func (f *apacheMimic) collectVars() *vars {
-	return &vars{
-		Date:         time.Now().Format(timeFormat),
-		LastModified: lastModified,
-		ETag:         etag,
-		Path:         f.path,
-		Host:         Host,
-		Port:         Port,
-	}
-}
-
-func makeETag() string {
-	const alphanum = "0123456789abcdefghijklmnopqrstuvwxyz"
-	bytes := [17]byte{}
-	rand.Read(bytes[:])
-	for i, b := range bytes {
-		bytes[i] = alphanum[b%byte(len(alphanum))]
-	}
-	bytes[4] = '-'
-	return string(bytes[:])
+	v := collectVars(f.req, f.path)
+	v.Server = f.server
+	v.Allow = f.allow
+	v.EchoURL = f.echoURL
+	return v
 }
 
 var KNOWN_URIS = map[string]bool{
@@ -220,32 +227,32 @@ var KNOWN_METHODS = map[string]bool{
 
 var indexHeader = template.Must(template.New("index").Parse("HTTP/1.1 200 OK\r\n" +
 	"Date: {{.Date}}\r\n" +
-	"Server: Apache/2.4.7 (Ubuntu)\r\n" +
+	"Server: {{.Server}}\r\n" +
 	"Last-Modified: {{.LastModified}}\r\n" +
 	"ETag: \"{{.ETag}}\"\r\n" +
 	"Accept-Ranges: bytes\r\n" +
-	"Content-Length: 11510\r\n" +
+	"Content-Length: {{.ContentLength}}\r\n" +
 	"Vary: Accept-Encoding\r\n" +
 	"Content-Type: text/html\r\n\r\n"))
 
 var logoHeader = template.Must(template.New("logo").Parse("HTTP/1.1 200 OK\r\n" +
 	"Date: {{.Date}}\r\n" +
-	"Server: Apache/2.4.7 (Ubuntu)\r\n" +
+	"Server: {{.Server}}\r\n" +
 	"Last-Modified: {{.LastModified}}\r\n" +
 	"ETag: \"{{.ETag}}\"\r\n" +
 	"Accept-Ranges: bytes\r\n" +
-	"Content-Length: 3404\r\n" +
+	"Content-Length: {{.ContentLength}}\r\n" +
 	"Content-Type: image/png\r\n\r\n"))
 
 var notFoundHeader = template.Must(template.New("notFoundHeader").Parse("HTTP/1.1 404 Not Found\r\n" +
 	"Date: {{.Date}}\r\n" +
-	"Server: Apache/2.4.7 (Ubuntu)\r\n" +
+	"Server: {{.Server}}\r\n" +
 	"Content-Length: {{.ContentLength}}\r\n" +
 	"Content-Type: text/html; charset=iso-8859-1\r\n\r\n"))
 
 var notFoundHeaderWhenHead = template.Must(template.New("notFoundHeaderWhenHead").Parse("HTTP/1.1 404 Not Found\r\n" +
 	"Date: {{.Date}}\r\n" +
-	"Server: Apache/2.4.7 (Ubuntu)\r\n" +
+	"Server: {{.Server}}\r\n" +
 	"Content-Type: text/html; charset=iso-8859-1\r\n\r\n"))
 
 var notFoundBody = template.Must(template.New("notFoundBody").Parse(`<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
@@ -253,21 +260,21 @@ var notFoundBody = template.Must(template.New("notFoundBody").Parse(`<!DOCTYPE H
 <title>404 Not Found</title>
 </head><body>
 <h1>Not Found</h1>
-<p>The requested URL {{.Path}} was not found on this server.</p>
+<p>The requested URL {{if .EchoURL}}{{.Path}} {{end}}was not found on this server.</p>
 <hr>
-<address>Apache/2.4.7 (Ubuntu) Server at {{.Host}} Port {{.Port}}</address>
+<address>{{.Server}} Server at {{.Host}} Port {{.Port}}</address>
 </body></html>
 `))
 
 var badRequestHeader = template.Must(template.New("badRequestHeader").Parse("HTTP/1.1 400 Bad Request\r\n" +
 	"Date: {{.Date}}\r\n" +
-	"Server: Apache/2.4.7 (Ubuntu)\r\n" +
+	"Server: {{.Server}}\r\n" +
 	"Content-Length: {{.ContentLength}}\r\n" +
 	"Connection: close\r\n" +
 	"Content-Type: text/html; charset=iso-8859-1\r\n\r\n"))
 var badRequestHeaderWithoutLength = template.Must(template.New("badRequestHeaderWithoutLength").Parse("HTTP/1.1 400 Bad Request\r\n" +
 	"Date: {{.Date}}\r\n" +
-	"Server: Apache/2.4.7 (Ubuntu)\r\n" +
+	"Server: {{.Server}}\r\n" +
 	"Connection: close\r\n" +
 	"Content-Type: text/html; charset=iso-8859-1\r\n\r\n"))
 var badRequestBody = template.Must(template.New("notFound").Parse(
@@ -279,34 +286,34 @@ var badRequestBody = template.Must(template.New("notFound").Parse(
 <p>Your browser sent a request that this server could not understand.<br />
 </p>
 <hr>
-<address>Apache/2.4.7 (Ubuntu) Server at {{.Host}} Port {{.Port}}</address>
+<address>{{.Server}} Server at {{.Host}} Port {{.Port}}</address>
 </body></html>
 `))
 
 var optionsHeader = template.Must(template.New("optionsHeader").Parse("HTTP/1.1 200 OK\r\n" +
 	"Date: {{.Date}}\r\n" +
-	"Server: Apache/2.4.7 (Ubuntu)\r\n" +
-	"Allow: GET,HEAD,POST,OPTIONS\r\n" +
+	"Server: {{.Server}}\r\n" +
+	"Allow: {{.Allow}}\r\n" +
 	"Content-Length: {{.ContentLength}}\r\n" +
 	"Content-Type: text/html\r\n\r\n"))
 
 var optionsHeaderWhenNotFound = template.Must(template.New("optionsHeaderWhenNotFound").Parse("HTTP/1.1 200 OK\r\n" +
 	"Date: {{.Date}}\r\n" +
-	"Server: Apache/2.4.7 (Ubuntu)\r\n" +
-	"Allow: GET,HEAD,POST,OPTIONS\r\n" +
+	"Server: {{.Server}}\r\n" +
+	"Allow: {{.Allow}}\r\n" +
 	"Content-Length: {{.ContentLength}}\r\n\r\n"))
 
 var optionsHeaderOfLogo = template.Must(template.New("optionsHeaderOfLogo").Parse("HTTP/1.1 200 OK\r\n" +
 	"Date: {{.Date}}\r\n" +
-	"Server: Apache/2.4.7 (Ubuntu)\r\n" +
-	"Allow: GET,HEAD,POST,OPTIONS\r\n" +
+	"Server: {{.Server}}\r\n" +
+	"Allow: {{.Allow}}\r\n" +
 	"Content-Length: {{.ContentLength}}\r\n" +
 	"Content-Type: image/png\r\n\r\n"))
 
 var methodNotAllowedHeader = template.Must(template.New("methodNotAllowedHeader").Parse("HTTP/1.1 405 Method Not Allowed\r\n" +
 	"Date: {{.Date}}\r\n" +
-	"Server: Apache/2.4.7 (Ubuntu)\r\n" +
-	"Allow: GET,HEAD,POST,OPTIONS\r\n" +
+	"Server: {{.Server}}\r\n" +
+	"Allow: {{.Allow}}\r\n" +
 	"Content-Length: {{.ContentLength}}\r\n" +
 	"Content-Type: text/html; charset=iso-8859-1\r\n\r\n"))
 
@@ -316,16 +323,16 @@ var methodNotAllowedBody = template.Must(template.New("methodNotAllowed").Parse(
 <title>405 Method Not Allowed</title>
 </head><body>
 <h1>Method Not Allowed</h1>
-<p>The requested method PUT is not allowed for the URL {{.Path}}.</p>
+<p>The requested method {{.Method}} is not allowed for {{if .EchoURL}}the URL {{.Path}}{{else}}this URL{{end}}.</p>
 <hr>
-<address>Apache/2.4.7 (Ubuntu) Server at {{.Host}} Port {{.Port}}</address>
+<address>{{.Server}} Server at {{.Host}} Port {{.Port}}</address>
 </body></html>
 `))
 
 var notImplementedHeader = template.Must(template.New("notImplementedHeader").Parse("HTTP/1.1 501 Not Implemented\r\n" +
 	"Date: {{.Date}}\r\n" +
-	"Server: Apache/2.4.7 (Ubuntu)\r\n" +
-	"Allow: GET,HEAD,POST,OPTIONS\r\n" +
+	"Server: {{.Server}}\r\n" +
+	"Allow: {{.Allow}}\r\n" +
 	"Content-Length: {{.ContentLength}}\r\n" +
 	"Connection: close\r\n" +
 	"Content-Type: text/html; charset=iso-8859-1\r\n\r\n"))
@@ -336,9 +343,34 @@ var notImplementedBody = template.Must(template.New("notImplementedBody").Parse(
 <title>501 Not Implemented</title>
 </head><body>
 <h1>Not Implemented</h1>
-<p>INVALID to {{.Path}} not supported.<br />
+<p>{{.Method}} {{if .EchoURL}}to {{.Path}} not supported{{else}}not supported for current URL{{end}}.<br />
 </p>
 <hr>
-<address>Apache/2.4.7 (Ubuntu) Server at {{.Host}} Port {{.Port}}</address>
+<address>{{.Server}} Server at {{.Host}} Port {{.Port}}</address>
+</body></html>
+`))
+
+var badGatewayHeader = template.Must(template.New("badGatewayHeader").Parse("HTTP/1.1 502 Proxy Error\r\n" +
+	"Date: {{.Date}}\r\n" +
+	"Server: {{.Server}}\r\n" +
+	"Content-Length: {{.ContentLength}}\r\n" +
+	"Content-Type: text/html; charset=iso-8859-1\r\n\r\n"))
+
+var badGatewayHeaderWhenHead = template.Must(template.New("badGatewayHeaderWhenHead").Parse("HTTP/1.1 502 Proxy Error\r\n" +
+	"Date: {{.Date}}\r\n" +
+	"Server: {{.Server}}\r\n" +
+	"Content-Type: text/html; charset=iso-8859-1\r\n\r\n"))
+
+var badGatewayBody = template.Must(template.New("badGatewayBody").Parse(
+	`<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
+<html><head>
+<title>502 Proxy Error</title>
+</head><body>
+<h1>Proxy Error</h1>
+<p>The proxy server received an invalid
+response from an upstream server.<br />
+The proxy server could not handle the request<p>Reason: <strong>Error reading from remote server</strong></p></p>
+<hr>
+<address>{{.Server}} Server at {{.Host}} Port {{.Port}}</address>
 </body></html>
 `))
@@ -0,0 +1,132 @@
+package mimic
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// caddyPersonality is Caddy 2 as installed by 'apt-get install caddy', which
+// runs file_server on /usr/share/caddy. Caddy is built on net/http, so headers
+// set by Caddy come in sorted order followed by the ones net/http adds itself.
+var caddyPersonality = &caddy{name: "caddy"}
+
+type caddy struct {
+	name string
+}
+
+func (c *caddy) Name() string {
+	return c.name
+}
+
+func (c *caddy) Mimic(conn net.Conn, req *http.Request) {
+	head := req.Method == http.MethodHead
+	if req.Host == "" && req.ProtoAtLeast(1, 1) {
+		// net/http rejects these before Caddy sees them
+		body := []byte("400 Bad Request: missing required Host header")
+		newResponse("400 Bad Request").
+			add("Content-Type", "text/plain; charset=utf-8").
+			add("Connection", "close").
+			writeTo(conn, false, body)
+		return
+	}
+	date := time.Now().UTC().Format(timeFormat)
+	path := collapseSlashes(req.URL.Path)
+	if path != "/" && path != "/index.html" {
+		newResponse("404 Not Found").
+			add("Server", "Caddy").
+			add("Date", date).
+			add("Content-Length", "0").
+			writeTo(conn, head, nil)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		newResponse("405 Method Not Allowed").
+			add("Allow", "GET, HEAD").
+			add("Server", "Caddy").
+			add("Date", date).
+			add("Content-Length", "0").
+			writeTo(conn, head, nil)
+		return
+	}
+	if path == "/index.html" {
+		// file_server redirects requests for index files to their directory
+		body := []byte("<a href=\"/\">Permanent Redirect</a>.\n\n")
+		newResponse("308 Permanent Redirect").
+			add("Content-Type", "text/html; charset=utf-8").
+			add("Location", "/").
+			add("Server", "Caddy").
+			add("Date", date).
+			add("Content-Length", strconv.Itoa(len(body))).
+			writeTo(conn, head, body)
+		return
+	}
+	// file_server derives the ETag from the modification time and size of the
+	// file in base 36
+	newResponse("200 OK").
+		add("Accept-Ranges", "bytes").
+		add("Content-Length", strconv.Itoa(len(caddyIndex))).
+		add("Content-Type", "text/html; charset=utf-8").
+		add("Etag", `"`+strconv.FormatInt(modTime.Unix(), 36)+strconv.FormatInt(int64(len(caddyIndex)), 36)+`"`).
+		add("Last-Modified", lastModified).
+		add("Server", "Caddy").
+		add("Date", date).
+		writeTo(conn, head, caddyIndex)
+}
+
+// BadGateway writes the response of reverse_proxy, which only has a status.
+func (c *caddy) BadGateway(conn net.Conn, req *http.Request) {
+	newResponse("502 Bad Gateway").
+		add("Server", "Caddy").
+		add("Date", time.Now().UTC().Format(timeFormat)).
+		add("Content-Length", "0").
+		writeTo(conn, req.Method == http.MethodHead, nil)
+}
+
+var caddyIndex = []byte(`<!DOCTYPE html>
+<html>
+	<head>
+		<title>Caddy works!</title>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1">
+		<style>
+			body {
+				font-family: system-ui, -apple-system, "Segoe UI", Roboto, sans-serif;
+				max-width: 800px;
+				margin: 0 auto;
+				padding: 2em;
+				line-height: 1.5;
+				color: #333;
+			}
+			h1 {
+				font-size: 2em;
+			}
+			code {
+				background: #eee;
+				padding: 0.1em 0.3em;
+				border-radius: 3px;
+			}
+		</style>
+	</head>
+	<body>
+		<h1>Congratulations!</h1>
+		<p>Your web server is working. Now make it work for you. 💪</p>
+		<p>Caddy is ready to serve your site over HTTPS:</p>
+		<ol>
+			<li>Point your domain's A/AAAA DNS records at this machine.</li>
+			<li>Upload your site's files to <code>/var/www/html</code>.</li>
+			<li>Edit your Caddyfile at <code>/etc/caddy/Caddyfile</code>:
+				<ol>
+					<li>Replace <code>:80</code> with your domain name</li>
+					<li>Change the site root to <code>/var/www/html</code></li>
+				</ol>
+			</li>
+			<li>Reload the configuration: <code>systemctl reload caddy</code></li>
+			<li>Visit your site!</li>
+		</ol>
+		<p>If you need help, visit the <a href="https://caddy.community">Caddy community forum</a>.</p>
+		<p>This page is served from <code>/usr/share/caddy/index.html</code>.</p>
+	</body>
+</html>
+`)
@@ -0,0 +1,196 @@
+package mimic
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	// headersFile is the template for the headers of every response of a custom
+	// site.
+	headersFile = "_headers"
+
+	// allowedMethods are the methods a custom site supports.
+	allowedMethods = "GET, HEAD, OPTIONS"
+)
+
+// stripNewlines keeps values from the request from adding lines, and so
+// headers, to the headers template.
+var stripNewlines = strings.NewReplacer("\r", "", "\n", "")
+
+var defaultHeaders = template.Must(template.New(headersFile).Parse("Date: {{.Date}}\n"))
+
+type dir struct {
+	name    string
+	root    fs.FS
+	headers *template.Template
+}
+
+// NewDir creates a Personality that serves the static site in the directory at
+// dirPath. Besides the site's files, the directory may contain:
+//
+//   - _headers: a template for the headers of every response, one "Name: value"
+//     per line, like "Server: lighttpd/1.4.76". Defaults to just a Date.
+//   - _<status>.html: HTML templates for error pages, like _404.html, whose
+//     values are escaped like with html/template. Without one, the error has
+//     an empty body. _502.html is used when the site is a reverse proxy, see
+//     BadGateway.
+//
+// Templates have access to {{.Date}}, {{.LastModified}}, {{.ETag}}, {{.Path}},
+// {{.Host}}, {{.Port}}, {{.Method}} and {{.Status}}. Line breaks are removed
+// from values in the headers template. Files and directories whose names start
+// with _ or . aren't served.
+func NewDir(dirPath string) (Personality, error) {
+	info, err := os.Stat(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat site directory %v: %v", dirPath, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%v is not a directory", dirPath)
+	}
+	d := &dir{name: dirPrefix + dirPath, root: os.DirFS(dirPath), headers: defaultHeaders}
+	headers, err := fs.ReadFile(d.root, headersFile)
+	if err == nil {
+		d.headers, err = template.New(headersFile).Parse(string(headers))
+		if err != nil {
+			return nil, fmt.Errorf("invalid headers template in %v: %v", dirPath, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read headers template in %v: %v", dirPath, err)
+	}
+	return d, nil
+}
+
+func (d *dir) Name() string {
+	return d.name
+}
+
+func (d *dir) Mimic(conn net.Conn, req *http.Request) {
+	head := req.Method == http.MethodHead
+	v := collectVars(req, collapseSlashes(req.URL.Path))
+	if req.Host == "" && req.ProtoAtLeast(1, 1) {
+		d.writeError(conn, v, http.StatusBadRequest, head)
+		return
+	}
+	name := d.resolve(v.Path)
+	if name == "" {
+		d.writeError(conn, v, http.StatusNotFound, head)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		body, err := fs.ReadFile(d.root, name)
+		if err != nil {
+			log.Debugf("Unable to read %v from custom site: %v", name, err)
+			d.writeError(conn, v, http.StatusNotFound, head)
+			return
+		}
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		d.response(v, http.StatusOK).
+			add("Content-Type", contentType).
+			add("Content-Length", strconv.Itoa(len(body))).
+			writeTo(conn, head, body)
+	case http.MethodOptions:
+		d.response(v, http.StatusOK).
+			add("Allow", allowedMethods).
+			add("Content-Length", "0").
+			writeTo(conn, false, nil)
+	default:
+		d.writeError(conn, v, http.StatusMethodNotAllowed, head)
+	}
+}
+
+// BadGateway writes the error page for 502 if the site has one.
+func (d *dir) BadGateway(conn net.Conn, req *http.Request) {
+	d.writeError(conn, collectVars(req, collapseSlashes(req.URL.Path)), http.StatusBadGateway, req.Method == http.MethodHead)
+}
+
+// resolve finds the file to serve for the given URL path, or returns an empty
+// string if there isn't any.
+func (d *dir) resolve(urlPath string) string {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name != "" {
+		for _, part := range strings.Split(name, "/") {
+			if strings.HasPrefix(part, "_") || strings.HasPrefix(part, ".") {
+				return ""
+			}
+		}
+	}
+	if name == "" {
+		name = "."
+	}
+	info, err := fs.Stat(d.root, name)
+	if err != nil {
+		return ""
+	}
+	if info.IsDir() {
+		name = path.Join(name, "index.html")
+		if info, err = fs.Stat(d.root, name); err != nil || info.IsDir() {
+			return ""
+		}
+	}
+	return name
+}
+
+// response starts a response with the templated headers.
+func (d *dir) response(v *vars, status int) *response {
+	v.Status = status
+	r := newResponse(fmt.Sprintf("%d %v", status, http.StatusText(status)))
+	hv := *v
+	for _, value := range []*string{&hv.Path, &hv.Host, &hv.Port, &hv.Method} {
+		*value = stripNewlines.Replace(*value)
+	}
+	var buf bytes.Buffer
+	if err := d.headers.Execute(&buf, &hv); err != nil {
+		log.Errorf("Unable to execute headers template for custom site: %v", err)
+		return r
+	}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if found && key != "" {
+			r.add(key, strings.TrimSpace(value))
+		}
+	}
+	return r
+}
+
+func (d *dir) writeError(conn net.Conn, v *vars, status int, head bool) {
+	r := d.response(v, status)
+	if status == http.StatusMethodNotAllowed {
+		r.add("Allow", allowedMethods)
+	}
+	var body bytes.Buffer
+	page, err := fs.ReadFile(d.root, fmt.Sprintf("_%d.html", status))
+	if err == nil {
+		tmpl, err := htmltemplate.New("error").Parse(string(page))
+		if err == nil {
+			err = tmpl.Execute(&body, v)
+		}
+		if err != nil {
+			log.Errorf("Unable to render error page %d for custom site: %v", status, err)
+			body.Reset()
+		}
+	}
+	if body.Len() > 0 {
+		r.add("Content-Type", "text/html; charset=utf-8")
+	}
+	r.add("Content-Length", strconv.Itoa(body.Len()))
+	if status == http.StatusBadRequest {
+		r.add("Connection", "close")
+	}
+	r.writeTo(conn, head, body.Bytes())
+}
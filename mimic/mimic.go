@@ -0,0 +1,179 @@
+/*
+Package mimic mimics popular web servers to keep the server from being detected.
+It can mimic an unconfigured Apache, nginx or Caddy, or serve a custom site
+from a directory, see ParsePersonality.
+*/
+package mimic
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/golog"
+)
+
+var (
+	log = golog.LoggerFor("mimic")
+)
+
+const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// DefaultPersonality is the name of the Personality used unless another one
+// is configured.
+const DefaultPersonality = "apache-2.4.7"
+
+// dirPrefix prefixes the directory of a custom site in personality names.
+const dirPrefix = "dir:"
+
+var (
+	Host         string
+	Port         string
+	modTime      = time.Now()
+	lastModified = modTime.UTC().Format(timeFormat)
+	etag         = makeETag()
+	mutex        = &sync.Mutex{}
+
+	personality atomic.Value
+)
+
+func init() {
+	SetPersonality(legacyApache)
+}
+
+// Personality responds to requests like a particular web server does.
+type Personality interface {
+	// Name is the name by which the personality is configured.
+	Name() string
+
+	// Mimic writes the response to req to conn.
+	Mimic(conn net.Conn, req *http.Request)
+
+	// BadGateway writes the response to req to conn of the web server acting
+	// as a reverse proxy whose upstream can't be reached.
+	BadGateway(conn net.Conn, req *http.Request)
+}
+
+type personalityHolder struct {
+	Personality
+}
+
+// ParsePersonality finds the Personality with the given name, which is one of
+//
+//   - "apache-2.4.7": Apache 2.4.7 on Ubuntu 14.04, the default
+//   - "apache": Apache 2.4.58 on Ubuntu 24.04
+//   - "nginx": nginx 1.24.0 on Ubuntu 24.04
+//   - "caddy": Caddy 2 serving its default page
+//   - "dir:<path>": a custom site in the given directory, see NewDir
+func ParsePersonality(name string) (Personality, error) {
+	switch name {
+	case "", legacyApache.name:
+		return legacyApache, nil
+	case modernApache.name:
+		return modernApache, nil
+	case nginxPersonality.name:
+		return nginxPersonality, nil
+	case caddyPersonality.name:
+		return caddyPersonality, nil
+	}
+	if strings.HasPrefix(name, dirPrefix) {
+		return NewDir(strings.TrimPrefix(name, dirPrefix))
+	}
+	return nil, fmt.Errorf("unknown mimic personality %v", name)
+}
+
+// SetPersonality sets the Personality used by Mimic.
+func SetPersonality(p Personality) {
+	personality.Store(personalityHolder{p})
+}
+
+// CurrentPersonality returns the Personality used by Mimic.
+func CurrentPersonality() Personality {
+	return personality.Load().(personalityHolder).Personality
+}
+
+// Mimic responds to req on conn with the configured Personality. Set 'Host'
+// and 'Port' before calling it.
+func Mimic(conn net.Conn, req *http.Request) {
+	p := CurrentPersonality()
+	if log.IsTraceEnabled() {
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		log.Tracef("Mimicking %v to client at %v", p.Name(), ip)
+	}
+	p.Mimic(conn, req)
+}
+
+// BadGateway responds to req on conn like the configured Personality does when
+// it's a reverse proxy that can't reach its upstream. Set 'Host' and 'Port'
+// before calling it.
+func BadGateway(conn net.Conn, req *http.Request) {
+	CurrentPersonality().BadGateway(conn, req)
+}
+
+func SetServerAddr(addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		panic("should not happen")
+	}
+	mutex.Lock()
+	Host = host
+	Port = port
+	mutex.Unlock()
+}
+
+// trimLeadingSlashes collapses multiple leading slashes into one.
+func trimLeadingSlashes(path string) string {
+	if len(path) > 0 && path[0] == '/' {
+		i := 1
+		for ; i < len(path) && path[i] == '/'; i++ {
+		}
+		path = path[i-1:]
+	}
+	return path
+}
+
+// collapseSlashes replaces any repeated slashes with a single one.
+func collapseSlashes(path string) string {
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	return path
+}
+
+// vars are available to templates
+type vars struct {
+	Date, LastModified, ETag, Path, Host, Port string
+	Method, Server, Allow                      string
+	EchoURL                                    bool
+	ContentType                                string
+	ContentLength                              int
+	Status                                     int
+}
+
+func collectVars(req *http.Request, path string) *vars {
+	return &vars{
+		Date:         time.Now().UTC().Format(timeFormat),
+		LastModified: lastModified,
+		ETag:         etag,
+		Path:         path,
+		Host:         Host,
+		Port:         Port,
+		Method:       req.Method,
+	}
+}
+
+func makeETag() string {
+	const alphanum = "0123456789abcdefghijklmnopqrstuvwxyz"
+	bytes := [17]byte{}
+	rand.Read(bytes[:])
+	for i, b := range bytes {
+		bytes[i] = alphanum[b%byte(len(alphanum))]
+	}
+	bytes[4] = '-'
+	return string(bytes[:])
+}
@@ -0,0 +1,262 @@
+package mimic
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// respond has the personality respond to the given raw request and parses the
+// response.
+func respond(t *testing.T, p Personality, rawReq string) (*http.Response, string) {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(rawReq)))
+	require.NoError(t, err)
+	server, client := net.Pipe()
+	go func() {
+		p.Mimic(server, req)
+		server.Close()
+	}()
+	raw, err := io.ReadAll(client)
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(string(raw))), req)
+	require.NoError(t, err, "invalid response %v", string(raw))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestParsePersonality(t *testing.T) {
+	for name, expected := range map[string]Personality{"": legacyApache, "apache-2.4.7": legacyApache, "apache": modernApache, "nginx": nginxPersonality, "caddy": caddyPersonality} {
+		p, err := ParsePersonality(name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, p)
+	}
+	_, err := ParsePersonality("iis")
+	assert.Error(t, err)
+	_, err = ParsePersonality("dir:" + filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+
+	defer SetPersonality(CurrentPersonality())
+	SetPersonality(nginxPersonality)
+	server, client := net.Pipe()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	go func() {
+		Mimic(server, req)
+		server.Close()
+	}()
+	raw, _ := io.ReadAll(client)
+	assert.Contains(t, string(raw), "Server: "+nginxServer)
+}
+
+func TestModernApache(t *testing.T) {
+	etag := fmt.Sprintf(`"%x-%x"`, len(modernIndexDotHTML), modTime.UnixMicro())
+	resp, body := respond(t, modernApache, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, string(modernIndexDotHTML), body)
+	assert.Contains(t, body, "systemctl start apache2")
+	assert.EqualValues(t, len(modernIndexDotHTML), resp.ContentLength)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp, body = respond(t, modernApache, "HEAD / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, strconv.Itoa(len(modernIndexDotHTML)), resp.Header.Get("Content-Length"))
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp, body = respond(t, modernApache, "GET /not-existed HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "Apache/2.4.58 (Ubuntu)", resp.Header.Get("Server"))
+	assert.Contains(t, body, "<p>The requested URL was not found on this server.</p>")
+
+	resp, body = respond(t, modernApache, "DELETE / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET,POST,OPTIONS,HEAD", resp.Header.Get("Allow"))
+	assert.Contains(t, body, "The requested method DELETE is not allowed for this URL.")
+
+	resp, body = respond(t, modernApache, "INVALID / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+	assert.Contains(t, body, "INVALID not supported for current URL.")
+}
+
+func TestApacheDates(t *testing.T) {
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.FixedZone("UTC+8", 8*60*60)
+
+	resp, _ := respond(t, legacyApache, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), date, time.Minute, "Date should be in GMT")
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	require.NoError(t, err)
+	assert.WithinDuration(t, modTime, lastModified, time.Second, "Last-Modified should be in GMT")
+}
+
+func TestNginx(t *testing.T) {
+	resp, body := respond(t, nginxPersonality, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, nginxServer, resp.Header.Get("Server"))
+	assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+	assert.NotEmpty(t, resp.Header.Get("ETag"))
+	assert.Contains(t, body, "Welcome to nginx!")
+
+	resp, body = respond(t, nginxPersonality, "GET //index.html HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, body, "<center><h1>404 Not Found</h1></center>\r\n<hr><center>"+nginxServer+"</center>")
+
+	for _, method := range []string{"POST", "PUT", "OPTIONS", "CONNECT", "INVALID"} {
+		resp, body = respond(t, nginxPersonality, method+" / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		assert.Equal(t, "405 Not Allowed", resp.Status, method)
+		assert.Empty(t, resp.Header.Get("Allow"), "nginx doesn't send Allow")
+		assert.Contains(t, body, "<title>405 Not Allowed</title>")
+	}
+
+	resp, _ = respond(t, nginxPersonality, "POST /missing HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, body = respond(t, nginxPersonality, "HEAD /missing HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Empty(t, body)
+
+	resp, _ = respond(t, nginxPersonality, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.True(t, resp.Close, "should close the connection")
+}
+
+func TestCaddy(t *testing.T) {
+	resp, body := respond(t, caddyPersonality, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Caddy", resp.Header.Get("Server"))
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, "Caddy works!")
+
+	resp, _ = respond(t, caddyPersonality, "GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+	assert.Equal(t, "/", resp.Header.Get("Location"))
+
+	resp, body = respond(t, caddyPersonality, "GET /missing HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Empty(t, body)
+
+	resp, _ = respond(t, caddyPersonality, "POST / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+
+	resp, body = respond(t, caddyPersonality, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "400 Bad Request: missing required Host header", body)
+}
+
+func TestBadGateway(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "_502.html"), []byte("<h1>Try again later</h1>"), 0644))
+	custom, err := NewDir(dir)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		p      Personality
+		status string
+		server string
+		body   string
+	}{
+		{legacyApache, "502 Proxy Error", "Apache/2.4.7 (Ubuntu)", "<h1>Proxy Error</h1>"},
+		{modernApache, "502 Proxy Error", "Apache/2.4.58 (Ubuntu)", "<h1>Proxy Error</h1>"},
+		{nginxPersonality, "502 Bad Gateway", nginxServer, "<center><h1>502 Bad Gateway</h1></center>"},
+		{caddyPersonality, "502 Bad Gateway", "Caddy", ""},
+		{custom, "502 Bad Gateway", "", "<h1>Try again later</h1>"},
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req, err := http.NewRequest(method, "http://example.com/path", nil)
+			require.NoError(t, err)
+			server, client := net.Pipe()
+			go func() {
+				test.p.BadGateway(server, req)
+				server.Close()
+			}()
+			resp, err := http.ReadResponse(bufio.NewReader(client), req)
+			require.NoError(t, err, test.p.Name())
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			client.Close()
+			assert.Equal(t, test.status, resp.Status, test.p.Name())
+			assert.Equal(t, test.server, resp.Header.Get("Server"), test.p.Name())
+			assert.NotEmpty(t, resp.Header.Get("Date"), test.p.Name())
+			assert.False(t, resp.Close, "%v should keep the connection open", test.p.Name())
+			if method == http.MethodHead {
+				assert.Empty(t, body, test.p.Name())
+			} else {
+				assert.Contains(t, string(body), test.body, test.p.Name())
+			}
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	write("index.html", "<h1>Home</h1>")
+	write("docs/index.html", "<h1>Docs</h1>")
+	write("style.css", "body {}")
+	write("_headers", "Server: lighttpd/1.4.76\nX-Status: {{.Status}}\nX-Path: {{.Path}}\n")
+	write("_404.html", "<h1>{{.Path}} is missing</h1>")
+	write(".secret", "hidden")
+	p, err := ParsePersonality("dir:" + dir)
+	require.NoError(t, err)
+
+	resp, body := respond(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "lighttpd/1.4.76", resp.Header.Get("Server"))
+	assert.Equal(t, "200", resp.Header.Get("X-Status"))
+	assert.Equal(t, "<h1>Home</h1>", body)
+
+	_, body = respond(t, p, "GET /docs/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, "<h1>Docs</h1>", body)
+	resp, _ = respond(t, p, "GET /style.css HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/css"))
+
+	for _, path := range []string{"/missing", "/_headers", "/.secret", "/../" + filepath.Base(dir) + "/index.html/x"} {
+		resp, body = respond(t, p, "GET "+path+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+		assert.Equal(t, "404", resp.Header.Get("X-Status"))
+		assert.Contains(t, body, "is missing")
+	}
+
+	resp, body = respond(t, p, "GET /%3Cscript%3Ealert(1)%3C/script%3E HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NotContains(t, body, "<script>", "the path should be escaped in error pages")
+	assert.Contains(t, body, "&lt;script&gt;")
+
+	resp, _ = respond(t, p, "GET /a%0D%0ASet-Cookie:%20injected=1 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Set-Cookie"), "the path shouldn't add headers")
+	assert.Equal(t, "/aSet-Cookie: injected=1", resp.Header.Get("X-Path"))
+
+	resp, _ = respond(t, p, "OPTIONS / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD, OPTIONS", resp.Header.Get("Allow"))
+
+	resp, body = respond(t, p, "PUT / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD, OPTIONS", resp.Header.Get("Allow"))
+	assert.Empty(t, body)
+
+	resp, _ = respond(t, p, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	write("_headers", "{{.Missing")
+	_, err = NewDir(dir)
+	assert.Error(t, err)
+}
@@ -0,0 +1,117 @@
+package mimic
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const nginxServer = "nginx/1.24.0 (Ubuntu)"
+
+// nginxPersonality is nginx 1.24.0 installed by 'apt-get install nginx' on
+// Ubuntu 24.04, which serves index.nginx-debian.html for / and doesn't have an
+// index.html.
+var nginxPersonality = &nginx{name: "nginx"}
+
+type nginx struct {
+	name string
+}
+
+func (n *nginx) Name() string {
+	return n.name
+}
+
+func (n *nginx) Mimic(conn net.Conn, req *http.Request) {
+	head := req.Method == http.MethodHead
+	if req.Host == "" && req.ProtoAtLeast(1, 1) {
+		// nginx always closes the connection after a bad request
+		n.writeError(conn, "400 Bad Request", false, head)
+		return
+	}
+	path := collapseSlashes(req.URL.Path)
+	found := path == "/" || path == "/index.nginx-debian.html"
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		if !found {
+			n.writeError(conn, "404 Not Found", !req.Close, head)
+			return
+		}
+		// nginx derives the ETag from the modification time and size of the file
+		newResponse("200 OK").
+			add("Server", nginxServer).
+			add("Date", time.Now().UTC().Format(timeFormat)).
+			add("Content-Type", "text/html").
+			add("Content-Length", strconv.Itoa(len(nginxIndex))).
+			add("Last-Modified", lastModified).
+			add("Connection", connectionHeader(!req.Close)).
+			add("ETag", fmt.Sprintf(`"%x-%x"`, modTime.Unix(), len(nginxIndex))).
+			add("Accept-Ranges", "bytes").
+			writeTo(conn, head, nginxIndex)
+	case http.MethodPost:
+		// the static module only serves GET and HEAD but still checks that the
+		// file exists for POST
+		if !found {
+			n.writeError(conn, "404 Not Found", !req.Close, head)
+			return
+		}
+		n.writeError(conn, "405 Not Allowed", !req.Close, head)
+	default:
+		// including CONNECT, which nginx rejects since 1.21.1
+		n.writeError(conn, "405 Not Allowed", !req.Close, head)
+	}
+}
+
+func (n *nginx) BadGateway(conn net.Conn, req *http.Request) {
+	n.writeError(conn, "502 Bad Gateway", !req.Close, req.Method == http.MethodHead)
+}
+
+func (n *nginx) writeError(conn net.Conn, status string, keepAlive, head bool) {
+	body := []byte("<html>\r\n" +
+		"<head><title>" + status + "</title></head>\r\n" +
+		"<body>\r\n" +
+		"<center><h1>" + status + "</h1></center>\r\n" +
+		"<hr><center>" + nginxServer + "</center>\r\n" +
+		"</body>\r\n" +
+		"</html>\r\n")
+	newResponse(status).
+		add("Server", nginxServer).
+		add("Date", time.Now().UTC().Format(timeFormat)).
+		add("Content-Type", "text/html").
+		add("Content-Length", strconv.Itoa(len(body))).
+		add("Connection", connectionHeader(keepAlive)).
+		writeTo(conn, head, body)
+}
+
+func connectionHeader(keepAlive bool) string {
+	if keepAlive {
+		return "keep-alive"
+	}
+	return "close"
+}
+
+var nginxIndex = []byte(`<!DOCTYPE html>
+<html>
+<head>
+<title>Welcome to nginx!</title>
+<style>
+html { color-scheme: light dark; }
+body { width: 35em; margin: 0 auto;
+font-family: Tahoma, Verdana, Arial, sans-serif; }
+</style>
+</head>
+<body>
+<h1>Welcome to nginx!</h1>
+<p>If you see this page, the nginx web server is successfully installed and
+working. Further configuration is required.</p>
+
+<p>For online documentation and support please refer to
+<a href="http://nginx.org/">nginx.org</a>.<br/>
+Commercial support is available at
+<a href="http://nginx.com/">nginx.com</a>.</p>
+
+<p><em>Thank you for using nginx.</em></p>
+</body>
+</html>
+`)
@@ -0,0 +1,40 @@
+package mimic
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// response is a response that's built header by header, for personalities
+// whose responses don't need templates.
+type response struct {
+	status string
+	header [][2]string
+}
+
+func newResponse(status string) *response {
+	return &response{status: status}
+}
+
+// add adds a header, keeping the order in which headers are added.
+func (r *response) add(key, value string) *response {
+	r.header = append(r.header, [2]string{key, value})
+	return r
+}
+
+// writeTo writes the response with the given body to conn, leaving out the
+// body if head is true.
+func (r *response) writeTo(conn net.Conn, head bool, body []byte) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %v\r\n", r.status)
+	for _, h := range r.header {
+		fmt.Fprintf(&buf, "%v: %v\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+	if !head {
+		buf.Write(body)
+	}
+	// ignore any errors writing back to connection
+	_, _ = buf.WriteTo(conn)
+}
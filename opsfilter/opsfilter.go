@@ -10,7 +10,10 @@ import (
 
 	"github.com/getlantern/http-proxy-lantern/v2/common"
 	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+	"github.com/getlantern/http-proxy-lantern/v2/shadowsocks"
 	"github.com/getlantern/http-proxy-lantern/v2/tlslistener"
+	"github.com/getlantern/http-proxy-lantern/v2/v2ray/vless"
+	"github.com/getlantern/http-proxy-lantern/v2/v2ray/vmess"
 )
 
 type opsfilter struct {
@@ -90,6 +93,23 @@ func (f *opsfilter) Apply(cs *filters.ConnectionState, req *http.Request, next f
 		return true
 	})
 
+	// Attribute usage to the shadowsocks access key or VMess/VLESS UUID the
+	// client used, if any
+	netx.WalkWrapped(cs.Downstream(), func(conn net.Conn) bool {
+		switch c := conn.(type) {
+		case shadowsocks.AccessKeyConn:
+			addVal(common.AccessKeyID, c.AccessKeyID())
+			return false
+		case vmess.UUIDConn:
+			addVal(common.VMessUUID, c.VMessUUID())
+			return false
+		case vless.UUIDConn:
+			addVal(common.VLESSUUID, c.VLESSUUID())
+			return false
+		}
+		return true
+	})
+
 	// Send the same context data to measured as well
 	wc := cs.Downstream().(listeners.WrapConn)
 	wc.ControlMessage("measured", measuredCtx)
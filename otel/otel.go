@@ -4,11 +4,13 @@ import (
 	"context"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	sdkotel "go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	"go.opentelemetry.io/otel/sdk/resource"
@@ -40,6 +42,10 @@ type Opts struct {
 	Addr             string
 	IsPro            bool
 	Legacy           bool
+
+	// PrometheusRegisterer, if specified, is used to expose metrics for
+	// scraping by Prometheus in addition to pushing them to Endpoint.
+	PrometheusRegisterer prometheus.Registerer
 }
 
 func (opts *Opts) buildResource() *resource.Resource {
@@ -126,32 +132,21 @@ func BuildTracerProvider(opts *Opts) (*sdktrace.TracerProvider, func()) {
 	return tp, stop
 }
 
+// InitGlobalMeterProvider sets up the global meter provider to push metrics to
+// opts.Endpoint and/or expose them to opts.PrometheusRegisterer, depending on
+// which of these are specified.
 func InitGlobalMeterProvider(opts *Opts) (func(), error) {
-	exp, err := otlpmetrichttp.New(context.Background(),
-		otlpmetrichttp.WithEndpoint(opts.Endpoint),
-		otlpmetrichttp.WithHeaders(opts.Headers),
-		otlpmetrichttp.WithTemporalitySelector(func(kind sdkmetric.InstrumentKind) metricdata.Temporality {
-			switch kind {
-			case
-				sdkmetric.InstrumentKindCounter,
-				sdkmetric.InstrumentKindUpDownCounter,
-				sdkmetric.InstrumentKindObservableCounter,
-				sdkmetric.InstrumentKindObservableUpDownCounter:
-				return metricdata.DeltaTemporality
-			default:
-				return metricdata.CumulativeTemporality
-			}
-		}),
-	)
+	readers, err := buildMetricReaders(opts)
 	if err != nil {
 		return nil, err
 	}
+	mpOpts := []sdkmetric.Option{sdkmetric.WithResource(opts.buildResource())}
+	for _, reader := range readers {
+		mpOpts = append(mpOpts, sdkmetric.WithReader(reader))
+	}
 
 	// Create a new meter provider
-	mp := sdkmetric.NewMeterProvider(
-		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp)),
-		sdkmetric.WithResource(opts.buildResource()),
-	)
+	mp := sdkmetric.NewMeterProvider(mpOpts...)
 
 	// Set the meter provider as global
 	sdkotel.SetMeterProvider(mp)
@@ -165,3 +160,45 @@ func InitGlobalMeterProvider(opts *Opts) (func(), error) {
 		}
 	}, nil
 }
+
+// buildMetricReaders builds a reader that pushes metrics to opts.Endpoint and
+// one that exposes them to opts.PrometheusRegisterer, if these are specified.
+func buildMetricReaders(opts *Opts) ([]sdkmetric.Reader, error) {
+	var readers []sdkmetric.Reader
+	if opts.Endpoint != "" {
+		exp, err := buildOTLPMetricExporter(opts)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Will push metrics to OpenTelemetry at %v", opts.Endpoint)
+		readers = append(readers, sdkmetric.NewPeriodicReader(exp))
+	}
+	if opts.PrometheusRegisterer != nil {
+		exp, err := otelprometheus.New(otelprometheus.WithRegisterer(opts.PrometheusRegisterer))
+		if err != nil {
+			return nil, err
+		}
+		log.Debug("Will expose metrics to Prometheus")
+		readers = append(readers, exp)
+	}
+	return readers, nil
+}
+
+func buildOTLPMetricExporter(opts *Opts) (sdkmetric.Exporter, error) {
+	return otlpmetrichttp.New(context.Background(),
+		otlpmetrichttp.WithEndpoint(opts.Endpoint),
+		otlpmetrichttp.WithHeaders(opts.Headers),
+		otlpmetrichttp.WithTemporalitySelector(func(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+			switch kind {
+			case
+				sdkmetric.InstrumentKindCounter,
+				sdkmetric.InstrumentKindUpDownCounter,
+				sdkmetric.InstrumentKindObservableCounter,
+				sdkmetric.InstrumentKindObservableUpDownCounter:
+				return metricdata.DeltaTemporality
+			default:
+				return metricdata.CumulativeTemporality
+			}
+		}),
+	)
+}
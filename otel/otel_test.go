@@ -0,0 +1,33 @@
+package otel
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+func TestBuildMetricReaders(t *testing.T) {
+	readers, err := buildMetricReaders(&Opts{})
+	require.NoError(t, err)
+	assert.Empty(t, readers, "no exporter should be used without an endpoint or registerer")
+
+	readers, err = buildMetricReaders(&Opts{Endpoint: "localhost:4318"})
+	require.NoError(t, err)
+	if assert.Len(t, readers, 1) {
+		assert.IsType(t, &sdkmetric.PeriodicReader{}, readers[0], "should push to OTLP endpoint")
+	}
+
+	readers, err = buildMetricReaders(&Opts{PrometheusRegisterer: prometheus.NewRegistry()})
+	require.NoError(t, err)
+	if assert.Len(t, readers, 1) {
+		assert.IsType(t, &otelprometheus.Exporter{}, readers[0], "should expose to Prometheus")
+	}
+
+	readers, err = buildMetricReaders(&Opts{Endpoint: "localhost:4318", PrometheusRegisterer: prometheus.NewRegistry()})
+	require.NoError(t, err)
+	assert.Len(t, readers, 2, "should both push to OTLP endpoint and expose to Prometheus")
+}
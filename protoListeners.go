@@ -1,35 +1,127 @@
 package proxy
 
+import "net"
+
+var (
+	// The following are the names of the Proxy fields that each kind of
+	// listener depends on. When one of them changes on Reload, the affected
+	// listeners are rebuilt unless they registered an in-place update for it.
+	tcpFields  = []string{"IdleTimeout", "DiffServTOS", "ProxyProtocolTrustedSources", "IPFilterReactions"}
+	certFields = []string{"CertFile", "KeyFile"}
+	tlsFields  = []string{
+		"HTTPS", "CertFile", "KeyFile", "SessionTicketKeyFile", "FirstSessionTicketKey", "SessionTicketKeys",
+		"RequireSessionTickets", "MissingTicketReaction", "TLSListenerAllowTLS13",
+	}
+	multiplexFields = []string{
+		"MultiplexProtocol", "SmuxVersion", "SmuxMaxFrameSize", "SmuxMaxReceiveBuffer", "SmuxMaxStreamBuffer",
+		"PsmuxVersion", "PsmuxMaxFrameSize", "PsmuxMaxReceiveBuffer", "PsmuxMaxStreamBuffer",
+		"PsmuxDisablePadding", "PsmuxMaxPaddingRatio", "PsmuxMaxPaddedSize",
+		"PsmuxDisableAggressivePadding", "PsmuxAggressivePadding", "PsmuxAggressivePaddingRatio",
+	}
+	obfs4Fields = []string{
+		"Obfs4Dir", "Obfs4HandshakeConcurrency", "Obfs4MaxPendingHandshakesPerClient", "Obfs4HandshakeTimeout",
+	}
+	lampshadeFields = []string{"LampshadeKeyCacheSize", "LampshadeMaxClientInitAge"}
+	tlsmasqFields   = []string{
+		"TLSMasqOriginAddr", "TLSMasqSecret", "TLSMasqTLSMinVersion", "TLSMasqTLSCipherSuites",
+	}
+	shadowsocksFields = []string{
+		"ShadowsocksSecret", "ShadowsocksCipher", "ShadowsocksKeysFile", "ShadowsocksReplayHistory", "ShadowsocksWithTLS",
+		"ShadowsocksUDP", "ShadowsocksUDPIdleTimeout", "ShadowsocksUDPMaxPerClient",
+		"ProxyProtocolTrustedSources", "IPFilterReactions",
+	}
+	vlessFields  = []string{"VLESSUUIDs", "VLESSFallbackAddr"}
+	trojanFields = []string{"TrojanPasswords", "TrojanFallbackAddr"}
+	socks5Fields = []string{"SOCKS5WithTLS", "CertFile", "KeyFile"}
+	waterFields  = []string{
+		"WaterWASM", "WaterWASMAvailableAt", "WaterTransport", "WaterMismatchProtocol",
+	}
+)
+
 type protoListenerArgs struct {
-	protocol string
-	addr     string
-	fn       listenerBuilderFN
+	protocol  string
+	addr      string
+	fn        listenerBuilderFN
+	restartOn []string
 }
 
-func getProtoListenersArgs(p *Proxy) []protoListenerArgs {
+func getProtoListenersArgs(p *Proxy, onListenerError func(net.Conn, error)) []protoListenerArgs {
 	return []protoListenerArgs{
 		/**********   listeners for base transport   **********/
-		{"https", p.HTTPAddr, p.wrapTLSIfNecessary(p.listenHTTP(p.listenTCP))},
+		{"https", p.HTTPAddr, p.wrapTLSIfNecessary(p.listenHTTP(p.listenTCP)), fields(tcpFields, p.tlsFields())},
 		{
 			"https_multiplex",
 			p.HTTPMultiplexAddr,
 			p.wrapMultiplexing(p.wrapTLSIfNecessary(p.listenHTTP(p.listenTCP))),
+			fields(tcpFields, p.tlsFields(), multiplexFields),
+		},
+		{
+			"tlsmasq",
+			p.TLSMasqAddr,
+			p.wrapMultiplexing(p.listenTLSMasq(p.listenTCP)),
+			fields(tcpFields, certFields, tlsmasqFields, multiplexFields),
+		},
+		{
+			"starbridge",
+			p.StarbridgeAddr,
+			p.wrapMultiplexing(p.listenStarbridge(p.listenTCP)),
+			fields(tcpFields, []string{"StarbridgePrivateKey"}, multiplexFields),
+		},
+		{"broflake", p.BroflakeAddr, p.listenBroflake(p.listenTCP), fields([]string{"IdleTimeout", "ProxyProtocolTrustedSources", "IPFilterReactions"}, certFields)},
+		{"algeneva", p.AlgenevaAddr, p.wrapMultiplexing(p.listenAlgeneva(p.listenTCP)), fields(tcpFields, certFields, multiplexFields)},
+		{"obfs4", p.Obfs4Addr, p.wrapTLSIfNecessary(p.listenOBFS4(p.listenTCP)), fields(tcpFields, p.tlsFields(), obfs4Fields)},
+		{
+			"obfs4_multiplex",
+			p.Obfs4MultiplexAddr,
+			p.wrapMultiplexing(p.wrapTLSIfNecessary(p.listenOBFS4(p.listenTCP))),
+			fields(tcpFields, p.tlsFields(), obfs4Fields, multiplexFields),
+		},
+		// lampshade does its own multiplexing, so it's never wrapped with wrapMultiplexing
+		{
+			"lampshade",
+			p.LampshadeAddr,
+			p.listenLampshade(onListenerError, p.listenTCP),
+			fields(tcpFields, certFields, lampshadeFields),
 		},
-		{"tlsmasq", p.TLSMasqAddr, p.wrapMultiplexing(p.listenTLSMasq(p.listenTCP))},
-		{"starbridge", p.StarbridgeAddr, p.wrapMultiplexing(p.listenStarbridge(p.listenTCP))},
-		{"broflake", p.BroflakeAddr, p.listenBroflake(p.listenTCP)},
-		{"algeneva", p.AlgenevaAddr, p.wrapMultiplexing(p.listenAlgeneva(p.listenTCP))},
 		/******************************************************/
 
-		{"kcp", p.KCPConf, p.wrapTLSIfNecessary(p.listenKCP)},
-		{"quic_ietf", p.QUICIETFAddr, p.listenQUICIETF},
-		{"shadowsocks", p.ShadowsocksAddr, p.listenShadowsocks},
+		{"kcp", p.KCPConf, p.wrapTLSIfNecessary(p.listenKCP), fields([]string{"IdleTimeout"}, p.tlsFields())},
+		{"quic_ietf", p.QUICIETFAddr, p.listenQUICIETF, certFields},
+		{"shadowsocks", p.ShadowsocksAddr, p.listenShadowsocks, fields(shadowsocksFields, certFields)},
 		{
 			"shadowsocks_multiplex",
 			p.ShadowsocksMultiplexAddr,
 			p.wrapMultiplexing(p.listenShadowsocks),
+			fields(shadowsocksFields, certFields, multiplexFields),
+		},
+		{"water", p.WaterAddr, p.wrapMultiplexing(p.listenWATER), fields(waterFields, certFields, multiplexFields)},
+		{"vmess", p.VMessAddr, p.wrapMultiplexing(p.listenVMess(p.listenTCP)), fields(tcpFields, multiplexFields)},
+		{"vless", p.VLESSAddr, p.wrapMultiplexing(p.listenVLESS(p.listenTCP)), fields(tcpFields, certFields, vlessFields, multiplexFields)},
+		{"trojan", p.TrojanAddr, p.wrapMultiplexing(p.listenTrojan(p.listenTCP)), fields(tcpFields, certFields, trojanFields, multiplexFields)},
+		{"socks5", p.SOCKS5Addr, p.listenSOCKS5(p.listenSOCKS5Base), fields(tcpFields, socks5Fields)},
+		// each multiplexed stream carries its own SOCKS5 session
+		{
+			"socks5_multiplex",
+			p.SOCKS5MultiplexAddr,
+			p.listenSOCKS5(p.wrapMultiplexing(p.listenSOCKS5Base)),
+			fields(tcpFields, socks5Fields, multiplexFields),
 		},
-		{"water", p.WaterAddr, p.wrapMultiplexing(p.listenWATER)},
-		{"vmess", p.VMessAddr, p.wrapMultiplexing(p.listenVMess(p.listenTCP))},
 	}
 }
+
+// tlsFields returns the fields that listeners wrapped with wrapTLSIfNecessary
+// depend on. Without HTTPS, only a change to HTTPS itself matters.
+func (p *Proxy) tlsFields() []string {
+	if p.HTTPS {
+		return tlsFields
+	}
+	return []string{"HTTPS"}
+}
+
+func fields(groups ...[]string) []string {
+	var result []string
+	for _, group := range groups {
+		result = append(result, group...)
+	}
+	return result
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/getlantern/cmux/v2"
+	"github.com/getlantern/keyman"
+	"github.com/getlantern/lampshade"
+	. "github.com/getlantern/waitforserver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+)
+
+func TestOBFS4AndLampshade(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "protolisteners-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	pk, err := keyman.GeneratePK(2048)
+	require.NoError(t, err)
+	cert, err := pk.TLSCertificateFor(time.Now().Add(10*time.Hour), false, nil, "org", "name")
+	require.NoError(t, err)
+	certFile := filepath.Join(tmpDir, "cert.pem")
+	keyFile := filepath.Join(tmpDir, "key.pem")
+	require.NoError(t, cert.WriteToFile(certFile))
+	require.NoError(t, pk.WriteToFile(keyFile))
+
+	obfs4Addr := "127.0.0.1:18713"
+	obfs4MultiplexAddr := "127.0.0.1:18717"
+	lampshadeAddr := "127.0.0.1:18715"
+	proxy := &Proxy{
+		TestingLocal:       true,
+		Token:              validToken,
+		IdleTimeout:        1 * time.Minute,
+		CertFile:           certFile,
+		KeyFile:            keyFile,
+		Obfs4Addr:          obfs4Addr,
+		Obfs4MultiplexAddr: obfs4MultiplexAddr,
+		Obfs4Dir:           tmpDir,
+		LampshadeAddr:      lampshadeAddr,
+		GoogleSearchRegex:  "bequiet",
+		GoogleCaptchaRegex: "bequiet",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		assert.NoError(t, proxy.ListenAndServe(ctx))
+	}()
+	require.NoError(t, WaitForServer("tcp", obfs4Addr, 10*time.Second))
+	require.NoError(t, WaitForServer("tcp", obfs4MultiplexAddr, 10*time.Second))
+	require.NoError(t, WaitForServer("tcp", lampshadeAddr, 10*time.Second))
+
+	t.Run("obfs4", func(t *testing.T) {
+		tr := &obfs4.Transport{}
+		cf, err := tr.ClientFactory("")
+		require.NoError(t, err)
+		args, err := cf.ParseArgs(obfs4ClientArgs(t, tmpDir))
+		require.NoError(t, err)
+
+		conn, err := cf.Dial("tcp", obfs4Addr, net.Dial, args)
+		require.NoError(t, err)
+		defer conn.Close()
+		testRequestThroughConn(t, conn)
+	})
+
+	t.Run("obfs4_multiplex", func(t *testing.T) {
+		tr := &obfs4.Transport{}
+		cf, err := tr.ClientFactory("")
+		require.NoError(t, err)
+		args, err := cf.ParseArgs(obfs4ClientArgs(t, tmpDir))
+		require.NoError(t, err)
+
+		dial := cmux.Dialer(&cmux.DialerOpts{
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return cf.Dial(network, addr, net.Dial, args)
+			},
+			Protocol: cmux.NewSmuxProtocol(nil),
+		})
+		// both streams share the same obfs4 connection
+		for i := 0; i < 2; i++ {
+			conn, err := dial(ctx, "tcp", obfs4MultiplexAddr)
+			require.NoError(t, err)
+			testRequestThroughConn(t, conn)
+			conn.Close()
+		}
+	})
+
+	t.Run("lampshade", func(t *testing.T) {
+		certRT, err := keyman.LoadCertificateFromPEMBytes(cert.PEMEncoded())
+		require.NoError(t, err)
+		dialer := lampshade.NewDialer(&lampshade.DialerOpts{
+			WindowSize:      50,
+			MaxPadding:      32,
+			Pool:            lampshade.NewBufferPool(100 * 1024 * 1024),
+			Cipher:          lampshade.AES128GCM,
+			ServerPublicKey: certRT.X509().PublicKey.(*rsa.PublicKey)})
+
+		conn, err := dialer.Dial(func() (net.Conn, error) {
+			return net.Dial("tcp", lampshadeAddr)
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+		testRequestThroughConn(t, conn)
+	})
+}
+
+// obfs4ClientArgs reads the client arguments from the bridge line that the
+// obfs4 server factory writes to its state directory.
+func obfs4ClientArgs(t *testing.T, stateDir string) *pt.Args {
+	bridgeLine, err := ioutil.ReadFile(filepath.Join(stateDir, "obfs4_bridgeline.txt"))
+	require.NoError(t, err)
+
+	args := &pt.Args{}
+	for _, line := range strings.Split(string(bridgeLine), "\n") {
+		if !strings.HasPrefix(line, "Bridge obfs4") {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) == 2 {
+				args.Add(parts[0], parts[1])
+			}
+		}
+	}
+	return args
+}
+
+func testRequestThroughConn(t *testing.T, conn net.Conn) {
+	status, body := requestThroughConn(t, conn, validToken)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, targetResponse, "should read proxied response")
+}
+
+// requestThroughConn sends a request for httpTargetURL with the given token
+// through conn and returns the response status and body.
+func requestThroughConn(t *testing.T, conn net.Conn, token string) (int, string) {
+	u, err := url.Parse(httpTargetURL)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	require.NoError(t, err)
+	req.Header.Set(common.TokenHeader, token)
+	req.Header.Set(common.DeviceIdHeader, deviceId)
+	require.NoError(t, req.Write(conn))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
@@ -5,37 +5,62 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
 
 	"github.com/getlantern/proxy/v3/filters"
 )
 
+// ConnectPortsFilter is a filter that restricts CONNECT requests to a list of
+// allowed ports. The allowed ports can be changed while the filter is in use.
+type ConnectPortsFilter struct {
+	allowedPorts []int
+	mx           sync.RWMutex
+}
+
 // RestrictConnectPorts restricts CONNECT requests to the given list of allowed
 // ports and returns either a 400 error if the request is missing a port or a
 // 403 error if the port is not allowed.
-func RestrictConnectPorts(allowedPorts []int) filters.Filter {
-	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
-		if req.Method != http.MethodConnect || len(allowedPorts) == 0 {
-			return next(cs, req)
-		}
+func RestrictConnectPorts(allowedPorts []int) *ConnectPortsFilter {
+	return &ConnectPortsFilter{allowedPorts: allowedPorts}
+}
 
-		log.Tracef("Checking CONNECT tunnel to %s against allowed ports %v", req.Host, allowedPorts)
-		_, portString, err := net.SplitHostPort(req.Host)
-		if err != nil {
-			// CONNECT request should always include port in req.Host.
-			// Ref https://tools.ietf.org/html/rfc2817#section-5.2.
-			return fail(cs, req, http.StatusBadRequest, "No port field in Request-URI / Host header")
-		}
+// SetAllowedPorts replaces the list of allowed ports. An empty list allows all
+// ports.
+func (f *ConnectPortsFilter) SetAllowedPorts(allowedPorts []int) {
+	f.mx.Lock()
+	f.allowedPorts = allowedPorts
+	f.mx.Unlock()
+}
 
-		port, err := strconv.Atoi(portString)
-		if err != nil {
-			return fail(cs, req, http.StatusBadRequest, fmt.Sprintf("Invalid port for %v: %v", req.Host, portString))
-		}
+func (f *ConnectPortsFilter) getAllowedPorts() []int {
+	f.mx.RLock()
+	defer f.mx.RUnlock()
+	return f.allowedPorts
+}
+
+func (f *ConnectPortsFilter) Apply(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	allowedPorts := f.getAllowedPorts()
+	if req.Method != http.MethodConnect || len(allowedPorts) == 0 {
+		return next(cs, req)
+	}
 
-		for _, p := range allowedPorts {
-			if port == p {
-				return next(cs, req)
-			}
+	log.Tracef("Checking CONNECT tunnel to %s against allowed ports %v", req.Host, allowedPorts)
+	_, portString, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		// CONNECT request should always include port in req.Host.
+		// Ref https://tools.ietf.org/html/rfc2817#section-5.2.
+		return fail(cs, req, http.StatusBadRequest, "No port field in Request-URI / Host header")
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return fail(cs, req, http.StatusBadRequest, fmt.Sprintf("Invalid port for %v: %v", req.Host, portString))
+	}
+
+	for _, p := range allowedPorts {
+		if port == p {
+			return next(cs, req)
 		}
-		return fail(cs, req, http.StatusForbidden, fmt.Sprintf("Port not allowed for %v: %d", req.Host, port))
-	})
+	}
+	return fail(cs, req, http.StatusForbidden, fmt.Sprintf("Port not allowed for %v: %d", req.Host, port))
 }
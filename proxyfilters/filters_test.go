@@ -57,9 +57,19 @@ func TestRestrictConnectNonConnect(t *testing.T) {
 	doTestRestrictConnectPort(t, []int{9999999}, http.MethodGet, http.StatusOK)
 }
 
+func TestRestrictConnectPortsUpdated(t *testing.T) {
+	filter := RestrictConnectPorts([]int{9999999})
+	filter.SetAllowedPorts(nil)
+	doTestRestrictConnectPortWithFilter(t, filter, http.MethodConnect, http.StatusOK)
+}
+
 func doTestRestrictConnectPort(t *testing.T, ports []int, method string, expectedStatus int) {
+	doTestRestrictConnectPortWithFilter(t, RestrictConnectPorts(ports), method, expectedStatus)
+}
+
+func doTestRestrictConnectPortWithFilter(t *testing.T, filter filters.Filter, method string, expectedStatus int) {
 	doTestFilter(t,
-		RestrictConnectPorts(ports),
+		filter,
 		func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
 			err := send(method, nil, "")
 			if !assert.NoError(t, err) {
@@ -45,14 +45,14 @@ func (s *ongoingSet) isMember(dev string) bool {
 
 // DeviceFetcher retrieves device information from Redis
 type DeviceFetcher struct {
-	rc      *redis.Client
+	rc      redis.UniversalClient
 	ongoing *ongoingSet
 	queue   chan string
 	ctx     context.Context
 }
 
 // NewDeviceFetcher creates a new DeviceFetcher
-func NewDeviceFetcher(rc *redis.Client) *DeviceFetcher {
+func NewDeviceFetcher(rc redis.UniversalClient) *DeviceFetcher {
 	df := &DeviceFetcher{
 		rc:      rc,
 		ongoing: &ongoingSet{set: make(map[string]bool, 512)},
@@ -2,8 +2,10 @@ package redis
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -13,6 +15,7 @@ import (
 	"github.com/getlantern/geo"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
 	"github.com/getlantern/http-proxy-lantern/v2/listeners"
 	"github.com/getlantern/http-proxy-lantern/v2/throttle"
 	"github.com/getlantern/http-proxy-lantern/v2/usage"
@@ -39,6 +42,12 @@ const (
 `
 
 	sixtyDays = 60 * 24 * time.Hour
+
+	// DefaultMaxPendingDevices is the default for ReporterOpts.MaxPendingDevices
+	DefaultMaxPendingDevices = 100000
+
+	// DefaultMaxRetryInterval is the default for ReporterOpts.MaxRetryInterval
+	DefaultMaxRetryInterval = 5 * time.Minute
 )
 
 var (
@@ -59,67 +68,226 @@ func (sac *statsAndContext) add(other *statsAndContext) *statsAndContext {
 	return &statsAndContext{other.ctx, &newStats}
 }
 
-func NewMeasuredReporter(countryLookup geo.CountryLookup, rc *redis.Client, reportInterval time.Duration, throttleConfig throttle.Config) listeners.MeasuredReportFN {
-	// Provide some buffering so that we don't lose data while submitting to Redis
-	statsCh := make(chan *statsAndContext, 10000)
-	go reportPeriodically(countryLookup, rc, reportInterval, throttleConfig, statsCh)
+func (sac *statsAndContext) bytes() int {
+	return sac.stats.SentTotal + sac.stats.RecvTotal
+}
+
+// ReporterOpts configures how NewMeasuredReporter deals with Redis being
+// unavailable.
+type ReporterOpts struct {
+	// MaxPendingDevices limits the number of devices whose usage is kept in
+	// memory while it can't be submitted. Defaults to DefaultMaxPendingDevices.
+	MaxPendingDevices int
+
+	// MaxRetryInterval caps the interval between attempts to submit usage after
+	// failures. Defaults to DefaultMaxRetryInterval.
+	MaxRetryInterval time.Duration
+
+	// SpoolFile, if set, is where pending usage is written once there's more of
+	// it than MaxPendingDevices, to be submitted once Redis is reachable again.
+	// Without it, usage over that limit is dropped.
+	SpoolFile string
+
+	// Instrument records dropped bytes and retries. Defaults to
+	// instrument.NoInstrument.
+	Instrument instrument.Instrument
+}
+
+// NewMeasuredReporter returns a listeners.MeasuredReportFN that submits usage to
+// Redis every reportInterval. Usage that couldn't be submitted is kept and
+// retried with exponential backoff, see ReporterOpts.
+func NewMeasuredReporter(countryLookup geo.CountryLookup, rc redis.UniversalClient, reportInterval time.Duration, throttleConfig throttle.Config, opts *ReporterOpts) listeners.MeasuredReportFN {
+	r := newReporter(countryLookup, rc, throttleConfig, opts)
+	go r.reportPeriodically(reportInterval)
 	return func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
 		select {
-		case statsCh <- &statsAndContext{ctx, deltaStats}:
+		case r.statsCh <- &statsAndContext{ctx, deltaStats}:
 			// submitted successfully
 		default:
 			// data lost, probably because Redis submission is taking longer than expected
+			r.opts.Instrument.UsageReportsDropped(context.Background(), deltaStats.SentTotal+deltaStats.RecvTotal, "queue_full")
 		}
 	}
 }
 
-func reportPeriodically(countryLookup geo.CountryLookup, rc *redis.Client, reportInterval time.Duration, throttleConfig throttle.Config, statsCh chan *statsAndContext) {
+type reporter struct {
+	countryLookup  geo.CountryLookup
+	rc             redis.UniversalClient
+	throttleConfig throttle.Config
+	opts           ReporterOpts
+	// Provide some buffering so that we don't lose data while submitting to Redis
+	statsCh   chan *statsAndContext
+	pending   map[string]*statsAndContext
+	scriptSHA string
+	// retryInterval is zero unless the last attempt to submit failed
+	retryInterval time.Duration
+	nextAttempt   time.Time
+}
+
+func newReporter(countryLookup geo.CountryLookup, rc redis.UniversalClient, throttleConfig throttle.Config, opts *ReporterOpts) *reporter {
+	r := &reporter{
+		countryLookup:  countryLookup,
+		rc:             rc,
+		throttleConfig: throttleConfig,
+		statsCh:        make(chan *statsAndContext, 10000),
+		pending:        make(map[string]*statsAndContext),
+	}
+	if opts != nil {
+		r.opts = *opts
+	}
+	if r.opts.MaxPendingDevices <= 0 {
+		r.opts.MaxPendingDevices = DefaultMaxPendingDevices
+	}
+	if r.opts.MaxRetryInterval <= 0 {
+		r.opts.MaxRetryInterval = DefaultMaxRetryInterval
+	}
+	if r.opts.Instrument == nil {
+		r.opts.Instrument = instrument.NoInstrument{}
+	}
+	return r
+}
+
+func (r *reporter) reportPeriodically(reportInterval time.Duration) {
 	// randomize the interval to evenly distribute traffic to reporting Redis.
 	randomized := time.Duration(reportInterval.Nanoseconds()/2 + rand.Int63n(reportInterval.Nanoseconds()))
 	log.Debugf("Will report data usage to Redis every %v", randomized)
 	ticker := time.NewTicker(randomized)
-	statsByDeviceID := make(map[string]*statsAndContext)
-	var scriptSHA string
 	for {
 		select {
-		case sac := <-statsCh:
-			_deviceID := sac.ctx[common.DeviceID]
-			if _deviceID == nil {
-				// ignore
-				continue
-			}
-			deviceID := _deviceID.(string)
-			statsByDeviceID[deviceID] = statsByDeviceID[deviceID].add(sac)
+		case sac := <-r.statsCh:
+			r.add(sac)
 		case <-ticker.C:
-			if log.IsTraceEnabled() {
-				log.Tracef("Submitting %d stats", len(statsByDeviceID))
-			}
-			if scriptSHA == "" {
-				var err error
-				scriptSHA, err = rc.ScriptLoad(context.Background(), updateUsageScript).Result()
-				if err != nil {
-					log.Errorf("Unable to load script, skip submitting stats: %v", err)
-					continue
-				}
-			}
+			r.attemptSubmit(randomized)
+		}
+	}
+}
 
-			err := submit(countryLookup, rc, scriptSHA, statsByDeviceID, throttleConfig)
-			if err != nil {
-				log.Errorf("Unable to submit stats: %v", err)
-			}
-			// Reset stats
-			statsByDeviceID = make(map[string]*statsAndContext)
+func (r *reporter) add(sac *statsAndContext) {
+	_deviceID := sac.ctx[common.DeviceID]
+	if _deviceID == nil {
+		// ignore
+		return
+	}
+	deviceID := _deviceID.(string)
+	existing := r.pending[deviceID]
+	if existing == nil && len(r.pending) >= r.opts.MaxPendingDevices {
+		r.shed()
+	}
+	r.pending[deviceID] = r.pending[deviceID].add(sac)
+}
+
+// shed moves pending usage to the spool file, or drops it if that's not
+// possible.
+func (r *reporter) shed() {
+	if r.opts.SpoolFile != "" {
+		err := appendToSpool(r.opts.SpoolFile, r.pending)
+		if err == nil {
+			log.Debugf("Spooled usage for %d devices to %v", len(r.pending), r.opts.SpoolFile)
+			r.pending = make(map[string]*statsAndContext)
+			return
 		}
+		log.Errorf("Unable to spool usage, dropping it: %v", err)
 	}
+	r.drop(r.pending, "overflow")
+	r.pending = make(map[string]*statsAndContext)
 }
 
-func submit(countryLookup geo.CountryLookup, rc *redis.Client, scriptSHA string, statsByDeviceID map[string]*statsAndContext, throttleConfig throttle.Config) error {
+func (r *reporter) drop(statsByDeviceID map[string]*statsAndContext, reason string) {
+	bytes := 0
+	for _, sac := range statsByDeviceID {
+		bytes += sac.bytes()
+	}
+	log.Errorf("Dropping %d bytes of usage for %d devices: %v", bytes, len(statsByDeviceID), reason)
+	r.opts.Instrument.UsageReportsDropped(context.Background(), bytes, reason)
+}
+
+// attemptSubmit submits pending usage, followed by any spooled usage, unless
+// it's backing off after a failure. Whatever isn't submitted stays pending.
+func (r *reporter) attemptSubmit(reportInterval time.Duration) {
+	if time.Now().Before(r.nextAttempt) {
+		return
+	}
+	if r.retryInterval > 0 {
+		r.opts.Instrument.UsageReportRetries(context.Background())
+	}
+	if log.IsTraceEnabled() {
+		log.Tracef("Submitting %d stats", len(r.pending))
+	}
+	err := r.submit(r.pending)
+	if err == nil {
+		err = r.submitSpooled()
+	}
+	if err != nil {
+		if r.retryInterval == 0 {
+			r.retryInterval = reportInterval
+		} else {
+			r.retryInterval *= 2
+		}
+		if r.retryInterval > r.opts.MaxRetryInterval {
+			r.retryInterval = r.opts.MaxRetryInterval
+		}
+		r.nextAttempt = time.Now().Add(r.retryInterval)
+		log.Errorf("Unable to submit stats, will retry in %v: %v", r.retryInterval, err)
+		return
+	}
+	r.retryInterval = 0
+	r.nextAttempt = time.Time{}
+}
+
+func (r *reporter) submitSpooled() error {
+	if r.opts.SpoolFile == "" {
+		return nil
+	}
+	spooled, err := readSpool(r.opts.SpoolFile)
+	if err != nil {
+		log.Errorf("Unable to read spooled usage: %v", err)
+		return nil
+	}
+	if len(spooled) == 0 {
+		return nil
+	}
+	log.Debugf("Submitting spooled usage for %d devices", len(spooled))
+	err = r.submit(spooled)
+	if rewriteErr := rewriteSpool(r.opts.SpoolFile, spooled); rewriteErr != nil {
+		// don't leave behind usage that's already been submitted
+		log.Errorf("Unable to update spooled usage, dropping it: %v", rewriteErr)
+		if removeErr := os.Remove(r.opts.SpoolFile); removeErr != nil {
+			log.Errorf("Unable to remove spool file: %v", removeErr)
+		}
+		r.drop(spooled, "spool_failed")
+	}
+	return err
+}
+
+// submit submits the usage in statsByDeviceID, removing devices from it as
+// their usage is submitted.
+func (r *reporter) submit(statsByDeviceID map[string]*statsAndContext) error {
+	if len(statsByDeviceID) == 0 {
+		return nil
+	}
+	if r.scriptSHA == "" {
+		var err error
+		r.scriptSHA, err = r.rc.ScriptLoad(context.Background(), updateUsageScript).Result()
+		if err != nil {
+			return fmt.Errorf("unable to load script: %v", err)
+		}
+	}
+	err := submit(r.countryLookup, r.rc, r.scriptSHA, statsByDeviceID, r.throttleConfig)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		// Redis lost the script, probably because it restarted or failed over
+		r.scriptSHA = ""
+	}
+	return err
+}
+
+func submit(countryLookup geo.CountryLookup, rc redis.UniversalClient, scriptSHA string, statsByDeviceID map[string]*statsAndContext, throttleConfig throttle.Config) error {
 	for deviceID, sac := range statsByDeviceID {
 		now := time.Now()
 
 		_clientIP := sac.ctx[common.ClientIP]
 		if _clientIP == nil {
 			log.Error("Missing client_ip in context, this shouldn't happen. Ignoring.")
+			delete(statsByDeviceID, deviceID)
 			continue
 		}
 		clientIP := _clientIP.(string)
@@ -142,7 +310,16 @@ func submit(countryLookup geo.CountryLookup, rc *redis.Client, scriptSHA string,
 		if ok {
 			supportedDataCaps = _supportedDataCaps.([]string)
 		}
-		throttleSettings, hasThrottleSettings := throttleConfig.SettingsFor(deviceID, countryCode, platform, appName, supportedDataCaps)
+		throttleSettings, _ := sac.ctx[common.ForcedThrottleSettings].(*throttle.Settings)
+		if throttleSettings == nil {
+			if throttleConfig == nil {
+				// no throttling applies to this device, nothing to track
+				delete(statsByDeviceID, deviceID)
+				continue
+			}
+			throttleSettings, _ = throttleConfig.SettingsFor(deviceID, countryCode, platform, appName, supportedDataCaps)
+		}
+		hasThrottleSettings := throttleSettings != nil
 
 		pl := rc.Pipeline()
 		throttleCohort := ""
@@ -168,7 +345,7 @@ func submit(countryLookup geo.CountryLookup, rc *redis.Client, scriptSHA string,
 				strconv.Itoa(stats.SentTotal),
 				strings.ToLower(countryCode),
 				clientIP,
-				expirationFor(now, throttleSettings.CapResets, timeZone))
+				throttle.ExpirationFor(now, throttleSettings.CapResets, timeZone))
 		}
 		log.Tracef("device %v on platform %v in country %v with supported data caps %v is in throttle cohort %v", deviceID, platform, countryCode, supportedDataCaps, throttleCohort)
 		countryCodeLower := strings.ToLower(countryCode)
@@ -179,7 +356,7 @@ func submit(countryLookup geo.CountryLookup, rc *redis.Client, scriptSHA string,
 		pl.SAdd(context.Background(), uniqueDevicesKey, deviceID)
 		// we don't keep these around forever to save space, however we do need to keep them around for longer than the purchase data from pro-server,
 		// to make sure that we can identify the device cohort for all purchases
-		pl.ExpireAt(context.Background(), uniqueDevicesKey, daysFrom(nowUTC.In(time.UTC), 4))
+		pl.ExpireAt(context.Background(), uniqueDevicesKey, throttle.DaysFrom(nowUTC.In(time.UTC), 4))
 
 		deviceLastSeenKey := "_deviceLastSeen:" + countryCodeLower + ":" + throttleCohort + ":" + deviceID
 		pl.Set(context.Background(), deviceLastSeenKey, now.Unix(), 0)
@@ -216,36 +393,7 @@ func submit(countryLookup geo.CountryLookup, rc *redis.Client, scriptSHA string,
 			ttlSeconds := result[3].(int64)
 			usage.Set(deviceID, countryCode, bytesIn+bytesOut, now, ttlSeconds)
 		}
+		delete(statsByDeviceID, deviceID)
 	}
 	return nil
 }
-
-func expirationFor(now time.Time, ttl throttle.CapInterval, timeZoneName string) int64 {
-	tz, err := time.LoadLocation(timeZoneName)
-	if err == nil {
-		// adjust to given timeZone
-		now = now.In(tz)
-	}
-	switch ttl {
-	case throttle.Daily:
-		return daysFrom(now, 1).Unix()
-	case throttle.Weekly:
-		daysFromSunday := int(now.Weekday())
-		daysToNextMonday := 8 - daysFromSunday
-		if daysToNextMonday > 7 {
-			// today's Sunday, so next Monday is in just 1 day
-			daysToNextMonday = 1
-		}
-		nextMonday := now.AddDate(0, 0, daysToNextMonday)
-		return time.Date(nextMonday.Year(), nextMonday.Month(), nextMonday.Day(), 0, 0, 0, 0, now.Location()).Add(-1 * time.Nanosecond).Unix()
-	case throttle.Monthly, throttle.Legacy:
-		nextMonth := now.AddDate(0, 1, 0)
-		return time.Date(nextMonth.Year(), nextMonth.Month(), 1, 0, 0, 0, 0, now.Location()).Add(-1 * time.Nanosecond).Unix()
-	}
-	return 0
-}
-
-func daysFrom(start time.Time, days int) time.Time {
-	next := start.AddDate(0, 0, days)
-	return time.Date(next.Year(), next.Month(), next.Day(), 0, 0, 0, 0, start.Location()).Add(-1 * time.Nanosecond)
-}
@@ -3,24 +3,145 @@ package redis
 import (
 	"crypto/tls"
 	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/go-redis/redis/v8"
 )
 
-// Creates a new redis client with the specified redis URL to use, in the form:
-// rediss://:password@host
-func NewClient(redisURL string) (*redis.Client, error) {
-	opt, err := redis.ParseURL(redisURL)
+// TLS modes for NewClient
+const (
+	// TLSAlways always uses TLS, irrespective of the URL scheme.
+	TLSAlways = "always"
+	// TLSNever never uses TLS, irrespective of the URL scheme.
+	TLSNever = "never"
+	// TLSFromScheme uses TLS for the rediss schemes only.
+	TLSFromScheme = "scheme"
+
+	// DefaultPoolSize is the default number of connections per redis node.
+	DefaultPoolSize = 2
+)
+
+// ClientOpts configures the client created by NewClient.
+type ClientOpts struct {
+	// PoolSize is the number of connections per redis node. Defaults to
+	// DefaultPoolSize.
+	PoolSize int
+
+	// TLSMode is one of TLSAlways (the default), TLSNever or TLSFromScheme.
+	TLSMode string
+}
+
+// NewClient creates a new redis client with the specified redis URL to use, in
+// one of the forms below, using TLS as given by opts (nil for defaults).
+//
+// Single node:
+//
+//	rediss://:password@host:port
+//
+// Sentinel, where master is the name of the master monitored by the sentinels:
+//
+//	rediss-sentinel://:password@sentinel1:port,sentinel2:port/master
+//
+// Cluster, listing one or more nodes from which to discover the cluster:
+//
+//	rediss-cluster://:password@node1:port,node2:port
+//
+// Each scheme also has an equivalent without the trailing s, which only differs
+// with TLSFromScheme.
+func NewClient(redisURL string, opts *ClientOpts) (redis.UniversalClient, error) {
+	if opts == nil {
+		opts = &ClientOpts{}
+	}
+	topology, uopts, err := parseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	uopts.PoolSize = opts.PoolSize
+	if uopts.PoolSize <= 0 {
+		uopts.PoolSize = DefaultPoolSize
+	}
+	switch opts.TLSMode {
+	case "", TLSAlways:
+		uopts.TLSConfig = newTLSConfig()
+	case TLSFromScheme:
+		if strings.HasPrefix(redisURL, "rediss") {
+			uopts.TLSConfig = newTLSConfig()
+		}
+	case TLSNever:
+	default:
+		return nil, fmt.Errorf("unknown redis TLS mode %v", opts.TLSMode)
+	}
+
+	switch topology {
+	case sentinel:
+		return redis.NewFailoverClient(uopts.Failover()), nil
+	case cluster:
+		return redis.NewClusterClient(uopts.Cluster()), nil
+	default:
+		return redis.NewClient(uopts.Simple()), nil
+	}
+}
+
+type topology int
+
+const (
+	single topology = iota
+	sentinel
+	cluster
+)
+
+func parseURL(redisURL string) (topology, *redis.UniversalOptions, error) {
+	u, err := url.Parse(redisURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse URL")
+		return single, nil, fmt.Errorf("failed to parse URL")
+	}
+
+	var t topology
+	switch u.Scheme {
+	case "redis", "rediss":
+		// parse as before to remain compatible with existing URLs
+		opt, err := redis.ParseURL(redisURL)
+		if err != nil {
+			return single, nil, fmt.Errorf("failed to parse URL")
+		}
+		return single, &redis.UniversalOptions{
+			Addrs:    []string{opt.Addr},
+			Password: opt.Password,
+		}, nil
+	case "redis-sentinel", "rediss-sentinel":
+		t = sentinel
+	case "redis-cluster", "rediss-cluster":
+		t = cluster
+	default:
+		return single, nil, fmt.Errorf("unsupported redis URL scheme %v", u.Scheme)
 	}
 
-	return redis.NewClient(&redis.Options{
-		Addr:     opt.Addr,
-		Password: opt.Password,
-		PoolSize: 2,
-		TLSConfig: &tls.Config{
-			ClientSessionCache: tls.NewLRUClientSessionCache(20),
-		},
-	}), nil
+	uopts := &redis.UniversalOptions{}
+	for _, addr := range strings.Split(u.Host, ",") {
+		if addr != "" {
+			uopts.Addrs = append(uopts.Addrs, addr)
+		}
+	}
+	if len(uopts.Addrs) == 0 {
+		return t, nil, fmt.Errorf("no redis addresses in URL")
+	}
+	if u.User != nil {
+		uopts.Username = u.User.Username()
+		uopts.Password, _ = u.User.Password()
+	}
+	if t == sentinel {
+		uopts.MasterName = strings.Trim(u.Path, "/")
+		if uopts.MasterName == "" {
+			return t, nil, fmt.Errorf("no sentinel master name in URL")
+		}
+	}
+	return t, uopts, nil
+}
+
+func newTLSConfig() *tls.Config {
+	return &tls.Config{
+		ClientSessionCache: tls.NewLRUClientSessionCache(20),
+	}
 }
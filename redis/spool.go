@@ -0,0 +1,154 @@
+package redis
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/getlantern/measured"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+)
+
+// spooledStats is the usage of a single device as written to the spool file,
+// along with the parts of its context that are needed to submit it.
+type spooledStats struct {
+	DeviceID          string   `json:"deviceID"`
+	ClientIP          string   `json:"clientIP,omitempty"`
+	Platform          string   `json:"platform,omitempty"`
+	App               string   `json:"app,omitempty"`
+	SupportedDataCaps []string `json:"supportedDataCaps,omitempty"`
+	TimeZone          string   `json:"timeZone,omitempty"`
+	Throttled         bool     `json:"throttled,omitempty"`
+	SentTotal         int      `json:"sent"`
+	RecvTotal         int      `json:"recv"`
+}
+
+func toSpooled(deviceID string, sac *statsAndContext) *spooledStats {
+	ss := &spooledStats{
+		DeviceID:  deviceID,
+		Throttled: sac.ctx["throttled"] == true,
+		SentTotal: sac.stats.SentTotal,
+		RecvTotal: sac.stats.RecvTotal,
+	}
+	ss.ClientIP, _ = sac.ctx[common.ClientIP].(string)
+	ss.Platform, _ = sac.ctx[common.Platform].(string)
+	ss.App, _ = sac.ctx[common.App].(string)
+	ss.SupportedDataCaps, _ = sac.ctx[common.SupportedDataCaps].([]string)
+	ss.TimeZone, _ = sac.ctx[common.TimeZone].(string)
+	return ss
+}
+
+func (ss *spooledStats) toStatsAndContext() *statsAndContext {
+	ctx := map[string]interface{}{
+		common.DeviceID: ss.DeviceID,
+		"throttled":     ss.Throttled,
+	}
+	if ss.ClientIP != "" {
+		ctx[common.ClientIP] = ss.ClientIP
+	}
+	if ss.Platform != "" {
+		ctx[common.Platform] = ss.Platform
+	}
+	if ss.App != "" {
+		ctx[common.App] = ss.App
+	}
+	if ss.SupportedDataCaps != nil {
+		ctx[common.SupportedDataCaps] = ss.SupportedDataCaps
+	}
+	if ss.TimeZone != "" {
+		ctx[common.TimeZone] = ss.TimeZone
+	}
+	return &statsAndContext{ctx, &measured.Stats{SentTotal: ss.SentTotal, RecvTotal: ss.RecvTotal}}
+}
+
+// appendToSpool appends the given usage to the spool file at path, one JSON
+// object per line.
+func appendToSpool(path string, statsByDeviceID map[string]*statsAndContext) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open spool file %v: %v", path, err)
+	}
+	if err := writeSpooled(f, statsByDeviceID); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write to spool file %v: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to close spool file %v: %v", path, err)
+	}
+	return nil
+}
+
+func writeSpooled(f *os.File, statsByDeviceID map[string]*statsAndContext) error {
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for deviceID, sac := range statsByDeviceID {
+		if err := enc.Encode(toSpooled(deviceID, sac)); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// readSpool reads the usage in the spool file at path, adding up the usage of
+// devices that were spooled more than once. A missing file has no usage.
+func readSpool(path string) (map[string]*statsAndContext, error) {
+	statsByDeviceID := make(map[string]*statsAndContext)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return statsByDeviceID, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open spool file %v: %v", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ss := &spooledStats{}
+		if err := json.Unmarshal(scanner.Bytes(), ss); err != nil {
+			// probably a partially written line, skip it
+			log.Errorf("Skipping invalid line in spool file %v: %v", path, err)
+			continue
+		}
+		if ss.DeviceID == "" {
+			continue
+		}
+		statsByDeviceID[ss.DeviceID] = statsByDeviceID[ss.DeviceID].add(ss.toStatsAndContext())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read spool file %v: %v", path, err)
+	}
+	return statsByDeviceID, nil
+}
+
+// rewriteSpool atomically replaces the spool file at path with the given
+// usage, removing the file if there's none left.
+func rewriteSpool(path string, statsByDeviceID map[string]*statsAndContext) error {
+	if len(statsByDeviceID) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove spool file %v: %v", path, err)
+		}
+		return nil
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open spool file %v: %v", tmpPath, err)
+	}
+	if err := writeSpooled(f, statsByDeviceID); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write to spool file %v: %v", tmpPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to close spool file %v: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("unable to replace spool file %v: %v", path, err)
+	}
+	return nil
+}
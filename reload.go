@@ -0,0 +1,534 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+
+	"github.com/getlantern/http-proxy-lantern/v2/admin"
+	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
+	"github.com/getlantern/http-proxy-lantern/v2/coversite"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+	"github.com/getlantern/http-proxy-lantern/v2/tokenfilter"
+)
+
+var (
+	// fields that are set up once per process and are never reloaded
+	nonReloadableFields = map[string]bool{
+		"CountryLookup":        true,
+		"ISPLookup":            true,
+		"ReportingRedisClient": true,
+	}
+
+	// fields holding the address of each protocol's listener, changes to which
+	// are detected by comparing protoListenerArgs
+	listenerAddrFields = map[string]string{
+		"https":                 "HTTPAddr",
+		"https_multiplex":       "HTTPMultiplexAddr",
+		"tlsmasq":               "TLSMasqAddr",
+		"starbridge":            "StarbridgeAddr",
+		"broflake":              "BroflakeAddr",
+		"algeneva":              "AlgenevaAddr",
+		"obfs4":                 "Obfs4Addr",
+		"obfs4_multiplex":       "Obfs4MultiplexAddr",
+		"lampshade":             "LampshadeAddr",
+		"kcp":                   "KCPConf",
+		"quic_ietf":             "QUICIETFAddr",
+		"shadowsocks":           "ShadowsocksAddr",
+		"shadowsocks_multiplex": "ShadowsocksMultiplexAddr",
+		"water":                 "WaterAddr",
+		"vmess":                 "VMessAddr",
+		"vless":                 "VLESSAddr",
+		"trojan":                "TrojanAddr",
+		"socks5":                "SOCKS5Addr",
+		"socks5_multiplex":      "SOCKS5MultiplexAddr",
+	}
+)
+
+// listenerUpdater applies changes to some configuration fields to a running
+// listener without rebuilding it.
+type listenerUpdater struct {
+	fields []string
+	update func(newCfg *Proxy) error
+}
+
+// runningListener is a listener that is currently being served for a given
+// protocol.
+type runningListener struct {
+	net.Listener
+	protocol string
+	addr     string
+	stopCh   chan interface{}
+	stopOnce sync.Once
+	conns    int64
+}
+
+func (rl *runningListener) Accept() (net.Conn, error) {
+	conn, err := rl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&rl.conns, 1)
+	wc, _ := conn.(listeners.WrapConnEmbeddable)
+	return &countedConn{WrapConnEmbeddable: wc, Conn: conn, listener: rl}, nil
+}
+
+// countedConn keeps track of how many connections accepted by a
+// runningListener are still open.
+type countedConn struct {
+	listeners.WrapConnEmbeddable
+	net.Conn
+	listener  *runningListener
+	closeOnce sync.Once
+}
+
+func (c *countedConn) OnState(s http.ConnState) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.OnState(s)
+	}
+}
+
+func (c *countedConn) ControlMessage(msgType string, data interface{}) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.ControlMessage(msgType, data)
+	}
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.AddInt64(&c.listener.conns, -1)
+	})
+	return c.Conn.Close()
+}
+
+// Protocol implements accesslog.ProtocolConn.
+func (c *countedConn) Protocol() string {
+	return c.listener.protocol
+}
+
+func (c *countedConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// stop closes the listener, signaling to whoever is serving it that it was
+// closed on purpose.
+func (rl *runningListener) stop() {
+	rl.stopOnce.Do(func() {
+		close(rl.stopCh)
+	})
+	if err := rl.Close(); err != nil {
+		log.Debugf("Error closing %v listener at %v: %v", rl.protocol, rl.addr, err)
+	}
+}
+
+// Drain stops accepting new connections on the listener without closing the
+// connections it already accepted.
+func (rl *runningListener) Drain() error {
+	return listeners.Drain(rl.Listener)
+}
+
+func (rl *runningListener) isStopped() bool {
+	select {
+	case <-rl.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// reloader keeps track of the running listeners and the configuration they
+// were built with so that a new configuration can be applied with Reload.
+type reloader struct {
+	current         *Proxy
+	onListenerError func(net.Conn, error)
+	wrapListener    func(net.Listener) net.Listener
+	listeners       map[string]*runningListener
+	serve           func(*runningListener)
+	mx              sync.Mutex
+
+	updaters   map[string][]*listenerUpdater
+	updatersMx sync.Mutex
+}
+
+func newReloader(p *Proxy, onListenerError func(net.Conn, error), wrapListener func(net.Listener) net.Listener) *reloader {
+	if wrapListener == nil {
+		wrapListener = func(l net.Listener) net.Listener { return l }
+	}
+	return &reloader{
+		current:         p,
+		onListenerError: onListenerError,
+		wrapListener:    wrapListener,
+		listeners:       make(map[string]*runningListener),
+		updaters:        make(map[string][]*listenerUpdater),
+	}
+}
+
+// add tracks a newly built listener for the given protocol and returns it
+// wrapped as a runningListener. The caller is responsible for serving it.
+func (r *reloader) add(protocol, addr string, l net.Listener) *runningListener {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.doAdd(protocol, addr, l)
+}
+
+func (r *reloader) doAdd(protocol, addr string, l net.Listener) *runningListener {
+	rl := &runningListener{
+		Listener: r.wrapListener(l),
+		protocol: protocol,
+		addr:     addr,
+		stopCh:   make(chan interface{}),
+	}
+	r.listeners[protocol] = rl
+	return rl
+}
+
+// serveWith starts serving all tracked listeners with the given function and
+// remembers it for serving listeners that get rebuilt on Reload. Without
+// calling this, Reload can't rebuild listeners, which is the case when serving
+// multipath.
+func (r *reloader) serveWith(serve func(*runningListener)) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.serve = serve
+	for _, rl := range r.listeners {
+		serve(rl)
+	}
+}
+
+// listenerInfo describes the running listeners, sorted by protocol.
+func (r *reloader) listenerInfo() []admin.Listener {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	result := make([]admin.Listener, 0, len(r.listeners))
+	for _, rl := range r.listeners {
+		result = append(result, admin.Listener{
+			Protocol:    rl.protocol,
+			Addr:        rl.Addr().String(),
+			Connections: atomic.LoadInt64(&rl.conns),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Protocol < result[j].Protocol
+	})
+	return result
+}
+
+func (r *reloader) addUpdater(addr string, fields []string, update func(newCfg *Proxy) error) {
+	r.updatersMx.Lock()
+	defer r.updatersMx.Unlock()
+	r.updaters[addr] = append(r.updaters[addr], &listenerUpdater{fields: fields, update: update})
+}
+
+func (r *reloader) removeUpdaters(addr string) {
+	r.updatersMx.Lock()
+	defer r.updatersMx.Unlock()
+	delete(r.updaters, addr)
+}
+
+// applyUpdaters tries to apply changes to the given fields to the listener at
+// addr in place. It returns false if the listener needs to be rebuilt instead.
+func (r *reloader) applyUpdaters(addr string, changed []string, newCfg *Proxy) bool {
+	r.updatersMx.Lock()
+	updaters := r.updaters[addr]
+	r.updatersMx.Unlock()
+
+	remaining := make(map[string]bool, len(changed))
+	for _, field := range changed {
+		remaining[field] = true
+	}
+	for _, u := range updaters {
+		applies := false
+		for _, field := range u.fields {
+			applies = applies || remaining[field]
+		}
+		if !applies {
+			continue
+		}
+		if err := u.update(newCfg); err != nil {
+			log.Errorf("Unable to update listener at %v in place, will rebuild it: %v", addr, err)
+			return false
+		}
+		for _, field := range u.fields {
+			delete(remaining, field)
+		}
+	}
+	return len(remaining) == 0
+}
+
+// restart stops the listener currently running for the given protocol, if
+// any, and starts a new one as specified by args.
+func (r *reloader) restart(args protoListenerArgs) error {
+	if r.serve == nil {
+		return errors.New("unable to rebuild %v listener, restart the process for the change to take effect", args.protocol)
+	}
+	if rl := r.listeners[args.protocol]; rl != nil {
+		log.Debugf("Stopping %v listener at %v", rl.protocol, rl.addr)
+		rl.stop()
+		delete(r.listeners, args.protocol)
+		r.removeUpdaters(rl.addr)
+	}
+	if args.addr == "" {
+		return nil
+	}
+	l, err := args.fn(args.addr)
+	if err != nil {
+		return errors.New("unable to rebuild %v listener: %v", args.protocol, err)
+	}
+	r.serve(r.doAdd(args.protocol, args.addr, l))
+	return nil
+}
+
+// onReload registers a function that applies changes to the given fields to
+// the listener built for addr without rebuilding it.
+func (p *Proxy) onReload(addr string, fields []string, update func(newCfg *Proxy) error) {
+	if p.reloader == nil {
+		return
+	}
+	p.reloader.addUpdater(addr, fields, update)
+}
+
+// Reload applies the configuration in newCfg to the running proxy without
+// dropping existing client connections. Changes to the token, tunnel ports,
+// throttle refresh interval, shadowsocks ciphers, VMess UUIDs, session ticket
+// keys and the blacklist settings other than its storage are applied in place.
+// Listeners affected by other changes are closed and rebuilt with the new
+// configuration while all other listeners keep running. Changes that can only
+// take effect with a process restart are logged.
+//
+// newCfg should be a freshly built Proxy that isn't used for anything else.
+// Reload can only be called once ListenAndServe is running.
+func (p *Proxy) Reload(newCfg *Proxy) error {
+	r := p.reloader
+	if r == nil {
+		return errors.New("proxy isn't running")
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	cur := r.current
+	newCfg.inheritRunningState(cur)
+	newCfg.setBenchmarkMode()
+
+	var allowedPorts []int
+	if newCfg.TunnelPorts != "" {
+		var err error
+		allowedPorts, err = portsFromCSV(newCfg.TunnelPorts)
+		if err != nil {
+			return errors.New("invalid tunnel ports %v: %v", newCfg.TunnelPorts, err)
+		}
+	}
+
+	tokenMode, err := tokenfilter.ParseMode(newCfg.TokenMode)
+	if err != nil {
+		return errors.New("invalid token mode: %v", err)
+	}
+
+	var coverSite *coversite.Site
+	if newCfg.CoverSiteOrigin != "" {
+		coverSite, err = coversite.New(newCfg.CoverSiteOrigin)
+		if err != nil {
+			return err
+		}
+	}
+
+	changed := changedFields(cur, newCfg)
+	if len(changed) == 0 {
+		log.Debug("Configuration unchanged, nothing to reload")
+		return nil
+	}
+	log.Debugf("Reloading configuration with changes to: %v", strings.Join(sortedFields(changed), ", "))
+
+	handled := make(map[string]bool)
+	if changed["Token"] {
+		if cur.tokenFilter != nil {
+			cur.tokenFilter.SetToken(newCfg.Token)
+		}
+		handled["Token"] = true
+	}
+	if changed["TokenMode"] || changed["TokenSecret"] {
+		if cur.tokenFilter != nil {
+			if err := cur.tokenFilter.SetHMAC(newCfg.TokenSecret, tokenMode); err != nil {
+				return errors.New("unable to update token filter: %v", err)
+			}
+		}
+		handled["TokenMode"] = true
+		handled["TokenSecret"] = true
+	}
+	if changed["CoverSiteOrigin"] {
+		if cur.tokenFilter != nil {
+			cur.tokenFilter.SetCoverSite(coverSite)
+		}
+		handled["CoverSiteOrigin"] = true
+	}
+	if changed["MimicPersonality"] {
+		if err := newCfg.setMimicPersonality(); err != nil {
+			log.Errorf("Unable to update mimic personality: %v", err)
+		} else {
+			handled["MimicPersonality"] = true
+		}
+	}
+	if changed["DeviceSignatureKeys"] && cur.deviceVerifier != nil {
+		if err := cur.deviceVerifier.SetKeys(newCfg.DeviceSignatureKeys); err != nil {
+			log.Errorf("Unable to update device signature keys: %v", err)
+		} else {
+			handled["DeviceSignatureKeys"] = true
+		}
+	}
+	if changed["VMessUUIDs"] && cur.vmessUsers != nil && newCfg.VMessAddr == "" {
+		// picked up when vmess is enabled again
+		handled["VMessUUIDs"] = true
+	} else if changed["VMessUUIDs"] && cur.vmessUsers != nil {
+		if err := cur.vmessUsers.Update(newCfg.VMessUUIDs); err != nil {
+			log.Errorf("Unable to update vmess UUIDs: %v", err)
+		} else {
+			handled["VMessUUIDs"] = true
+		}
+	}
+	if changed["TunnelPorts"] {
+		if cur.connectPorts != nil {
+			cur.connectPorts.SetAllowedPorts(allowedPorts)
+		}
+		handled["TunnelPorts"] = true
+	}
+	if changed["BlacklistEnabled"] {
+		blacklist.SetEnabled(newCfg.BlacklistEnabled)
+		handled["BlacklistEnabled"] = true
+	}
+	if changed["BlacklistDryRun"] {
+		blacklist.SetDryRun(newCfg.BlacklistDryRun)
+		handled["BlacklistDryRun"] = true
+	}
+	if changed["BlacklistEntries"] && cur.blacklist != nil {
+		if err := cur.blacklist.SetEntries(newCfg.BlacklistEntries); err != nil {
+			log.Errorf("Unable to update blacklist entries: %v", err)
+		} else {
+			handled["BlacklistEntries"] = true
+		}
+	}
+	if changed["BlacklistAllowlist"] && cur.blacklist != nil {
+		if err := cur.blacklist.SetAllowlist(newCfg.BlacklistAllowlist); err != nil {
+			log.Errorf("Unable to update blacklist allowlist: %v", err)
+		} else {
+			handled["BlacklistAllowlist"] = true
+		}
+	}
+	// DrainTimeout is looked up from the current configuration on shutdown
+	handled["DrainTimeout"] = true
+	if changed["ThrottleRefreshInterval"] && cur.throttleConfig != nil && newCfg.ThrottleRefreshInterval > 0 {
+		if err := throttle.SetRefreshInterval(cur.throttleConfig, newCfg.ThrottleRefreshInterval); err != nil {
+			log.Errorf("Unable to update throttle refresh interval: %v", err)
+		} else {
+			handled["ThrottleRefreshInterval"] = true
+		}
+	}
+
+	var errs []string
+	curArgs := getProtoListenersArgs(cur, r.onListenerError)
+	for i, args := range getProtoListenersArgs(newCfg, r.onListenerError) {
+		handled[listenerAddrFields[args.protocol]] = true
+		var affected []string
+		for _, field := range args.restartOn {
+			if changed[field] {
+				handled[field] = true
+				affected = append(affected, field)
+			}
+		}
+
+		running := r.listeners[args.protocol]
+		needsRestart := args.addr != curArgs[i].addr || (running == nil && args.addr != "")
+		if !needsRestart && running != nil && len(affected) > 0 {
+			needsRestart = !r.applyUpdaters(running.addr, affected, newCfg)
+		}
+		if !needsRestart {
+			continue
+		}
+		if err := r.restart(args); err != nil {
+			log.Error(err)
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if newCfg.ShadowsocksAddr == "" && newCfg.ShadowsocksMultiplexAddr == "" && newCfg.shadowsocksKeys != nil {
+		// the keys are kept for the admin API and in case shadowsocks is enabled
+		// again, but there's no point in watching the keys file until then
+		newCfg.shadowsocksKeys.Close()
+	}
+	if newCfg.VMessAddr == "" && newCfg.vmessUsers != nil {
+		// likewise, the VMess service is started again once it's needed
+		if err := newCfg.vmessUsers.Close(); err != nil {
+			log.Errorf("Unable to close vmess service: %v", err)
+		}
+	}
+
+	for _, field := range sortedFields(changed) {
+		if !handled[field] {
+			log.Debugf("Change to %v requires restarting the process to take effect", field)
+		}
+	}
+
+	r.current = newCfg
+	if len(errs) > 0 {
+		return errors.New("errors reloading configuration: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// inheritRunningState copies the state that was set up by ListenAndServe from
+// the running proxy so that listeners built from this configuration share it.
+func (p *Proxy) inheritRunningState(running *Proxy) {
+	p.CountryLookup = running.CountryLookup
+	p.ISPLookup = running.ISPLookup
+	p.ReportingRedisClient = running.ReportingRedisClient
+	p.throttleConfig = running.throttleConfig
+	p.localUsage = running.localUsage
+	p.shadowsocksKeys = running.shadowsocksKeys
+	p.vmessUsers = running.vmessUsers
+	p.instrument = running.instrument
+	p.tokenFilter = running.tokenFilter
+	p.deviceVerifier = running.deviceVerifier
+	p.blacklist = running.blacklist
+	p.ipFilter = running.ipFilter
+	p.connectPorts = running.connectPorts
+	p.reloader = running.reloader
+}
+
+// changedFields returns the names of the exported fields that differ between
+// the two configurations.
+func changedFields(a, b *Proxy) map[string]bool {
+	changed := make(map[string]bool)
+	av, bv := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	t := av.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || nonReloadableFields[field.Name] {
+			continue
+		}
+		if field.Name == "MissingTicketReaction" {
+			// HandshakeReactions contain funcs, which are never deeply equal
+			if a.MissingTicketReaction.Action() != b.MissingTicketReaction.Action() {
+				changed[field.Name] = true
+			}
+			continue
+		}
+		if !reflect.DeepEqual(av.Field(i).Interface(), bv.Field(i).Interface()) {
+			changed[field.Name] = true
+		}
+	}
+	return changed
+}
+
+func sortedFields(fields map[string]bool) []string {
+	result := make([]string, 0, len(fields))
+	for field := range fields {
+		result = append(result, field)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/getlantern/waitforserver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+	"github.com/getlantern/http-proxy-lantern/v2/tlslistener"
+)
+
+func TestReload(t *testing.T) {
+	cfg := func(token, addr string) *Proxy {
+		return &Proxy{
+			TestingLocal:       true,
+			Token:              token,
+			IdleTimeout:        1 * time.Minute,
+			HTTPAddr:           addr,
+			GoogleSearchRegex:  "bequiet",
+			GoogleCaptchaRegex: "bequiet",
+		}
+	}
+
+	oldAddr := "127.0.0.1:18721"
+	newAddr := "127.0.0.1:18723"
+	newToken := "n3wT0k3n"
+	proxy := cfg(validToken, oldAddr)
+	require.Error(t, proxy.Reload(cfg(newToken, oldAddr)), "reloading before serving should fail")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		assert.NoError(t, proxy.ListenAndServe(ctx))
+	}()
+	require.NoError(t, WaitForServer("tcp", oldAddr, 10*time.Second))
+
+	request := func(addr, token string) (int, string) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		return requestThroughConn(t, conn, token)
+	}
+
+	t.Run("token is updated in place", func(t *testing.T) {
+		conn, err := net.Dial("tcp", oldAddr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, proxy.Reload(cfg(newToken, oldAddr)))
+
+		_, body := request(oldAddr, validToken)
+		assert.NotContains(t, body, targetResponse, "old token should no longer be accepted")
+		status, body := request(oldAddr, newToken)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, targetResponse)
+
+		status, body = requestThroughConn(t, conn, newToken)
+		assert.Equal(t, http.StatusOK, status, "connection opened before reload should still work")
+		assert.Contains(t, body, targetResponse)
+	})
+
+	t.Run("listener is rebuilt on address change", func(t *testing.T) {
+		require.NoError(t, proxy.Reload(cfg(newToken, newAddr)))
+		require.NoError(t, WaitForServer("tcp", newAddr, 10*time.Second))
+
+		status, body := request(newAddr, newToken)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, targetResponse)
+
+		_, err := net.DialTimeout("tcp", oldAddr, 1*time.Second)
+		assert.Error(t, err, "old listener should have been closed")
+	})
+
+	t.Run("invalid config is rejected", func(t *testing.T) {
+		bad := cfg(validToken, newAddr)
+		bad.TunnelPorts = "443,notaport"
+		require.Error(t, proxy.Reload(bad))
+
+		status, body := request(newAddr, newToken)
+		assert.Equal(t, http.StatusOK, status, "rejected config should leave the token unchanged")
+		assert.Contains(t, body, targetResponse)
+	})
+}
+
+func TestChangedFields(t *testing.T) {
+	a := &Proxy{Token: "a", MissingTicketReaction: tlslistener.ReflectToSite("example.com")}
+	b := &Proxy{Token: "b", MissingTicketReaction: tlslistener.ReflectToSite("example.com")}
+	assert.Equal(t, map[string]bool{"Token": true}, changedFields(a, b))
+
+	b.MissingTicketReaction = tlslistener.CloseConnection
+	b.VMessUUIDs = []string{"uuid"}
+	assert.Equal(t, map[string]bool{"Token": true, "MissingTicketReaction": true, "VMessUUIDs": true}, changedFields(a, b))
+}
+
+func TestListenerFieldsExist(t *testing.T) {
+	proxyType := reflect.TypeOf(Proxy{})
+	p := &Proxy{HTTPS: true}
+	for _, args := range getProtoListenersArgs(p, nil) {
+		addrField, found := listenerAddrFields[args.protocol]
+		if assert.True(t, found, "missing address field for %v", args.protocol) {
+			_, found = proxyType.FieldByName(addrField)
+			assert.True(t, found, "unknown address field %v", addrField)
+		}
+		for _, field := range args.restartOn {
+			_, found := proxyType.FieldByName(field)
+			assert.True(t, found, "unknown field %v for %v", field, args.protocol)
+		}
+	}
+}
+
+type controlledConn struct {
+	net.Conn
+	states   []http.ConnState
+	messages []string
+}
+
+func (c *controlledConn) OnState(s http.ConnState) {
+	c.states = append(c.states, s)
+}
+
+func (c *controlledConn) ControlMessage(msgType string, data interface{}) {
+	c.messages = append(c.messages, msgType)
+}
+
+func (c *controlledConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+func TestCountedConnPassesThroughControl(t *testing.T) {
+	base, client := net.Pipe()
+	defer client.Close()
+	inner := &controlledConn{Conn: base}
+	rl := &runningListener{Listener: &singleConnListener{conn: inner}, stopCh: make(chan interface{})}
+	conn, err := rl.Accept()
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, rl.conns)
+
+	wc, ok := conn.(listeners.WrapConn)
+	require.True(t, ok, "counted conn should be a WrapConn")
+	wc.OnState(http.StateActive)
+	wc.ControlMessage("measured", nil)
+	wc.ControlMessage("throttle", nil)
+	assert.Equal(t, []http.ConnState{http.StateActive}, inner.states)
+	assert.Equal(t, []string{"measured", "throttle"}, inner.messages)
+
+	require.NoError(t, conn.Close())
+	assert.EqualValues(t, 0, rl.conns)
+}
+
+type singleConnListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	return l.conn, nil
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/getlantern/measured"
 
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/localusage"
 	"github.com/getlantern/http-proxy-lantern/v2/redis"
 	"github.com/getlantern/http-proxy-lantern/v2/throttle"
 )
@@ -27,7 +28,7 @@ type reportingConfig struct {
 	wrapper func(ls net.Listener) net.Listener
 }
 
-func newReportingConfig(countryLookup geo.CountryLookup, rc *rclient.Client, instrument instrument.Instrument, throttleConfig throttle.Config) *reportingConfig {
+func newReportingConfig(countryLookup geo.CountryLookup, rc rclient.UniversalClient, localUsage *localusage.Store, instrument instrument.Instrument, throttleConfig throttle.Config, reporterOpts *redis.ReporterOpts) *reportingConfig {
 	proxiedBytesReporter := func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
 		if deltaStats.SentTotal == 0 && deltaStats.RecvTotal == 0 {
 			// nothing to report
@@ -43,6 +44,10 @@ func newReportingConfig(countryLookup geo.CountryLookup, rc *rclient.Client, ins
 		deviceID := fromContext(ctx, common.DeviceID)
 		originHost := fromContext(ctx, common.OriginHost)
 		probingError := fromContext(ctx, common.ProbingError)
+		tokenLabel := fromContext(ctx, common.TokenLabel)
+		accessKeyID := fromContext(ctx, common.AccessKeyID)
+		vmessUUID := fromContext(ctx, common.VMessUUID)
+		vlessUUID := fromContext(ctx, common.VLESSUUID)
 		arch := fromContext(ctx, common.KernelArch)
 
 		var client_ip net.IP
@@ -56,18 +61,20 @@ func newReportingConfig(countryLookup geo.CountryLookup, rc *rclient.Client, ins
 		if hasThrottleSettings {
 			dataCapCohort = throttleSettings.(*throttle.Settings).Label
 		}
-		instrument.ProxiedBytes(context.Background(), deltaStats.SentTotal, deltaStats.RecvTotal, platform, platformVersion, libraryVersion, appVersion, app, locale, dataCapCohort, probingError, client_ip, deviceID, originHost, arch)
+		instrument.ProxiedBytes(context.Background(), deltaStats.SentTotal, deltaStats.RecvTotal, platform, platformVersion, libraryVersion, appVersion, app, locale, dataCapCohort, probingError, client_ip, deviceID, originHost, arch, tokenLabel, accessKeyID, vmessUUID, vlessUUID)
 	}
 
 	var reporter listeners.MeasuredReportFN
-	if throttleConfig == nil {
-		log.Debug("No throttling configured, don't bother reporting bandwidth usage to Redis")
+	if rc == nil && localUsage == nil {
+		log.Debug("No Redis or local usage store, don't bother reporting bandwidth usage")
 		reporter = func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats,
 			final bool) {
 			// noop
 		}
 	} else if rc != nil {
-		reporter = redis.NewMeasuredReporter(countryLookup, rc, measuredReportingInterval, throttleConfig)
+		reporter = redis.NewMeasuredReporter(countryLookup, rc, measuredReportingInterval, throttleConfig, reporterOpts)
+	} else {
+		reporter = localUsage.NewMeasuredReporter()
 	}
 	reporter = combineReporter(reporter, proxiedBytesReporter)
 	wrapper := func(ls net.Listener) net.Listener {
@@ -23,6 +23,13 @@ import (
 var (
 	testingLocal = false
 	log          = golog.LoggerFor("server")
+
+	// ErrServerClosed is returned by Serve and friends once the Server has been
+	// shut down.
+	ErrServerClosed = errors.New("server closed")
+
+	// how often Shutdown checks whether all connections have finished
+	drainCheckInterval = 500 * time.Millisecond
 )
 
 // A ListenerGenerator generates a new listener from an existing one.
@@ -56,6 +63,10 @@ type Opts struct {
 	// OnActive is called only once when a connection is accepted and has done
 	// either a first Read() or Write()
 	OnActive func(conn net.Conn)
+
+	// OnDrain is called periodically during Shutdown with the number of
+	// connections that are still open.
+	OnDrain func(remaining int)
 }
 
 // Server is an HTTP proxy server.
@@ -68,6 +79,12 @@ type Server struct {
 	onError            func(conn net.Conn, err error)
 	onAcceptError      func(err error) (fatalErr error)
 	onActive           func(conn net.Conn)
+	onDrain            func(remaining int)
+
+	listeners    map[net.Listener]bool
+	conns        map[*trackedConn]http.ConnState
+	shuttingDown bool
+	mx           sync.Mutex
 }
 
 // New constructs a new HTTP proxy server using the given options
@@ -101,11 +118,17 @@ func New(opts *Opts) *Server {
 	if opts.OnActive == nil {
 		opts.OnActive = func(conn net.Conn) {}
 	}
+	if opts.OnDrain == nil {
+		opts.OnDrain = func(remaining int) {}
+	}
 	return &Server{
 		proxy:         p,
 		onError:       opts.OnError,
 		onAcceptError: opts.OnAcceptError,
 		onActive:      opts.OnActive,
+		onDrain:       opts.OnDrain,
+		listeners:     make(map[net.Listener]bool),
+		conns:         make(map[*trackedConn]http.ConnState),
 	}
 }
 
@@ -143,6 +166,12 @@ func (s *Server) Serve(listener net.Listener, readyCb func(addr string)) error {
 }
 
 func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
+	if !s.addListener(listener) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer s.removeListener(listener)
+
 	l := listeners.NewDefaultListener(listener)
 
 	for _, wrap := range s.listenerGenerators {
@@ -169,12 +198,20 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 				}
 				log.Errorf("http: Accept error: %v; retrying in %v", err, tempDelay)
 				time.Sleep(tempDelay)
+			} else if s.isShuttingDown() {
+				return ErrServerClosed
 			} else if fatalErr := s.onAcceptError(err); fatalErr != nil {
 				return fatalErr
 			}
 			continue
 		}
 		tempDelay = 0
+		if s.isShuttingDown() {
+			// connections accepted while draining, e.g. new streams on existing
+			// multiplexed sessions, aren't handled anymore
+			safeClose(conn)
+			continue
+		}
 		// wrap the conn so s.onActive will be called after first successful Read or Write
 		conn = wrapOnActiveConn(conn, s.onActive)
 		s.handle(conn)
@@ -182,6 +219,7 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 }
 
 func (s *Server) handle(conn net.Conn) {
+	conn = s.wrapTrackedConn(conn)
 	wrapConn, isWrapConn := conn.(listeners.WrapConn)
 	if isWrapConn {
 		wrapConn.OnState(http.StateNew)
@@ -206,6 +244,9 @@ func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.Wra
 				op.FailIf(err)
 			}
 			safeClose(conn)
+			if isWrapConn {
+				wrapConn.OnState(http.StateClosed)
+			}
 		}
 	}()
 
@@ -219,6 +260,104 @@ func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.Wra
 	}
 }
 
+// Shutdown gracefully shuts down the server. It stops accepting new
+// connections on all listeners being served and waits for the open
+// connections to finish. If ctx is done first, the remaining connections are
+// forcibly closed and ctx's error is returned. Once Shutdown has been called,
+// Serve and friends return ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mx.Lock()
+	s.shuttingDown = true
+	ls := make([]net.Listener, 0, len(s.listeners))
+	for l := range s.listeners {
+		ls = append(ls, l)
+	}
+	s.mx.Unlock()
+
+	for _, l := range ls {
+		if err := listeners.Drain(l); err != nil {
+			log.Debugf("Error draining listener at %v: %v", l.Addr(), err)
+		}
+	}
+	defer func() {
+		for _, l := range ls {
+			l.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		remaining := s.numConns()
+		s.onDrain(remaining)
+		if remaining == 0 {
+			log.Debug("All connections finished")
+			return nil
+		}
+		log.Debugf("Waiting for %d connections to finish", remaining)
+		select {
+		case <-ctx.Done():
+			log.Debugf("Forcibly closing %d remaining connections: %v", s.closeConns(), ctx.Err())
+			s.onDrain(0)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) addListener(l net.Listener) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.listeners[l] = true
+	return true
+}
+
+func (s *Server) removeListener(l net.Listener) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.shuttingDown
+}
+
+func (s *Server) setConnState(c *trackedConn, state http.ConnState) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if state == http.StateClosed || state == http.StateHijacked {
+		delete(s.conns, c)
+	} else {
+		s.conns[c] = state
+	}
+}
+
+func (s *Server) numConns() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return len(s.conns)
+}
+
+// closeConns closes all tracked connections and returns how many there were.
+func (s *Server) closeConns() int {
+	s.mx.Lock()
+	conns := make([]*trackedConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mx.Unlock()
+
+	for _, c := range conns {
+		safeClose(c)
+	}
+	return len(conns)
+}
+
 func safeClose(conn net.Conn) {
 	defer func() {
 		p := recover()
@@ -273,6 +412,10 @@ func (l *allowinglistener) Close() error {
 	return l.wrapped.Close()
 }
 
+func (l *allowinglistener) Drain() error {
+	return listeners.Drain(l.wrapped)
+}
+
 func (l *allowinglistener) Addr() net.Addr {
 	return l.wrapped.Addr()
 }
@@ -326,3 +469,34 @@ func (c *onActiveConn) Write(b []byte) (int, error) {
 	}
 	return n, err
 }
+
+// trackedConn keeps track of the state of a connection in the Server so that
+// Shutdown can wait for it to finish.
+type trackedConn struct {
+	listeners.WrapConnEmbeddable
+	net.Conn
+
+	s *Server
+}
+
+func (s *Server) wrapTrackedConn(conn net.Conn) net.Conn {
+	wc, _ := conn.(listeners.WrapConnEmbeddable)
+	return &trackedConn{wc, conn, s}
+}
+
+func (c *trackedConn) OnState(state http.ConnState) {
+	c.s.setConnState(c, state)
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.OnState(state)
+	}
+}
+
+func (c *trackedConn) ControlMessage(msgType string, data interface{}) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.ControlMessage(msgType, data)
+	}
+}
+
+func (c *trackedConn) Wrapped() net.Conn {
+	return c.Conn
+}
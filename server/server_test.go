@@ -3,9 +3,11 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -23,6 +25,7 @@ import (
 	"github.com/getlantern/mockconn"
 	"github.com/getlantern/proxy/v3/filters"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/getlantern/http-proxy-lantern/v2/listeners"
 )
@@ -454,6 +457,71 @@ func TestPanicRecover(t *testing.T) {
 	assert.True(t, conn.Closed(), "Connection should have been closed after recovering from panic")
 }
 
+func TestShutdown(t *testing.T) {
+	var drainMx sync.Mutex
+	var drained []int
+	srv := New(&Opts{
+		IdleTimeout: 30 * time.Second,
+		OnDrain: func(remaining int) {
+			drainMx.Lock()
+			drained = append(drained, remaining)
+			drainMx.Unlock()
+		},
+	})
+	addr, serveErr := serveForShutdown(t, srv)
+
+	conn := openTunnel(t, addr)
+	defer conn.Close()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.Shutdown(context.Background())
+	}()
+
+	assert.Equal(t, ErrServerClosed, <-serveErr, "Serve should return once shutting down")
+	_, err := net.DialTimeout("tcp", addr, 1*time.Second)
+	assert.Error(t, err, "should not accept new connections while draining")
+
+	_, err = conn.Write([]byte(tunneledReq))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err, "open tunnel should keep working while draining")
+	buf, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(buf), originResponse)
+
+	conn.Close()
+	select {
+	case err := <-shutdownErr:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Shutdown should finish once all connections are closed")
+	}
+
+	drainMx.Lock()
+	defer drainMx.Unlock()
+	assert.Equal(t, 1, drained[0], "should report the open tunnel")
+	assert.Equal(t, 0, drained[len(drained)-1], "should report when done draining")
+	assert.Equal(t, ErrServerClosed, srv.Serve(&net.TCPListener{}, nil), "should not serve once shut down")
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv := New(&Opts{IdleTimeout: 30 * time.Second})
+	addr, serveErr := serveForShutdown(t, srv)
+
+	conn := openTunnel(t, addr)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, srv.Shutdown(ctx))
+	assert.Equal(t, ErrServerClosed, <-serveErr)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "remaining connections should have been closed")
+	assert.Eventually(t, func() bool { return srv.numConns() == 0 }, 5*time.Second, 50*time.Millisecond)
+}
+
 //
 // Auxiliary functions
 //
@@ -631,3 +699,27 @@ func newOriginHandler(msg string, tls bool) (string, *originHandler) {
 	log.Debugf("Started origin server at %v", m.server.URL)
 	return m.server.URL, &m
 }
+
+func serveForShutdown(t *testing.T, srv *Server) (string, chan error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(l, nil)
+	}()
+	return l.Addr().String(), serveErr
+}
+
+// openTunnel opens a CONNECT tunnel to the HTTP origin through the proxy at
+// addr.
+func openTunnel(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	originURL, _ := url.Parse(httpOriginURL)
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", originURL.Host, originURL.Host)
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return conn
+}
@@ -9,6 +9,8 @@ import (
 
 	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
 	"github.com/Jigsaw-Code/outline-ss-server/service"
+
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
 )
 
 const (
@@ -18,9 +20,13 @@ const (
 )
 
 type CipherConfig struct {
-	ID     string
-	Cipher string
-	Secret string
+	ID     string `json:"id"`
+	Cipher string `json:"cipher,omitempty"`
+	Secret string `json:"secret,omitempty"`
+
+	// Throttle, if set, replaces the throttle settings that would otherwise
+	// apply to clients using this key.
+	Throttle *throttle.Settings `json:"throttle,omitempty"`
 }
 
 // NewCipherListWithConfigs creates a CipherList with the given
@@ -13,7 +13,7 @@ type LocalDialer struct {
 }
 
 func (d *LocalDialer) DialStream(ctx context.Context, addr string) (transport.StreamConn, error) {
-	cliConn, ok := ctx.Value(clientConnCtxKey{}).(transport.StreamConn)
+	cliConn, ok := ctx.Value(clientConnCtxKey{}).(*clientConn)
 	if !ok {
 		return nil, fmt.Errorf("expected stream connection in context but received type %T", ctx.Value(clientConnCtxKey{}))
 	}
@@ -29,8 +29,10 @@ func (d *LocalDialer) DialStream(ctx context.Context, addr string) (transport.St
 	b := &lfwd{
 		Conn:           c2,
 		remoteAddr:     cliConn.RemoteAddr(),
-		clientTCPConn:  cliConn,
+		clientTCPConn:  cliConn.StreamConn,
 		upstreamTarget: addr,
+		accessKeyID:    cliConn.keyID,
+		forcedThrottle: cliConn.forcedThrottle,
 	}
 	d.connections <- b
 
@@ -0,0 +1,259 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service"
+
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+)
+
+// DefaultKeysRefreshInterval is how often a keys file is checked for changes by
+// default.
+const DefaultKeysRefreshInterval = 30 * time.Second
+
+// AccessKeys is the set of access keys accepted by shadowsocks listeners
+// sharing its CipherList. It consists of static keys, which are typically
+// configured with flags, and keys that can be updated at runtime, which are
+// kept in a JSON-encoded file if one is given.
+type AccessKeys struct {
+	ciphers         service.CipherList
+	path            string
+	refreshInterval time.Duration
+	stop            chan struct{}
+	watchers        sync.WaitGroup
+	staticKeys      []CipherConfig
+	keys            []CipherConfig
+	throttles       map[string]*throttle.Settings
+	modTime         time.Time
+	mx              sync.Mutex
+}
+
+// NewAccessKeys creates AccessKeys with the given static keys, loading the
+// other keys from the file at path if it's not empty. The file contains a
+// JSON array of CipherConfigs and is checked for changes every
+// refreshInterval until the AccessKeys are closed.
+func NewAccessKeys(staticKeys []CipherConfig, path string, refreshInterval time.Duration) (*AccessKeys, error) {
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultKeysRefreshInterval
+	}
+	k := &AccessKeys{
+		ciphers:         service.NewCipherList(),
+		refreshInterval: refreshInterval,
+		staticKeys:      staticKeys,
+	}
+	if err := k.update(); err != nil {
+		return nil, err
+	}
+	if err := k.SetPath(path); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// SetPath switches to the keys file at path, replacing the keys that were
+// loaded from the previous one. An empty path means that keys are only kept in
+// memory.
+func (k *AccessKeys) SetPath(path string) error {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	if path == k.path && (path == "" || k.stop != nil) {
+		return nil
+	}
+	previousPath, previousKeys, previousModTime := k.path, k.keys, k.modTime
+	k.path, k.keys, k.modTime = path, nil, time.Time{}
+	err := k.update()
+	if err == nil && path != "" {
+		err = k.refreshKeysLocked()
+	}
+	if err != nil {
+		k.path, k.keys, k.modTime = previousPath, previousKeys, previousModTime
+		if restoreErr := k.update(); restoreErr != nil {
+			log.Errorf("Unable to restore shadowsocks keys from %v: %v", previousPath, restoreErr)
+		}
+		return err
+	}
+	k.stopWatching()
+	if path != "" {
+		k.stop = make(chan struct{})
+		k.watchers.Add(1)
+		go k.keepCurrent(path, k.refreshInterval, k.stop)
+	}
+	return nil
+}
+
+// Close stops checking the keys file for changes, waiting until that's done.
+func (k *AccessKeys) Close() {
+	k.mx.Lock()
+	k.stopWatching()
+	k.mx.Unlock()
+	k.watchers.Wait()
+}
+
+// stopWatching must be called with mx held.
+func (k *AccessKeys) stopWatching() {
+	if k.stop != nil {
+		close(k.stop)
+		k.stop = nil
+	}
+}
+
+// CipherList returns the CipherList to use with shadowsocks listeners, which
+// is kept up to date with the keys.
+func (k *AccessKeys) CipherList() service.CipherList {
+	return k.ciphers
+}
+
+// SetStaticKeys replaces the static keys.
+func (k *AccessKeys) SetStaticKeys(staticKeys []CipherConfig) error {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	previous := k.staticKeys
+	k.staticKeys = staticKeys
+	if err := k.update(); err != nil {
+		k.staticKeys = previous
+		return err
+	}
+	return nil
+}
+
+// Keys returns the keys that can be updated at runtime.
+func (k *AccessKeys) Keys() []CipherConfig {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	return append([]CipherConfig{}, k.keys...)
+}
+
+// ForcedThrottle returns the throttle settings of the key with the given ID,
+// if it has its own.
+func (k *AccessKeys) ForcedThrottle(id string) *throttle.Settings {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	return k.throttles[id]
+}
+
+// SetKeys replaces the keys that can be updated at runtime, saving them to the
+// keys file if there is one.
+func (k *AccessKeys) SetKeys(keys []CipherConfig) error {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	previous := k.keys
+	k.keys = keys
+	if err := k.update(); err != nil {
+		k.keys = previous
+		return err
+	}
+	if k.path == "" {
+		return nil
+	}
+	return k.save()
+}
+
+// update updates the CipherList with the current keys. It must be called with
+// mx held (or before the AccessKeys are shared).
+func (k *AccessKeys) update() error {
+	configs := append(append([]CipherConfig{}, k.staticKeys...), k.keys...)
+	ids := make(map[string]bool, len(configs))
+	throttles := make(map[string]*throttle.Settings)
+	for _, config := range configs {
+		if config.ID == "" {
+			return fmt.Errorf("ID was not specified for access key")
+		}
+		if ids[config.ID] {
+			return fmt.Errorf("Duplicate access key ID %v", config.ID)
+		}
+		ids[config.ID] = true
+		if config.Throttle != nil {
+			if err := config.Throttle.Validate(); err != nil {
+				return fmt.Errorf("Invalid throttle settings for access key %v: %v", config.ID, err)
+			}
+			throttles[config.ID] = config.Throttle
+		}
+	}
+	if err := UpdateCipherList(k.ciphers, configs); err != nil {
+		return err
+	}
+	k.throttles = throttles
+	return nil
+}
+
+func (k *AccessKeys) keepCurrent(path string, refreshInterval time.Duration, stop <-chan struct{}) {
+	defer k.watchers.Done()
+	log.Debugf("Checking %v for changes every %v", path, refreshInterval)
+	for {
+		select {
+		case <-stop:
+			log.Debugf("Stopped checking %v for changes", path)
+			return
+		case <-time.After(refreshInterval):
+			if err := k.refreshKeys(); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+func (k *AccessKeys) refreshKeys() error {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	return k.refreshKeysLocked()
+}
+
+// refreshKeysLocked must be called with mx held.
+func (k *AccessKeys) refreshKeysLocked() error {
+	info, err := os.Stat(k.path)
+	if os.IsNotExist(err) {
+		// no keys yet, they may still be added with SetKeys
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to stat shadowsocks keys file %v: %v", k.path, err)
+	}
+	if info.ModTime().Equal(k.modTime) {
+		return nil
+	}
+	// don't bother trying again until the file changes
+	k.modTime = info.ModTime()
+
+	encoded, err := os.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("Unable to read shadowsocks keys from %v: %v", k.path, err)
+	}
+	var keys []CipherConfig
+	if err := json.Unmarshal(encoded, &keys); err != nil {
+		return fmt.Errorf("Unable to parse shadowsocks keys in %v: %v", k.path, err)
+	}
+	previous := k.keys
+	k.keys = keys
+	if err := k.update(); err != nil {
+		k.keys = previous
+		return fmt.Errorf("Invalid shadowsocks keys in %v: %v", k.path, err)
+	}
+	log.Debugf("Loaded %d shadowsocks keys from %v", len(keys), k.path)
+	return nil
+}
+
+// save writes the keys to the keys file, replacing it atomically. It must be
+// called with mx held.
+func (k *AccessKeys) save() error {
+	encoded, err := json.MarshalIndent(k.keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode shadowsocks keys: %v", err)
+	}
+	tmpPath := k.path + ".tmp"
+	if err := os.WriteFile(tmpPath, encoded, 0600); err != nil {
+		return fmt.Errorf("Unable to write shadowsocks keys to %v: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, k.path); err != nil {
+		return fmt.Errorf("Unable to save shadowsocks keys to %v: %v", k.path, err)
+	}
+	if info, err := os.Stat(k.path); err == nil {
+		// no need to reload what we just saved
+		k.modTime = info.ModTime()
+	}
+	return nil
+}
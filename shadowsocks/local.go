@@ -12,6 +12,8 @@ import (
 	"github.com/Jigsaw-Code/outline-sdk/transport"
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
 	"github.com/Jigsaw-Code/outline-ss-server/service"
+
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
 )
 
 // shadowsocks/local.go houses adapters for use with Lantern. This mostly is in
@@ -30,19 +32,24 @@ const tcpReadTimeout time.Duration = 59 * time.Second
 
 // ListenLocalTCP creates a net.Listener that returns all inbound shadowsocks connections to the
 // returned listener rather than dialing upstream. Any upstream or local handling should be handled by the
-// caller of Accept().
+// caller of Accept(). Clients authenticate with keys. Connections are recorded with metrics, if not nil.
 func ListenLocalTCP(
 	l net.Listener,
-	ciphers service.CipherList,
+	keys *AccessKeys,
 	replayHistory int,
+	metrics SSMetrics,
 ) (net.Listener, error) {
 	replayCache := service.NewReplayCache(replayHistory)
+	if metrics == nil {
+		metrics = &service.NoOpTCPMetrics{}
+	}
 
 	options := &ListenerOptions{
 		Listener:           &tcpListenerAdapter{l},
-		Ciphers:            ciphers,
+		Ciphers:            keys.CipherList(),
 		ReplayCache:        &replayCache,
-		ShadowsocksMetrics: &service.NoOpTCPMetrics{},
+		ShadowsocksMetrics: metrics,
+		ForcedThrottle:     keys.ForcedThrottle,
 	}
 
 	return ListenLocalTCPOptions(options), nil
@@ -75,8 +82,8 @@ func ListenLocalTCPOptions(options *ListenerOptions) net.Listener {
 	}
 
 	authFunc := service.NewShadowsocksStreamAuthenticator(options.Ciphers, options.ReplayCache, options.ShadowsocksMetrics)
-	tcpHandler := service.NewTCPHandler(options.Listener.Addr().(*net.TCPAddr).Port, authFunc, options.ShadowsocksMetrics, timeout)
-	tcpHandler.SetTargetDialer(&LocalDialer{connections: l.connections})
+	port := options.Listener.Addr().(*net.TCPAddr).Port
+	dialer := &LocalDialer{connections: l.connections}
 
 	accept := func() (transport.StreamConn, error) {
 		listener, ok := l.wrapped.(*tcpListenerAdapter)
@@ -94,7 +101,24 @@ func ListenLocalTCPOptions(options *ListenerOptions) net.Listener {
 
 	handler := func(ctx context.Context, conn transport.StreamConn) {
 		// Add the client connection to the context so it can be used by the LocalDialer
-		ctx = context.WithValue(ctx, clientConnCtxKey{}, conn)
+		client := &clientConn{StreamConn: conn}
+		ctx = context.WithValue(ctx, clientConnCtxKey{}, client)
+		// The handler is created per connection so that the LocalDialer can
+		// find out which access key the client authenticated with.
+		authenticate := func(conn transport.StreamConn) (string, transport.StreamConn, *onet.ConnectionError) {
+			keyID, innerConn, err := authFunc(conn)
+			client.keyID = keyID
+			if err == nil && options.ForcedThrottle != nil {
+				client.forcedThrottle = options.ForcedThrottle(keyID)
+			}
+			return keyID, innerConn, err
+		}
+		metrics := options.ShadowsocksMetrics
+		if cm, ok := metrics.(clientMetrics); ok {
+			metrics = cm.forClient(conn.RemoteAddr())
+		}
+		tcpHandler := service.NewTCPHandler(port, authenticate, metrics, timeout)
+		tcpHandler.SetTargetDialer(dialer)
 		tcpHandler.Handle(ctx, conn)
 	}
 
@@ -105,6 +129,25 @@ func ListenLocalTCPOptions(options *ListenerOptions) net.Listener {
 // clientConnCtxKey is a context key being used to share the client connection
 type clientConnCtxKey struct{}
 
+// clientConn is the client connection along with the ID and throttle settings
+// of the access key it authenticated with.
+type clientConn struct {
+	transport.StreamConn
+	keyID          string
+	forcedThrottle *throttle.Settings
+}
+
+// AccessKeyConn is implemented by the connections accepted by shadowsocks
+// listeners.
+type AccessKeyConn interface {
+	// AccessKeyID returns the ID of the access key the client used.
+	AccessKeyID() string
+
+	// ForcedThrottle returns the throttle settings of the access key the
+	// client used, if it has its own.
+	ForcedThrottle() *throttle.Settings
+}
+
 // Accept implements Accept() from net.Listener
 func (l *llistener) Accept() (net.Conn, error) {
 	select {
@@ -209,6 +252,8 @@ type lfwd struct {
 	clientTCPConn  net.Conn
 	remoteAddr     net.Addr
 	upstreamTarget string
+	accessKeyID    string
+	forcedThrottle *throttle.Settings
 }
 
 func (l *lfwd) RemoteAddr() net.Addr {
@@ -219,6 +264,14 @@ func (l *lfwd) UpstreamTarget() string {
 	return l.upstreamTarget
 }
 
+func (l *lfwd) AccessKeyID() string {
+	return l.accessKeyID
+}
+
+func (l *lfwd) ForcedThrottle() *throttle.Settings {
+	return l.forcedThrottle
+}
+
 func (l *lfwd) Wrapped() net.Conn {
 	return l.clientTCPConn.(*tcpConnAdapter).Wrapped()
 }
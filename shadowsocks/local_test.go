@@ -6,6 +6,8 @@ import (
 	crand "crypto/rand"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -19,6 +21,8 @@ import (
 	"github.com/Jigsaw-Code/outline-ss-server/service"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
 )
 
 func init() {
@@ -239,3 +243,118 @@ func TestConcurrentLocalUpstreamHandling(t *testing.T) {
 	require.Nil(t, fdc.AssertDelta(0), "After closing listener, there should be no lingering file descriptors")
 	grtracker.Check(t)
 }
+
+func TestAccessKeys(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	keys, err := NewAccessKeys([]CipherConfig{{ID: "default", Secret: "static-secret"}}, keysFile, time.Hour)
+	require.NoError(t, err)
+
+	l0, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	replayCache := service.NewReplayCache(1)
+	l1 := ListenLocalTCPOptions(&ListenerOptions{
+		Listener:           &tcpListenerAdapter{l0},
+		Ciphers:            keys.CipherList(),
+		Timeout:            200 * time.Millisecond,
+		ReplayCache:        &replayCache,
+		ShadowsocksMetrics: &service.NoOpTCPMetrics{},
+		ForcedThrottle:     keys.ForcedThrottle,
+	})
+	defer l1.Close()
+
+	accessKeyIDs := make(chan string, 10)
+	go func() {
+		for {
+			c, err := l1.Accept()
+			if err != nil {
+				return
+			}
+			akc := c.(AccessKeyConn)
+			id := akc.AccessKeyID()
+			if akc.ForcedThrottle() != nil {
+				id += " (" + akc.ForcedThrottle().Label + ")"
+			}
+			accessKeyIDs <- id
+			c.Close()
+		}
+	}()
+
+	connectWith := func(secret string) (string, error) {
+		key, err := shadowsocks.NewEncryptionKey(DefaultCipher, secret)
+		require.NoError(t, err)
+		client, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: l1.Addr().String()}, key)
+		require.NoError(t, err)
+		conn, err := client.DialStream(context.Background(), "127.0.0.1:443")
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			return "", err
+		}
+		select {
+		case id := <-accessKeyIDs:
+			return id, nil
+		case <-time.After(time.Second):
+			return "", fmt.Errorf("connection not accepted")
+		}
+	}
+
+	id, err := connectWith("static-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "default", id)
+
+	_, err = connectWith("user-secret")
+	assert.Error(t, err, "unknown key shouldn't be accepted")
+
+	require.NoError(t, keys.SetKeys([]CipherConfig{{ID: "user1", Secret: "user-secret"}}))
+	id, err = connectWith("user-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "user1", id, "added key should be accepted without restarting the listener")
+
+	// keys file changes are picked up
+	require.NoError(t, os.WriteFile(keysFile, []byte(`[{"id": "user2", "secret": "other-secret"}]`), 0600))
+	require.NoError(t, os.Chtimes(keysFile, time.Now(), time.Now().Add(time.Minute)))
+	require.NoError(t, keys.refreshKeys())
+	assert.Equal(t, []CipherConfig{{ID: "user2", Secret: "other-secret"}}, keys.Keys())
+	id, err = connectWith("other-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "user2", id)
+
+	assert.Error(t, keys.SetKeys([]CipherConfig{{ID: "default", Secret: "duplicate"}}), "duplicate IDs should be rejected")
+	assert.Error(t, keys.SetKeys([]CipherConfig{{ID: "user3", Secret: "user-secret", Throttle: &throttle.Settings{Label: "bad"}}}), "invalid throttle settings should be rejected")
+	assert.Equal(t, "user2", keys.Keys()[0].ID, "keys should be unchanged after a failed update")
+
+	require.NoError(t, keys.SetKeys([]CipherConfig{{ID: "user3", Secret: "user-secret", Throttle: &throttle.Settings{
+		Label: "partner", Threshold: 1000, Rate: 100, CapResets: throttle.Daily,
+	}}}))
+	id, err = connectWith("user-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "user3 (partner)", id, "key's throttle settings should be available from the connection")
+}
+
+func TestAccessKeysPath(t *testing.T) {
+	dir := t.TempDir()
+	keysFile1, keysFile2 := filepath.Join(dir, "keys1.json"), filepath.Join(dir, "keys2.json")
+	require.NoError(t, os.WriteFile(keysFile1, []byte(`[{"id": "user1", "secret": "secret1"}]`), 0600))
+	require.NoError(t, os.WriteFile(keysFile2, []byte(`[{"id": "user2", "secret": "secret2"}]`), 0600))
+
+	grtracker := grtrack.Start()
+	keys, err := NewAccessKeys(nil, keysFile1, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []CipherConfig{{ID: "user1", Secret: "secret1"}}, keys.Keys())
+
+	require.NoError(t, keys.SetPath(keysFile2))
+	assert.Equal(t, []CipherConfig{{ID: "user2", Secret: "secret2"}}, keys.Keys(), "keys should come from the new file")
+
+	require.NoError(t, os.WriteFile(keysFile1, []byte(`not json`), 0600))
+	assert.Error(t, keys.SetPath(keysFile1))
+	assert.Equal(t, []CipherConfig{{ID: "user2", Secret: "secret2"}}, keys.Keys(), "keys should be unchanged after failing to switch files")
+
+	require.NoError(t, keys.SetPath(""))
+	assert.Empty(t, keys.Keys(), "keys from the file should be dropped")
+
+	require.NoError(t, keys.SetPath(keysFile2))
+	keys.Close()
+	grtracker.Check(t)
+}
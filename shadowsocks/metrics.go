@@ -0,0 +1,63 @@
+package shadowsocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/ipinfo"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+)
+
+// NewInstrumentMetrics returns SSMetrics that record shadowsocks connections
+// with the given instrument. Connections that fail to authenticate, including
+// replays, are reported as suspected probing from the client's IP.
+func NewInstrumentMetrics(ins instrument.Instrument) SSMetrics {
+	return &instrumentMetrics{instrument: ins}
+}
+
+type instrumentMetrics struct {
+	instrument instrument.Instrument
+	clientIP   net.IP
+}
+
+// clientMetrics is implemented by SSMetrics that need to know which client a
+// connection came from.
+type clientMetrics interface {
+	forClient(clientAddr net.Addr) SSMetrics
+}
+
+func (m *instrumentMetrics) forClient(clientAddr net.Addr) SSMetrics {
+	var clientIP net.IP
+	if tcpAddr, ok := clientAddr.(*net.TCPAddr); ok {
+		clientIP = tcpAddr.IP
+	} else if clientAddr != nil {
+		host, _, _ := net.SplitHostPort(clientAddr.String())
+		clientIP = net.ParseIP(host)
+	}
+	return &instrumentMetrics{instrument: m.instrument, clientIP: clientIP}
+}
+
+func (m *instrumentMetrics) GetIPInfo(net.IP) (ipinfo.IPInfo, error) {
+	// the instrument looks up the country itself
+	return ipinfo.IPInfo{}, nil
+}
+
+func (m *instrumentMetrics) AddOpenTCPConnection(clientInfo ipinfo.IPInfo) {}
+
+func (m *instrumentMetrics) AddAuthenticatedTCPConnection(clientAddr net.Addr, accessKey string) {}
+
+func (m *instrumentMetrics) AddClosedTCPConnection(clientInfo ipinfo.IPInfo, clientAddr net.Addr, accessKey string, status string, data metrics.ProxyMetrics, duration time.Duration) {
+	m.instrument.ShadowsocksConnection(context.Background(), status)
+}
+
+func (m *instrumentMetrics) AddTCPProbe(status, drainResult string, port int, clientProxyBytes int64) {
+	m.instrument.SuspectedProbing(context.Background(), m.clientIP, fmt.Sprintf("shadowsocks %v (drain %v)", status, drainResult))
+}
+
+func (m *instrumentMetrics) AddTCPCipherSearch(accessKeyFound bool, timeToCipher time.Duration) {
+	m.instrument.ShadowsocksCipherSearch(context.Background(), accessKeyFound, timeToCipher)
+}
@@ -0,0 +1,102 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+)
+
+type fakeInstrument struct {
+	instrument.NoInstrument
+	probes       []string
+	probeIPs     []string
+	cipherFound  []bool
+	connStatuses []string
+	mx           sync.Mutex
+}
+
+func (i *fakeInstrument) SuspectedProbing(ctx context.Context, fromIP net.IP, reason string) {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	i.probes = append(i.probes, reason)
+	i.probeIPs = append(i.probeIPs, fromIP.String())
+}
+
+func (i *fakeInstrument) ShadowsocksCipherSearch(ctx context.Context, found bool, timeToCipher time.Duration) {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	i.cipherFound = append(i.cipherFound, found)
+}
+
+func (i *fakeInstrument) ShadowsocksConnection(ctx context.Context, status string) {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	i.connStatuses = append(i.connStatuses, status)
+}
+
+func (i *fakeInstrument) numConnStatuses() int {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	return len(i.connStatuses)
+}
+
+func TestInstrumentMetrics(t *testing.T) {
+	keys, err := NewAccessKeys([]CipherConfig{{ID: "default", Secret: "secret"}}, "", 0)
+	require.NoError(t, err)
+	ins := &fakeInstrument{}
+
+	l0, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l1, err := ListenLocalTCP(l0, keys, 10, NewInstrumentMetrics(ins))
+	require.NoError(t, err)
+	defer l1.Close()
+	go func() {
+		for {
+			c, err := l1.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// a connection that doesn't authenticate looks like a probe
+	probe, err := net.Dial("tcp", l1.Addr().String())
+	require.NoError(t, err)
+	_, err = probe.Write(make([]byte, 100))
+	require.NoError(t, err)
+	probe.Close()
+	require.Eventually(t, func() bool {
+		return ins.numConnStatuses() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	key, err := shadowsocks.NewEncryptionKey(DefaultCipher, "secret")
+	require.NoError(t, err)
+	client, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: l1.Addr().String()}, key)
+	require.NoError(t, err)
+	conn, err := client.DialStream(context.Background(), "127.0.0.1:443")
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return ins.numConnStatuses() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ins.mx.Lock()
+	defer ins.mx.Unlock()
+	assert.Equal(t, []string{"shadowsocks ERR_CIPHER (drain eof)"}, ins.probes)
+	assert.Equal(t, []string{"127.0.0.1"}, ins.probeIPs)
+	assert.Equal(t, []bool{false, true}, ins.cipherFound)
+	assert.Equal(t, "ERR_CIPHER", ins.connStatuses[0])
+	assert.NotEqual(t, "ERR_CIPHER", ins.connStatuses[1], "connection should have authenticated")
+}
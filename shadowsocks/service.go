@@ -8,6 +8,8 @@ import (
 	"github.com/Jigsaw-Code/outline-sdk/transport"
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
 	"github.com/Jigsaw-Code/outline-ss-server/service"
+
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
 )
 
 type llistener struct {
@@ -43,4 +45,5 @@ type ListenerOptions struct {
 	TargetIPValidator     onet.TargetIPValidator // determines validity of non-local upstream dials
 	MaxPendingConnections int                    // defaults to 1000
 	ShadowsocksMetrics    SSMetrics
+	ForcedThrottle        func(keyID string) *throttle.Settings // throttle settings of the given access key, if any
 }
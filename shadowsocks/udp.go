@@ -0,0 +1,382 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/service"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	// DefaultUDPIdleTimeout is how long a UDP association is kept without any
+	// traffic by default. This matches outline-ss-server's NAT timeout.
+	DefaultUDPIdleTimeout = 5 * time.Minute
+	// DefaultMaxUDPAssociationsPerClient is the default number of UDP
+	// associations a single client IP can have at the same time.
+	DefaultMaxUDPAssociationsPerClient = 64
+	// DefaultMaxUDPAssociations is the default number of UDP associations the
+	// relay can have at the same time.
+	DefaultMaxUDPAssociations = 10000
+
+	// Max UDP buffer size, matching outline-ss-server
+	udpBufferSize = 64 * 1024
+
+	// how many packets an association queues up for its targets before
+	// dropping them
+	udpPacketQueueSize = 64
+)
+
+var (
+	errTooManyAssociations          = errors.New("too many UDP associations")
+	errTooManyAssociationsForClient = errors.New("too many UDP associations for client")
+	errRelayClosed                  = errors.New("UDP relay closed")
+)
+
+// UDPOptions configures a UDPRelay.
+type UDPOptions struct {
+	// Ciphers are the access keys clients can use, typically the same as for
+	// the TCP listener.
+	Ciphers service.CipherList
+	// ReplayCache, if set, is used to reject packets with a salt that was
+	// already seen.
+	ReplayCache *service.ReplayCache
+	// IdleTimeout defaults to DefaultUDPIdleTimeout.
+	IdleTimeout time.Duration
+	// MaxAssociationsPerClient defaults to DefaultMaxUDPAssociationsPerClient.
+	MaxAssociationsPerClient int
+	// MaxAssociations defaults to DefaultMaxUDPAssociations.
+	MaxAssociations int
+	// TargetIPValidator determines which targets packets can be relayed to,
+	// defaults to public IPs only.
+	TargetIPValidator onet.TargetIPValidator
+	// AllowClient, if set, determines whether a client that authenticated can
+	// get an association. Packets from clients that aren't allowed are
+	// dropped.
+	AllowClient func(clientIP net.IP) bool
+}
+
+// UDPRelay relays shadowsocks UDP packets between clients and their targets.
+// Every client address gets an association in a NAT table, which is a UDP
+// socket used to exchange packets with all of that client's targets. An
+// association is removed once it's idle for longer than the IdleTimeout.
+//
+// Unlike TCP connections, relayed packets aren't measured or throttled, and the
+// client's address is always the packet's source address.
+type UDPRelay struct {
+	clientConn net.PacketConn
+	opts       UDPOptions
+	nat        map[string]*udpAssociation
+	perClient  map[string]int
+	closed     bool
+	mx         sync.Mutex
+	running    sync.WaitGroup
+
+	resolveUDPAddr func(address string) (*net.UDPAddr, error)
+}
+
+type udpAssociation struct {
+	clientAddr net.Addr
+	clientIP   string
+	keyID      string
+	cryptoKey  *shadowsocks.EncryptionKey
+	targetConn net.PacketConn
+	packets    chan udpPacket
+	done       chan struct{}
+}
+
+// udpPacket is a packet from a client on its way to its target.
+type udpPacket struct {
+	target  string
+	payload []byte
+}
+
+// NewUDPRelay creates a UDPRelay for packets received on clientConn. Call
+// Serve to start relaying.
+func NewUDPRelay(clientConn net.PacketConn, opts *UDPOptions) *UDPRelay {
+	r := &UDPRelay{
+		clientConn: clientConn,
+		opts:       *opts,
+		nat:        make(map[string]*udpAssociation),
+		perClient:  make(map[string]int),
+		resolveUDPAddr: func(address string) (*net.UDPAddr, error) {
+			return net.ResolveUDPAddr("udp", address)
+		},
+	}
+	if r.opts.IdleTimeout <= 0 {
+		r.opts.IdleTimeout = DefaultUDPIdleTimeout
+	}
+	if r.opts.MaxAssociationsPerClient <= 0 {
+		r.opts.MaxAssociationsPerClient = DefaultMaxUDPAssociationsPerClient
+	}
+	if r.opts.MaxAssociations <= 0 {
+		r.opts.MaxAssociations = DefaultMaxUDPAssociations
+	}
+	if r.opts.TargetIPValidator == nil {
+		r.opts.TargetIPValidator = onet.RequirePublicIP
+	}
+	return r
+}
+
+// Serve relays packets until the relay is closed.
+func (r *UDPRelay) Serve() error {
+	defer r.closeAssociations()
+
+	cipherBuf := make([]byte, udpBufferSize)
+	textBuf := make([]byte, udpBufferSize)
+	for {
+		n, clientAddr, err := r.clientConn.ReadFrom(cipherBuf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			log.Debugf("Error reading shadowsocks UDP packet: %v", err)
+			continue
+		}
+		if err := r.handlePacket(clientAddr, cipherBuf[:n], textBuf); err != nil {
+			log.Debugf("Dropping shadowsocks UDP packet from %v: %v", clientAddr, err)
+		}
+	}
+}
+
+// Close stops the relay and closes all of its associations.
+func (r *UDPRelay) Close() error {
+	return r.clientConn.Close()
+}
+
+// Addr returns the address on which the relay receives packets.
+func (r *UDPRelay) Addr() net.Addr {
+	return r.clientConn.LocalAddr()
+}
+
+// NumAssociations returns the number of associations in the NAT table.
+func (r *UDPRelay) NumAssociations() int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return len(r.nat)
+}
+
+func (r *UDPRelay) handlePacket(clientAddr net.Addr, pkt, textBuf []byte) error {
+	clientIP := clientIPOf(clientAddr)
+	r.mx.Lock()
+	assoc := r.nat[clientAddr.String()]
+	r.mx.Unlock()
+
+	var text []byte
+	var keyID string
+	var cryptoKey *shadowsocks.EncryptionKey
+	var err error
+	if assoc == nil {
+		text, keyID, cryptoKey, err = findAccessKeyUDP(clientIP, textBuf, pkt, r.opts.Ciphers)
+	} else {
+		keyID, cryptoKey = assoc.keyID, assoc.cryptoKey
+		text, err = shadowsocks.Unpack(textBuf, pkt, cryptoKey)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to decrypt: %v", err)
+	}
+	if r.opts.ReplayCache != nil && !r.opts.ReplayCache.Add(keyID, pkt[:cryptoKey.SaltSize()]) {
+		return fmt.Errorf("replay detected")
+	}
+
+	tgtAddr := socks.SplitAddr(text)
+	if tgtAddr == nil {
+		return fmt.Errorf("unable to read target address")
+	}
+
+	if assoc == nil {
+		if r.opts.AllowClient != nil && !r.opts.AllowClient(clientIP) {
+			return fmt.Errorf("client not allowed")
+		}
+		assoc, err = r.associate(clientAddr, clientIP, keyID, cryptoKey)
+		if err != nil {
+			return err
+		}
+	}
+	assoc.targetConn.SetReadDeadline(time.Now().Add(r.opts.IdleTimeout))
+	// the association resolves the target, so that slow lookups don't hold up
+	// the packets of other clients
+	select {
+	case assoc.packets <- udpPacket{target: tgtAddr.String(), payload: append([]byte(nil), text[len(tgtAddr):]...)}:
+		return nil
+	case <-assoc.done:
+		return fmt.Errorf("UDP association closed")
+	default:
+		return fmt.Errorf("too many pending UDP packets")
+	}
+}
+
+// associate adds an association for the given client to the NAT table,
+// enforcing the limits on associations.
+func (r *UDPRelay) associate(clientAddr net.Addr, clientIP net.IP, keyID string, cryptoKey *shadowsocks.EncryptionKey) (*udpAssociation, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.closed {
+		return nil, errRelayClosed
+	}
+	if len(r.nat) >= r.opts.MaxAssociations {
+		return nil, errTooManyAssociations
+	}
+	ip := clientIP.String()
+	if r.perClient[ip] >= r.opts.MaxAssociationsPerClient {
+		return nil, errTooManyAssociationsForClient
+	}
+	targetConn, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create UDP socket: %v", err)
+	}
+	assoc := &udpAssociation{
+		clientAddr: clientAddr,
+		clientIP:   ip,
+		keyID:      keyID,
+		cryptoKey:  cryptoKey,
+		targetConn: targetConn,
+		packets:    make(chan udpPacket, udpPacketQueueSize),
+		done:       make(chan struct{}),
+	}
+	r.nat[clientAddr.String()] = assoc
+	r.perClient[ip]++
+	r.running.Add(2)
+	go r.relayToTarget(assoc)
+	go r.relayFromTarget(assoc)
+	return assoc, nil
+}
+
+// relayToTarget sends the association's packets to their targets until the
+// association is removed.
+func (r *UDPRelay) relayToTarget(assoc *udpAssociation) {
+	defer r.running.Done()
+	for {
+		select {
+		case <-assoc.done:
+			return
+		case pkt := <-assoc.packets:
+			if err := r.sendToTarget(assoc, pkt); err != nil {
+				log.Debugf("Dropping shadowsocks UDP packet from %v: %v", assoc.clientAddr, err)
+			}
+		}
+	}
+}
+
+func (r *UDPRelay) sendToTarget(assoc *udpAssociation, pkt udpPacket) error {
+	tgtUDPAddr, err := r.resolveUDPAddr(pkt.target)
+	if err != nil {
+		return fmt.Errorf("unable to resolve target address %v: %v", pkt.target, err)
+	}
+	if err := r.opts.TargetIPValidator(tgtUDPAddr.IP); err != nil {
+		return fmt.Errorf("target %v not allowed: %v", tgtUDPAddr, err)
+	}
+	if _, err := assoc.targetConn.WriteTo(pkt.payload, tgtUDPAddr); err != nil {
+		return fmt.Errorf("unable to write to target %v: %v", tgtUDPAddr, err)
+	}
+	return nil
+}
+
+// relayFromTarget sends packets from the association's targets back to the
+// client until the association is idle for too long.
+func (r *UDPRelay) relayFromTarget(assoc *udpAssociation) {
+	defer r.running.Done()
+	defer r.remove(assoc)
+
+	readBuf := make([]byte, udpBufferSize)
+	packBuf := make([]byte, udpBufferSize)
+	saltSize := assoc.cryptoKey.SaltSize()
+	for {
+		n, srcAddr, err := assoc.targetConn.ReadFrom(readBuf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Debugf("UDP association for %v timed out", assoc.clientAddr)
+			}
+			return
+		}
+		assoc.targetConn.SetReadDeadline(time.Now().Add(r.opts.IdleTimeout))
+		socksSrcAddr := socks.ParseAddr(srcAddr.String())
+		if saltSize+len(socksSrcAddr)+n+assoc.cryptoKey.TagSize() > len(packBuf) {
+			log.Debugf("Dropping oversized UDP packet from %v", srcAddr)
+			continue
+		}
+		// leave room for the salt so that the plaintext and the packed packet
+		// are aligned, see shadowsocks.Pack
+		plaintext := append(append(packBuf[saltSize:saltSize], socksSrcAddr...), readBuf[:n]...)
+		pkt, err := shadowsocks.Pack(packBuf, plaintext, assoc.cryptoKey)
+		if err != nil {
+			log.Debugf("Unable to pack UDP packet from %v: %v", srcAddr, err)
+			continue
+		}
+		if _, err := r.clientConn.WriteTo(pkt, assoc.clientAddr); err != nil {
+			log.Debugf("Unable to write UDP packet to %v: %v", assoc.clientAddr, err)
+		}
+	}
+}
+
+func (r *UDPRelay) remove(assoc *udpAssociation) {
+	r.mx.Lock()
+	key := assoc.clientAddr.String()
+	if r.nat[key] == assoc {
+		delete(r.nat, key)
+		r.perClient[assoc.clientIP]--
+		if r.perClient[assoc.clientIP] <= 0 {
+			delete(r.perClient, assoc.clientIP)
+		}
+	}
+	r.mx.Unlock()
+	close(assoc.done)
+	assoc.targetConn.Close()
+}
+
+func (r *UDPRelay) closeAssociations() {
+	r.mx.Lock()
+	r.closed = true
+	for _, assoc := range r.nat {
+		assoc.targetConn.Close()
+	}
+	r.mx.Unlock()
+	r.running.Wait()
+}
+
+// findAccessKeyUDP decrypts src into dst by trying each cipher until it finds
+// one that authenticates correctly, like outline-ss-server does.
+func findAccessKeyUDP(clientIP net.IP, dst, src []byte, cipherList service.CipherList) ([]byte, string, *shadowsocks.EncryptionKey, error) {
+	// We snapshot the list because it may be modified while we use it.
+	snapshot := cipherList.SnapshotForClientIP(clientIP)
+	for _, entry := range snapshot {
+		cipherEntry := entry.Value.(*service.CipherEntry)
+		buf, err := shadowsocks.Unpack(dst, src, cipherEntry.CryptoKey)
+		if err != nil {
+			continue
+		}
+		// Move the active cipher to the front, so that the search is quicker next time.
+		cipherList.MarkUsedByClientIP(entry, clientIP)
+		return buf, cipherEntry.ID, cipherEntry.CryptoKey, nil
+	}
+	return nil, "", nil, errors.New("could not find valid UDP cipher")
+}
+
+func clientIPOf(addr net.Addr) net.IP {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	return net.ParseIP(host)
+}
+
+// WithUDPRelay returns a listener that closes the given relay along with l.
+func WithUDPRelay(l net.Listener, relay *UDPRelay) net.Listener {
+	return &udpRelayListener{l, relay}
+}
+
+type udpRelayListener struct {
+	net.Listener
+	relay *UDPRelay
+}
+
+func (l *udpRelayListener) Close() error {
+	l.relay.Close()
+	return l.Listener.Close()
+}
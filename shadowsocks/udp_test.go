@@ -0,0 +1,238 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/Jigsaw-Code/outline-ss-server/service"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPRelay(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	cipherList, err := makeTestCiphers(makeTestSecrets(2))
+	require.NoError(t, err)
+	key := cipherList.SnapshotForClientIP(nil)[1].Value.(*service.CipherEntry).CryptoKey
+
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	replayCache := service.NewReplayCache(100)
+	relay := NewUDPRelay(clientConn, &UDPOptions{
+		Ciphers:                  cipherList,
+		ReplayCache:              &replayCache,
+		IdleTimeout:              250 * time.Millisecond,
+		MaxAssociationsPerClient: 2,
+		TargetIPValidator:        func(net.IP) error { return nil },
+	})
+	served := make(chan error)
+	go func() {
+		served <- relay.Serve()
+	}()
+
+	listener, err := shadowsocks.NewPacketListener(&transport.UDPEndpoint{Address: relay.Addr().String()}, key)
+	require.NoError(t, err)
+	newClient := func() net.PacketConn {
+		pc, err := listener.ListenPacket(context.Background())
+		require.NoError(t, err)
+		t.Cleanup(func() { pc.Close() })
+		return pc
+	}
+	echoes := func(pc net.PacketConn, msg string) bool {
+		_, err := pc.WriteTo([]byte(msg), echo.LocalAddr())
+		require.NoError(t, err)
+		pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 2048)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return false
+		}
+		assert.Equal(t, echo.LocalAddr().String(), addr.String(), "response should come from the target")
+		return assert.Equal(t, msg, string(buf[:n]))
+	}
+
+	client1 := newClient()
+	assert.True(t, echoes(client1, "hello"))
+	assert.True(t, echoes(client1, "hello again"), "association should be reused")
+	assert.Equal(t, 1, relay.NumAssociations())
+
+	client2 := newClient()
+	assert.True(t, echoes(client2, "hello"))
+	assert.False(t, echoes(newClient(), "hello"), "client should be limited to 2 associations")
+	assert.Equal(t, 2, relay.NumAssociations())
+
+	require.Eventually(t, func() bool {
+		return relay.NumAssociations() == 0
+	}, 2*time.Second, 50*time.Millisecond, "idle associations should be removed")
+	assert.True(t, echoes(client1, "hello after idle"), "client should be able to associate again")
+
+	// replayed packets are dropped
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer raw.Close()
+	packBuf := make([]byte, 2048)
+	plaintext := append(append(packBuf[key.SaltSize():key.SaltSize()], socks.ParseAddr(echo.LocalAddr().String())...), "replay"...)
+	pkt, err := shadowsocks.Pack(packBuf, plaintext, key)
+	require.NoError(t, err)
+	readResponse := func() bool {
+		raw.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err := raw.ReadFrom(make([]byte, 2048))
+		return err == nil
+	}
+	_, err = raw.WriteTo(pkt, relay.Addr())
+	require.NoError(t, err)
+	assert.True(t, readResponse())
+	_, err = raw.WriteTo(pkt, relay.Addr())
+	require.NoError(t, err)
+	assert.False(t, readResponse(), "replayed packet shouldn't be relayed")
+
+	require.NoError(t, relay.Close())
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("relay didn't stop")
+	}
+	assert.Zero(t, relay.NumAssociations())
+}
+
+func TestUDPRelaySlowResolution(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	cipherList, err := makeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err)
+	key := cipherList.SnapshotForClientIP(nil)[0].Value.(*service.CipherEntry).CryptoKey
+
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	relay := NewUDPRelay(clientConn, &UDPOptions{
+		Ciphers:           cipherList,
+		TargetIPValidator: func(net.IP) error { return nil },
+	})
+	resolved := make(chan struct{})
+	relay.resolveUDPAddr = func(address string) (*net.UDPAddr, error) {
+		if address == "slow.example:1234" {
+			<-resolved
+			return echo.LocalAddr().(*net.UDPAddr), nil
+		}
+		return net.ResolveUDPAddr("udp", address)
+	}
+	go relay.Serve()
+	defer relay.Close()
+
+	send := func(target, msg string) net.PacketConn {
+		raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { raw.Close() })
+		packBuf := make([]byte, 2048)
+		plaintext := append(append(packBuf[key.SaltSize():key.SaltSize()], socks.ParseAddr(target)...), msg...)
+		pkt, err := shadowsocks.Pack(packBuf, plaintext, key)
+		require.NoError(t, err)
+		_, err = raw.WriteTo(pkt, relay.Addr())
+		require.NoError(t, err)
+		return raw
+	}
+	receives := func(raw net.PacketConn, timeout time.Duration) bool {
+		raw.SetReadDeadline(time.Now().Add(timeout))
+		_, _, err := raw.ReadFrom(make([]byte, 2048))
+		return err == nil
+	}
+
+	slow := send("slow.example:1234", "slow")
+	fast := send(echo.LocalAddr().String(), "fast")
+	assert.True(t, receives(fast, time.Second), "other clients shouldn't wait for the slow lookup")
+	close(resolved)
+	assert.True(t, receives(slow, time.Second), "packet should be relayed once its target is resolved")
+}
+
+func TestUDPRelayAllowClient(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	cipherList, err := makeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err)
+	key := cipherList.SnapshotForClientIP(nil)[0].Value.(*service.CipherEntry).CryptoKey
+
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var allowed atomic.Bool
+	var checked []string
+	var checkedMx sync.Mutex
+	relay := NewUDPRelay(clientConn, &UDPOptions{
+		Ciphers:           cipherList,
+		TargetIPValidator: func(net.IP) error { return nil },
+		AllowClient: func(clientIP net.IP) bool {
+			checkedMx.Lock()
+			checked = append(checked, clientIP.String())
+			checkedMx.Unlock()
+			return allowed.Load()
+		},
+	})
+	go relay.Serve()
+	defer relay.Close()
+
+	listener, err := shadowsocks.NewPacketListener(&transport.UDPEndpoint{Address: relay.Addr().String()}, key)
+	require.NoError(t, err)
+	pc, err := listener.ListenPacket(context.Background())
+	require.NoError(t, err)
+	defer pc.Close()
+	echoes := func(msg string) bool {
+		_, err := pc.WriteTo([]byte(msg), echo.LocalAddr())
+		require.NoError(t, err)
+		pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err = pc.ReadFrom(make([]byte, 2048))
+		return err == nil
+	}
+
+	assert.False(t, echoes("hello"), "packets from clients that aren't allowed shouldn't be relayed")
+	assert.Zero(t, relay.NumAssociations())
+	allowed.Store(true)
+	assert.True(t, echoes("hello again"))
+	assert.True(t, echoes("hello once more"))
+	checkedMx.Lock()
+	defer checkedMx.Unlock()
+	assert.Equal(t, []string{"127.0.0.1", "127.0.0.1"}, checked, "client should only be checked until it has an association")
+}
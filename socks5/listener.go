@@ -0,0 +1,306 @@
+// Package socks5 provides a listener that accepts SOCKS5 clients and hands
+// their CONNECT requests to the proxy as HTTP CONNECT requests, so that they go
+// through the same filter chain as requests arriving over any other transport.
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/getlantern/golog"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+)
+
+const (
+	version5 = 5
+
+	methodNoAuth       = 0
+	methodUserPass     = 2
+	methodNoAcceptable = 0xff
+
+	userPassVersion = 1
+	userPassSuccess = 0
+	userPassFailure = 1
+
+	cmdConnect = 1
+
+	replySucceeded            = 0
+	replyGeneralFailure       = 1
+	replyNotAllowed           = 2
+	replyHostUnreachable      = 4
+	replyCommandNotSupported  = 7
+	replyAddrTypeNotSupported = 8
+
+	// the most we'll buffer of the proxy's response to the CONNECT request
+	maxResponseHeaderSize = 64 * 1024
+)
+
+var (
+	log = golog.LoggerFor("socks5")
+
+	headerEnd = []byte("\r\n\r\n")
+)
+
+// NewListener wraps a net.Listener with a SOCKS5 server. Clients that
+// authenticate with a username and password have them passed to the proxy as
+// the device ID and the auth token respectively, clients that don't have
+// neither. Only the CONNECT command is supported.
+//
+// The connections it returns present each client's CONNECT command as an HTTP
+// CONNECT request and translate the proxy's response to it back into a SOCKS5
+// reply, after which data is passed through unchanged.
+func NewListener(base net.Listener) net.Listener {
+	return listeners.NewHandshakingListener(base, handshake, "")
+}
+
+func handshake(conn net.Conn) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+	deviceID, token, err := negotiateAuth(br, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("unable to read request: %w", err)
+	}
+	if header[0] != version5 {
+		return nil, fmt.Errorf("unsupported version %d", header[0])
+	}
+	if header[1] != cmdConnect {
+		writeReply(conn, replyCommandNotSupported)
+		return nil, fmt.Errorf("unsupported command %d", header[1])
+	}
+	addr, err := socks.ReadAddr(br)
+	if err != nil {
+		writeReply(conn, replyAddrTypeNotSupported)
+		return nil, fmt.Errorf("unable to read destination: %w", err)
+	}
+
+	if !validField(addr.String()) {
+		writeReply(conn, replyGeneralFailure)
+		return nil, fmt.Errorf("invalid destination %q", addr)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr.String()},
+		Host:   addr.String(),
+		Header: make(http.Header),
+	}
+	// don't let net/http add its own
+	req.Header.Set("User-Agent", "")
+	if token != "" {
+		req.Header.Set(common.TokenHeader, token)
+	}
+	if deviceID != "" {
+		req.Header.Set(common.DeviceIdHeader, deviceID)
+	}
+	var encoded bytes.Buffer
+	if err := req.Write(&encoded); err != nil {
+		writeReply(conn, replyGeneralFailure)
+		return nil, fmt.Errorf("unable to encode CONNECT request: %w", err)
+	}
+
+	return &socksConn{
+		Conn:   conn,
+		reader: io.MultiReader(&encoded, br),
+	}, nil
+}
+
+// validField reports whether s can be passed to the proxy as is, which isn't
+// the case if it contains whitespace or control characters that could end a
+// header or the request early.
+func validField(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// negotiateAuth reads the client's greeting and, if the client chose to
+// authenticate with a username and password (RFC 1929), its credentials.
+func negotiateAuth(br *bufio.Reader, conn net.Conn) (username, password string, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", "", fmt.Errorf("unable to read greeting: %w", err)
+	}
+	if header[0] != version5 {
+		return "", "", fmt.Errorf("unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", "", fmt.Errorf("unable to read auth methods: %w", err)
+	}
+	method := byte(methodNoAcceptable)
+	if bytes.IndexByte(methods, methodUserPass) >= 0 {
+		method = methodUserPass
+	} else if bytes.IndexByte(methods, methodNoAuth) >= 0 {
+		method = methodNoAuth
+	}
+	if _, err := conn.Write([]byte{version5, method}); err != nil {
+		return "", "", fmt.Errorf("unable to write auth method: %w", err)
+	}
+
+	switch method {
+	case methodNoAuth:
+		return "", "", nil
+	case methodUserPass:
+		username, password, err = readUserPass(br)
+		status := byte(userPassSuccess)
+		if err != nil {
+			status = userPassFailure
+		}
+		if _, writeErr := conn.Write([]byte{userPassVersion, status}); writeErr != nil && err == nil {
+			err = fmt.Errorf("unable to write auth status: %w", writeErr)
+		}
+		return username, password, err
+	default:
+		return "", "", errors.New("no acceptable auth method")
+	}
+}
+
+func readUserPass(r io.Reader) (string, string, error) {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(r, version); err != nil {
+		return "", "", fmt.Errorf("unable to read auth version: %w", err)
+	}
+	if version[0] != userPassVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", version[0])
+	}
+	username, err := readString(r)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to read username: %w", err)
+	}
+	password, err := readString(r)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to read password: %w", err)
+	}
+	if !validField(username) || !validField(password) {
+		return "", "", errors.New("invalid characters in username or password")
+	}
+	return username, password, nil
+}
+
+// readString reads a string preceded by its length in one byte.
+func readString(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+	b := make([]byte, length[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func writeReply(w io.Writer, reply byte) error {
+	// the address the proxy binds to for the client isn't meaningful, so
+	// always report 0.0.0.0:0
+	_, err := w.Write([]byte{version5, reply, 0, socks.AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// replyFor maps the status of the proxy's response to a CONNECT request to a
+// SOCKS5 reply.
+func replyFor(statusCode int) byte {
+	switch {
+	case statusCode >= 200 && statusCode < 300:
+		return replySucceeded
+	case statusCode == http.StatusBadGateway || statusCode == http.StatusGatewayTimeout:
+		return replyHostUnreachable
+	case statusCode >= 500:
+		return replyGeneralFailure
+	default:
+		return replyNotAllowed
+	}
+}
+
+// socksConn is the connection of a client that completed the SOCKS5 handshake.
+// Reads start with the synthesized CONNECT request, and the proxy's response
+// to it is held back until it's complete so that it can be replaced with the
+// corresponding SOCKS5 reply.
+type socksConn struct {
+	net.Conn
+	reader   io.Reader
+	response []byte
+	replied  bool
+	failed   bool
+	mx       sync.Mutex
+}
+
+func (c *socksConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *socksConn) Write(b []byte) (int, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.failed {
+		// the client was already told the request failed, drop whatever else
+		// the proxy has to say, like the body of an error response
+		return len(b), nil
+	}
+	if c.replied {
+		return c.Conn.Write(b)
+	}
+
+	c.response = append(c.response, b...)
+	end := bytes.Index(c.response, headerEnd)
+	if end < 0 {
+		if len(c.response) > maxResponseHeaderSize {
+			c.failed = true
+			writeReply(c.Conn, replyGeneralFailure)
+			return 0, errors.New("response to CONNECT request too large")
+		}
+		return len(b), nil
+	}
+	end += len(headerEnd)
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.response[:end])), nil)
+	if err != nil {
+		c.failed = true
+		writeReply(c.Conn, replyGeneralFailure)
+		return 0, fmt.Errorf("unable to read response to CONNECT request: %w", err)
+	}
+	resp.Body.Close()
+	remaining := c.response[end:]
+	c.response = nil
+
+	reply := replyFor(resp.StatusCode)
+	if reply != replySucceeded {
+		log.Debugf("CONNECT from %v failed with %v", c.RemoteAddr(), resp.Status)
+		c.failed = true
+		// per RFC 1928 the server closes the connection shortly after a
+		// failure reply
+		writeReply(c.Conn, reply)
+		c.Conn.Close()
+		return len(b), nil
+	}
+	c.replied = true
+	if err := writeReply(c.Conn, reply); err != nil {
+		return 0, err
+	}
+	if len(remaining) > 0 {
+		if _, err := c.Conn.Write(remaining); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (c *socksConn) Wrapped() net.Conn {
+	return c.Conn
+}
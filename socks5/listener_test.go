@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+)
+
+// serveFakeProxy accepts connections from l and responds to their CONNECT
+// requests the way the proxy would, only allowing requests with the right
+// token and echoing data after that.
+func serveFakeProxy(t *testing.T, l net.Listener, requests chan<- *http.Request) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			req, err := http.ReadRequest(br)
+			if !assert.NoError(t, err) {
+				return
+			}
+			requests <- req
+			if req.Header.Get(common.TokenHeader) != "token" {
+				conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 9\r\n\r\nForbidden"))
+				return
+			}
+			// the response and the first data may be written in one go
+			conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\nhello "))
+			io.Copy(conn, br)
+		}()
+	}
+}
+
+func TestListener(t *testing.T) {
+	l0, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewListener(l0)
+	defer l.Close()
+	requests := make(chan *http.Request, 10)
+	go serveFakeProxy(t, l, requests)
+
+	dial := func(auth *proxy.Auth) (net.Conn, error) {
+		dialer, err := proxy.SOCKS5("tcp", l.Addr().String(), auth, proxy.Direct)
+		require.NoError(t, err)
+		return dialer.Dial("tcp", "example.com:443")
+	}
+
+	t.Run("authenticated", func(t *testing.T) {
+		conn, err := dial(&proxy.Auth{User: "device", Password: "token"})
+		require.NoError(t, err)
+		defer conn.Close()
+
+		req := <-requests
+		assert.Equal(t, http.MethodConnect, req.Method)
+		assert.Equal(t, "example.com:443", req.Host)
+		assert.Equal(t, "token", req.Header.Get(common.TokenHeader))
+		assert.Equal(t, "device", req.Header.Get(common.DeviceIdHeader))
+		assert.NotContains(t, req.Header, "User-Agent")
+
+		_, err = conn.Write([]byte("world"))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, len("hello world"))
+		_, err = io.ReadFull(conn, b)
+		require.NoError(t, err)
+		assert.Equal(t, "hello world", string(b))
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		_, err := dial(&proxy.Auth{User: "device", Password: "wrong"})
+		assert.Error(t, err, "failed CONNECT should be reported as a SOCKS5 failure")
+		<-requests
+	})
+
+	t.Run("no auth", func(t *testing.T) {
+		_, err := dial(nil)
+		assert.Error(t, err)
+		req := <-requests
+		assert.Empty(t, req.Header.Get(common.TokenHeader))
+		assert.Empty(t, req.Header.Get(common.DeviceIdHeader))
+	})
+
+	t.Run("header injection", func(t *testing.T) {
+		_, err := dial(&proxy.Auth{User: "device\r\nX-Injected: 1", Password: "token"})
+		assert.Error(t, err, "username with CRLF should be rejected")
+		_, err = dial(&proxy.Auth{User: "device", Password: "token\r\n\r\nGET / HTTP/1.1"})
+		assert.Error(t, err, "password with CRLF should be rejected")
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		// greeting with no auth, then a CONNECT to a domain with a CRLF
+		domain := "example.com\r\nX-Injected: 1"
+		request := append([]byte{5, 1, 0, 5, 1, 0, 3, byte(len(domain))}, domain...)
+		_, err = conn.Write(append(request, 1, 187))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 4)
+		_, err = io.ReadFull(conn, b)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{5, 0, 5, replyGeneralFailure}, b)
+
+		select {
+		case req := <-requests:
+			t.Fatalf("request shouldn't have reached the proxy: %v", req.Header)
+		default:
+		}
+	})
+
+	t.Run("unsupported command", func(t *testing.T) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		// greeting with no auth, then a UDP ASSOCIATE request
+		_, err = conn.Write([]byte{5, 1, 0, 5, 3, 0, 1, 127, 0, 0, 1, 0, 80})
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 4)
+		_, err = io.ReadFull(conn, b)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{5, 0, 5, replyCommandNotSupported}, b)
+	})
+}
@@ -0,0 +1,40 @@
+package throttle
+
+import (
+	"time"
+)
+
+// ExpirationFor returns the unix timestamp at which usage that's capped per
+// the given interval resets, as of now in the given time zone. Time zones that
+// can't be loaded are ignored.
+func ExpirationFor(now time.Time, ttl CapInterval, timeZoneName string) int64 {
+	tz, err := time.LoadLocation(timeZoneName)
+	if err == nil {
+		// adjust to given timeZone
+		now = now.In(tz)
+	}
+	switch ttl {
+	case Daily:
+		return DaysFrom(now, 1).Unix()
+	case Weekly:
+		daysFromSunday := int(now.Weekday())
+		daysToNextMonday := 8 - daysFromSunday
+		if daysToNextMonday > 7 {
+			// today's Sunday, so next Monday is in just 1 day
+			daysToNextMonday = 1
+		}
+		nextMonday := now.AddDate(0, 0, daysToNextMonday)
+		return time.Date(nextMonday.Year(), nextMonday.Month(), nextMonday.Day(), 0, 0, 0, 0, now.Location()).Add(-1 * time.Nanosecond).Unix()
+	case Monthly, Legacy:
+		nextMonth := now.AddDate(0, 1, 0)
+		return time.Date(nextMonth.Year(), nextMonth.Month(), 1, 0, 0, 0, 0, now.Location()).Add(-1 * time.Nanosecond).Unix()
+	}
+	return 0
+}
+
+// DaysFrom returns the last instant of the day that's the given number of days
+// after start, in start's location.
+func DaysFrom(start time.Time, days int) time.Time {
+	next := start.AddDate(0, 0, days)
+	return time.Date(next.Year(), next.Month(), next.Day(), 0, 0, 0, 0, start.Location()).Add(-1 * time.Nanosecond)
+}
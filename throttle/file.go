@@ -0,0 +1,103 @@
+package throttle
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+type fileConfig struct {
+	path            string
+	refreshInterval time.Duration
+	settings        SettingsByCountryAndPlatform
+	modTime         time.Time
+	mx              sync.RWMutex
+}
+
+// NewFileConfig returns a new Config that loads the same JSON-encoded
+// SettingsByCountryAndPlatform that's stored in redis from the file at path.
+// The file is checked for changes every refreshInterval and reloaded when it
+// changes. Invalid settings, including cohorts with "legacy" cap resets, are
+// rejected, which on reload means that the previous settings stay in effect.
+func NewFileConfig(path string, refreshInterval time.Duration) (Config, error) {
+	cfg := &fileConfig{
+		path:            path,
+		refreshInterval: refreshInterval,
+	}
+	if err := cfg.refreshSettings(); err != nil {
+		return nil, err
+	}
+	go cfg.keepCurrent()
+	return cfg, nil
+}
+
+func (cfg *fileConfig) setRefreshInterval(refreshInterval time.Duration) {
+	cfg.mx.Lock()
+	cfg.refreshInterval = refreshInterval
+	cfg.mx.Unlock()
+}
+
+func (cfg *fileConfig) getRefreshInterval() time.Duration {
+	cfg.mx.RLock()
+	defer cfg.mx.RUnlock()
+	if cfg.refreshInterval <= 0 {
+		return DefaultRefreshInterval
+	}
+	return cfg.refreshInterval
+}
+
+func (cfg *fileConfig) keepCurrent() {
+	log.Debugf("Checking %v for changes every %v", cfg.path, cfg.getRefreshInterval())
+	for {
+		time.Sleep(cfg.getRefreshInterval())
+		if err := cfg.refreshSettings(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func (cfg *fileConfig) refreshSettings() error {
+	info, err := os.Stat(cfg.path)
+	if err != nil {
+		return errors.New("Unable to stat throttle settings file %v: %v", cfg.path, err)
+	}
+	cfg.mx.RLock()
+	unchanged := cfg.settings != nil && info.ModTime().Equal(cfg.modTime)
+	cfg.mx.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	encoded, err := os.ReadFile(cfg.path)
+	if err != nil {
+		return errors.New("Unable to read throttle settings from %v: %v", cfg.path, err)
+	}
+	settings, err := decodeSettingsByCountryAndPlatform(encoded)
+	if err == nil {
+		err = settings.Validate()
+	}
+	if err != nil {
+		// don't bother trying again until the file changes
+		cfg.mx.Lock()
+		cfg.modTime = info.ModTime()
+		cfg.mx.Unlock()
+		return errors.New("Invalid throttle settings in %v: %v", cfg.path, err)
+	}
+
+	log.Debugf("Loaded throttle config from %v: %v", cfg.path, string(encoded))
+
+	cfg.mx.Lock()
+	cfg.settings = settings
+	cfg.modTime = info.ModTime()
+	cfg.mx.Unlock()
+	return nil
+}
+
+func (cfg *fileConfig) SettingsFor(deviceID, countryCode, platform, appName string, supportedDataCaps []string) (*Settings, bool) {
+	cfg.mx.RLock()
+	settings := cfg.settings
+	cfg.mx.RUnlock()
+	return settings.settingsFor(deviceID, countryCode, platform, appName, supportedDataCaps)
+}
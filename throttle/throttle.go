@@ -136,9 +136,11 @@ func decodeSettingsByCountryAndPlatform(encoded []byte) (settings SettingsByCoun
 }
 
 type redisConfig struct {
-	rc              *redis.Client
+	rc              redis.UniversalClient
 	refreshInterval time.Duration
 	settings        SettingsByCountryAndPlatform
+	fallback        Config
+	unreachable     bool
 	mx              sync.RWMutex
 	ctx             context.Context
 }
@@ -146,10 +148,18 @@ type redisConfig struct {
 // NewRedisConfig returns a new Config that uses the given redis client to load
 // its configuration information and reload that information every
 // refreshInterval.
-func NewRedisConfig(rc *redis.Client, refreshInterval time.Duration) Config {
+func NewRedisConfig(rc redis.UniversalClient, refreshInterval time.Duration) Config {
+	return NewRedisConfigWithFallback(rc, refreshInterval, nil)
+}
+
+// NewRedisConfigWithFallback is like NewRedisConfig, but uses the fallback
+// Config whenever redis couldn't be reached on the most recent refresh. The
+// fallback may be nil.
+func NewRedisConfigWithFallback(rc redis.UniversalClient, refreshInterval time.Duration, fallback Config) Config {
 	cfg := &redisConfig{
 		rc:              rc,
 		refreshInterval: refreshInterval,
+		fallback:        fallback,
 		ctx:             context.Background(),
 	}
 	cfg.refreshSettings()
@@ -157,21 +167,52 @@ func NewRedisConfig(rc *redis.Client, refreshInterval time.Duration) Config {
 	return cfg
 }
 
-func (cfg *redisConfig) keepCurrent() {
+// refreshingConfig is implemented by Configs that periodically refresh their
+// settings.
+type refreshingConfig interface {
+	setRefreshInterval(refreshInterval time.Duration)
+}
+
+// SetRefreshInterval changes how frequently the given Config refreshes its
+// settings. It returns an error if the Config doesn't refresh periodically.
+func SetRefreshInterval(cfg Config, refreshInterval time.Duration) error {
+	rc, ok := cfg.(refreshingConfig)
+	if !ok {
+		return errors.New("throttle config of type %T does not refresh", cfg)
+	}
+	rc.setRefreshInterval(refreshInterval)
+	log.Debugf("Refreshing every %v", refreshInterval)
+	return nil
+}
+
+func (cfg *redisConfig) setRefreshInterval(refreshInterval time.Duration) {
+	cfg.mx.Lock()
+	cfg.refreshInterval = refreshInterval
+	cfg.mx.Unlock()
+}
+
+func (cfg *redisConfig) getRefreshInterval() time.Duration {
+	cfg.mx.RLock()
+	defer cfg.mx.RUnlock()
 	if cfg.refreshInterval <= 0 {
-		log.Debugf("Defaulting refresh interval to %v", DefaultRefreshInterval)
-		cfg.refreshInterval = DefaultRefreshInterval
+		return DefaultRefreshInterval
 	}
+	return cfg.refreshInterval
+}
 
-	log.Debugf("Refreshing every %v", cfg.refreshInterval)
+func (cfg *redisConfig) keepCurrent() {
+	log.Debugf("Refreshing every %v", cfg.getRefreshInterval())
 	for {
-		time.Sleep(cfg.refreshInterval)
+		time.Sleep(cfg.getRefreshInterval())
 		cfg.refreshSettings()
 	}
 }
 
 func (cfg *redisConfig) refreshSettings() {
 	encoded, err := cfg.rc.Get(cfg.ctx, "_throttle").Bytes()
+	cfg.mx.Lock()
+	cfg.unreachable = err != nil && err != redis.Nil
+	cfg.mx.Unlock()
 	if err != nil {
 		log.Errorf("Unable to load throttle settings from redis: %v", err)
 		return
@@ -192,8 +233,18 @@ func (cfg *redisConfig) refreshSettings() {
 func (cfg *redisConfig) SettingsFor(deviceID, countryCode, platform, appName string, supportedDataCaps []string) (*Settings, bool) {
 	cfg.mx.RLock()
 	settings := cfg.settings
+	useFallback := cfg.unreachable && cfg.fallback != nil
 	cfg.mx.RUnlock()
 
+	if useFallback {
+		log.Trace("Redis unreachable, using fallback throttle config")
+		return cfg.fallback.SettingsFor(deviceID, countryCode, platform, appName, supportedDataCaps)
+	}
+	return settings.settingsFor(deviceID, countryCode, platform, appName, supportedDataCaps)
+}
+
+// settingsFor implements Config.SettingsFor on top of a set of settings.
+func (settings SettingsByCountryAndPlatform) settingsFor(deviceID, countryCode, platform, appName string, supportedDataCaps []string) (*Settings, bool) {
 	platformSettings := settings[strings.ToLower(countryCode)]
 	if platformSettings == nil {
 		log.Tracef("No settings found for country %v, use default", countryCode)
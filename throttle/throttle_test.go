@@ -3,6 +3,8 @@ package throttle
 import (
 	"context"
 	"crypto/tls"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -53,6 +55,10 @@ const (
 }`
 )
 
+// fileSettings are goodSettings without legacy cohorts, which aren't valid in
+// settings files
+var fileSettings = strings.ReplaceAll(goodSettings, `"capResets": "legacy"`, `"capResets": "daily"`)
+
 func doTest(t *testing.T, cfg Config, deviceID, countryCode, platform, appName string, supportedDataCaps []string, expectedThreshold int64, expectedRate int64, expectedCapResets CapInterval, testCase string) {
 	settings, ok := cfg.SettingsFor(deviceID, countryCode, platform, appName, supportedDataCaps)
 	require.True(t, ok, "valid config for "+testCase)
@@ -112,6 +118,7 @@ func TestForcedConfig(t *testing.T) {
 
 	cfg := NewForcedConfig(1024, 512, "weekly")
 	doTest(t, cfg, deviceIDInSegment1, "", "", "lantern", []string{"monthly", "weekly"}, 1024, 512, "weekly", "forced config")
+	require.Error(t, SetRefreshInterval(cfg, refreshInterval), "forced config doesn't refresh")
 }
 
 func TestFailToConnectRedis(t *testing.T) {
@@ -135,3 +142,84 @@ func TestFailToConnectRedis(t *testing.T) {
 	// Should load the config when Redis is back up online
 	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 4000, 400, "weekly", "known country, known platform, segment 1, redis back online")
 }
+
+func TestFileConfig(t *testing.T) {
+	stopCapture := testlog.Capture(t)
+	defer stopCapture()
+
+	path := filepath.Join(t.TempDir(), "throttle.json")
+	write := func(settings string, age time.Duration) {
+		require.NoError(t, os.WriteFile(path, []byte(settings), 0644))
+		// make sure the modification time changes between writes
+		modTime := time.Now().Add(-age)
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	write("blah I'm bad settings blah", time.Hour)
+	_, err := NewFileConfig(path, refreshInterval)
+	require.Error(t, err, "Loading throttle settings from bad file should fail")
+
+	write(strings.ReplaceAll(fileSettings, `"capResets": "weekly"`, `"capResets": "yearly"`), time.Hour)
+	_, err = NewFileConfig(path, refreshInterval)
+	require.Error(t, err, "Loading invalid throttle settings should fail")
+
+	write(fileSettings, time.Hour)
+	cfg, err := NewFileConfig(path, refreshInterval)
+	require.NoError(t, err)
+	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 4000, 400, "weekly", "known country, known platform, segment 1")
+	doTest(t, cfg, deviceIDInSegment1, "ir", "", "specialapp", []string{"monthly", "weekly"}, 1000000, 100, "monthly", "uncapped app")
+
+	// update settings
+	write(strings.ReplaceAll(fileSettings, "4", "5"), 30*time.Minute)
+	time.Sleep(refreshInterval * 5)
+	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 5000, 500, "weekly", "known country, known platform, segment 1, after update")
+
+	// invalid updates are ignored
+	write("blah I'm bad settings blah", 0)
+	time.Sleep(refreshInterval * 5)
+	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 5000, 500, "weekly", "known country, known platform, segment 1, after bad update")
+}
+
+func TestRedisConfigFallback(t *testing.T) {
+	stopCapture := testlog.Capture(t)
+	defer stopCapture()
+
+	path := filepath.Join(t.TempDir(), "throttle.json")
+	require.NoError(t, os.WriteFile(path, []byte(fileSettings), 0644))
+	fallback, err := NewFileConfig(path, refreshInterval)
+	require.NoError(t, err)
+
+	bogusClient := redis.NewClient(&redis.Options{
+		Addr:      "localhost:80",
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	cfg := NewRedisConfigWithFallback(bogusClient, refreshInterval, fallback)
+	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 4000, 400, "weekly", "redis unreachable, using fallback")
+
+	redisClient := testutil.TestRedis(t)
+	require.NoError(t, redisClient.Set(context.Background(), "_throttle", strings.ReplaceAll(goodSettings, "4", "5"), 0).Err())
+	cfg = NewRedisConfigWithFallback(redisClient, refreshInterval, fallback)
+	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 5000, 500, "weekly", "redis reachable, using redis")
+}
+
+func TestExpirationFor(t *testing.T) {
+	timeZone := "Asia/Shanghai"
+	tz, err := time.LoadLocation(timeZone)
+	require.NoError(t, err)
+
+	thursday := time.Date(2020, 12, 31, 23, 0, 0, 0, tz).In(time.UTC)
+	friday := time.Date(2021, 1, 1, 0, 0, 0, 0, tz).Add(-1 * time.Nanosecond)
+	sunday := time.Date(2021, 1, 3, 0, 0, 0, 0, tz).Add(-1 * time.Nanosecond)
+	nextMonday := time.Date(2021, 1, 4, 0, 0, 0, 0, tz).Add(-1 * time.Nanosecond)
+
+	require.Equal(t, friday.Unix(), ExpirationFor(thursday, Daily, timeZone), 0)
+	require.Equal(t, friday.Unix(), ExpirationFor(thursday.Add(5*time.Minute), Daily, timeZone), 0)
+	require.Equal(t, friday.Unix(), ExpirationFor(thursday, Monthly, timeZone), 0)
+	require.Equal(t, friday.Unix(), ExpirationFor(thursday, Legacy, timeZone), 0)
+	require.Equal(t, friday.Unix(), ExpirationFor(thursday.Add(5*time.Minute), Monthly, timeZone), 0)
+	require.Equal(t, friday.Unix(), ExpirationFor(thursday.Add(5*time.Minute), Legacy, timeZone), 0)
+
+	require.Equal(t, nextMonday.Unix(), ExpirationFor(thursday, Weekly, timeZone), 0)
+	require.Equal(t, nextMonday.Unix(), ExpirationFor(thursday.Add(5*time.Minute), Weekly, timeZone), 0)
+	require.Equal(t, nextMonday.Unix(), ExpirationFor(sunday, Weekly, timeZone), 0)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/getlantern/errors"
@@ -101,36 +102,77 @@ func makeSessionTicketKey() []byte {
 	return b
 }
 
+// inMemorySessionTicketKeys rotates through a fixed set of session ticket keys
+// held in memory. The set of keys can be replaced at runtime with update.
+type inMemorySessionTicketKeys struct {
+	keyListener func(keys [][keySize]byte)
+	keyBytes    []byte
+	mx          sync.Mutex
+	stopCh      chan interface{}
+	stopOnce    sync.Once
+}
+
 func maintainSessionTicketKeysInMemory(
-	sessionTicketKeys string, keyListener func(keys [][keySize]byte)) error {
+	sessionTicketKeys string, keyListener func(keys [][keySize]byte)) (*inMemorySessionTicketKeys, error) {
+
+	m := &inMemorySessionTicketKeys{
+		keyListener: keyListener,
+		stopCh:      make(chan interface{}),
+	}
+	// Initialize key
+	if err := m.update(sessionTicketKeys); err != nil {
+		return nil, err
+	}
+
+	go m.rotatePeriodically()
+	return m, nil
+}
 
+// update replaces the session ticket keys with the given base64 encoded keys
+// and immediately makes them available to the listener.
+func (m *inMemorySessionTicketKeys) update(sessionTicketKeys string) error {
 	keyBytes, err := base64.StdEncoding.DecodeString(sessionTicketKeys)
 	if err != nil {
 		return errors.New("failed to parse session ticket keys: %v", err)
 	}
-	if len(keyBytes)%keySize != 0 {
+	if len(keyBytes) == 0 || len(keyBytes)%keySize != 0 {
 		return errors.New("session ticket keys should be multiple of keySize bytes")
 	}
 
-	// Initialize key
-	keyListener(buildKeysArray(keyBytes))
-
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.keyBytes = keyBytes
+	m.keyListener(buildKeysArray(keyBytes))
 	if len(keyBytes) == keySize {
 		log.Debug("session ticket keys contains only one key, we'll use that and not bother rotating")
-		return nil
+	} else {
+		log.Debugf("Will rotate %d session ticket keys in memory every %v hours", len(keyBytes)/keySize, rotateInterval)
 	}
+	return nil
+}
 
-	log.Debugf("Will rotate %d session ticket keys in memory every %v hours", len(keyBytes)/keySize, rotateInterval)
-
-	go func() {
-		for {
-			time.Sleep(rotateInterval)
-			keyBytes = rotateSessionTicketKeysInMemory(keyBytes)
-			keyListener(buildKeysArray(keyBytes))
+func (m *inMemorySessionTicketKeys) rotatePeriodically() {
+	ticker := time.NewTicker(rotateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-ticker.C:
+			m.mx.Lock()
+			if len(m.keyBytes) > keySize {
+				m.keyBytes = rotateSessionTicketKeysInMemory(m.keyBytes)
+				m.keyListener(buildKeysArray(m.keyBytes))
+			}
+			m.mx.Unlock()
 		}
-	}()
+	}
+}
 
-	return nil
+func (m *inMemorySessionTicketKeys) stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopCh)
+	})
 }
 
 func rotateSessionTicketKeysInMemory(keyBytes []byte) []byte {
@@ -1,6 +1,7 @@
 package tlslistener
 
 import (
+	"encoding/base64"
 	"math/rand"
 	"testing"
 
@@ -23,3 +24,29 @@ func TestRotateSessionTicketKeysInMemory(t *testing.T) {
 	rotatedKeyBytes = rotateSessionTicketKeysInMemory(rotatedKeyBytes)
 	require.EqualValues(t, initialKeyBytes, rotatedKeyBytes)
 }
+
+func TestUpdateSessionTicketKeysInMemory(t *testing.T) {
+	key1 := make([]byte, keySize)
+	key2 := make([]byte, keySize)
+	_, err := rand.Read(key1)
+	require.NoError(t, err)
+	_, err = rand.Read(key2)
+	require.NoError(t, err)
+
+	var currentKeys [][keySize]byte
+	m, err := maintainSessionTicketKeysInMemory(base64.StdEncoding.EncodeToString(key1), func(keys [][keySize]byte) {
+		currentKeys = keys
+	})
+	require.NoError(t, err)
+	defer m.stop()
+	require.Len(t, currentKeys, 1)
+	require.EqualValues(t, key1, currentKeys[0][:])
+
+	require.NoError(t, m.update(base64.StdEncoding.EncodeToString(append(key2, key1...))))
+	require.Len(t, currentKeys, 2)
+	require.EqualValues(t, key2, currentKeys[0][:])
+	require.EqualValues(t, key1, currentKeys[1][:])
+
+	require.Error(t, m.update(base64.StdEncoding.EncodeToString(key1[:keySize-1])))
+	require.Len(t, currentKeys, 2, "invalid keys should leave the current keys in place")
+}
@@ -74,9 +74,11 @@ func Wrap(wrapped net.Listener, keyFile, certFile, sessionTicketKeyFile, firstSe
 		maintainSessionTicketKeyFile(sessionTicketKeyFile, firstSessionTicketKey, onKeys)
 	} else if expectTicketsInMemory {
 		log.Debug("Will rotate through session tickets in memory")
-		if err := maintainSessionTicketKeysInMemory(sessionTicketKeys, onKeys); err != nil {
+		inMemoryKeys, err := maintainSessionTicketKeysInMemory(sessionTicketKeys, onKeys)
+		if err != nil {
 			return nil, errors.New("unable to maintain session ticket keys in memory: %v", err)
 		}
+		listener.inMemoryKeys = inMemoryKeys
 	}
 
 	return listener, nil
@@ -93,6 +95,21 @@ type tlslistener struct {
 	instrument            instrument.Instrument
 	ticketKeys            utls.TicketKeys
 	ticketKeysMutex       sync.RWMutex
+	inMemoryKeys          *inMemorySessionTicketKeys
+}
+
+// UpdateSessionTicketKeys replaces the session ticket keys used by a listener
+// obtained from Wrap with the given base64 encoded keys. This only works for
+// listeners that were configured with in-memory session ticket keys.
+func UpdateSessionTicketKeys(l net.Listener, sessionTicketKeys string) error {
+	tl, ok := l.(*tlslistener)
+	if !ok {
+		return errors.New("not a tlslistener: %T", l)
+	}
+	if tl.inMemoryKeys == nil {
+		return errors.New("listener isn't using in-memory session ticket keys")
+	}
+	return tl.inMemoryKeys.update(sessionTicketKeys)
 }
 
 func (l *tlslistener) Accept() (net.Conn, error) {
@@ -119,6 +136,9 @@ func (l *tlslistener) Addr() net.Addr {
 }
 
 func (l *tlslistener) Close() error {
+	if l.inMemoryKeys != nil {
+		l.inMemoryKeys.stop()
+	}
 	return l.wrapped.Close()
 }
 
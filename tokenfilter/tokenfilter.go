@@ -1,70 +1,305 @@
 package tokenfilter
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/getlantern/golog"
 	"github.com/getlantern/proxy/v3/filters"
 
 	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/coversite"
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/internal/ttlcache"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
 	"github.com/getlantern/http-proxy-lantern/v2/mimic"
 )
 
+// Mode determines which kinds of tokens a TokenFilter accepts.
+type Mode string
+
+const (
+	// Static only accepts the configured static and labeled tokens.
+	Static Mode = "static"
+	// HMAC only accepts time-based HMAC tokens derived from the shared secret.
+	HMAC Mode = "hmac"
+	// Transition accepts both static and HMAC tokens, for while
+	// clients are migrating.
+	Transition Mode = "transition"
+)
+
+const (
+	// DefaultHMACWindow is how far an HMAC token's timestamp may be from the
+	// proxy's clock.
+	DefaultHMACWindow = 5 * time.Minute
+	// DefaultNonceCacheSize is the maximum number of nonces remembered to
+	// reject replayed HMAC tokens. Nonces are remembered until their tokens
+	// leave the window, so with the DefaultHMACWindow, this allows for at least
+	// 160 new tokens per second. Beyond that, new tokens are rejected.
+	DefaultNonceCacheSize = 100000
+
+	hmacTokenVersion = "v1"
+	minNonceLength   = 16
+	maxNonceLength   = 64
+)
+
 var log = golog.LoggerFor("tokenfilter")
 
-type tokenFilter struct {
+// ParseMode parses a Mode, defaulting to Static if mode is empty.
+func ParseMode(mode string) (Mode, error) {
+	switch m := Mode(strings.ToLower(mode)); m {
+	case "":
+		return Static, nil
+	case Static, HMAC, Transition:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown token mode %v", mode)
+	}
+}
+
+// NewHMACToken creates a token that's valid for the given secret around the
+// given time. Each token carries a random nonce and can only be used once.
+//
+// Tokens look like v1.<unix timestamp>.<nonce>.<signature>, where the signature
+// is the base64url-encoded HMAC-SHA256 of "v1.<unix timestamp>.<nonce>".
+func NewHMACToken(secret string, now time.Time) (string, error) {
+	b := make([]byte, minNonceLength/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate nonce: %v", err)
+	}
+	payload := fmt.Sprintf("%v.%d.%v", hmacTokenVersion, now.Unix(), hex.EncodeToString(b))
+	return payload + "." + sign(secret, payload), nil
+}
+
+func sign(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TokenFilter is a filter that only allows requests carrying a valid token and
+// mimics a web server or reverse-proxies to a cover site for everything else.
+type TokenFilter struct {
 	token      string
+	tokens     map[string]*Token
+	secret     string
+	mode       Mode
+	tokenMx    sync.RWMutex
+	window     time.Duration
+	coverSite  *coversite.Site
+	nonces     *ttlcache.Cache
+	maxNonces  int
+	noncesFull bool
+	lastSweep  time.Time
+	noncesMx   sync.Mutex
 	instrument instrument.Instrument
 }
 
-func New(token string, instrument instrument.Instrument) filters.Filter {
-	return &tokenFilter{
+// New creates a TokenFilter that requires the given static token. Use SetTokens
+// to accept additional labeled tokens and SetHMAC to accept HMAC tokens.
+func New(token string, instrument instrument.Instrument) *TokenFilter {
+	return &TokenFilter{
 		token:      token,
+		mode:       Static,
+		window:     DefaultHMACWindow,
+		nonces:     ttlcache.New(ttlcache.Opts{}),
+		maxNonces:  DefaultNonceCacheSize,
 		instrument: instrument,
 	}
 }
 
-func (f *tokenFilter) Apply(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+// SetToken changes the token required by this filter. It takes effect for all
+// subsequent requests.
+func (f *TokenFilter) SetToken(token string) {
+	f.tokenMx.Lock()
+	f.token = token
+	f.tokenMx.Unlock()
+}
+
+// SetHMAC changes the secret used to verify HMAC tokens along with the mode. It
+// takes effect for all subsequent requests.
+func (f *TokenFilter) SetHMAC(secret string, mode Mode) error {
+	if mode != Static && secret == "" {
+		return fmt.Errorf("token mode %v requires a secret", mode)
+	}
+	f.tokenMx.Lock()
+	f.secret = secret
+	f.mode = mode
+	f.tokenMx.Unlock()
+	return nil
+}
+
+// SetCoverSite sets the site to which requests without a valid token are
+// reverse-proxied instead of mimicking a web server. A nil site turns this off.
+// The idle connections of the previous site are closed.
+func (f *TokenFilter) SetCoverSite(site *coversite.Site) {
+	f.tokenMx.Lock()
+	previous := f.coverSite
+	f.coverSite = site
+	f.tokenMx.Unlock()
+	if previous != nil && previous != site {
+		previous.CloseIdleConnections()
+	}
+}
+
+func (f *TokenFilter) getCoverSite() *coversite.Site {
+	f.tokenMx.RLock()
+	defer f.tokenMx.RUnlock()
+	return f.coverSite
+}
+
+func (f *TokenFilter) getSettings() (string, map[string]*Token, string, Mode) {
+	f.tokenMx.RLock()
+	defer f.tokenMx.RUnlock()
+	return f.token, f.tokens, f.secret, f.mode
+}
+
+func (f *TokenFilter) Apply(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
 	if log.IsTraceEnabled() {
 		reqStr, _ := httputil.DumpRequest(req, true)
 		log.Tracef("Token Filter Middleware received request:\n%s", reqStr)
 	}
 
-	if f.token == "" {
+	token, labeled, secret, mode := f.getSettings()
+	if mode == Static && token == "" && len(labeled) == 0 {
 		log.Trace("Not checking token")
 		return next(cs, req)
 	}
 
 	tokens := req.Header[common.TokenHeader]
 	if tokens == nil || len(tokens) == 0 || tokens[0] == "" {
-		log.Errorf("No token provided, mimicking apache")
+		log.Errorf("No token provided, mimicking web server")
 		f.instrument.Mimic(req.Context(), true)
-		return mimicApache(cs, req)
+		return f.reject(cs, req)
 	}
-	tokenMatched := false
+	now := time.Now()
+	var matched *Token
+	var tokenErr error
 	for _, candidate := range tokens {
-		if candidate == f.token {
-			tokenMatched = true
-			break
+		if mode != HMAC {
+			if token != "" && candidate == token {
+				matched = &Token{Token: token}
+				break
+			}
+			if t := labeled[candidate]; t != nil {
+				if !t.expired(now) {
+					matched = t
+					break
+				}
+				tokenErr = fmt.Errorf("token with label %v expired at %v", t.Label, t.ExpiresAt)
+			}
+		}
+		if mode != Static && strings.HasPrefix(candidate, hmacTokenVersion+".") {
+			if tokenErr = f.verifyHMAC(secret, candidate, now); tokenErr == nil {
+				matched = &Token{Token: candidate}
+				break
+			}
 		}
 	}
-	if tokenMatched {
+	if matched != nil {
 		req.Header.Del(common.TokenHeader)
 		log.Tracef("Allowing connection from %v to %v", req.RemoteAddr, req.Host)
 		f.instrument.Mimic(req.Context(), false)
+		if matched.Label != "" {
+			if wc, ok := cs.Downstream().(listeners.WrapConn); ok {
+				wc.ControlMessage("measured", map[string]interface{}{common.TokenLabel: matched.Label})
+			}
+		}
+		if matched.Throttle != nil {
+			req = req.WithContext(context.WithValue(req.Context(), forcedThrottleKey{}, matched.Throttle))
+		}
 		return next(cs, req)
 	}
-	log.Errorf("Mismatched token(s) %v, mimicking apache", strings.Join(tokens, ","))
+	if tokenErr != nil {
+		log.Errorf("Invalid token from %v: %v, mimicking web server", req.RemoteAddr, tokenErr)
+	} else {
+		log.Errorf("Mismatched token(s) %v, mimicking web server", strings.Join(tokens, ","))
+	}
 	f.instrument.Mimic(req.Context(), true)
-	return mimicApache(cs, req)
+	return f.reject(cs, req)
+}
+
+// verifyHMAC checks that the token is signed with the secret, that its
+// timestamp is within the window around now and that its nonce hasn't been
+// seen before.
+func (f *TokenFilter) verifyHMAC(secret, token string, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return fmt.Errorf("malformed token")
+	}
+	ts, nonce, signature := parts[1], parts[2], parts[3]
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+		return fmt.Errorf("invalid nonce length %d", len(nonce))
+	}
+	expected := sign(secret, strings.Join(parts[:3], "."))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("invalid signature")
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %v", ts)
+	}
+	issuedAt := time.Unix(unix, 0)
+	if skew := now.Sub(issuedAt); skew > f.window || skew < -f.window {
+		return fmt.Errorf("timestamp %v outside of window", issuedAt)
+	}
+
+	// Tokens are rejected once their timestamp leaves the window anyway, so
+	// their nonces only need to be remembered until then.
+	f.noncesMx.Lock()
+	defer f.noncesMx.Unlock()
+	if _, seen := f.nonces.Get(nonce); seen {
+		return fmt.Errorf("replayed nonce %v", nonce)
+	}
+	// Forgetting nonces any earlier would allow replaying their tokens, so the
+	// cache doesn't evict them to make room and new tokens are rejected instead.
+	if f.nonces.Len() >= f.maxNonces && now.Sub(f.lastSweep) >= time.Second {
+		f.nonces.Sweep()
+		f.lastSweep = now
+	}
+	if f.nonces.Len() >= f.maxNonces {
+		if !f.noncesFull {
+			log.Errorf("Remembering %d HMAC token nonces, rejecting new tokens until some of them expire", f.maxNonces)
+			f.noncesFull = true
+		}
+		return fmt.Errorf("too many recent tokens")
+	}
+	f.noncesFull = false
+	f.nonces.Set(nonce, true, issuedAt.Add(f.window).Sub(now)+time.Second)
+	return nil
+}
+
+// reject answers a request without a valid token from the cover site if there
+// is one, or like a web server otherwise. Once there's a cover site, the web
+// server's usual responses are never mimicked, not even when the cover site
+// fails, since clients could tell the two apart.
+func (f *TokenFilter) reject(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+	site := f.getCoverSite()
+	if site == nil {
+		return mimicWebServer(cs, req)
+	}
+	conn := cs.Downstream()
+	if err := site.Serve(conn, req); err != nil {
+		log.Error(err)
+	}
+	conn.Close()
+	return nil, cs, nil
 }
 
-func mimicApache(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+func mimicWebServer(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
 	conn := cs.Downstream()
-	mimic.Apache(conn, req)
+	mimic.Mimic(conn, req)
 	conn.Close()
 	return nil, cs, nil
 }
@@ -0,0 +1,282 @@
+package tokenfilter
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v3/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/coversite"
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+)
+
+const (
+	staticToken = "static-token"
+	secret      = "shared-secret"
+)
+
+type measuredConn struct {
+	net.Conn
+	measured map[string]interface{}
+}
+
+func (c *measuredConn) OnState(s http.ConnState) {}
+
+func (c *measuredConn) ControlMessage(msgType string, data interface{}) {
+	if msgType == "measured" {
+		for key, value := range data.(map[string]interface{}) {
+			c.measured[key] = value
+		}
+	}
+}
+
+func (c *measuredConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// apply applies the filter to a request carrying the given tokens. It returns
+// the request passed on to the next filter, or nil if it was answered like
+// a web server, along with the context sent to measured.
+func apply(t *testing.T, f *TokenFilter, tokens ...string) (*http.Request, map[string]interface{}) {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	for _, token := range tokens {
+		req.Header.Add(common.TokenHeader, token)
+	}
+	downstream, client := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	conn := &measuredConn{Conn: downstream, measured: make(map[string]interface{})}
+
+	var passed *http.Request
+	_, _, err := f.Apply(filters.NewConnectionState(req, nil, conn), req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		passed = req
+		assert.Empty(t, req.Header.Get(common.TokenHeader), "token header should be removed")
+		return nil, cs, nil
+	})
+	require.NoError(t, err)
+	return passed, conn.measured
+}
+
+// allowed reports whether a request carrying the given tokens is passed on
+// rather than answered like a web server.
+func allowed(t *testing.T, f *TokenFilter, tokens ...string) bool {
+	req, _ := apply(t, f, tokens...)
+	return req != nil
+}
+
+func TestStatic(t *testing.T) {
+	f := New(staticToken, instrument.NoInstrument{})
+	hmacToken, err := NewHMACToken(secret, time.Now())
+	require.NoError(t, err)
+
+	assert.True(t, allowed(t, f, staticToken))
+	assert.True(t, allowed(t, f, "other", staticToken))
+	assert.False(t, allowed(t, f))
+	assert.False(t, allowed(t, f, "other"))
+	assert.False(t, allowed(t, f, hmacToken), "HMAC tokens shouldn't be accepted in static mode")
+
+	f.SetToken("")
+	assert.True(t, allowed(t, f), "token shouldn't be checked")
+}
+
+func TestHMAC(t *testing.T) {
+	f := New(staticToken, instrument.NoInstrument{})
+	require.NoError(t, f.SetHMAC(secret, HMAC))
+
+	token, err := NewHMACToken(secret, time.Now())
+	require.NoError(t, err)
+	assert.True(t, allowed(t, f, token))
+	assert.False(t, allowed(t, f, token), "replayed token should be rejected")
+	assert.False(t, allowed(t, f, staticToken), "static token shouldn't be accepted in HMAC mode")
+	assert.False(t, allowed(t, f))
+
+	for _, at := range []time.Time{time.Now().Add(-DefaultHMACWindow - time.Minute), time.Now().Add(DefaultHMACWindow + time.Minute)} {
+		token, err := NewHMACToken(secret, at)
+		require.NoError(t, err)
+		assert.False(t, allowed(t, f, token), "token from %v should be outside of window", at)
+	}
+
+	token, err = NewHMACToken("wrong-secret", time.Now())
+	require.NoError(t, err)
+	assert.False(t, allowed(t, f, token))
+
+	token, err = NewHMACToken(secret, time.Now())
+	require.NoError(t, err)
+	parts := strings.Split(token, ".")
+	parts[1] = "1"
+	assert.False(t, allowed(t, f, strings.Join(parts, ".")), "tampered timestamp should be rejected")
+	assert.False(t, allowed(t, f, "v1.garbage"))
+
+	assert.Error(t, f.SetHMAC("", HMAC))
+	assert.Error(t, f.SetHMAC("", Transition))
+}
+
+func TestHMACNoncesFull(t *testing.T) {
+	f := New(staticToken, instrument.NoInstrument{})
+	require.NoError(t, f.SetHMAC(secret, HMAC))
+	f.maxNonces = 2
+
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		token, err := NewHMACToken(secret, time.Now())
+		require.NoError(t, err)
+		tokens = append(tokens, token)
+	}
+	assert.True(t, allowed(t, f, tokens[0]))
+	assert.True(t, allowed(t, f, tokens[1]))
+	assert.False(t, allowed(t, f, tokens[2]), "new token should be rejected while the nonces are full")
+	assert.False(t, allowed(t, f, tokens[0]), "replayed token should still be rejected")
+	assert.False(t, allowed(t, f, tokens[1]), "replayed token should still be rejected")
+}
+
+func TestTransition(t *testing.T) {
+	f := New(staticToken, instrument.NoInstrument{})
+	require.NoError(t, f.SetHMAC(secret, Transition))
+
+	token, err := NewHMACToken(secret, time.Now())
+	require.NoError(t, err)
+	assert.True(t, allowed(t, f, token))
+	assert.True(t, allowed(t, f, staticToken))
+	assert.False(t, allowed(t, f, token))
+	assert.False(t, allowed(t, f, "other"))
+}
+
+func TestLabeledTokens(t *testing.T) {
+	f := New(staticToken, instrument.NoInstrument{})
+	settings := &throttle.Settings{Label: "partner-cap", Threshold: 1, Rate: 1024, CapResets: throttle.Daily}
+	require.NoError(t, f.SetTokens([]Token{
+		{Token: "partner-token", Label: "partner", Throttle: settings},
+		{Token: "retiring-token", Label: "retiring", ExpiresAt: time.Now().Add(time.Hour)},
+		{Token: "retired-token", Label: "retired", ExpiresAt: time.Now().Add(-time.Minute)},
+	}))
+
+	req, measured := apply(t, f, "partner-token")
+	require.NotNil(t, req)
+	assert.Equal(t, "partner", measured[common.TokenLabel])
+	assert.Equal(t, settings, ForcedThrottle(req.Context()))
+
+	req, measured = apply(t, f, "retiring-token")
+	require.NotNil(t, req)
+	assert.Equal(t, "retiring", measured[common.TokenLabel])
+	assert.Nil(t, ForcedThrottle(req.Context()))
+
+	req, measured = apply(t, f, staticToken)
+	require.NotNil(t, req)
+	assert.Empty(t, measured, "static token has no label")
+
+	assert.False(t, allowed(t, f, "retired-token"), "expired token should be rejected")
+
+	require.NoError(t, f.SetHMAC(secret, HMAC))
+	assert.False(t, allowed(t, f, "partner-token"), "labeled tokens shouldn't be accepted in HMAC mode")
+
+	assert.Error(t, f.SetTokens([]Token{{Label: "empty"}}))
+	assert.Error(t, f.SetTokens([]Token{{Token: "a", Label: "a"}, {Token: "a", Label: "b"}}))
+	assert.Error(t, f.SetTokens([]Token{{Token: "a", Label: "a", Throttle: &throttle.Settings{Label: "a", CapResets: "yearly"}}}))
+}
+
+func TestWatchTokens(t *testing.T) {
+	f := New(staticToken, instrument.NoInstrument{})
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	invalidPath := filepath.Join(t.TempDir(), "invalid.json")
+	require.NoError(t, os.WriteFile(invalidPath, []byte("["), 0600))
+	require.Error(t, f.WatchTokens(context.Background(), invalidPath, 0), "invalid file should be an error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, f.WatchTokens(ctx, path, 50*time.Millisecond), "missing file should be watched until it exists")
+	assert.False(t, allowed(t, f, "first"))
+
+	write := func(tokens []Token, modTime time.Time) {
+		b, err := json.Marshal(tokens)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, b, 0600))
+		// make sure the modification time changes
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	write([]Token{{Token: "first", Label: "first"}}, time.Now())
+	require.Eventually(t, func() bool {
+		return allowed(t, f, "first")
+	}, 5*time.Second, 20*time.Millisecond, "tokens should be loaded once the file exists")
+	assert.False(t, allowed(t, f, "second"))
+
+	write([]Token{{Token: "second", Label: "second"}}, time.Now().Add(time.Minute))
+	require.Eventually(t, func() bool {
+		return allowed(t, f, "second")
+	}, 5*time.Second, 20*time.Millisecond, "tokens should be reloaded")
+	assert.False(t, allowed(t, f, "first"))
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	write([]Token{{Token: "third", Label: "third"}}, time.Now().Add(2*time.Minute))
+	time.Sleep(150 * time.Millisecond)
+	assert.False(t, allowed(t, f, "third"), "file shouldn't be checked anymore once done")
+}
+
+func TestParseMode(t *testing.T) {
+	for mode, expected := range map[string]Mode{"": Static, "static": Static, "HMAC": HMAC, "transition": Transition} {
+		actual, err := ParseMode(mode)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+	_, err := ParseMode("rotating")
+	assert.Error(t, err)
+}
+
+func TestCoverSite(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("cover site"))
+	}))
+	defer origin.Close()
+	site, err := coversite.New(origin.URL)
+	require.NoError(t, err)
+
+	f := New(staticToken, instrument.NoInstrument{})
+	f.SetCoverSite(site)
+	respond := func(method string) string {
+		req, _ := http.NewRequest(method, "http://example.com/", nil)
+		// the cover site keeps serving the connection otherwise
+		req.Close = true
+		downstream, client := net.Pipe()
+		defer client.Close()
+		received := make(chan string, 1)
+		go func() {
+			b, _ := io.ReadAll(client)
+			received <- string(b)
+		}()
+		_, _, err := f.Apply(filters.NewConnectionState(req, nil, downstream), req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			t.Error("request without token shouldn't be passed on")
+			return nil, cs, nil
+		})
+		require.NoError(t, err)
+		downstream.Close()
+		return <-received
+	}
+
+	assert.Contains(t, respond(http.MethodGet), "cover site")
+	assert.Contains(t, respond(http.MethodConnect), "cover site", "CONNECT should be answered by the cover site")
+	assert.True(t, allowed(t, f, staticToken))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable, err := coversite.New("http://" + l.Addr().String())
+	require.NoError(t, err)
+	l.Close()
+	f.SetCoverSite(unreachable)
+	assert.Contains(t, respond(http.MethodGet), "HTTP/1.1 502 ", "unreachable cover site should get the web server's bad gateway rather than its usual response")
+
+	f.SetCoverSite(nil)
+	assert.NotContains(t, respond(http.MethodGet), "cover site")
+}
@@ -0,0 +1,128 @@
+package tokenfilter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+)
+
+// DefaultTokensRefreshInterval is how often the tokens file is checked for
+// changes by default.
+const DefaultTokensRefreshInterval = 30 * time.Second
+
+type forcedThrottleKey struct{}
+
+// Token is a static token accepted in addition to the one passed to New.
+type Token struct {
+	// Token is the value clients send in the X-Lantern-Auth-Token header.
+	Token string `json:"token"`
+
+	// Label identifies who the token was given to, like a distribution channel
+	// or partner, and is reported along with the usage of its clients.
+	Label string `json:"label"`
+
+	// ExpiresAt is when the token stops being accepted. Zero means never.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+
+	// Throttle, if set, replaces the throttle settings that would otherwise
+	// apply to clients using this token, see ForcedThrottle.
+	Throttle *throttle.Settings `json:"throttle,omitempty"`
+}
+
+func (t *Token) expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// ForcedThrottle returns the throttle settings of the token that the request
+// with the given context was authenticated with, if any.
+func ForcedThrottle(ctx context.Context) *throttle.Settings {
+	settings, _ := ctx.Value(forcedThrottleKey{}).(*throttle.Settings)
+	return settings
+}
+
+// SetTokens replaces the labeled tokens accepted by this filter. It takes
+// effect for all subsequent requests.
+func (f *TokenFilter) SetTokens(tokens []Token) error {
+	byValue := make(map[string]*Token, len(tokens))
+	for i := range tokens {
+		t := tokens[i]
+		if t.Token == "" {
+			return fmt.Errorf("missing token for label %v", t.Label)
+		}
+		if _, dupe := byValue[t.Token]; dupe {
+			return fmt.Errorf("duplicate token for label %v", t.Label)
+		}
+		if t.Throttle != nil {
+			if err := t.Throttle.Validate(); err != nil {
+				return fmt.Errorf("invalid throttle settings for label %v: %v", t.Label, err)
+			}
+		}
+		byValue[t.Token] = &t
+	}
+	f.tokenMx.Lock()
+	f.tokens = byValue
+	f.tokenMx.Unlock()
+	return nil
+}
+
+// WatchTokens sets the labeled tokens to the JSON-encoded list of Tokens in the
+// file at path, which is checked for changes every refreshInterval until ctx is
+// done. Until the file exists, there are no labeled tokens.
+func (f *TokenFilter) WatchTokens(ctx context.Context, path string, refreshInterval time.Duration) error {
+	var modTime time.Time
+	refresh := func() error {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			log.Debugf("No tokens at %v yet", path)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to stat tokens %v: %v", path, err)
+		}
+		if info.ModTime().Equal(modTime) {
+			return nil
+		}
+		// don't bother trying again until the file changes
+		modTime = info.ModTime()
+
+		encoded, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("unable to read tokens from %v: %v", path, err)
+		}
+		var tokens []Token
+		if err := json.Unmarshal(encoded, &tokens); err != nil {
+			return fmt.Errorf("unable to parse tokens in %v: %v", path, err)
+		}
+		if err := f.SetTokens(tokens); err != nil {
+			return fmt.Errorf("invalid tokens in %v: %v", path, err)
+		}
+		log.Debugf("Loaded %d tokens from %v", len(tokens), path)
+		return nil
+	}
+
+	if err := refresh(); err != nil {
+		return err
+	}
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultTokensRefreshInterval
+	}
+	go func() {
+		log.Debugf("Checking %v for changes every %v", path, refreshInterval)
+		for {
+			select {
+			case <-ctx.Done():
+				log.Debugf("Stopped checking %v for changes", path)
+				return
+			case <-time.After(refreshInterval):
+				if err := refresh(); err != nil {
+					log.Error(err)
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -1,13 +1,36 @@
 package usage
 
 import (
+	"context"
 	"sync"
 	"time"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/internal/ttlcache"
+)
+
+const (
+	// maximum number of devices for which usage is kept
+	maxDevices = 250000
+
+	// how long usage is kept for a device that isn't being looked up
+	idleTimeout = 1 * time.Hour
 )
 
 var (
-	mutex           sync.RWMutex
-	usageByDeviceID = make(map[string]*Usage)
+	usageByDeviceID = ttlcache.New(ttlcache.Opts{
+		MaxSize:     maxDevices,
+		IdleTimeout: idleTimeout,
+		OnEvict: func(reason string, count int) {
+			getInstrument().CacheEvictions(context.Background(), "usage", reason, count)
+		},
+		OnSweep: func(size int) {
+			getInstrument().CacheSize(context.Background(), "usage", size)
+		},
+	})
+
+	ins   instrument.Instrument = instrument.NoInstrument{}
+	insMx sync.RWMutex
 )
 
 type Usage struct {
@@ -17,17 +40,41 @@ type Usage struct {
 	TTLSeconds  int64
 }
 
-// Set sets the Usage in bytes for the given device as of the given time and known to be resetting within ttlSeconds
+// SetInstrument sets the instrument to which evictions from and the size of
+// the usage cache are reported.
+func SetInstrument(instrument instrument.Instrument) {
+	insMx.Lock()
+	ins = instrument
+	insMx.Unlock()
+}
+
+func getInstrument() instrument.Instrument {
+	insMx.RLock()
+	defer insMx.RUnlock()
+	return ins
+}
+
+// Set sets the Usage in bytes for the given device as of the given time and
+// known to be resetting within ttlSeconds. The usage is forgotten once it
+// resets, so usage that already reset replaces any usage known before.
 func Set(dev string, countryCode string, usage int64, asOf time.Time, ttlSeconds int64) {
-	mutex.Lock()
-	usageByDeviceID[dev] = &Usage{countryCode, usage, asOf, ttlSeconds}
-	mutex.Unlock()
+	var ttl time.Duration
+	if ttlSeconds > 0 {
+		ttl = time.Until(asOf.Add(time.Duration(ttlSeconds) * time.Second))
+		if ttl <= 0 {
+			// already reset
+			usageByDeviceID.Delete(dev)
+			return
+		}
+	}
+	usageByDeviceID.Set(dev, &Usage{countryCode, usage, asOf, ttlSeconds}, ttl)
 }
 
 // Get gets the Usage for the given device.
 func Get(dev string) *Usage {
-	mutex.RLock()
-	result := usageByDeviceID[dev]
-	mutex.RUnlock()
-	return result
+	result, found := usageByDeviceID.Get(dev)
+	if !found {
+		return nil
+	}
+	return result.(*Usage)
 }
@@ -0,0 +1,23 @@
+package usage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSet(t *testing.T) {
+	Set("device", "ir", 1000, time.Now(), 3600)
+	if assert.NotNil(t, Get("device")) {
+		assert.EqualValues(t, 1000, Get("device").Bytes)
+	}
+
+	Set("device", "ir", 2000, time.Now().Add(-2*time.Hour), 3600)
+	assert.Nil(t, Get("device"), "usage that already reset should replace known usage")
+
+	Set("device", "ir", 3000, time.Now(), 0)
+	if assert.NotNil(t, Get("device")) {
+		assert.EqualValues(t, 3000, Get("device").Bytes)
+	}
+}
@@ -0,0 +1,157 @@
+package trojan
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/sagernet/sing/common/metadata"
+
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+)
+
+const (
+	commandConnect = 1
+
+	// hex encoded SHA-224 of the password
+	keyLength = 56
+)
+
+var crlf = []byte{'\r', '\n'}
+
+// NewTrojanListener wraps a net.Listener with a Trojan service, which accepts
+// connections from clients that know one of the given passwords. Trojan is
+// meant to be used over TLS, so baseListener should be a TLS listener. As with
+// VMess, the destination requested by the client is ignored. Connections from
+// clients that fail to authenticate are handed off to the cover site at
+// fallbackAddr, if it's not empty, which is what makes Trojan look like a
+// regular HTTPS server to probes.
+func NewTrojanListener(baseListener net.Listener, passwords []string, fallbackAddr string) (net.Listener, error) {
+	keys := make([][keyLength]byte, 0, len(passwords))
+	for _, password := range passwords {
+		if password != "" {
+			keys = append(keys, Key(password))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("at least one trojan password is required")
+	}
+
+	return listeners.NewHandshakingListener(baseListener, func(conn net.Conn) (net.Conn, error) {
+		br := bufio.NewReader(conn)
+		if err := peekKey(br); err != nil {
+			return nil, err
+		}
+		if err := readRequest(br, keys); err != nil {
+			return nil, err
+		}
+		return &bufferedConn{conn, br}, nil
+	}, fallbackAddr), nil
+}
+
+// Key returns the key with which clients authenticate using the given
+// password.
+func Key(password string) [keyLength]byte {
+	var key [keyLength]byte
+	hash := sha256.Sum224([]byte(password))
+	hex.Encode(key[:], hash[:])
+	return key
+}
+
+// peekKey waits for the key, which may arrive in several segments, without
+// consuming it. It looks at every byte as soon as it arrives, so that probes
+// like HTTP requests, which are often shorter than a key, are handed off to the
+// fallback right away instead of when the handshake times out. Only the
+// characters are checked, not whether the key read so far is the prefix of a
+// known key, as falling back early on a mismatch would let probes guess the
+// keys one character at a time.
+func peekKey(br *bufio.Reader) error {
+	for i := 1; i <= keyLength; i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			return fmt.Errorf("request too short: %w", err)
+		}
+		if !isHex(b[i-1]) {
+			return errors.New("not a key")
+		}
+	}
+	return nil
+}
+
+// isHex determines whether c is a digit of a key, which is lower case hex.
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f'
+}
+
+// readRequest reads the Trojan request header, which is followed by the
+// client's data:
+//
+//	+-----------------------+---------+----------------+---------+----------+
+//	| hex(SHA224(password)) |  CRLF   | Trojan Request |  CRLF   | Payload  |
+//	+-----------------------+---------+----------------+---------+----------+
+//	|          56           | X'0D0A' |    Variable    | X'0D0A' | Variable |
+//	+-----------------------+---------+----------------+---------+----------+
+//
+// where the request consists of a command followed by a SOCKS5 address.
+func readRequest(r io.Reader, keys [][keyLength]byte) error {
+	var key [keyLength]byte
+	if _, err := io.ReadFull(r, key[:]); err != nil {
+		return fmt.Errorf("unable to read key: %w", err)
+	}
+	found := 0
+	for _, k := range keys {
+		found |= subtle.ConstantTimeCompare(k[:], key[:])
+	}
+	if found != 1 {
+		return errors.New("unknown key")
+	}
+	if err := readCRLF(r); err != nil {
+		return err
+	}
+	command := make([]byte, 1)
+	if _, err := io.ReadFull(r, command); err != nil {
+		return fmt.Errorf("unable to read command: %w", err)
+	}
+	if command[0] != commandConnect {
+		return fmt.Errorf("unsupported command %d", command[0])
+	}
+	if _, err := metadata.SocksaddrSerializer.ReadAddrPort(r); err != nil {
+		return fmt.Errorf("unable to read destination: %w", err)
+	}
+	if err := readCRLF(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readCRLF(r io.Reader) error {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return fmt.Errorf("unable to read CRLF: %w", err)
+	}
+	if !bytes.Equal(b, crlf) {
+		return errors.New("expected CRLF")
+	}
+	return nil
+}
+
+// bufferedConn reads the data that was buffered while reading the request
+// before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) Wrapped() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,101 @@
+package trojan
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrojan(t *testing.T) {
+	coverSite := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("cover site"))
+	}))
+	defer coverSite.Close()
+
+	_, err := NewTrojanListener(nil, []string{""}, "")
+	assert.Error(t, err, "passwords should be required")
+
+	// the base listener would normally be a TLS listener
+	tcpListener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	l, err := NewTrojanListener(tcpListener, []string{"password1", "password2"}, coverSite.Listener.Addr().String())
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				n, _ := conn.Read(buf)
+				conn.Write(append([]byte("proxied:"), buf[:n]...))
+			}()
+		}
+	}()
+
+	request := func(password string, command byte, payload string) []byte {
+		var b bytes.Buffer
+		key := Key(password)
+		b.Write(key[:])
+		b.Write(crlf)
+		b.WriteByte(command)
+		require.NoError(t, metadata.SocksaddrSerializer.WriteAddrPort(&b, metadata.ParseSocksaddrHostPort("random.stuff.com", 443)))
+		b.Write(crlf)
+		b.WriteString(payload)
+		return b.Bytes()
+	}
+	roundTrip := func(data []byte) string {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write(data)
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := io.ReadAtLeast(conn, buf, 1)
+		require.NoError(t, err)
+		return string(buf[:n])
+	}
+
+	assert.Equal(t, "proxied:hello", roundTrip(request("password1", commandConnect, "hello")))
+	assert.Equal(t, "proxied:hello", roundTrip(request("password2", commandConnect, "hello")))
+
+	// the request may be split across segments
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	split := request("password1", commandConnect, "hello")
+	_, err = conn.Write(split[:keyLength/2])
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = conn.Write(split[keyLength/2:])
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := io.ReadAtLeast(conn, buf, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "proxied:hello", string(buf[:n]), "split request should be accepted")
+
+	assert.Contains(t, roundTrip([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nUser-Agent: Mozilla/5.0\r\n\r\n")), "cover site", "probes should get the cover site")
+	// roundTrip gives up well before the handshake times out
+	assert.Contains(t, roundTrip([]byte("GET / HTTP/1.0\r\n\r\n")), "cover site", "short probes should get the cover site right away")
+	for name, data := range map[string][]byte{
+		"wrong password":    request("wrong", commandConnect, "GET / HTTP/1.1\r\n\r\n"),
+		"udp associate":     request("password1", 3, "GET / HTTP/1.1\r\n\r\n"),
+		"malformed request": append(request("password1", commandConnect, "")[:keyLength], "\r\nGET / HTTP/1.1\r\n\r\n"...),
+	} {
+		assert.Contains(t, roundTrip(data), "400 Bad Request", name+" should get the cover site's response")
+	}
+}
@@ -0,0 +1,95 @@
+package vless
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	N "github.com/getlantern/sing-vmess/network"
+	"github.com/getlantern/sing-vmess/vless"
+	"github.com/sagernet/sing/common/auth"
+	"github.com/sagernet/sing/common/logger"
+	"github.com/sagernet/sing/common/metadata"
+
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+)
+
+// NewVLESSListener wraps a net.Listener with a VLESS service, which accepts
+// connections from clients identified by one of the given UUIDs. Unlike VMess,
+// VLESS doesn't encrypt the connection so it's meant to be used inside of
+// another layer that does, like TLS. As with VMess, the destination requested
+// by the client is ignored. Connections from clients that fail to
+// authenticate are handed off to fallbackAddr, if it's not empty.
+func NewVLESSListener(baseListener net.Listener, uuids []string, fallbackAddr string) net.Listener {
+	var users, flows []string
+	for _, uuid := range uuids {
+		if uuid != "" {
+			users = append(users, uuid)
+			flows = append(flows, "") // we don't support XTLS flows
+		}
+	}
+	service := vless.NewService[string](logger.NOP())
+	service.UpdateUsers(users, users, flows)
+
+	return listeners.NewHandshakingListener(baseListener, func(conn net.Conn) (net.Conn, error) {
+		h := &handler{}
+		if err := service.NewConnection(context.Background(), conn, metadata.Socksaddr{}, nil, h); err != nil {
+			return nil, err
+		}
+		return h.accepted()
+	}, fallbackAddr)
+}
+
+// UUIDConn is implemented by the connections accepted by VLESS listeners.
+type UUIDConn interface {
+	// VLESSUUID returns the UUID the client authenticated with.
+	VLESSUUID() string
+}
+
+type uuidConn struct {
+	net.Conn
+	uuid string
+}
+
+func (c *uuidConn) VLESSUUID() string {
+	return c.uuid
+}
+
+func (c *uuidConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// handler stores the connection accepted by the VLESS service. Only plain TCP
+// connections are supported, not UDP or mux.
+type handler struct {
+	conn net.Conn
+	mx   sync.Mutex
+}
+
+func (h *handler) NewConnectionEx(ctx context.Context, conn net.Conn, _ metadata.Socksaddr, _ metadata.Socksaddr, _ N.CloseHandlerFunc) {
+	uuid, _ := auth.UserFromContext[string](ctx)
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if h.conn != nil {
+		// only happens with mux
+		conn.Close()
+		return
+	}
+	h.conn = &uuidConn{conn, uuid}
+}
+
+func (h *handler) NewPacketConnectionEx(_ context.Context, conn N.PacketConn, _ metadata.Socksaddr, _ metadata.Socksaddr, _ N.CloseHandlerFunc) {
+	conn.Close()
+}
+
+func (h *handler) accepted() (net.Conn, error) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if h.conn == nil {
+		return nil, errUnsupportedCommand
+	}
+	return h.conn, nil
+}
+
+var errUnsupportedCommand = errors.New("unsupported VLESS command")
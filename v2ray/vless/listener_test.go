@@ -0,0 +1,82 @@
+package vless
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getlantern/sing-vmess/vless"
+	"github.com/sagernet/sing/common/logger"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVLESS(t *testing.T) {
+	uuid1 := "3fed9a96-900c-4dd4-9fd2-f333a5667681"
+	uuid2 := "3fed9a96-900c-4dd4-9fd2-f333a5667682"
+
+	coverSite := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("cover site"))
+	}))
+	defer coverSite.Close()
+
+	tcpListener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	l := NewVLESSListener(tcpListener, []string{uuid1}, coverSite.Listener.Addr().String())
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				n, _ := conn.Read(buf)
+				conn.Write(append([]byte(conn.(UUIDConn).VLESSUUID()+":"), buf[:n]...))
+			}()
+		}
+	}()
+
+	roundTrip := func(conn net.Conn, msg string) string {
+		defer conn.Close()
+		_, err := conn.Write([]byte(msg))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := io.ReadAtLeast(conn, buf, 1)
+		require.NoError(t, err)
+		return string(buf[:n])
+	}
+	dialVLESS := func(uuid string) net.Conn {
+		tcpConn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		client, err := vless.NewClient(uuid, "", logger.NOP())
+		require.NoError(t, err)
+		conn, err := client.DialEarlyConn(tcpConn, metadata.ParseSocksaddrHostPort("random.stuff.com", 443))
+		require.NoError(t, err)
+		return conn
+	}
+
+	assert.Equal(t, uuid1+":hello", roundTrip(dialVLESS(uuid1), "hello"))
+
+	probe, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	assert.Contains(t, roundTrip(probe, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "cover site", "probes should be handed to the fallback")
+
+	// a client with an unknown UUID is handed to the fallback too, which
+	// doesn't respond with anything it can make sense of
+	unknown := dialVLESS(uuid2)
+	defer unknown.Close()
+	_, err = unknown.Write([]byte("hello"))
+	require.NoError(t, err)
+	unknown.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, err = unknown.Read(make([]byte, 1024))
+	assert.Error(t, err)
+}
@@ -3,15 +3,112 @@ package vmess
 import (
 	"context"
 	"net"
+	"sync"
 
 	vmess "github.com/getlantern/sing-vmess"
 	N "github.com/getlantern/sing-vmess/network"
+	"github.com/sagernet/sing/common/auth"
 	"github.com/sagernet/sing/common/metadata"
 )
 
+// Users is the set of UUIDs accepted by the VMess listeners sharing it, which
+// can be updated while the listeners are running.
+type Users struct {
+	current   *users
+	currentMx sync.RWMutex
+	closed    bool
+}
+
+type users struct {
+	service *vmess.Service[string]
+	uuids   []string
+	// handshakes in progress with service, which is only closed once they're
+	// done
+	handshakes sync.WaitGroup
+}
+
+// NewUsers creates Users accepting the given UUIDs.
+func NewUsers(uuids []string) (*Users, error) {
+	u := &Users{}
+	if err := u.Update(uuids); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// UUIDs returns the UUIDs currently accepted.
+func (u *Users) UUIDs() []string {
+	u.currentMx.RLock()
+	defer u.currentMx.RUnlock()
+	return append([]string{}, u.current.uuids...)
+}
+
+// Update atomically replaces the accepted UUIDs, reopening the Users if they
+// were closed. Connections that were already accepted are unaffected, even if
+// their UUID is no longer accepted.
+func (u *Users) Update(uuids []string) error {
+	var nonEmpty []string
+	for _, uuid := range uuids {
+		if uuid != "" {
+			nonEmpty = append(nonEmpty, uuid)
+		}
+	}
+	service, err := newService(nonEmpty)
+	if err != nil {
+		return err
+	}
+	u.currentMx.Lock()
+	old, wasClosed := u.current, u.closed
+	u.current, u.closed = &users{service: service, uuids: nonEmpty}, false
+	u.currentMx.Unlock()
+	if old != nil && !wasClosed {
+		go old.close()
+	}
+	return nil
+}
+
+// Close stops the current VMess service once the handshakes in progress are
+// done. Listeners using the Users stop accepting connections until they're
+// updated again.
+func (u *Users) Close() error {
+	u.currentMx.Lock()
+	current, wasClosed := u.current, u.closed
+	u.closed = true
+	u.currentMx.Unlock()
+	if wasClosed {
+		return nil
+	}
+	return current.close()
+}
+
+// Closed returns whether the Users were closed and haven't been updated since.
+func (u *Users) Closed() bool {
+	u.currentMx.RLock()
+	defer u.currentMx.RUnlock()
+	return u.closed
+}
+
+// acquire returns the current users for a handshake, which must be released
+// with handshakes.Done.
+func (u *Users) acquire() (*users, error) {
+	u.currentMx.RLock()
+	defer u.currentMx.RUnlock()
+	if u.closed {
+		return nil, net.ErrClosed
+	}
+	u.current.handshakes.Add(1)
+	return u.current, nil
+}
+
+func (u *users) close() error {
+	u.handshakes.Wait()
+	return u.service.Close()
+}
+
 type listener struct {
 	net.Listener
-	service *vmess.Service[int]
+	users     *Users
+	ownsUsers bool
 }
 
 // NewVMessListener wraps a net.Listener with a VMess service
@@ -21,24 +118,65 @@ type listener struct {
 // The UUIDs will be distributed between the users. There is no 1-1 mapping between UUIDs and users and this is just
 // intended as a source of extra entropy
 func NewVMessListener(baseListener net.Listener, uuids []string) (net.Listener, error) {
-	var userNum []int
+	users, err := NewUsers(uuids)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{Listener: baseListener, users: users, ownsUsers: true}, nil
+}
+
+// NewVMessListenerWithUsers is like NewVMessListener but accepts the UUIDs in
+// users, which are shared with other listeners and can be updated at any time.
+func NewVMessListenerWithUsers(baseListener net.Listener, users *Users) net.Listener {
+	return &listener{Listener: baseListener, users: users}
+}
+
+func newService(uuids []string) (*vmess.Service[string], error) {
 	var userAlt []int
-	for i := range uuids {
-		userNum = append(userNum, i)
+	for range uuids {
 		userAlt = append(userAlt, 0) // we don't use altId
 	}
 
-	l := &listener{baseListener, nil}
-	l.service = vmess.NewService[int]()
-
-	if err := l.service.UpdateUsers(userNum, uuids, userAlt); err != nil {
+	// users are identified by their UUIDs so that we know which UUID a
+	// connection authenticated with
+	service := vmess.NewService[string]()
+	if err := service.UpdateUsers(uuids, uuids, userAlt); err != nil {
 		return nil, err
 	}
-	return l, l.service.Start()
+	if err := service.Start(); err != nil {
+		return nil, err
+	}
+	return service, nil
 }
 
 func (l *listener) Close() error {
-	return l.service.Close()
+	var usersErr error
+	if l.ownsUsers {
+		usersErr = l.users.Close()
+	}
+	if err := l.Listener.Close(); err != nil {
+		return err
+	}
+	return usersErr
+}
+
+// UUIDConn is implemented by the connections accepted by VMess listeners.
+type UUIDConn interface {
+	// VMessUUID returns the UUID the client authenticated with.
+	VMessUUID() string
+}
+
+type uuidConn struct {
+	net.Conn
+	uuid string
+}
+
+func (c *uuidConn) VMessUUID() string {
+	return c.uuid
+}
+
+func (c *uuidConn) Wrapped() net.Conn {
+	return c.Conn
 }
 
 // handler is a connection handler for VMess inbound connections.
@@ -49,8 +187,9 @@ type handler struct {
 	destination metadata.Socksaddr
 }
 
-func (h *handler) NewConnectionEx(_ context.Context, conn net.Conn, source metadata.Socksaddr, destination metadata.Socksaddr, _ N.CloseHandlerFunc) {
-	h.conn = conn
+func (h *handler) NewConnectionEx(ctx context.Context, conn net.Conn, source metadata.Socksaddr, destination metadata.Socksaddr, _ N.CloseHandlerFunc) {
+	uuid, _ := auth.UserFromContext[string](ctx)
+	h.conn = &uuidConn{conn, uuid}
 	h.source = source
 	h.destination = destination
 }
@@ -64,8 +203,14 @@ func (l *listener) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	current, err := l.users.acquire()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer current.handshakes.Done()
 	h := &handler{}
-	err = l.service.NewConnection(context.Background(), conn, metadata.Socksaddr{}, nil, h)
+	err = current.service.NewConnection(context.Background(), conn, metadata.Socksaddr{}, nil, h)
 	if err != nil {
 		return nil, err
 	}
@@ -1,7 +1,9 @@
 package vmess
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -165,3 +167,126 @@ func TestUUIDMismatch(t *testing.T) {
 		}
 	}
 }
+
+func TestSharedUsers(t *testing.T) {
+	uuid1 := "3fed9a96-900c-4dd4-9fd2-f333a5667681"
+	uuid2 := "3fed9a96-900c-4dd4-9fd2-f333a5667682"
+
+	users, err := NewUsers([]string{uuid1, ""})
+	require.NoError(t, err)
+	defer users.Close()
+	assert.Equal(t, []string{uuid1}, users.UUIDs())
+
+	tcpListener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	l := NewVMessListenerWithUsers(tcpListener, users)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func(uuid string) net.Conn {
+		tcpConn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		client, err := vmess.NewClient(uuid, "auto", 0)
+		require.NoError(t, err)
+		conn := client.DialEarlyConn(tcpConn, metadata.ParseSocksaddrHostPort("random.stuff.com", 443))
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		return conn
+	}
+
+	clientConn1 := dial(uuid1)
+	defer clientConn1.Close()
+	var serverConn1 net.Conn
+	select {
+	case serverConn1 = <-accepted:
+		defer serverConn1.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection with uuid1 not accepted")
+	}
+
+	require.NoError(t, users.Update([]string{uuid2}))
+	assert.Equal(t, []string{uuid2}, users.UUIDs())
+
+	// the connection authenticated before the update keeps working
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(serverConn1, buf)
+	require.NoError(t, err)
+	_, err = serverConn1.Write([]byte("world"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(clientConn1, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(buf))
+
+	clientConn2 := dial(uuid1)
+	defer clientConn2.Close()
+	select {
+	case <-accepted:
+		t.Fatal("connection with removed uuid1 shouldn't be accepted")
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	clientConn3 := dial(uuid2)
+	defer clientConn3.Close()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		assert.Equal(t, uuid2, conn.(UUIDConn).VMessUUID())
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection with uuid2 not accepted")
+	}
+}
+
+func TestUsersClose(t *testing.T) {
+	uuid := "3fed9a96-900c-4dd4-9fd2-f333a5667681"
+
+	users, err := NewUsers([]string{uuid})
+	require.NoError(t, err)
+	tcpListener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	l := NewVMessListenerWithUsers(tcpListener, users)
+	defer l.Close()
+
+	// like a handshake in progress
+	handshaking, err := users.acquire()
+	require.NoError(t, err)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- users.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("service shouldn't be closed during a handshake")
+	case <-time.After(250 * time.Millisecond):
+	}
+	handshaking.handshakes.Done()
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("service not closed after the handshake")
+	}
+	assert.NoError(t, users.Close(), "closing again should be a no-op")
+
+	tcpConn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer tcpConn.Close()
+	_, err = l.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed, "closed users shouldn't accept connections")
+
+	require.NoError(t, users.Update([]string{uuid}), "users should be reopened by an update")
+	assert.Equal(t, []string{uuid}, users.UUIDs())
+	require.NoError(t, users.Close())
+}